@@ -0,0 +1,170 @@
+package sfu
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the interval that the SFU bandwidth usage is measured and checked against the bandwidth limit
+	bandwidthMonitorInterval = time.Second
+	// the simulcast quality cap is raised one layer when the outbound bitrate drops below this ratio of the limit
+	bandwidthRecoverRatio = 0.5
+)
+
+// bandwidthMeter counts the RTP bytes received from the publishers and forwarded to the subscribers of the SFU
+type bandwidthMeter struct {
+	inboundBytes  atomic.Uint64
+	outboundBytes atomic.Uint64
+
+	// the highest simulcast quality sent to the subscribers, lowered when the outbound bitrate is over the limit
+	maxQuality atomic.Uint32
+
+	mu              sync.Mutex
+	inboundSamples  []bitrateSample
+	outboundSamples []bitrateSample
+	inboundBitrate  uint64
+	outboundBitrate uint64
+}
+
+func newBandwidthMeter() *bandwidthMeter {
+	meter := &bandwidthMeter{}
+	meter.maxQuality.Store(uint32(QualityHigh))
+
+	return meter
+}
+
+func (m *bandwidthMeter) addInbound(bytes int) {
+	if m == nil {
+		return
+	}
+
+	m.inboundBytes.Add(uint64(bytes))
+}
+
+func (m *bandwidthMeter) addOutbound(bytes int) {
+	if m == nil {
+		return
+	}
+
+	m.outboundBytes.Add(uint64(bytes))
+}
+
+// update measures the bitrates in bits per second over the window from the bytes counters
+func (m *bandwidthMeter) update(now time.Time, window time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var bitrate uint32
+	var ok bool
+
+	m.inboundSamples, bitrate, ok = windowBitrate(m.inboundSamples, bitrateSample{ts: now, bytes: m.inboundBytes.Load()}, window)
+	if ok {
+		m.inboundBitrate = uint64(bitrate)
+	}
+
+	m.outboundSamples, bitrate, ok = windowBitrate(m.outboundSamples, bitrateSample{ts: now, bytes: m.outboundBytes.Load()}, window)
+	if ok {
+		m.outboundBitrate = uint64(bitrate)
+	}
+}
+
+func (m *bandwidthMeter) usage() (inbound, outbound uint64) {
+	if m == nil {
+		return 0, 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.inboundBitrate, m.outboundBitrate
+}
+
+// GetBandwidthUsage returns the total bitrates in bits per second of the RTP packets received from all the published tracks
+// and forwarded to all the subscribers of the SFU, measured over the bitrate window.
+// Use it to bill or cap the bandwidth of a room in a multi-tenant deployment.
+func (s *SFU) GetBandwidthUsage() (inbound, outbound uint64) {
+	return s.bandwidth.usage()
+}
+
+// monitorBandwidth measures the bandwidth usage and limits the simulcast quality sent to the subscribers
+// when the outbound bitrate is over the bandwidth limit.
+func (s *SFU) monitorBandwidth() {
+	window := s.bitrateWindow
+	if window <= 0 {
+		window = DefaultBitrateWindow
+	}
+
+	ticker := time.NewTicker(min(window, bandwidthMonitorInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.context.Done():
+			return
+		case now := <-ticker.C:
+			s.bandwidth.update(now, window)
+
+			if s.bandwidthLimit > 0 {
+				s.checkBandwidthLimit()
+			}
+		}
+	}
+}
+
+// checkBandwidthLimit lowers the simulcast quality cap one layer each time the outbound bitrate is over the limit,
+// and raises it one layer back when the outbound bitrate is well below the limit.
+func (s *SFU) checkBandwidthLimit() {
+	_, outbound := s.bandwidth.usage()
+
+	maxQuality := QualityLevel(s.bandwidth.maxQuality.Load())
+
+	switch {
+	case outbound > s.bandwidthLimit && maxQuality > QualityLow:
+		maxQuality = prevSimulcastQuality(maxQuality)
+		s.log.Warnf("sfu: outbound bitrate %d is over the bandwidth limit %d, limit the simulcast quality to %d", outbound, s.bandwidthLimit, maxQuality)
+	case float64(outbound) < float64(s.bandwidthLimit)*bandwidthRecoverRatio && maxQuality < QualityHigh:
+		maxQuality = nextSimulcastQuality(maxQuality)
+		s.log.Infof("sfu: outbound bitrate %d is below the bandwidth limit %d, raise the simulcast quality to %d", outbound, s.bandwidthLimit, maxQuality)
+	default:
+		return
+	}
+
+	s.bandwidth.maxQuality.Store(uint32(maxQuality))
+
+	// request the keyframes so the subscribers switch to the new layer immediately
+	s.RequestKeyFrameAll()
+}
+
+// maxSimulcastQuality returns the highest simulcast quality that is sent to the subscribers under the bandwidth limit
+// and the max simulcast layers
+func (s *SFU) maxSimulcastQuality() QualityLevel {
+	if s == nil {
+		return QualityHigh
+	}
+
+	if s.bandwidth == nil {
+		return s.simulcastLayerQuality()
+	}
+
+	return min(QualityLevel(s.bandwidth.maxQuality.Load()), s.simulcastLayerQuality())
+}
+
+func prevSimulcastQuality(quality QualityLevel) QualityLevel {
+	switch quality {
+	case QualityHigh:
+		return QualityMid
+	default:
+		return QualityLow
+	}
+}
+
+func nextSimulcastQuality(quality QualityLevel) QualityLevel {
+	switch quality {
+	case QualityLow:
+		return QualityMid
+	default:
+		return QualityHigh
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
@@ -20,6 +21,35 @@ const (
 	DefaultReceiveBitrate = 1_500_000
 )
 
+// IClientTrack is a track sent to a subscriber client, the bitrate controller selects the quality level of it
+type IClientTrack interface {
+	ID() string
+	StreamID() string
+	Kind() webrtc.RTPCodecType
+	MimeType() string
+	IsScreen() bool
+	IsMuted() bool
+	IsSimulcast() bool
+	IsScaleable() bool
+	Client() *Client
+	// MaxQuality is the max quality based on the remote viewed size and the client decoder
+	MaxQuality() QualityLevel
+	// ReceiveBitrate is the bitrate in bits per second received from the publisher
+	ReceiveBitrate() uint32
+	// SendBitrate is the bitrate in bits per second sent to the subscriber
+	SendBitrate() uint32
+}
+
+// IBitrateController selects the quality level of the simulcast and scaleable tracks sent to a client.
+// Set it with ClientOptions.BitrateController to replace the built-in controller with another algorithm.
+type IBitrateController interface {
+	// GetQuality is called on every forwarded packet of the track, so it must be fast.
+	// The returned quality is capped by the track max quality and the client quality, return QualityNone to pause the track.
+	GetQuality(track IClientTrack) QualityLevel
+	// OnBandwidthEstimated is called every second with the estimated bandwidth and the total bitrate sent to the client in bits per second
+	OnBandwidthEstimated(client *Client, bandwidth, sentBitrate uint32)
+}
+
 type bitrateClaim struct {
 	mu        sync.RWMutex
 	track     iClientTrack
@@ -49,6 +79,16 @@ func (c *bitrateClaim) SendBitrate() uint32 {
 
 }
 
+// TargetBitrate returns the bitrate targeted by the bitrate controller for the track at the current quality level.
+func (c *bitrateClaim) TargetBitrate() uint32 {
+	quality := c.Quality()
+	if quality == QualityAudio || quality == QualityAudioRed {
+		return c.track.ReceiveBitrate()
+	}
+
+	return c.QualityLevelToBitrate(quality)
+}
+
 func (c *bitrateClaim) IsAdjustable() bool {
 	return c.track.IsSimulcast() || c.track.IsScaleable()
 }
@@ -107,6 +147,10 @@ type bitrateController struct {
 	claims               sync.Map
 	enabledQualityLevels []QualityLevel
 	log                  logging.LeveledLogger
+	// when the sent bitrates started to exceed the bandwidth, only accessed from loopMonitor
+	congestedSince time.Time
+	// the ID of the track pinned at the high quality, empty if no track is pinned
+	pinnedTrackID atomic.Value
 }
 
 func newbitrateController(client *Client, qualityLevels []QualityLevel) *bitrateController {
@@ -114,7 +158,7 @@ func newbitrateController(client *Client, qualityLevels []QualityLevel) *bitrate
 		client:               client,
 		claims:               sync.Map{},
 		enabledQualityLevels: qualityLevels,
-		log:                  logging.NewDefaultLoggerFactory().NewLogger("bitratecontroller"),
+		log:                  client.log,
 	}
 
 	go bc.loopMonitor()
@@ -122,6 +166,19 @@ func newbitrateController(client *Client, qualityLevels []QualityLevel) *bitrate
 	return bc
 }
 
+// GetQuality returns the quality of the track claim, QualityNone if the track is not claimed yet
+func (bc *bitrateController) GetQuality(track IClientTrack) QualityLevel {
+	claim := bc.GetClaim(track.ID())
+	if claim == nil {
+		return QualityNone
+	}
+
+	return claim.Quality()
+}
+
+// OnBandwidthEstimated is not used by the built-in controller, it reads the estimated bandwidth in its own loop
+func (bc *bitrateController) OnBandwidthEstimated(_ *Client, _, _ uint32) {}
+
 func (bc *bitrateController) Claims() map[string]*bitrateClaim {
 	claims := make(map[string]*bitrateClaim, 0)
 	bc.claims.Range(func(key, value interface{}) bool {
@@ -232,6 +289,11 @@ func (bc *bitrateController) addStaticVideoClaims(clientTracks []iClientTrack) (
 
 // calculate the quality level for each track based on the available bandwidth and max bitrate of tracks
 func (bc *bitrateController) qualityLevelPerTrack(clientTracks []iClientTrack) QualityLevel {
+	if len(clientTracks) == 0 {
+		// no other track to share the bandwidth with
+		return QualityHigh
+	}
+
 	maxBitrate := uint32(0)
 
 	for _, clientTrack := range clientTracks {
@@ -244,13 +306,7 @@ func (bc *bitrateController) qualityLevelPerTrack(clientTracks []iClientTrack) Q
 
 	received := bc.totalReceivedBitrates()
 
-	var bandwidthLeft uint32
-
-	if bw < received {
-		bandwidthLeft = 0
-	} else {
-		bandwidthLeft = bw - received
-	}
+	bandwidthLeft := subtractBitrate(bw, received)
 
 	bc.log.Debugf("bitratecontroller: estimated bandwidth %s, received %s, bandwidth left %s", ThousandSeparator(int(bw)), ThousandSeparator(int(received)), ThousandSeparator(int(bandwidthLeft)))
 
@@ -305,14 +361,16 @@ func (bc *bitrateController) addClaims(clientTracks []iClientTrack) error {
 				continue
 			}
 
+			quality := min(trackQuality, bc.maxPinQuality(clientTrack.ID()))
+
 			// set last quality that use for requesting PLI after claim added
 			if clientTrack.IsSimulcast() {
-				clientTrack.(*simulcastClientTrack).lastQuality.Store(uint32(trackQuality))
+				clientTrack.(*simulcastClientTrack).lastQuality.Store(uint32(quality))
 			} else if clientTrack.IsScaleable() {
-				clientTrack.(*scaleableClientTrack).setLastQuality(trackQuality)
+				clientTrack.(*scaleableClientTrack).setLastQuality(quality)
 			}
 
-			_, err := bc.addClaim(clientTrack, trackQuality)
+			_, err := bc.addClaim(clientTrack, quality)
 			if err != nil {
 				errors = append(errors, err)
 			}
@@ -350,6 +408,57 @@ func (bc *bitrateController) removeClaim(id string) {
 	if _, exist := bc.claims.LoadAndDelete(id); !exist {
 		bc.log.Errorf("bitrate: track %s is not exists", id)
 	}
+
+	bc.pinnedTrackID.CompareAndSwap(id, "")
+}
+
+func (bc *bitrateController) pinnedTrack() string {
+	id, _ := bc.pinnedTrackID.Load().(string)
+
+	return id
+}
+
+// pin forces the track to the high quality and demotes the other adjustable video tracks to the low quality
+func (bc *bitrateController) pin(id string) {
+	bc.pinnedTrackID.Store(id)
+
+	for _, claim := range bc.Claims() {
+		if claim.track.Kind() != webrtc.RTPCodecTypeVideo || !claim.IsAdjustable() {
+			continue
+		}
+
+		var quality QualityLevel
+
+		if claim.track.ID() == id {
+			quality = QualityHigh
+		} else if claim.Quality() > QualityLow {
+			quality = QualityLow
+		}
+
+		if quality == QualityNone || claim.Quality() == quality {
+			continue
+		}
+
+		bc.log.Debugf("bitratecontroller: pinned track %s, set track %s quality from %d to %d", id, claim.track.ID(), claim.Quality(), quality)
+		bc.setQuality(claim.track.ID(), quality)
+		claim.track.RequestPLI()
+	}
+}
+
+// unpin releases the pinned track, the quality of the tracks is adjusted to the bandwidth again
+func (bc *bitrateController) unpin() {
+	bc.pinnedTrackID.Store("")
+}
+
+// maxPinQuality returns the max quality of the track when a track is pinned,
+// the other tracks are limited to the low quality so the pinned track gets the bandwidth
+func (bc *bitrateController) maxPinQuality(id string) QualityLevel {
+	pinned := bc.pinnedTrack()
+	if pinned == "" || pinned == id {
+		return QualityHigh
+	}
+
+	return QualityLow
 }
 
 func (bc *bitrateController) totalSentBitrates() uint32 {
@@ -376,12 +485,20 @@ func (bc *bitrateController) totalReceivedBitrates() uint32 {
 	return total
 }
 
-func (bc *bitrateController) canDecreaseBitrate() bool {
+func (bc *bitrateController) canDecreaseBitrate(totalSentBitrates, bw uint32) bool {
 	claims := bc.Claims()
 
 	for _, claim := range claims {
-		if claim.IsAdjustable() &&
-			claim.Quality() > QualityLow {
+		if !claim.IsAdjustable() {
+			continue
+		}
+
+		if claim.Quality() > QualityLow {
+			return true
+		}
+
+		// the track can be paused if the bandwidth is critically low
+		if claim.Quality() > QualityNone && bc.isLowestLayerExceeded(claim, totalSentBitrates, bw) {
 			return true
 		}
 	}
@@ -389,12 +506,20 @@ func (bc *bitrateController) canDecreaseBitrate() bool {
 	return false
 }
 
+// isLowestLayerExceeded returns true if the bandwidth left for the claim can't fit the lowest video layer bitrate,
+// in that case the track is paused with QualityNone instead of forced to send the lowest layer
+func (bc *bitrateController) isLowestLayerExceeded(claim *bitrateClaim, totalSentBitrates, bw uint32) bool {
+	otherBitrates := subtractBitrate(totalSentBitrates, claim.SendBitrate())
+
+	return subtractBitrate(bw, otherBitrates) < bc.client.sfu.bitrateConfigs.VideoLow
+}
+
 func (bc *bitrateController) canIncreaseBitrate(availableBw uint32) bool {
 	claims := bc.Claims()
 
 	for _, claim := range claims {
 		if claim.IsAdjustable() {
-			if claim.Quality() < claim.track.MaxQuality() {
+			if claim.Quality() < min(claim.track.MaxQuality(), bc.maxPinQuality(claim.track.ID())) {
 				return bc.isEnoughBandwidthToIncrase(availableBw, claim)
 			}
 		}
@@ -417,27 +542,34 @@ func (bc *bitrateController) loopMonitor() {
 		case <-ticker.C:
 			var needAdjustment bool
 
+			bc.capStaticVideoBitrates()
+
 			totalSendBitrates := bc.totalSentBitrates()
 			bw := bc.client.GetEstimatedBandwidth()
 
+			if controller := bc.client.options.BitrateController; controller != nil {
+				controller.OnBandwidthEstimated(bc.client, bw, totalSendBitrates)
+			}
+
 			if totalSendBitrates == 0 {
 				continue
 			}
 
-			var availableBw uint32
-			if bw < totalSendBitrates {
-				availableBw = 0
-			} else {
-				availableBw = bw - totalSendBitrates
-			}
+			availableBw := subtractBitrate(bw, totalSendBitrates)
 
 			if totalSendBitrates < uint32(bw) {
+				bc.congestedSince = time.Time{}
+
 				needAdjustment = bc.canIncreaseBitrate(availableBw)
 				if needAdjustment {
 					bc.log.Tracef("bitratecontroller: need to increase bitrate, available bandwidth %s", ThousandSeparator(int(availableBw)))
 				}
 			} else {
-				needAdjustment = bc.canDecreaseBitrate()
+				if !bc.isCongestionSustained(totalSendBitrates, bw, time.Now()) {
+					continue
+				}
+
+				needAdjustment = bc.canDecreaseBitrate(totalSendBitrates, bw)
 				if needAdjustment {
 					bc.log.Tracef("bitratecontroller: need to decrease bitrate, available bandwidth ", ThousandSeparator(int(availableBw)))
 				}
@@ -453,6 +585,58 @@ func (bc *bitrateController) loopMonitor() {
 
 }
 
+// request the publishers of the non adjustable video tracks to reduce the bitrate
+// if the client max bitrate is set and the tracks are sending more than their share of it
+func (bc *bitrateController) capStaticVideoBitrates() {
+	maxBitrate := bc.client.maxBitrateCap()
+	if maxBitrate == 0 {
+		return
+	}
+
+	staticClaims := make([]*bitrateClaim, 0)
+
+	for _, claim := range bc.Claims() {
+		if claim.track.Kind() == webrtc.RTPCodecTypeVideo && !claim.IsAdjustable() {
+			staticClaims = append(staticClaims, claim)
+		}
+	}
+
+	if len(staticClaims) == 0 {
+		return
+	}
+
+	bitratePerTrack := maxBitrate / uint32(len(staticClaims))
+
+	for _, claim := range staticClaims {
+		if claim.SendBitrate() <= bitratePerTrack {
+			continue
+		}
+
+		if ct, ok := claim.track.(*clientTrack); ok {
+			bc.log.Tracef("bitratecontroller: request publisher to reduce track %s bitrate to %s", ct.ID(), ThousandSeparator(int(bitratePerTrack)))
+			ct.requestMaxBitrate(bitratePerTrack)
+		}
+	}
+}
+
+// isCongestionSustained returns true if the sent bitrates exceed the bandwidth more than the down switch threshold
+// for at least the down switch hold time. This is to avoid switching down the quality on a short congestion blip.
+func (bc *bitrateController) isCongestionSustained(totalSentBitrates, bw uint32, now time.Time) bool {
+	configs := bc.client.sfu.bitrateConfigs
+
+	threshold := uint64(bw) * uint64(100+configs.DownswitchThreshold) / 100
+	if uint64(totalSentBitrates) <= threshold {
+		bc.congestedSince = time.Time{}
+		return false
+	}
+
+	if bc.congestedSince.IsZero() {
+		bc.congestedSince = now
+	}
+
+	return now.Sub(bc.congestedSince) >= configs.DownswitchHoldTime
+}
+
 // TODO: use video size to prioritize the video. Higher resolution video should have higher priority
 func (bc *bitrateController) fitBitratesToBandwidth(bw uint32) {
 	totalSentBitrates := bc.totalSentBitrates()
@@ -460,25 +644,30 @@ func (bc *bitrateController) fitBitratesToBandwidth(bw uint32) {
 	claims := bc.Claims()
 	if totalSentBitrates > bw {
 		// reduce bitrates
-		for i := QualityHigh; i > QualityLowLow; i-- {
+		for i := QualityHigh; i > QualityNone; i-- {
 			bc.log.Trace("bitratecontroller: trying to reduce bitrate")
 			for _, claim := range claims {
 				quality := claim.Quality()
 				if claim.IsAdjustable() &&
-					quality == QualityLevel(i) {
+					quality == QualityLevel(i) &&
+					claim.track.ID() != bc.pinnedTrack() {
 					oldBitrate := claim.SendBitrate()
 					if oldBitrate == 0 {
 						continue
 					}
 
 					newQuality := bc.getPrevQuality(quality)
+					if newQuality == QualityNone && !bc.isLowestLayerExceeded(claim, totalSentBitrates, bw) {
+						continue
+					}
+
 					newBitrate := claim.QualityLevelToBitrate(newQuality)
-					bitrateGap := oldBitrate - newBitrate
+					bitrateGap := subtractBitrate(oldBitrate, newBitrate)
 					bc.log.Tracef("bitratecontroller: reduce bitrate for track %s from %d to %d", claim.track.ID(), claim.Quality(), newQuality)
 					bc.setQuality(claim.track.ID(), newQuality)
 
 					claim.track.RequestPLI()
-					totalSentBitrates = totalSentBitrates - bitrateGap
+					totalSentBitrates = subtractBitrate(totalSentBitrates, bitrateGap)
 
 					bc.log.Infof("bitratecontroller: total sent bitrates %s bandwidth %s", ThousandSeparator(int(totalSentBitrates)), ThousandSeparator(int(bw)))
 
@@ -493,17 +682,17 @@ func (bc *bitrateController) fitBitratesToBandwidth(bw uint32) {
 	} else if totalSentBitrates < bw {
 		bc.log.Trace("bitratecontroller: trying to increase bitrate")
 		// increase bitrates
-		for i := QualityLowLow; i < QualityHigh; i++ {
+		for i := QualityNone; i < QualityHigh; i++ {
 			for _, claim := range claims {
 				quality := claim.Quality()
 				if claim.IsAdjustable() &&
 					quality == QualityLevel(i) &&
-					quality < claim.track.MaxQuality() {
+					quality < min(claim.track.MaxQuality(), bc.maxPinQuality(claim.track.ID())) {
 					oldBitrate := claim.SendBitrate()
 
 					newQuality := bc.getNextQuality(quality)
 					newBitrate := claim.QualityLevelToBitrate(newQuality)
-					bitrateIncrease := newBitrate - oldBitrate
+					bitrateIncrease := subtractBitrate(newBitrate, oldBitrate)
 
 					// check if the bitrate increase will more than the available bandwidth
 					newSentBitrates := totalSentBitrates + bitrateIncrease
@@ -535,9 +724,14 @@ func (bc *bitrateController) getNextQuality(quality QualityLevel) QualityLevel {
 	return quality
 }
 
+// getPrevQuality returns the next lower enabled quality, or QualityNone if the quality is already the lowest
 func (bc *bitrateController) getPrevQuality(quality QualityLevel) QualityLevel {
 	ok := false
 	for !ok {
+		if quality <= QualityLowLow {
+			return QualityNone
+		}
+
 		quality = quality - 1
 		if slices.Contains(bc.enabledQualityLevels, quality) {
 			ok = true
@@ -606,3 +800,12 @@ func (bc *bitrateController) isEnoughBandwidthToIncrase(bandwidthLeft uint32, cl
 	bc.log.Tracef("bitratecontroller: track %s can't increase, need bandwidth %d to increase, but bandwidth left %d", claim.track.ID(), bandwidthGap, bandwidthLeft)
 	return false
 }
+
+// subtractBitrate returns a - b, or 0 if b is larger so the bitrate can't underflow
+func subtractBitrate(a, b uint32) uint32 {
+	if b > a {
+		return 0
+	}
+
+	return a - b
+}
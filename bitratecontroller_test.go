@@ -0,0 +1,218 @@
+package sfu
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownswitchHoldTime(t *testing.T) {
+	bitrates := DefaultBitrates()
+	bitrates.DownswitchThreshold = 10
+	bitrates.DownswitchHoldTime = 3 * time.Second
+
+	bc := &bitrateController{
+		client: &Client{sfu: &SFU{bitrateConfigs: bitrates}},
+	}
+
+	bw := uint32(1_000_000)
+	now := time.Now()
+
+	// within the threshold is not a congestion
+	require.False(t, bc.isCongestionSustained(1_050_000, bw, now))
+
+	// short congestion blip shorter than the hold time
+	require.False(t, bc.isCongestionSustained(1_500_000, bw, now))
+	require.False(t, bc.isCongestionSustained(1_500_000, bw, now.Add(1*time.Second)))
+
+	// recovered, the hold time should start over on the next congestion
+	require.False(t, bc.isCongestionSustained(900_000, bw, now.Add(2*time.Second)))
+	require.False(t, bc.isCongestionSustained(1_500_000, bw, now.Add(4*time.Second)))
+
+	// sustained congestion longer than the hold time
+	require.True(t, bc.isCongestionSustained(1_500_000, bw, now.Add(7*time.Second)))
+}
+
+func TestDownswitchWithoutHoldTime(t *testing.T) {
+	bc := &bitrateController{
+		client: &Client{sfu: &SFU{bitrateConfigs: DefaultBitrates()}},
+	}
+
+	// switch down as soon as the bandwidth is exceeded
+	require.True(t, bc.isCongestionSustained(1_000_001, 1_000_000, time.Now()))
+}
+
+type bitrateTestTrack struct {
+	iClientTrack
+	id             string
+	receiveBitrate uint32
+	sendBitrate    uint32
+	scaleable      bool
+}
+
+func (t *bitrateTestTrack) ID() string {
+	return t.id
+}
+
+func (t *bitrateTestTrack) StreamID() string {
+	return "stream"
+}
+
+func (t *bitrateTestTrack) Kind() webrtc.RTPCodecType {
+	return webrtc.RTPCodecTypeVideo
+}
+
+func (t *bitrateTestTrack) ReceiveBitrate() uint32 {
+	return t.receiveBitrate
+}
+
+func (t *bitrateTestTrack) SendBitrate() uint32 {
+	return t.sendBitrate
+}
+
+func (t *bitrateTestTrack) IsSimulcast() bool {
+	return false
+}
+
+func (t *bitrateTestTrack) IsScaleable() bool {
+	return t.scaleable
+}
+
+func (t *bitrateTestTrack) MaxQuality() QualityLevel {
+	return QualityHigh
+}
+
+func (t *bitrateTestTrack) RequestPLI() {}
+
+func newQualityTestController(bandwidth uint32) *bitrateController {
+	bitrates := DefaultBitrates()
+	bitrates.InitialBandwidth = bandwidth
+
+	return &bitrateController{
+		client:               &Client{sfu: &SFU{bitrateConfigs: bitrates}, maxBitrate: &atomic.Uint32{}},
+		enabledQualityLevels: DefaultQualityLevels(),
+		log:                  logging.NewDefaultLoggerFactory().NewLogger("sfu"),
+	}
+}
+
+func TestQualityLevelPerTrackSinglePublisher(t *testing.T) {
+	bc := newQualityTestController(1_000_000)
+
+	// there is no other simulcast track to share the bandwidth with
+	require.NotPanics(t, func() {
+		require.Equal(t, QualityLevel(QualityHigh), bc.qualityLevelPerTrack(nil))
+	})
+
+	track := &bitrateTestTrack{id: "video", receiveBitrate: 500_000}
+	require.Equal(t, QualityLevel(QualityHigh), bc.qualityLevelPerTrack([]iClientTrack{track}))
+}
+
+func TestQualityLevelPerTrackOverSubscribed(t *testing.T) {
+	bc := newQualityTestController(1_000_000)
+
+	// the claimed tracks already receive more than the estimated bandwidth
+	for _, id := range []string{"video1", "video2"} {
+		bc.claims.Store(id, &bitrateClaim{track: &bitrateTestTrack{id: id, receiveBitrate: 1_500_000}})
+	}
+
+	track := &bitrateTestTrack{id: "video3", receiveBitrate: 1_500_000}
+	require.Equal(t, QualityLevel(QualityLowLow), bc.qualityLevelPerTrack([]iClientTrack{track}))
+}
+
+func TestSubtractBitrate(t *testing.T) {
+	require.Equal(t, uint32(500), subtractBitrate(1500, 1000))
+	require.Equal(t, uint32(0), subtractBitrate(1000, 1500))
+}
+
+func TestBitrateControllerPauseOnCriticalBandwidth(t *testing.T) {
+	bc := newQualityTestController(1_000_000)
+
+	track := &bitrateTestTrack{id: "video", receiveBitrate: 1_600_000, sendBitrate: 200_000, scaleable: true}
+	claim := &bitrateClaim{track: track, quality: QualityLowLow}
+	bc.claims.Store(track.ID(), claim)
+
+	videoLow := bc.client.sfu.bitrateConfigs.VideoLow
+
+	// the bandwidth still fits the lowest layer, keep sending it
+	require.False(t, bc.canDecreaseBitrate(track.sendBitrate, videoLow))
+	bc.fitBitratesToBandwidth(videoLow)
+	require.Equal(t, QualityLevel(QualityLowLow), claim.Quality())
+
+	// the lowest layer exceeds the bandwidth, pause the track
+	require.True(t, bc.canDecreaseBitrate(track.sendBitrate, videoLow-1))
+	bc.fitBitratesToBandwidth(videoLow - 1)
+	require.Equal(t, QualityLevel(QualityNone), claim.Quality())
+
+	// resume the track once the bandwidth recovers
+	track.sendBitrate = 0
+	bc.fitBitratesToBandwidth(1_000_000)
+	require.Greater(t, claim.Quality(), QualityLevel(QualityNone))
+}
+
+func TestGetPrevQualityStopsAtNone(t *testing.T) {
+	bc := newQualityTestController(1_000_000)
+
+	require.Equal(t, QualityLevel(QualityLowMid), bc.getPrevQuality(QualityLow))
+	require.Equal(t, QualityLevel(QualityNone), bc.getPrevQuality(QualityLowLow))
+	require.Equal(t, QualityLevel(QualityNone), bc.getPrevQuality(QualityNone))
+}
+
+func TestBitrateControllerPinTrack(t *testing.T) {
+	bc := newQualityTestController(1_000_000)
+
+	tracks := make(map[string]iClientTrack)
+
+	for _, id := range []string{"speaker", "thumbnail1", "thumbnail2"} {
+		track := &bitrateTestTrack{id: id, receiveBitrate: 1_600_000, scaleable: true}
+		tracks[id] = track
+		bc.claims.Store(id, &bitrateClaim{track: track, quality: QualityMid})
+	}
+
+	client := bc.client
+	client.clientTracks = tracks
+	client.bitrateController = bc
+	client.log = bc.log
+
+	require.ErrorIs(t, client.PinTrack("stream", "unknown"), ErrTrackIsNotExists)
+	require.ErrorIs(t, client.PinTrack("other-stream", "speaker"), ErrTrackIsNotExists)
+
+	require.NoError(t, client.PinTrack("stream", "speaker"))
+	require.Equal(t, "speaker", client.PinnedTrack())
+
+	require.Equal(t, QualityLevel(QualityHigh), bc.GetClaim("speaker").Quality())
+	require.Equal(t, QualityLevel(QualityLow), bc.GetClaim("thumbnail1").Quality())
+	require.Equal(t, QualityLevel(QualityLow), bc.GetClaim("thumbnail2").Quality())
+
+	// the thumbnails are not increased above the low quality while a track is pinned
+	bc.fitBitratesToBandwidth(10_000_000)
+	require.Equal(t, QualityLevel(QualityLow), bc.GetClaim("thumbnail1").Quality())
+
+	// the pinned track is not reduced when the bandwidth is exceeded
+	for _, track := range tracks {
+		track.(*bitrateTestTrack).sendBitrate = 1_000_000
+	}
+
+	bc.fitBitratesToBandwidth(500_000)
+	require.Equal(t, QualityLevel(QualityHigh), bc.GetClaim("speaker").Quality())
+	require.Less(t, bc.GetClaim("thumbnail1").Quality(), QualityLevel(QualityLow))
+
+	// the thumbnails can be increased again once unpinned
+	client.UnpinTrack()
+	require.Empty(t, client.PinnedTrack())
+
+	for _, track := range tracks {
+		track.(*bitrateTestTrack).sendBitrate = 0
+	}
+
+	bc.fitBitratesToBandwidth(10_000_000)
+	require.Greater(t, bc.GetClaim("thumbnail1").Quality(), QualityLevel(QualityLow))
+
+	// the pinned track is released when it's ended
+	require.NoError(t, client.PinTrack("stream", "thumbnail2"))
+	bc.removeClaim("thumbnail2")
+	require.Empty(t, client.PinnedTrack())
+}
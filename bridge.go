@@ -0,0 +1,136 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrClientIsNotBridge = errors.New("client: error client is not a bridge")
+)
+
+// TrackDescriptor identifies a track forwarded to a bridge client
+type TrackDescriptor = SubscribeTrackRequest
+
+// BridgeTracks returns the tracks forwarded to the bridge client, they can be replayed with RebuildBridge when the bridge link drops
+func (c *Client) BridgeTracks() []TrackDescriptor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tracks := make([]TrackDescriptor, len(c.bridgeTracks))
+	copy(tracks, c.bridgeTracks)
+
+	return tracks
+}
+
+// addBridgeTrack stores the track forwarded to the bridge client so it can be replayed, until the track ends
+func (c *Client) addBridgeTrack(descriptor TrackDescriptor, track ITrack) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, t := range c.bridgeTracks {
+		if t == descriptor {
+			return
+		}
+	}
+
+	c.bridgeTracks = append(c.bridgeTracks, descriptor)
+
+	track.OnEnded(func() {
+		c.removeBridgeTrack(descriptor)
+	})
+}
+
+// removeBridgeTrack removes the ended track, so it's not replayed when the bridge is rebuilt
+func (c *Client) removeBridgeTrack(descriptor TrackDescriptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.bridgeTracks = slices.DeleteFunc(c.bridgeTracks, func(t TrackDescriptor) bool {
+		return t == descriptor
+	})
+}
+
+// RebuildBridge re-subscribes the forwarded tracks after the bridge link drops, without affecting the local clients.
+// Use the tracks from BridgeTracks of the dropped bridge client when the bridge is rebuilt with a new client,
+// or pass nil to replay the tracks of this client. The tracks already forwarded to the client are skipped.
+// If the bridge link is disconnected or failed, the next InitNegotiation offer restarts ICE,
+// then complete it with CompleteNegotiation to re-establish the link. The tracks are forwarded once it's connected.
+// The tracks that are no longer published are skipped and returned as an error.
+func (c *Client) RebuildBridge(remoteTracks []TrackDescriptor) error {
+	if !c.IsBridge() {
+		return ErrClientIsNotBridge
+	}
+
+	if remoteTracks == nil {
+		remoteTracks = c.BridgeTracks()
+	}
+
+	switch c.peerConnection.PC().ConnectionState() {
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		c.iceRestartNeeded.Store(true)
+	}
+
+	subscribed := c.ClientTracks()
+
+	requests := make([]SubscribeTrackRequest, 0, len(remoteTracks))
+	errs := make([]error, 0)
+
+	for _, track := range remoteTracks {
+		if _, ok := subscribed[track.TrackID]; ok {
+			continue
+		}
+
+		if !c.sfu.isTrackPublished(track) {
+			errs = append(errs, fmt.Errorf("client: track %s not found", track.TrackID))
+			continue
+		}
+
+		requests = append(requests, track)
+	}
+
+	if len(requests) > 0 {
+		c.log.Infof("client: rebuild bridge %s with %d tracks", c.ID(), len(requests))
+
+		if err := c.SubscribeTracks(requests); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return FlattenErrors(errs)
+}
+
+// isTrackPublished returns true if the track is published by the client or it's a relay track
+func (s *SFU) isTrackPublished(track TrackDescriptor) bool {
+	_, ok := s.publishedTrack(track)
+
+	return ok
+}
+
+// publishedTrack returns the track published by the client or the relay track
+func (s *SFU) publishedTrack(descriptor TrackDescriptor) (ITrack, bool) {
+	if client, err := s.clients.GetClient(descriptor.ClientID); err == nil {
+		if track, err := client.tracks.Get(descriptor.TrackID); err == nil {
+			return track, true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	track, ok := s.relayTracks[descriptor.TrackID]
+
+	return track, ok
+}
+
+// offerOptions returns the options to create the offer, it restarts ICE once after the bridge link drops
+func (c *Client) offerOptions() *webrtc.OfferOptions {
+	if c.iceRestartNeeded.Swap(false) {
+		return &webrtc.OfferOptions{ICERestart: true}
+	}
+
+	return nil
+}
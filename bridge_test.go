@@ -0,0 +1,90 @@
+package sfu
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRebuildBridge(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-rebuild-bridge", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, publisher, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+
+	require.Eventually(t, func() bool {
+		return len(publisher.Tracks()) == 2
+	}, 30*time.Second, 100*time.Millisecond)
+
+	// only the bridge clients can be rebuilt
+	require.ErrorIs(t, publisher.RebuildBridge(nil), ErrClientIsNotBridge)
+
+	opts := DefaultClientOptions()
+	opts.Type = ClientTypeUpBridge
+
+	bridge, err := testRoom.AddClient(testRoom.CreateClientID(), "bridge", opts)
+	require.NoError(t, err)
+
+	tracks := make([]TrackDescriptor, 0)
+	for _, track := range publisher.Tracks() {
+		tracks = append(tracks, TrackDescriptor{ClientID: publisher.ID(), TrackID: track.ID()})
+	}
+
+	require.NoError(t, bridge.SubscribeTracks(tracks))
+	require.ElementsMatch(t, tracks, bridge.BridgeTracks())
+
+	// the bridge link is dropped and rebuilt with a new bridge client
+	require.NoError(t, bridge.End())
+
+	newBridge, err := testRoom.AddClient(testRoom.CreateClientID(), "new-bridge", opts)
+	require.NoError(t, err)
+
+	// the track that is no longer published is reported and the others are replayed
+	replay := append(bridge.BridgeTracks(), TrackDescriptor{ClientID: publisher.ID(), TrackID: "unpublished"})
+
+	err = newBridge.RebuildBridge(replay)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unpublished")
+
+	require.ElementsMatch(t, tracks, newBridge.BridgeTracks())
+
+	newBridge.mu.Lock()
+	require.ElementsMatch(t, tracks, newBridge.pendingReceivedTracks)
+	newBridge.mu.Unlock()
+
+	// the ended track is no longer replayed
+	remaining := make([]TrackDescriptor, 0)
+	for _, track := range publisher.Tracks() {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			track.(*Track).onEnded()
+			continue
+		}
+
+		remaining = append(remaining, TrackDescriptor{ClientID: publisher.ID(), TrackID: track.ID()})
+	}
+
+	require.Len(t, remaining, 1)
+	require.ElementsMatch(t, remaining, newBridge.BridgeTracks())
+
+	// the next offer restarts ICE once the link is dropped
+	newBridge.iceRestartNeeded.Store(true)
+	require.Equal(t, &webrtc.OfferOptions{ICERestart: true}, newBridge.offerOptions())
+	require.Nil(t, newBridge.offerOptions())
+
+	require.NoError(t, testRoom.Close())
+}
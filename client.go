@@ -12,6 +12,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/inlivedev/sfu/pkg/interceptors/abssendtime"
 	"github.com/inlivedev/sfu/pkg/interceptors/playoutdelay"
 	"github.com/inlivedev/sfu/pkg/interceptors/voiceactivedetector"
 	"github.com/inlivedev/sfu/pkg/networkmonitor"
@@ -22,7 +23,9 @@ import (
 	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/logging"
 	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
+	"golang.org/x/exp/slices"
 )
 
 type ClientState int
@@ -55,6 +58,21 @@ const (
 	messageTypeStats      = "stats"
 	messageTypeVADStarted = "vad_started"
 	messageTypeVADEnded   = "vad_ended"
+	messageTypePaused     = "track_paused"
+	messageTypeResumed    = "track_resumed"
+
+	// the sampling window that used to measure the bitrate on client.GetStats()
+	statsSamplingWindow = 200 * time.Millisecond
+
+	// request a keyframe when the subscriber reports at least 10% packet loss on a video track, at most once a second
+	lossKeyframeThreshold = 0.1
+	lossKeyframeInterval  = time.Second
+
+	// the maximum number of times a sender is added again when its SSRC collides with another SSRC in the client session
+	maxSSRCCollisionRetries = 3
+
+	// the maximum playout delay that fits in the 12 bits of the playout delay extension in 10ms units
+	maxPlayoutDelay = 40950 * time.Millisecond
 )
 
 type QualityLevel uint32
@@ -62,7 +80,19 @@ type QualityLevel uint32
 var (
 	ErrNegotiationIsNotRequested = errors.New("client: error negotiation is called before requested")
 	ErrRenegotiationCallback     = errors.New("client: error renegotiation callback is not set")
-	ErrClientStoped              = errors.New("client: error client already stopped")
+	ErrClientStopped             = errors.New("client: error client already stopped")
+	ErrTooManyMediaSections      = errors.New("client: error offer has too many media sections")
+	ErrSDPTooLarge               = errors.New("client: error offer SDP is too large")
+	ErrInvalidClientType         = errors.New("client: error invalid client type")
+	ErrClientTypeNegotiating     = errors.New("client: error can't change the client type during a negotiation")
+	ErrRenegotiationTimeout      = errors.New("client: error renegotiation answer is not received before the timeout")
+	ErrCandidatePairNotSelected  = errors.New("client: error ICE candidate pair is not selected yet")
+	ErrPlayoutDelayNotEnabled    = errors.New("client: error playout delay is not enabled")
+	ErrInvalidPlayoutDelay       = errors.New("client: error playout delay must be 0 <= min <= max <= 40.95s")
+	ErrRenegotiationPanic        = errors.New("client: error OnRenegotiation callback panicked")
+
+	// Deprecated: use ErrClientStopped
+	ErrClientStoped = ErrClientStopped
 )
 
 type ClientOptions struct {
@@ -88,9 +118,51 @@ type ClientOptions struct {
 	JitterBufferMaxWait time.Duration `json:"jitter_buffer_max_wait"`
 	// On unstable network, the packets can be arrived unordered which may affected the nack and packet loss counts, set this to true to allow the SFU to handle reordered packet
 	ReorderPackets bool `json:"reorder_packets"`
-	Log            logging.LeveledLogger
-	settingEngine  webrtc.SettingEngine
-	qualityLevels  []QualityLevel
+	// The header extension URIs that will be removed from the SDP sent to the client.
+	// Use this for the endpoints that can't handle some of the header extensions that the SFU advertises.
+	StripHeaderExtensions []string `json:"strip_header_extensions"`
+	// The group of the client, used for breakout groups within a room.
+	// The published tracks are only broadcasted to the clients in the same group. Empty group is a group too.
+	Group string `json:"group"`
+	// The maximum number of media sections (m-lines) allowed in the offer from the client, 0 means no limit.
+	// The offer with more media sections is rejected to protect the SFU from pathological offers.
+	MaxMediaSections int `json:"max_media_sections"`
+	// The maximum size in bytes of the offer SDP from the client, 0 means no limit.
+	// The larger offer is rejected before it's parsed, to protect the SFU from the offers that are expensive to process.
+	MaxSDPSize int `json:"max_sdp_size"`
+	// The token from Client.ResumeToken of the previous session when the same user reconnects with a new peer connection.
+	// The previous client is ended, and its metadata and subscriptions are carried over to the new client.
+	ResumeToken string `json:"resume_token"`
+	// The maximum time to wait for the SDP answer from the OnRenegotiation callback, DefaultClientOptions uses 30s.
+	// 0 is replaced with the timeout of the SFU default client options if they are set, use a negative value to disable the timeout.
+	// The client is stopped when it's reached, and OnRenegotiationFailed is called so the remote client can reconnect.
+	RenegotiationTimeout time.Duration `json:"renegotiation_timeout"`
+	// Set to true for the audio only clients like a dial-in or a recording sink.
+	// The video codecs and the video header extensions are not registered, and the video tracks are not forwarded to the client.
+	AudioOnly bool `json:"audio_only"`
+	// The peer connection configuration of the client, use it to set the ICETransportPolicy to relay only
+	// or to tune the BundlePolicy and the RTCPMuxPolicy. The ICE servers of the SFU are appended to its ICE servers.
+	PeerConnectionConfig *webrtc.Configuration `json:"-"`
+	// The time to wait for the client to leave after RequestMigration sends the migration message, before the client is stopped.
+	MigrationGracePeriod time.Duration `json:"migration_grace_period"`
+	// The filter of the local ICE candidates sent to the client with OnIceCandidate, the candidates that it returns false for are dropped.
+	// Use it to drop the mDNS or the private network candidates. The candidates that are already gathered
+	// when the local description is created are included in the SDP and not filtered.
+	ICECandidateFilter func(*webrtc.ICECandidate) bool `json:"-"`
+	// The codec mime types in the order the client prefers to receive, like video/VP8 before video/H264.
+	// The tracks sent to the client are offered with the preferred codecs first, the codecs not listed are kept after them.
+	// Empty means the room codecs are offered in the default order of the SFU.
+	CodecPreferences []string `json:"codec_preferences"`
+	// The controller that selects the quality of the simulcast and scaleable tracks sent to the client.
+	// Default is nil means the built-in controller that fits the qualities to the estimated bandwidth.
+	BitrateController IBitrateController `json:"-"`
+	// By default the simulcast quality sent to the client is capped by the max resolution that the client can decode,
+	// based on the H264 level or the max-fs parameter in the client SDP.
+	// Set this to true to send all the simulcast qualities regardless of the negotiated level.
+	IgnoreDecoderLevel bool `json:"ignore_decoder_level"`
+	Log                logging.LeveledLogger
+	settingEngine      webrtc.SettingEngine
+	qualityLevels      []QualityLevel
 }
 
 type internalDataMessage struct {
@@ -113,6 +185,15 @@ type internalDataVideoSize struct {
 	Data videoSize `json:"data"`
 }
 
+type internalDataTrackPaused struct {
+	Type string      `json:"type"`
+	Data trackPaused `json:"data"`
+}
+
+type trackPaused struct {
+	TrackID string `json:"track_id"`
+}
+
 type videoSize struct {
 	TrackID string `json:"track_id"`
 	Width   uint32 `json:"width"`
@@ -126,27 +207,46 @@ type remoteClientStats struct {
 	QualityLimitationReason string `json:"quality_limitation_reason"`
 }
 
+// TransceiverInfo is a read-only snapshot of a client transceiver, returned by Client.GetTransceiverInfo
+type TransceiverInfo struct {
+	Mid  string              `json:"mid"`
+	Kind webrtc.RTPCodecType `json:"kind"`
+	// Direction is the preferred direction of the transceiver
+	Direction webrtc.RTPTransceiverDirection `json:"direction"`
+	// CurrentDirection is the direction negotiated in the current local description,
+	// RTPTransceiverDirectionUnknown if the transceiver is not negotiated yet
+	CurrentDirection webrtc.RTPTransceiverDirection `json:"current_direction"`
+	// Codec is the mime type of the sent or received track codec, empty if there is no track
+	Codec   string `json:"codec"`
+	TrackID string `json:"track_id"`
+}
+
 type Client struct {
-	id                    string
-	name                  string
-	bitrateController     *bitrateController
-	context               context.Context
-	cancel                context.CancelFunc
-	canAddCandidate       *atomic.Bool
-	clientTracks          map[string]iClientTrack
-	muTracks              sync.Mutex
-	internalDataChannel   *webrtc.DataChannel
-	dataChannels          *DataChannelList
-	dataChannelsInitiated bool
-	estimator             cc.BandwidthEstimator
-	initialReceiverCount  atomic.Uint32
-	initialSenderCount    atomic.Uint32
-	isInRenegotiation     *atomic.Bool
-	isInRemoteNegotiation *atomic.Bool
-	idleTimeoutContext    context.Context
-	idleTimeoutCancel     context.CancelFunc
-	mu                    sync.Mutex
-	peerConnection        *PeerConnection
+	id                     string
+	name                   string
+	meta                   *Metadata
+	metadataBroadcast      *OnMetaChangedCallback
+	metadataBatchBroadcast *OnMetaChangedCallback
+	metadataDataChannel    *atomic.Pointer[webrtc.DataChannel]
+	bitrateController      *bitrateController
+	context                context.Context
+	cancel                 context.CancelFunc
+	canAddCandidate        *atomic.Bool
+	clientTracks           map[string]iClientTrack
+	muTracks               sync.Mutex
+	internalDataChannel    *webrtc.DataChannel
+	dataChannels           *DataChannelList
+	dataChannelsInitiated  bool
+	estimator              cc.BandwidthEstimator
+	initialReceiverCount   atomic.Uint32
+	initialSenderCount     atomic.Uint32
+	isInRenegotiation      *atomic.Bool
+	isInRemoteNegotiation  *atomic.Bool
+	clientType             atomic.Value // set by SetType, the options type is used if it's not set
+	idleTimeoutContext     context.Context
+	idleTimeoutCancel      context.CancelFunc
+	mu                     sync.Mutex
+	peerConnection         *PeerConnection
 	// pending received tracks are the remote tracks from other clients that waiting to add when the client is connected
 	pendingReceivedTracks []SubscribeTrackRequest
 	// pending published tracks are the remote tracks that still state as unknown source, and can't be published until the client state the source media or screen
@@ -155,19 +255,34 @@ type Client struct {
 	// published tracks are the remote tracks from other clients that are published to this client
 	publishedTracks                   *trackList
 	pendingRemoteRenegotiation        *atomic.Bool
-	receiveRED                        bool
+	coalescedNegotiations             *atomic.Uint64
+	iceRestartNeeded                  *atomic.Bool
+	bridgeTracks                      []TrackDescriptor
+	resumeToken                       string
+	receiveRED                        atomic.Bool
 	state                             *atomic.Value
 	sfu                               *SFU
 	muCallback                        sync.Mutex
 	onConnectionStateChangedCallbacks []func(webrtc.PeerConnectionState)
+	onICEStateChangedCallbacks        []func(webrtc.ICEConnectionState)
 	onJoinedCallbacks                 []func()
 	onLeftCallbacks                   []func()
 	onVoiceSentDetectedCallbacks      []func(voiceactivedetector.VoiceActivity)
 	onVoiceReceivedDetectedCallbacks  []func(voiceactivedetector.VoiceActivity)
+	onTrackAddedCallbacks             []func(sourceType string, track *webrtc.TrackLocalStaticRTP)
 	onTrackRemovedCallbacks           []func(sourceType string, track *webrtc.TrackLocalStaticRTP)
+	onQualityChangedCallbacks         []func(trackID string, from, to QualityLevel)
+	onTrackPauseChangedCallbacks      []func(trackID string, paused bool)
+	trackEvents                       callbackQueue
+	onDataChannelCallbacks            []func(*webrtc.DataChannel)
+	onMessageCallbacks                map[string][]func(data []byte)
 	onIceCandidate                    func(context.Context, *webrtc.ICECandidate)
 	onRenegotiation                   func(context.Context, webrtc.SessionDescription) (webrtc.SessionDescription, error)
+	onLocalDescription                func(webrtc.SessionDescription) webrtc.SessionDescription
 	onAllowedRemoteRenegotiation      func()
+	onRenegotiationCompleteCallbacks  []func()
+	onRenegotiationFailedCallbacks    []func(error)
+	onNegotiationNeededCallbacks      []func()
 	onTracksAvailableCallbacks        []func([]ITrack)
 	onTracksReadyCallbacks            []func([]ITrack)
 	onNetworkConditionChangedFunc     func(networkmonitor.NetworkConditionType)
@@ -181,13 +296,18 @@ type Client struct {
 	negotiationNeeded              *atomic.Bool
 	pendingRemoteCandidates        []webrtc.ICECandidateInit
 	pendingLocalCandidates         []*webrtc.ICECandidate
+	muLocalCandidates              sync.Mutex
+	muSimulcastTracks              sync.Mutex
 	quality                        *atomic.Uint32
 	receivingBandwidth             *atomic.Uint32
 	egressBandwidth                *atomic.Uint32
 	ingressBandwidth               *atomic.Uint32
+	maxBitrate                     *atomic.Uint32
+	maxDecodePixels                *atomic.Pointer[map[string]uint32]
 	ingressQualityLimitationReason *atomic.Value
 	isDebug                        bool
 	vadInterceptor                 *voiceactivedetector.Interceptor
+	playoutDelay                   *playoutdelay.InterceptorFactory
 	vads                           map[uint32]*voiceactivedetector.VoiceDetector
 	log                            logging.LeveledLogger
 }
@@ -205,6 +325,8 @@ func DefaultClientOptions() ClientOptions {
 		JitterBufferMinWait:  20 * time.Millisecond,
 		JitterBufferMaxWait:  150 * time.Millisecond,
 		ReorderPackets:       false,
+		RenegotiationTimeout: 30 * time.Second,
+		MigrationGracePeriod: 5 * time.Second,
 		Log:                  logging.NewDefaultLoggerFactory().NewLogger("sfu"),
 	}
 }
@@ -212,16 +334,29 @@ func DefaultClientOptions() ClientOptions {
 func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Configuration, opts ClientOptions) *Client {
 	var client *Client
 	var vadInterceptor *voiceactivedetector.Interceptor
+	var playoutDelayInterceptor *playoutdelay.InterceptorFactory
 
 	localCtx, cancel := context.WithCancel(s.context)
 	m := &webrtc.MediaEngine{}
 
-	if err := RegisterCodecs(m, s.codecs); err != nil {
+	codecs := s.codecs
+	if opts.AudioOnly {
+		codecs = audioCodecsOnly(codecs)
+	}
+
+	if err := registerCodecs(m, codecs, s.opusFmtpLine); err != nil {
 		panic(err)
 	}
 
-	// let the client knows that we're receiving simulcast tracks
-	RegisterSimulcastHeaderExtensions(m, webrtc.RTPCodecTypeVideo)
+	if !opts.AudioOnly {
+		// let the client knows that we're receiving simulcast tracks
+		RegisterSimulcastHeaderExtensions(m, webrtc.RTPCodecTypeVideo)
+
+		// forward the AV1 dependency descriptor so the subscribers can decode the AV1 SVC streams
+		if slices.Contains(s.codecs, webrtc.MimeTypeAV1) {
+			RegisterAV1HeaderExtensions(m)
+		}
+	}
 
 	if opts.EnableVoiceDetection {
 		voiceactivedetector.RegisterAudioLevelHeaderExtension(m)
@@ -288,13 +423,18 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 
 	i.Add(congestionController)
 
+	// stamp the forwarded packets with the transport-wide CC sequence numbers for both audio and video
 	if err = webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
 		panic(err)
 	}
 
+	// stamp the forwarded packets with the SFU send time, the publisher send time is meaningless for the subscribers
+	abssendtime.RegisterAbsSendTimeHeaderExtension(m)
+	i.Add(abssendtime.NewInterceptor(opts.Log))
+
 	if opts.EnablePlayoutDelay {
 		playoutdelay.RegisterPlayoutDelayHeaderExtension(m)
-		playoutDelayInterceptor := playoutdelay.NewInterceptor(opts.Log, opts.MinPlayoutDelay, opts.MaxPlayoutDelay)
+		playoutDelayInterceptor = playoutdelay.NewInterceptor(opts.Log, opts.MinPlayoutDelay, opts.MaxPlayoutDelay)
 
 		i.Add(playoutDelayInterceptor)
 	}
@@ -320,6 +460,8 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 	client = &Client{
 		id:                             id,
 		name:                           name,
+		meta:                           newMetadata(localCtx, opts.Log),
+		metadataDataChannel:            &atomic.Pointer[webrtc.DataChannel]{},
 		context:                        localCtx,
 		cancel:                         cancel,
 		clientTracks:                   make(map[string]iClientTrack, 0),
@@ -334,8 +476,11 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 		tracks:                         newTrackList(opts.Log),
 		options:                        opts,
 		pendingReceivedTracks:          make([]SubscribeTrackRequest, 0),
+		resumeToken:                    GenerateID(32),
 		pendingPublishedTracks:         newTrackList(opts.Log),
 		pendingRemoteRenegotiation:     &atomic.Bool{},
+		coalescedNegotiations:          &atomic.Uint64{},
+		iceRestartNeeded:               &atomic.Bool{},
 		publishedTracks:                newTrackList(opts.Log),
 		sfu:                            s,
 		statsGetter:                    statsGetter,
@@ -343,9 +488,12 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 		receivingBandwidth:             &atomic.Uint32{},
 		egressBandwidth:                &atomic.Uint32{},
 		ingressBandwidth:               &atomic.Uint32{},
+		maxBitrate:                     &atomic.Uint32{},
+		maxDecodePixels:                &atomic.Pointer[map[string]uint32]{},
 		ingressQualityLimitationReason: &atomic.Value{},
 		onTracksAvailableCallbacks:     make([]func([]ITrack), 0),
 		vadInterceptor:                 vadInterceptor,
+		playoutDelay:                   playoutDelayInterceptor,
 		vads:                           vads,
 		log:                            opts.Log,
 	}
@@ -368,11 +516,7 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 
 		s.log.Infof("sfu: client %s publish tracks, initial tracks count: %d, pending published tracks: %d", id, initialReceiverCount, client.pendingPublishedTracks.Length())
 
-		addedTracks := client.pendingPublishedTracks.GetTracks()
-
-		if client.onTracksAdded != nil {
-			client.onTracksAdded(addedTracks)
-		}
+		client.publishPendingTracks()
 	}
 
 	client.peerConnection.PC().OnSignalingStateChange(func(state webrtc.SignalingState) {
@@ -382,6 +526,25 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 		}
 	})
 
+	client.peerConnection.PC().OnDataChannel(func(dc *webrtc.DataChannel) {
+		if IsReservedDataChannelLabel(dc.Label()) {
+			client.log.Warnf("client: ignore data channel %s from client %s, the label is reserved", dc.Label(), client.ID())
+			return
+		}
+
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			client.onMessage(dc.Label(), msg.Data)
+		})
+
+		client.onDataChannel(dc)
+	})
+
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		client.log.Debugf("client: ice connection state changed %s", connectionState.String())
+
+		client.onICEConnectionStateChanged(connectionState)
+	})
+
 	peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
 
 		client.log.Infof("client: connection state changed %s", connectionState.String())
@@ -399,6 +562,11 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 				availableTracks := make([]ITrack, 0)
 
 				for _, c := range s.clients.GetClients() {
+					// only the tracks within the same group are available
+					if c.Group() != client.Group() {
+						continue
+					}
+
 					for _, track := range c.tracks.GetTracks() {
 						_, err := client.publishedTracks.Get(track.ID())
 						if track.ClientID() != client.ID() {
@@ -504,6 +672,9 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 			maxWait := opts.JitterBufferMaxWait
 
 			track = newTrack(client.context, client, remoteTrack, minWait, maxWait, s.pliInterval, onPLI, client.statsGetter, onStatsUpdated)
+			if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+				track.(*Track).base.dependencyDescriptorID.Store(uint32(getHeaderExtensionID(receiver.GetParameters().HeaderExtensions, AV1DependencyDescriptorURI)))
+			}
 			track.OnEnded(func() {
 				client.stats.removeReceiverStats(remoteTrack.ID() + remoteTrack.RID())
 				client.tracks.remove([]string{remoteTrack.ID()})
@@ -538,62 +709,25 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 			track.SetAsProcessed()
 		} else {
 			// simulcast
-			var simulcast *SimulcastTrack
-			var ok bool
-
-			id := remoteTrack.ID()
-
-			track, err = client.tracks.Get(id) // not found because the track is not added yet due to race condition
-
-			if err != nil {
-				// if track not found, add it
-				track = newSimulcastTrack(client, remoteTrack, opts.JitterBufferMinWait, opts.JitterBufferMaxWait, s.pliInterval, onPLI, client.statsGetter, onStatsUpdated)
-				if err := client.tracks.Add(track); err != nil {
-					client.log.Errorf("client: error add track ", err)
-				}
-
-				track.OnEnded(func() {
-					simulcastTrack := track.(*SimulcastTrack)
-					simulcastTrack.mu.Lock()
-					defer simulcastTrack.mu.Unlock()
-					if simulcastTrack.remoteTrackHigh != nil {
-						client.stats.removeReceiverStats(simulcastTrack.remoteTrackHigh.track.ID() + simulcastTrack.remoteTrackHigh.track.RID())
-					}
-
-					if simulcastTrack.remoteTrackMid != nil {
-						client.stats.removeReceiverStats(simulcastTrack.remoteTrackMid.track.ID() + simulcastTrack.remoteTrackMid.track.RID())
-					}
-
-					if simulcastTrack.remoteTrackLow != nil {
-						client.stats.removeReceiverStats(simulcastTrack.remoteTrackLow.track.ID() + simulcastTrack.remoteTrackLow.track.RID())
-					}
-
-					client.tracks.remove([]string{remoteTrack.ID()})
-				})
-
-			} else if simulcast, ok = track.(*SimulcastTrack); ok {
-				simulcast.AddRemoteTrack(remoteTrack, opts.JitterBufferMinWait, opts.JitterBufferMaxWait, client.statsGetter, onStatsUpdated, onPLI)
-			}
-
-			if !track.IsProcessed() {
-				client.onTrack(track)
-				track.SetAsProcessed()
+			// the layers above the max simulcast layers are never read, the packets are dropped by the receiver buffer
+			if !s.isSimulcastLayerEnabled(RIDToQuality(remoteTrack.RID())) {
+				client.log.Infof("client: skip track id %s rid %s above the max simulcast layers", remoteTrack.ID(), remoteTrack.RID())
+				return
 			}
 
+			client.addSimulcastRemoteTrack(remoteTrack, onPLI, onStatsUpdated)
 		}
 	})
 
 	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		// only sending candidate when the local description is set, means expecting the remote peer already has the remote description
 		if candidate != nil {
-			if client.canAddCandidate.Load() {
-				go client.onIceCandidateCallback(candidate)
-
+			if client.options.ICECandidateFilter != nil && !client.options.ICECandidateFilter(candidate) {
+				client.log.Debugf("client: %s drop filtered ice candidate %s", client.ID(), candidate.String())
 				return
 			}
-			client.mu.Lock()
-			client.pendingLocalCandidates = append(client.pendingLocalCandidates, candidate)
-			client.mu.Unlock()
+
+			client.queueLocalCandidate(candidate)
 		}
 	})
 
@@ -604,6 +738,55 @@ func NewClient(s *SFU, id string, name string, peerConnectionConfig webrtc.Confi
 	return client
 }
 
+// addSimulcastRemoteTrack adds the RID layer of a simulcast remote track to the client tracks.
+// The RID layers of the transceiver arrive on their own OnTrack goroutines with the same track ID,
+// they are grouped under the lock so only the first layer creates the simulcast track and the others are added to it.
+func (c *Client) addSimulcastRemoteTrack(remoteTrack IRemoteTrack, onPLI func(), onStatsUpdated func(*stats.Stats)) {
+	c.muSimulcastTracks.Lock()
+
+	track, err := c.tracks.Get(remoteTrack.ID())
+	if err != nil {
+		// if track not found, add it
+		track = newSimulcastTrack(c, remoteTrack, c.options.JitterBufferMinWait, c.options.JitterBufferMaxWait, c.sfu.pliInterval, onPLI, c.statsGetter, onStatsUpdated)
+		if err := c.tracks.Add(track); err != nil {
+			c.log.Errorf("client: error add track ", err)
+		}
+
+		track.OnEnded(func() {
+			simulcastTrack := track.(*SimulcastTrack)
+			simulcastTrack.mu.Lock()
+			defer simulcastTrack.mu.Unlock()
+			if simulcastTrack.remoteTrackHigh != nil {
+				c.stats.removeReceiverStats(simulcastTrack.remoteTrackHigh.track.ID() + simulcastTrack.remoteTrackHigh.track.RID())
+			}
+
+			if simulcastTrack.remoteTrackMid != nil {
+				c.stats.removeReceiverStats(simulcastTrack.remoteTrackMid.track.ID() + simulcastTrack.remoteTrackMid.track.RID())
+			}
+
+			if simulcastTrack.remoteTrackLow != nil {
+				c.stats.removeReceiverStats(simulcastTrack.remoteTrackLow.track.ID() + simulcastTrack.remoteTrackLow.track.RID())
+			}
+
+			c.tracks.remove([]string{remoteTrack.ID()})
+		})
+
+	} else if simulcast, ok := track.(*SimulcastTrack); ok {
+		simulcast.AddRemoteTrack(remoteTrack, c.options.JitterBufferMinWait, c.options.JitterBufferMaxWait, c.statsGetter, onStatsUpdated, onPLI)
+	}
+
+	processed := track.IsProcessed()
+	if !processed {
+		track.SetAsProcessed()
+	}
+
+	c.muSimulcastTracks.Unlock()
+
+	if !processed {
+		c.onTrack(track)
+	}
+}
+
 func (c *Client) initDataChannel() {
 	// make sure the exisiting data channels is created on new clients
 	c.SFU().createExistingDataChannels(c)
@@ -611,26 +794,57 @@ func (c *Client) initDataChannel() {
 	var internalDataChannel *webrtc.DataChannel
 	var err error
 
-	if internalDataChannel, err = c.createInternalDataChannel("internal", c.onInternalMessage); err != nil {
+	if internalDataChannel, err = c.createInternalDataChannel(internalDataChannelLabel, c.onInternalMessage); err != nil {
 		c.log.Errorf("client: error create internal data channel %s", err.Error())
 	}
 
 	c.internalDataChannel = internalDataChannel
+
+	if c.sfu.broadcastMetadata {
+		// the metadata is only changed through the server, so the messages from the client are ignored
+		metadataDataChannel, err := c.createInternalDataChannel(metadataDataChannelLabel, func(msg webrtc.DataChannelMessage) {})
+		if err != nil {
+			c.log.Errorf("client: error create metadata data channel %s", err.Error())
+			return
+		}
+
+		c.metadataDataChannel.Store(metadataDataChannel)
+	}
 }
 
 func (c *Client) ID() string {
 	return c.id
 }
 
+// Name returns the display name of the client, or the client ID if the name is not set.
+// The name is used to label the client in the stats.
 func (c *Client) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.name == "" {
+		return c.id
+	}
+
 	return c.name
 }
 
+// Metadata returns the client metadata, use it to store the client data like the display name or the role.
+// Use `Metadata().OnChanged()` to get notified when the metadata is changed, for example to relay it to the other clients.
+func (c *Client) Metadata() *Metadata {
+	return c.meta
+}
+
+// Group returns the breakout group of the client
+func (c *Client) Group() string {
+	return c.options.Group
+}
+
 func (c *Client) Context() context.Context {
 	return c.context
 }
 
-// OnTrackAdded event is to confirmed the source type of the pending published tracks.
+// OnTracksAdded event is to confirmed the source type of the pending published tracks.
 // If the event is not listened, the pending published tracks will be ignored and not published to other clients.
 // Once received, respond with `client.SetTracksSourceType()“ to confirm the source type of the pending published tracks
 func (c *Client) OnTracksAdded(callback func(addedTracks []ITrack)) {
@@ -642,7 +856,7 @@ func (c *Client) OnTracksAdded(callback func(addedTracks []ITrack)) {
 
 // Init and Complete negotiation is used for bridging the room between servers
 func (c *Client) InitNegotiation() *webrtc.SessionDescription {
-	offer, err := c.peerConnection.PC().CreateOffer(nil)
+	offer, err := c.peerConnection.PC().CreateOffer(c.offerOptions())
 	if err != nil {
 		panic(err)
 	}
@@ -653,9 +867,11 @@ func (c *Client) InitNegotiation() *webrtc.SessionDescription {
 	}
 
 	// allow add candidates once the local description is set
-	c.canAddCandidate.Store(true)
+	go c.sendPendingLocalCandidates()
+
+	localDescription := c.mungeLocalDescription(*c.peerConnection.PC().LocalDescription())
 
-	return c.peerConnection.PC().LocalDescription()
+	return &localDescription
 }
 
 func (c *Client) CompleteNegotiation(answer webrtc.SessionDescription) {
@@ -663,6 +879,10 @@ func (c *Client) CompleteNegotiation(answer webrtc.SessionDescription) {
 	if err != nil {
 		panic(err)
 	}
+
+	c.updateMaxDecodePixels(answer)
+	c.updateReceiveRED(answer)
+	c.updateDependencyDescriptorIDs()
 }
 
 // ask if allowed for remote negotiation is required before call negotiation to make sure there is no racing condition of negotiation between local and remote clients.
@@ -671,107 +891,316 @@ func (c *Client) CompleteNegotiation(answer webrtc.SessionDescription) {
 func (c *Client) IsAllowNegotiation() bool {
 	if c.isInRenegotiation.Load() {
 		c.pendingRemoteRenegotiation.Store(true)
+		c.logNegotiationState("remote_negotiation_rejected")
+
 		return false
 	}
 
 	c.isInRemoteNegotiation.Store(true)
+	c.logNegotiationState("remote_negotiation_allowed")
 
 	return true
 }
 
+// PendingNegotiations returns the number of negotiations that are running or waiting to run for the client.
+// The renegotiation requests are coalesced into a single pending renegotiation, so it is at most 3:
+// a running negotiation, a pending renegotiation, and a remote negotiation waiting for the renegotiation to finish.
+func (c *Client) PendingNegotiations() int {
+	pending := 0
+
+	if c.isInRenegotiation.Load() || c.isInRemoteNegotiation.Load() {
+		pending++
+	}
+
+	if c.negotiationNeeded.Load() {
+		pending++
+	}
+
+	if c.pendingRemoteRenegotiation.Load() {
+		pending++
+	}
+
+	return pending
+}
+
+// CoalescedNegotiations returns the number of renegotiation requests that are merged into a pending renegotiation
+func (c *Client) CoalescedNegotiations() uint64 {
+	return c.coalescedNegotiations.Load()
+}
+
+// logNegotiationState logs the negotiation flags and the peer connection states on debug level,
+// use it on each transition of the negotiation state machine to debug the negotiation races.
+func (c *Client) logNegotiationState(event string) {
+	c.log.Debugf("client: negotiation state event=%s client_id=%s signaling_state=%s connection_state=%s in_renegotiation=%t in_remote_negotiation=%t negotiation_needed=%t pending_remote_renegotiation=%t",
+		event,
+		c.ID(),
+		c.peerConnection.PC().SignalingState(),
+		c.peerConnection.PC().ConnectionState(),
+		c.isInRenegotiation.Load(),
+		c.isInRemoteNegotiation.Load(),
+		c.negotiationNeeded.Load(),
+		c.pendingRemoteRenegotiation.Load(),
+	)
+}
+
 func (c *Client) Negotiate(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if err := c.checkOffer(offer); err != nil {
+		c.log.Errorf("client: reject offer %s", err.Error())
+		return nil, c.negotiationError(NegotiationStepCheckOffer, err)
+	}
+
 	c.isInRemoteNegotiation.Store(true)
+	c.logNegotiationState("remote_negotiation_started")
 
 	defer func() {
 		c.isInRemoteNegotiation.Store(false)
+		c.logNegotiationState("remote_negotiation_finished")
+
 		if c.negotiationNeeded.Load() {
 			c.renegotiate(false)
 		}
 	}()
 
-	currentReceiversCount := 0
-	currentSendersCount := 0
+	// the mids of the negotiated transceivers, the new media sections in the offer are the tracks to publish or to receive
+	currentMids := make(map[string]bool)
 	for _, trscv := range c.peerConnection.PC().GetTransceivers() {
-		if trscv.Receiver() != nil {
-			currentReceiversCount++
-		}
-
-		if trscv.Sender() != nil {
-			currentSendersCount++
+		if trscv.Mid() != "" {
+			currentMids[trscv.Mid()] = true
 		}
 	}
 
-	if !c.receiveRED {
-		match, err := regexp.MatchString(`a=rtpmap:63`, offer.SDP)
-		if err != nil {
-			c.log.Errorf("client: error on check RED support in SDP ", err)
-		} else {
-			c.receiveRED = match
-		}
-	}
+	c.updateReceiveRED(offer)
 
 	// Set the remote SessionDescription
 	err := c.peerConnection.PC().SetRemoteDescription(offer)
 	if err != nil {
 		c.log.Errorf("client: error set remote description ", err)
 
-		return nil, err
+		return nil, c.negotiationError(NegotiationStepSetRemoteDescription, err)
 	}
 
+	c.updateMaxDecodePixels(offer)
+
 	// Create answer
 	answer, err := c.peerConnection.PC().CreateAnswer(nil)
 	if err != nil {
 		c.log.Errorf("client: error create answer ", err)
-		return nil, err
+		return nil, c.negotiationError(NegotiationStepCreateAnswer, err)
 	}
 
 	// Sets the LocalDescription, and starts our UDP listeners
 	err = c.peerConnection.PC().SetLocalDescription(answer)
 	if err != nil {
 		c.log.Errorf("client: error set local description ", err)
-		return nil, err
+		return nil, c.negotiationError(NegotiationStepSetLocalDescription, err)
 	}
 
-	// allow add candidates once the local description is set
-	c.canAddCandidate.Store(true)
+	c.updateDependencyDescriptorIDs()
 
 	// process pending ice
 	for _, iceCandidate := range c.pendingRemoteCandidates {
 		err = c.peerConnection.PC().AddICECandidate(iceCandidate)
 		if err != nil {
 			c.log.Errorf("client: error add ice candidate ", err)
-			return nil, err
+			return nil, c.negotiationError(NegotiationStepAddICECandidate, err)
 		}
 	}
 
-	newReceiversCount := 0
-	newSenderCount := 0
-	for _, trscv := range c.peerConnection.PC().GetTransceivers() {
-		if trscv.Receiver() != nil {
-			newReceiversCount++
+	// every transceiver has a receiver and a sender, so count the new media sections by the direction of the client instead.
+	// The receive only media sections must not be counted as the tracks to publish, otherwise the publishing waits forever.
+	if parsed, err := offer.Unmarshal(); err != nil {
+		c.log.Errorf("client: error parse offer to count the initial tracks %s", err.Error())
+	} else {
+		initialReceiverCount, initialSenderCount := countNewMediaSections(parsed, currentMids)
+
+		c.initialReceiverCount.Store(uint32(initialReceiverCount))
+		c.initialSenderCount.Store(uint32(initialSenderCount))
+	}
+
+	// allow add candidates once the local description is set, and send pending local candidates if any
+	go c.sendPendingLocalCandidates()
+
+	c.pendingRemoteCandidates = nil
+
+	sdp := c.mungeLocalDescription(c.stripHeaderExtensions(c.setOpusSDP(*c.peerConnection.PC().LocalDescription())))
+
+	return &sdp, nil
+}
+
+func (c *Client) negotiationError(step string, err error) error {
+	return &NegotiationError{
+		ClientID: c.ID(),
+		Step:     step,
+		Err:      err,
+	}
+}
+
+// checkOffer returns an error if the offer SDP is larger or has more media sections than allowed by the client options
+func (c *Client) checkOffer(offer webrtc.SessionDescription) error {
+	if c.options.MaxSDPSize > 0 && len(offer.SDP) > c.options.MaxSDPSize {
+		return fmt.Errorf("%w: %d bytes, max %d", ErrSDPTooLarge, len(offer.SDP), c.options.MaxSDPSize)
+	}
+
+	if c.options.MaxMediaSections <= 0 {
+		return nil
+	}
+
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return err
+	}
+
+	if len(parsed.MediaDescriptions) > c.options.MaxMediaSections {
+		return fmt.Errorf("%w: %d media sections, max %d", ErrTooManyMediaSections, len(parsed.MediaDescriptions), c.options.MaxMediaSections)
+	}
+
+	return nil
+}
+
+// countNewMediaSections counts the audio and video media sections in the client offer that are not in the known mids.
+// The sending sections are the ones the client sends a track on, and the receiving sections are the ones the client receives a track on.
+// A sendrecv section is counted as both.
+func countNewMediaSections(offer *sdp.SessionDescription, knownMids map[string]bool) (sending, receiving int) {
+	// the session level direction applies to the media sections without a direction, the default is sendrecv
+	sessionDirection := sdp.AttrKeySendRecv
+
+	for _, direction := range []string{sdp.AttrKeySendRecv, sdp.AttrKeySendOnly, sdp.AttrKeyRecvOnly, sdp.AttrKeyInactive} {
+		if _, ok := offer.Attribute(direction); ok {
+			sessionDirection = direction
+		}
+	}
+
+	for _, media := range offer.MediaDescriptions {
+		if media.MediaName.Media != "audio" && media.MediaName.Media != "video" {
+			continue
+		}
+
+		if mid, ok := media.Attribute(sdp.AttrKeyMID); ok && knownMids[mid] {
+			continue
+		}
+
+		direction := sessionDirection
+
+		for _, mediaDirection := range []string{sdp.AttrKeySendRecv, sdp.AttrKeySendOnly, sdp.AttrKeyRecvOnly, sdp.AttrKeyInactive} {
+			if _, ok := media.Attribute(mediaDirection); ok {
+				direction = mediaDirection
+			}
 		}
 
-		if trscv.Sender() != nil {
-			newSenderCount++
+		switch direction {
+		case sdp.AttrKeySendRecv:
+			sending++
+			receiving++
+		case sdp.AttrKeySendOnly:
+			sending++
+		case sdp.AttrKeyRecvOnly:
+			receiving++
 		}
 	}
 
-	initialReceiverCount := newReceiversCount - currentReceiversCount
+	return sending, receiving
+}
 
-	c.initialReceiverCount.Store(uint32(initialReceiverCount))
+// updateReceiveRED enables forwarding the RED packets to the client once the client SDP has the RED codec,
+// the audio tracks subscribed after this are sent with RED
+func (c *Client) updateReceiveRED(sdp webrtc.SessionDescription) {
+	if c.receiveRED.Load() {
+		return
+	}
 
-	initialSenderCount := newSenderCount - currentSendersCount
+	match, err := supportsRED(sdp)
+	if err != nil {
+		c.log.Errorf("client: error on check RED support in SDP %s", err.Error())
+		return
+	}
 
-	c.initialSenderCount.Store(uint32(initialSenderCount))
+	if match {
+		c.receiveRED.Store(true)
+	}
+}
 
-	// send pending local candidates if any
-	go c.sendPendingLocalCandidates()
+// updateDependencyDescriptorIDs stores the AV1 dependency descriptor header extension IDs negotiated for the client tracks,
+// the IDs are only available after the negotiation and they are not looked up on the packet path
+func (c *Client) updateDependencyDescriptorIDs() {
+	c.muTracks.Lock()
+	tracks := make([]*clientTrack, 0)
 
-	c.pendingRemoteCandidates = nil
+	for _, track := range c.clientTracks {
+		if ct := clientTrackOf(track); ct != nil && ct.mimeType == webrtc.MimeTypeAV1 {
+			tracks = append(tracks, ct)
+		}
+	}
+	c.muTracks.Unlock()
 
-	sdp := c.setOpusSDP(*c.peerConnection.PC().LocalDescription())
+	for _, track := range tracks {
+		track.updateDependencyDescriptorID()
+	}
+}
 
-	return &sdp, nil
+// updateMaxDecodePixels stores the max frame size that the client can decode from the client SDP
+func (c *Client) updateMaxDecodePixels(sdp webrtc.SessionDescription) {
+	limits, err := maxDecodePixels(sdp)
+	if err != nil {
+		c.log.Errorf("client: error parsing the decoder level from SDP %s", err.Error())
+		return
+	}
+
+	c.maxDecodePixels.Store(&limits)
+}
+
+// maxDecodeQuality returns the highest simulcast quality that the client can decode for the codec.
+// The quality is based on the pixels thresholds of the bitrate configs, the same as the remote viewed size.
+func (c *Client) maxDecodeQuality(mimeType string) QualityLevel {
+	if c.options.IgnoreDecoderLevel {
+		return QualityHigh
+	}
+
+	limits := c.maxDecodePixels.Load()
+	if limits == nil {
+		return QualityHigh
+	}
+
+	pixels, ok := (*limits)[strings.ToLower(mimeType)]
+	if !ok {
+		return QualityHigh
+	}
+
+	configs := c.sfu.bitrateConfigs
+
+	switch {
+	case pixels >= configs.VideoHighPixels:
+		return QualityHigh
+	case pixels >= configs.VideoMidPixels:
+		return QualityMid
+	default:
+		return QualityLow
+	}
+}
+
+// stripHeaderExtensions removes the extmap lines of the configured header extensions from the SDP
+func (c *Client) stripHeaderExtensions(sdp webrtc.SessionDescription) webrtc.SessionDescription {
+	if len(c.options.StripHeaderExtensions) == 0 {
+		return sdp
+	}
+
+	lines := strings.Split(sdp.SDP, "\r\n")
+	strippedLines := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=extmap:") {
+			// a=extmap:<id>[/direction] <uri> [attributes]
+			fields := strings.Fields(line)
+			if len(fields) > 1 && slices.Contains(c.options.StripHeaderExtensions, fields[1]) {
+				continue
+			}
+		}
+
+		strippedLines = append(strippedLines, line)
+	}
+
+	sdp.SDP = strings.Join(strippedLines, "\r\n")
+
+	return sdp
 }
 
 func (c *Client) setOpusSDP(sdp webrtc.SessionDescription) webrtc.SessionDescription {
@@ -845,9 +1274,75 @@ func (c *Client) OnRenegotiation(callback func(context.Context, webrtc.SessionDe
 	c.onRenegotiation = callback
 }
 
+// OnLocalDescription event is called with the offer or answer of the SFU before it's sent to the remote client,
+// on InitNegotiation, Negotiate, and the renegotiation offer passed to OnRenegotiation.
+// The callback can return a modified SDP, for example to reorder the codec preferences or to strip a codec.
+// The peer connection doesn't allow to modify its own local description, so only the SDP sent to the remote client is modified.
+// The modified SDP must be a valid SDP of the same type with the same media sections, otherwise it's ignored and the original SDP is used.
+func (c *Client) OnLocalDescription(callback func(webrtc.SessionDescription) webrtc.SessionDescription) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onLocalDescription = callback
+}
+
+// mungeLocalDescription passes the offer or answer to the OnLocalDescription callback
+// and returns the modified SDP, or the original SDP if the modified one is invalid.
+func (c *Client) mungeLocalDescription(desc webrtc.SessionDescription) webrtc.SessionDescription {
+	c.muCallback.Lock()
+	callback := c.onLocalDescription
+	c.muCallback.Unlock()
+
+	if callback == nil {
+		return desc
+	}
+
+	// the original SDP is used if the callback panics
+	munged := desc
+	callUserCallback(c.log, "OnLocalDescription", func() {
+		munged = callback(desc)
+	})
+
+	if err := validateMungedDescription(desc, munged); err != nil {
+		c.log.Errorf("client: error invalid local description from OnLocalDescription, use the original %s", err.Error())
+		return desc
+	}
+
+	return munged
+}
+
+// validateMungedDescription makes sure the munged SDP can still be set as the local description
+func validateMungedDescription(original, munged webrtc.SessionDescription) error {
+	if munged.Type != original.Type {
+		return fmt.Errorf("client: error SDP type changed from %s to %s", original.Type, munged.Type)
+	}
+
+	parsedMunged, err := munged.Unmarshal()
+	if err != nil {
+		return err
+	}
+
+	parsedOriginal, err := original.Unmarshal()
+	if err != nil {
+		return err
+	}
+
+	if len(parsedMunged.MediaDescriptions) != len(parsedOriginal.MediaDescriptions) {
+		return fmt.Errorf("client: error SDP media sections changed from %d to %d", len(parsedOriginal.MediaDescriptions), len(parsedMunged.MediaDescriptions))
+	}
+
+	return nil
+}
+
 func (c *Client) renegotiate(offerFlexFec bool) {
-	c.log.Debug("client: renegotiate")
-	c.negotiationNeeded.Store(true)
+	// the renegotiation is idempotent, the request is merged to the pending one that is not started yet
+	if c.negotiationNeeded.Swap(true) {
+		c.coalescedNegotiations.Add(1)
+	}
+
+	c.onNegotiationNeeded()
+
+	c.logNegotiationState("renegotiation_requested")
 
 	if c.onRenegotiation == nil {
 		c.log.Errorf("client: onRenegotiation is not set, can't do renegotiation")
@@ -856,97 +1351,277 @@ func (c *Client) renegotiate(offerFlexFec bool) {
 	}
 
 	if c.isInRemoteNegotiation.Load() {
-		c.log.Infof("sfu: renegotiation is delayed because the remote client %s is doing negotiation ", c.ID)
+		c.log.Infof("sfu: renegotiation is delayed because the remote client %s is doing negotiation", c.ID())
 
 		return
 	}
 
 	// no need to run another negotiation if it's already in progress, it will rerun because we mark the negotiationneeded to true
 	if c.isInRenegotiation.Load() {
-		c.log.Infof("sfu: renegotiation is delayed because the client %s is doing negotiation ", c.ID)
+		c.log.Infof("sfu: renegotiation is delayed because the client %s is doing negotiation", c.ID())
 		return
 	}
 
 	// mark negotiation is in progress to make sure no concurrent negotiation
 	c.isInRenegotiation.Store(true)
+	c.logNegotiationState("renegotiation_started")
 
 	go func() {
+		inRenegotiation := true
+
 		defer func() {
-			c.isInRenegotiation.Store(false)
+			if inRenegotiation {
+				c.isInRenegotiation.Store(false)
+			}
+
+			c.logNegotiationState("renegotiation_finished")
+
 			if c.pendingRemoteRenegotiation.Load() {
 				c.allowRemoteRenegotiation()
 			}
 		}()
 
-		for c.negotiationNeeded.Load() {
-			timout, cancel := context.WithTimeout(c.context, 100*time.Millisecond)
-			defer cancel()
+		renegotiated := false
 
-			<-timout.Done()
+		for {
+			for c.negotiationNeeded.Load() {
+				// batch the track changes within the negotiation window into a single renegotiation
+				timout, cancel := context.WithTimeout(c.context, c.negotiationWindow())
+				<-timout.Done()
+				cancel()
+
+				// mark negotiation is not needed after this done, so it will out of the loop
+				c.negotiationNeeded.Store(false)
+
+				// only renegotiate when client is connected
+				if c.state.Load() != ClientStateEnded &&
+					c.peerConnection.PC().SignalingState() == webrtc.SignalingStateStable &&
+					c.peerConnection.PC().ConnectionState() == webrtc.PeerConnectionStateConnected {
+
+					if c.onRenegotiation == nil {
+						return
+					}
 
-			// mark negotiation is not needed after this done, so it will out of the loop
-			c.negotiationNeeded.Store(false)
+					offer, err := c.createOffer(c.offerOptions())
+					if err != nil {
+						// nothing is changed in the peer connection yet, so keep the renegotiation state clean
+						// and let the next request try again instead of stopping the client
+						c.log.Errorf("sfu: error create offer on renegotiation ", err)
+						continue
+					}
 
-			// only renegotiate when client is connected
-			if c.state.Load() != ClientStateEnded &&
-				c.peerConnection.PC().SignalingState() == webrtc.SignalingStateStable &&
-				c.peerConnection.PC().ConnectionState() == webrtc.PeerConnectionStateConnected {
+					if offerFlexFec {
+						// munge the offer to include FlexFEC
+						// get the payload code of video track
 
-				if c.onRenegotiation == nil {
-					return
-				}
+					}
 
-				offer, err := c.peerConnection.PC().CreateOffer(nil)
-				if err != nil {
-					c.log.Errorf("sfu: error create offer on renegotiation ", err)
-					return
-				}
+					// Sets the LocalDescription, and starts our UDP listeners
+					err = c.peerConnection.PC().SetLocalDescription(offer)
+					if err != nil {
+						c.log.Errorf("sfu: error set local description on renegotiation ", err)
+						_ = c.stop()
 
-				if offerFlexFec {
-					// munge the offer to include FlexFEC
-					// get the payload code of video track
+						return
+					}
 
-				}
+					c.logNegotiationState("renegotiation_offer_sent")
 
-				// Sets the LocalDescription, and starts our UDP listeners
-				err = c.peerConnection.PC().SetLocalDescription(offer)
-				if err != nil {
-					c.log.Errorf("sfu: error set local description on renegotiation ", err)
-					_ = c.stop()
+					// this will be blocking until the renegotiation is done or the renegotiation timeout is reached
+					sdp := c.mungeLocalDescription(c.stripHeaderExtensions(c.setOpusSDP(*c.peerConnection.PC().LocalDescription())))
+					answer, err := c.requestRenegotiationAnswer(sdp)
+					if err != nil {
+						// the peer connection can't roll back the local offer and can't renegotiate anymore,
+						// so close the client and let the app ask the remote client to reconnect
+						c.log.Errorf("sfu: error on renegotiation ", err)
+						_ = c.stop()
+						c.onRenegotiationFailed(c.negotiationError(NegotiationStepRenegotiationAnswer, err))
 
-					return
-				}
+						return
+					}
 
-				// this will be blocking until the renegotiation is done
-				sdp := c.setOpusSDP(*c.peerConnection.PC().LocalDescription())
-				answer, err := c.onRenegotiation(c.context, sdp)
-				if err != nil {
-					//TODO: when this happen, we need to close the client and ask the remote client to reconnect
-					c.log.Errorf("sfu: error on renegotiation ", err)
-					_ = c.stop()
+					if answer.Type != webrtc.SDPTypeAnswer {
+						c.log.Errorf("sfu: error on renegotiation, the answer is not an answer type")
+						_ = c.stop()
+						c.onRenegotiationFailed(c.negotiationError(NegotiationStepRenegotiationAnswer, fmt.Errorf("client: error renegotiation answer type is %s", answer.Type)))
 
-					return
-				}
+						return
+					}
 
-				if answer.Type != webrtc.SDPTypeAnswer {
-					c.log.Errorf("sfu: error on renegotiation, the answer is not an answer type")
-					_ = c.stop()
+					err = c.peerConnection.PC().SetRemoteDescription(answer)
+					if err != nil {
+						_ = c.stop()
+						c.onRenegotiationFailed(c.negotiationError(NegotiationStepSetRemoteDescription, err))
 
-					return
-				}
+						return
+					}
 
-				err = c.peerConnection.PC().SetRemoteDescription(answer)
-				if err != nil {
-					_ = c.stop()
+					c.updateMaxDecodePixels(answer)
+					c.updateReceiveRED(answer)
+					c.updateDependencyDescriptorIDs()
 
-					return
+					c.logNegotiationState("renegotiation_answer_received")
+
+					renegotiated = true
 				}
 			}
+
+			// the tracks can be changed inside the OnRenegotiation callback after the last check of the negotiation needed flag,
+			// the renegotiate call is skipped while this renegotiation is in progress, so check it again after releasing it
+			c.isInRenegotiation.Store(false)
+			inRenegotiation = false
+
+			if !c.negotiationNeeded.Load() || !c.isInRenegotiation.CompareAndSwap(false, true) {
+				break
+			}
+
+			inRenegotiation = true
+		}
+
+		if renegotiated && c.peerConnection.PC().SignalingState() == webrtc.SignalingStateStable {
+			c.onRenegotiationComplete()
 		}
 	}()
 
 }
 
+// createPeerConnectionOffer creates the renegotiation offer of the peer connection, the tests replace it to make the offer fail
+var createPeerConnectionOffer = func(pc *webrtc.PeerConnection, options *webrtc.OfferOptions) (webrtc.SessionDescription, error) {
+	return pc.CreateOffer(options)
+}
+
+// createOffer creates the renegotiation offer with the peer connection
+func (c *Client) createOffer(options *webrtc.OfferOptions) (webrtc.SessionDescription, error) {
+	return createPeerConnectionOffer(c.peerConnection.PC(), options)
+}
+
+// getBitrateController returns the bitrate controller from ClientOptions, or the built-in one if it's not set
+func (c *Client) getBitrateController() IBitrateController {
+	if c.options.BitrateController != nil {
+		return c.options.BitrateController
+	}
+
+	return c.bitrateController
+}
+
+// negotiationWindow returns the duration that the renegotiation requests are batched in before the offer is created
+func (c *Client) negotiationWindow() time.Duration {
+	if c.sfu == nil || c.sfu.negotiationWindow <= 0 {
+		return DefaultNegotiationWindow
+	}
+
+	return c.sfu.negotiationWindow
+}
+
+// requestRenegotiationAnswer passes the renegotiation offer to the OnRenegotiation callback and waits for the answer.
+// It returns ErrRenegotiationTimeout if the answer is not returned before the renegotiation timeout,
+// the context passed to the callback is canceled at the same time so the callback can stop waiting for the remote client.
+func (c *Client) requestRenegotiationAnswer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if c.options.RenegotiationTimeout <= 0 {
+		return c.callOnRenegotiation(c.context, offer)
+	}
+
+	ctx, cancel := context.WithTimeout(c.context, c.options.RenegotiationTimeout)
+	defer cancel()
+
+	type renegotiationResult struct {
+		answer webrtc.SessionDescription
+		err    error
+	}
+
+	// buffered so the callback that returns after the timeout is not blocked
+	resultChan := make(chan renegotiationResult, 1)
+
+	go func() {
+		answer, err := c.callOnRenegotiation(ctx, offer)
+		resultChan <- renegotiationResult{answer: answer, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		return result.answer, result.err
+	case <-ctx.Done():
+		if c.context.Err() != nil {
+			return webrtc.SessionDescription{}, c.context.Err()
+		}
+
+		return webrtc.SessionDescription{}, ErrRenegotiationTimeout
+	}
+}
+
+// callOnRenegotiation calls the OnRenegotiation callback, it returns ErrRenegotiationPanic if the callback panics
+func (c *Client) callOnRenegotiation(ctx context.Context, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	answer := webrtc.SessionDescription{}
+	err := ErrRenegotiationPanic
+
+	callUserCallback(c.log, "OnRenegotiation", func() {
+		answer, err = c.onRenegotiation(ctx, offer)
+	})
+
+	return answer, err
+}
+
+// OnRenegotiationFailed event is called when the renegotiation started by the SFU is failed and the client is stopped.
+// If the OnRenegotiation callback doesn't return the answer before the renegotiation timeout, the error is ErrRenegotiationTimeout.
+// Use this event to ask the remote client to reconnect, for example with the resume token.
+func (c *Client) OnRenegotiationFailed(callback func(error)) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onRenegotiationFailedCallbacks = append(c.onRenegotiationFailedCallbacks, callback)
+}
+
+func (c *Client) onRenegotiationFailed(err error) {
+	c.muCallback.Lock()
+	callbacks := slices.Clone(c.onRenegotiationFailedCallbacks)
+	c.muCallback.Unlock()
+
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnRenegotiationFailed", func() {
+			callback(err)
+		})
+	}
+}
+
+// OnNegotiationNeeded event is called each time a renegotiation is requested by the SFU, including the requests
+// that are merged into a pending renegotiation. The callback is called on its own goroutine and doesn't take part
+// in the negotiation, use it to count how often a client is renegotiated.
+func (c *Client) OnNegotiationNeeded(callback func()) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onNegotiationNeededCallbacks = append(c.onNegotiationNeededCallbacks, callback)
+}
+
+func (c *Client) onNegotiationNeeded() {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	for _, callback := range c.onNegotiationNeededCallbacks {
+		go callUserCallback(c.log, "OnNegotiationNeeded", callback)
+	}
+}
+
+// OnRenegotiationComplete event is called when the renegotiation started by the SFU is completed,
+// the SDP answer from the client is set and the signaling state is back to stable.
+// Use this event to update the client UI after the tracks are added or removed.
+func (c *Client) OnRenegotiationComplete(callback func()) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onRenegotiationCompleteCallbacks = append(c.onRenegotiationCompleteCallbacks, callback)
+}
+
+func (c *Client) onRenegotiationComplete() {
+	c.muCallback.Lock()
+	callbacks := slices.Clone(c.onRenegotiationCompleteCallbacks)
+	c.muCallback.Unlock()
+
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnRenegotiationComplete", callback)
+	}
+}
+
 // OnAllowedRemoteRenegotiation event is called when the SFU is done with the renegotiation
 // and ready to receive the renegotiation from the client.
 // Use this event to trigger the client to do renegotiation if needed.
@@ -961,13 +1636,18 @@ func (c *Client) OnAllowedRemoteRenegotiation(callback func()) {
 func (c *Client) allowRemoteRenegotiation() {
 	if c.onAllowedRemoteRenegotiation != nil {
 		c.isInRemoteNegotiation.Store(true)
-		go c.onAllowedRemoteRenegotiation()
+		go callUserCallback(c.log, "OnAllowedRemoteRenegotiation", c.onAllowedRemoteRenegotiation)
 	}
 }
 
 func (c *Client) setClientTrack(t ITrack) iClientTrack {
 	var outputTrack iClientTrack
 
+	// the audio only client can't receive the video tracks
+	if c.options.AudioOnly && t.Kind() == webrtc.RTPCodecTypeVideo {
+		return nil
+	}
+
 	err := c.publishedTracks.Add(t)
 	if err != nil {
 		return nil
@@ -990,12 +1670,16 @@ func (c *Client) setClientTrack(t ITrack) iClientTrack {
 
 	localTrack := outputTrack.LocalTrack()
 
-	senderTcv, err := c.peerConnection.PC().AddTransceiverFromTrack(localTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	senderTcv, err := c.addSenderTransceiver(localTrack)
 	if err != nil {
 		c.log.Errorf("client: error on adding track ", err)
 		return nil
 	}
 
+	if ct := clientTrackOf(outputTrack); ct != nil {
+		ct.setSender(senderTcv.Sender())
+	}
+
 	// TODO: change to non goroutine
 
 	outputTrack.OnEnded(func() {
@@ -1003,12 +1687,16 @@ func (c *Client) setClientTrack(t ITrack) iClientTrack {
 			return
 		}
 
-		defer func() {
-			c.muTracks.Lock()
-			delete(c.clientTracks, outputTrack.ID())
-			c.publishedTracks.remove([]string{outputTrack.ID()})
-			c.muTracks.Unlock()
-		}()
+		// the sender of a detached track is already used by the replacement track
+		c.muTracks.Lock()
+		current := c.clientTracks[outputTrack.ID()]
+		c.muTracks.Unlock()
+
+		if current != outputTrack {
+			return
+		}
+
+		defer c.removeClientTrack(outputTrack.ID())
 
 		sender := senderTcv.Sender()
 
@@ -1026,9 +1714,183 @@ func (c *Client) setClientTrack(t ITrack) iClientTrack {
 	c.clientTracks[outputTrack.ID()] = outputTrack
 	c.muTracks.Unlock()
 
+	sourceType := TrackTypeMedia
+	if outputTrack.IsScreen() {
+		sourceType = TrackTypeScreen
+	}
+
+	c.onTrackAdded(sourceType, localTrack)
+
 	return outputTrack
 }
 
+// removeClientTrack removes the track sent to the client and lets the client know the source track is ended,
+// so it can remove the track from the UI. The callback is only called once if the track is removed more than once.
+func (c *Client) removeClientTrack(id string) {
+	c.muTracks.Lock()
+	track, ok := c.clientTracks[id]
+	delete(c.clientTracks, id)
+	c.publishedTracks.remove([]string{id})
+	c.muTracks.Unlock()
+
+	if !ok {
+		return
+	}
+
+	sourceType := TrackTypeMedia
+	if track.IsScreen() {
+		sourceType = TrackTypeScreen
+	}
+
+	c.onTrackRemoved(sourceType, track.LocalTrack())
+}
+
+// detachClientTrack stops forwarding the source track to the client track without ending the source track.
+// The track is removed from the forwarding list of the source track and its bitrate claim is released,
+// the sender is kept for the caller to replace or remove.
+func (c *Client) detachClientTrack(id string) {
+	c.muTracks.Lock()
+	track, ok := c.clientTracks[id]
+	c.muTracks.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if source, err := c.publishedTracks.Get(id); err == nil {
+		if base := trackBase(source); base != nil {
+			base.clientTracks.removeTrack(track)
+		}
+	}
+
+	if c.bitrateController.Exist(id) {
+		c.bitrateController.removeClaim(id)
+	}
+
+	c.removeClientTrack(id)
+}
+
+// removeOrphanedTracks removes the senders of the client tracks that are forwarded from the tracks of a removed publisher.
+// The senders are matched by the client track itself, because the other publishers can use the same track IDs.
+// Returns the number of the removed senders, each removal triggers a renegotiation with the client.
+func (c *Client) removeOrphanedTracks(clientTracks []iClientTrack) int {
+	localTracks := make(map[webrtc.TrackLocal]bool, len(clientTracks))
+	for _, track := range clientTracks {
+		localTracks[track.LocalTrack()] = true
+	}
+
+	removed := 0
+
+	for _, transceiver := range c.peerConnection.PC().GetTransceivers() {
+		sender := transceiver.Sender()
+		if sender == nil || sender.Track() == nil || !localTracks[sender.Track()] {
+			continue
+		}
+
+		if err := c.peerConnection.PC().RemoveTrack(sender); err != nil {
+			c.log.Errorf("client: %s error remove orphaned track %s: %s", c.ID(), sender.Track().ID(), err.Error())
+			continue
+		}
+
+		removed++
+	}
+
+	for _, track := range clientTracks {
+		c.muTracks.Lock()
+		current := c.clientTracks[track.ID()]
+		c.muTracks.Unlock()
+
+		if current == track {
+			c.removeClientTrack(track.ID())
+		}
+	}
+
+	return removed
+}
+
+// addSenderTransceiver adds the local track to be forwarded to the client.
+// The local track binding rewrites the SSRC of the forwarded packets to the SSRC generated for the sender,
+// so each subscriber sees its own stable SSRCs instead of the publisher SSRCs. The SSRC is generated randomly,
+// so the sender is added again if it collides with another SSRC in the client session.
+func (c *Client) addSenderTransceiver(localTrack *webrtc.TrackLocalStaticRTP) (*webrtc.RTPTransceiver, error) {
+	for i := 0; ; i++ {
+		transceiver, err := c.peerConnection.PC().AddTransceiverFromTrack(localTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(c.options.CodecPreferences) > 0 {
+			codecs := sortCodecsByPreference(codecParameters(transceiver.Kind(), c.sfu.codecs, c.sfu.opusFmtpLine), c.options.CodecPreferences)
+			if err := transceiver.SetCodecPreferences(codecs); err != nil {
+				c.log.Warnf("client: %s error set codec preferences on track %s: %s", c.ID(), localTrack.ID(), err.Error())
+			}
+		}
+
+		used := usedSSRCs(c.peerConnection.PC(), transceiver)
+		if !ssrcsCollide(senderSSRCs(transceiver.Sender()), used) || i == maxSSRCCollisionRetries {
+			return transceiver, nil
+		}
+
+		c.log.Warnf("client: %s sender SSRC collision on track %s, add the sender again", c.ID(), localTrack.ID())
+
+		if err := c.peerConnection.PC().RemoveTrack(transceiver.Sender()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// senderSSRCs returns the SSRCs of the sender encodings including the RTX SSRCs
+func senderSSRCs(sender *webrtc.RTPSender) []webrtc.SSRC {
+	ssrcs := make([]webrtc.SSRC, 0)
+
+	for _, encoding := range sender.GetParameters().Encodings {
+		ssrcs = append(ssrcs, encoding.SSRC)
+
+		if encoding.RTX.SSRC != 0 {
+			ssrcs = append(ssrcs, encoding.RTX.SSRC)
+		}
+	}
+
+	return ssrcs
+}
+
+// usedSSRCs returns the SSRCs of the active senders and the remote tracks in the peer connection except the transceiver
+func usedSSRCs(pc *webrtc.PeerConnection, except *webrtc.RTPTransceiver) map[webrtc.SSRC]bool {
+	used := make(map[webrtc.SSRC]bool)
+
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver == except {
+			continue
+		}
+
+		if sender := transceiver.Sender(); sender != nil && sender.Track() != nil {
+			for _, ssrc := range senderSSRCs(sender) {
+				used[ssrc] = true
+			}
+		}
+
+		if receiver := transceiver.Receiver(); receiver != nil {
+			for _, track := range receiver.Tracks() {
+				if track.SSRC() != 0 {
+					used[track.SSRC()] = true
+				}
+			}
+		}
+	}
+
+	return used
+}
+
+func ssrcsCollide(ssrcs []webrtc.SSRC, used map[webrtc.SSRC]bool) bool {
+	for _, ssrc := range ssrcs {
+		if used[ssrc] {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (c *Client) ClientTracks() map[string]iClientTrack {
 	c.muTracks.Lock()
 	defer c.muTracks.Unlock()
@@ -1041,6 +1903,35 @@ func (c *Client) ClientTracks() map[string]iClientTrack {
 	return clientTracks
 }
 
+// GetSubscribedQualities returns the quality forwarded to the client for each subscribed track, keyed by `streamID-trackID`.
+// The simulcast and scaleable tracks return the last forwarded quality, or QualityNone if the track is paused.
+// The other tracks return their single quality.
+func (c *Client) GetSubscribedQualities() map[string]QualityLevel {
+	c.muTracks.Lock()
+	defer c.muTracks.Unlock()
+
+	qualities := make(map[string]QualityLevel, len(c.clientTracks))
+
+	for _, track := range c.clientTracks {
+		key := track.StreamID() + "-" + track.ID()
+
+		switch t := track.(type) {
+		case *simulcastClientTrack:
+			if t.IsPaused() {
+				qualities[key] = QualityNone
+			} else {
+				qualities[key] = t.LastQuality()
+			}
+		case *scaleableClientTrack:
+			qualities[key] = t.LastQuality()
+		default:
+			qualities[key] = track.Quality()
+		}
+	}
+
+	return qualities
+}
+
 func readRTCP(r *webrtc.RTPSender, b []byte) ([]rtcp.Packet, interceptor.Attributes, error) {
 	n, attributes, err := r.Read(b)
 	if err != nil {
@@ -1058,6 +1949,39 @@ func readRTCP(r *webrtc.RTPSender, b []byte) ([]rtcp.Packet, interceptor.Attribu
 	return pkts, attributes, nil
 }
 
+// lossKeyframeRequester decides when to request a keyframe from the publisher because the subscriber reports a high packet loss.
+// The decoder is likely corrupted by the lost packets, a keyframe recovers it faster than waiting for the subscriber PLI.
+type lossKeyframeRequester struct {
+	// the fraction lost from the receiver report that triggers the keyframe request, between 0 and 1
+	threshold float64
+	// the minimum interval between the keyframe requests, the receiver reports keep reporting the loss until the keyframe is received
+	interval    time.Duration
+	lastRequest time.Time
+}
+
+func newLossKeyframeRequester() *lossKeyframeRequester {
+	return &lossKeyframeRequester{
+		threshold: lossKeyframeThreshold,
+		interval:  lossKeyframeInterval,
+	}
+}
+
+// onReceiverReport returns true if a keyframe should be requested for the fraction lost of the receiver report
+func (r *lossKeyframeRequester) onReceiverReport(fractionLost uint8, now time.Time) bool {
+	// the fraction lost is a fixed point number with the binary point at the left edge
+	if float64(fractionLost)/256 < r.threshold {
+		return false
+	}
+
+	if now.Sub(r.lastRequest) < r.interval {
+		return false
+	}
+
+	r.lastRequest = now
+
+	return true
+}
+
 // TODO: need to improve and reduce goroutine usage
 func (c *Client) enableReportAndStats(rtpSender *webrtc.RTPSender, track iClientTrack) {
 	ssrc := rtpSender.GetParameters().Encodings[0].SSRC
@@ -1070,6 +1994,8 @@ func (c *Client) enableReportAndStats(rtpSender *webrtc.RTPSender, track iClient
 
 		buff := make([]byte, 1500)
 
+		lossKeyframe := newLossKeyframeRequester()
+
 		for {
 			select {
 			case <-clientCtx.Done():
@@ -1082,12 +2008,26 @@ func (c *Client) enableReportAndStats(rtpSender *webrtc.RTPSender, track iClient
 					return
 				}
 
+				// the keyframe requests are forwarded to the publisher track with the publisher SSRC, rate limited per publisher track.
+				// The NACKs are not forwarded, they are answered by the NACK responder from the packets sent to the subscriber,
+				// and the packets that the SFU doesn't receive from the publisher are already NACKed by the NACK generator.
 				for _, p := range rtcpPackets {
-					switch p.(type) {
+					switch packet := p.(type) {
 					case *rtcp.PictureLossIndication:
 						track.RequestPLI()
 					case *rtcp.FullIntraRequest:
 						track.RequestPLI()
+					case *rtcp.ReceiverReport:
+						if track.Kind() != webrtc.RTPCodecTypeVideo {
+							continue
+						}
+
+						for _, report := range packet.Reports {
+							if report.SSRC == uint32(ssrc) && lossKeyframe.onReceiverReport(report.FractionLost, time.Now()) {
+								c.log.Debugf("client: request keyframe for track %s, subscriber %s reports fraction lost %d/256", track.ID(), c.ID(), report.FractionLost)
+								track.RequestPLI()
+							}
+						}
 					}
 				}
 			}
@@ -1130,20 +2070,19 @@ func (c *Client) processPendingTracks() {
 
 // make sure to call this when client's done to clean everything
 func (c *Client) afterClosed() {
-	c.mu.Lock()
-	state := c.state.Load()
-	if state == ClientStateEnded {
-		c.mu.Unlock()
+	// swap the state so the clean up only run once when it's called concurrently
+	if c.state.Swap(ClientStateEnded) == ClientStateEnded {
 		return
 	}
-	c.mu.Unlock()
-
-	c.state.Store(ClientStateEnded)
 
 	if c.internalDataChannel != nil {
 		c.internalDataChannel.Close()
 	}
 
+	if metadataDataChannel := c.metadataDataChannel.Load(); metadataDataChannel != nil {
+		metadataDataChannel.Close()
+	}
+
 	c.dataChannels.Clear()
 
 	c.onLeft()
@@ -1169,7 +2108,56 @@ func (c *Client) stop() error {
 	return nil
 }
 
-// End the client connection and clean up the resources.
+// Close gracefully ends the client connection and cleans up the resources.
+// Unlike End that closes the peer connection immediately, Close waits until the running and the pending negotiations are done
+// and the buffered data channel messages are sent, then fires OnLeft and closes the peer connection.
+// If the context is done before that, the client is closed anyway and the context error is returned.
+func (c *Client) Close(ctx context.Context) error {
+	waitErr := c.waitGracefulClose(ctx)
+
+	c.afterClosed()
+
+	if err := c.stop(); err != nil {
+		c.log.Errorf("client: error stop client %s", err.Error())
+		return err
+	}
+
+	return waitErr
+}
+
+func (c *Client) waitGracefulClose(ctx context.Context) error {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for c.PendingNegotiations() > 0 || c.bufferedDataChannelAmount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.context.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) bufferedDataChannelAmount() uint64 {
+	total := c.dataChannels.BufferedAmount()
+
+	if c.internalDataChannel != nil && c.internalDataChannel.ReadyState() == webrtc.DataChannelStateOpen {
+		total += c.internalDataChannel.BufferedAmount()
+	}
+
+	if metadataDataChannel := c.metadataDataChannel.Load(); metadataDataChannel != nil && metadataDataChannel.ReadyState() == webrtc.DataChannelStateOpen {
+		total += metadataDataChannel.BufferedAmount()
+	}
+
+	return total
+}
+
+// End the client connection immediately and clean up the resources.
+// The running negotiation is aborted and the buffered data channel messages are dropped, use Close to end the client gracefully.
 func (c *Client) End() error {
 	err := c.stop()
 	if err != nil {
@@ -1205,79 +2193,307 @@ func (c *Client) onIceCandidateCallback(candidate *webrtc.ICECandidate) {
 		return
 	}
 
-	c.onIceCandidate(c.context, candidate)
+	callUserCallback(c.log, "OnIceCandidate", func() {
+		c.onIceCandidate(c.context, candidate)
+	})
+}
+
+// queueLocalCandidate queues the local candidate in the gather order, the queue is flushed once the local description is set.
+// The candidates gathered before and after the local description is set go through the same queue, so they're sent in the gather order.
+func (c *Client) queueLocalCandidate(candidate *webrtc.ICECandidate) {
+	c.mu.Lock()
+	c.pendingLocalCandidates = append(c.pendingLocalCandidates, candidate)
+	canAdd := c.canAddCandidate.Load()
+	c.mu.Unlock()
+
+	if canAdd {
+		// don't block the ICE gatherer while the candidates are sent
+		go c.flushLocalCandidates()
+	}
+}
+
+// sendPendingLocalCandidates allows sending the local candidates and sends the candidates gathered before.
+func (c *Client) sendPendingLocalCandidates() {
+	c.mu.Lock()
+	c.canAddCandidate.Store(true)
+	c.mu.Unlock()
+
+	c.flushLocalCandidates()
+}
+
+// flushLocalCandidates sends the queued local candidates. The flushes are serialized, and each one takes the candidates
+// queued so far, so the candidates are sent in the gather order even when the flushes run concurrently.
+func (c *Client) flushLocalCandidates() {
+	c.muLocalCandidates.Lock()
+	defer c.muLocalCandidates.Unlock()
+
+	for {
+		c.mu.Lock()
+		candidates := c.pendingLocalCandidates
+		c.pendingLocalCandidates = nil
+		c.mu.Unlock()
+
+		if len(candidates) == 0 {
+			return
+		}
+
+		for _, candidate := range candidates {
+			c.onIceCandidateCallback(candidate)
+		}
+	}
+}
+
+// OnConnectionStateChanged event is called when the SFU connection state is changed.
+// The callback will receive the connection state as the new state.
+func (c *Client) OnConnectionStateChanged(callback func(webrtc.PeerConnectionState)) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onConnectionStateChangedCallbacks = append(c.onConnectionStateChangedCallbacks, callback)
+}
+
+func (c *Client) onConnectionStateChanged(state webrtc.PeerConnectionState) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	for _, callback := range c.onConnectionStateChangedCallbacks {
+		callback := callback
+		go callUserCallback(c.log, "OnConnectionStateChanged", func() {
+			callback(webrtc.PeerConnectionState(state))
+		})
+	}
+}
+
+// OnICEConnectionStateChanged event is called when the ICE connection state is changed.
+// The ICE state tells the connectivity issues apart, disconnected may recover by itself while failed needs an ICE restart.
+func (c *Client) OnICEConnectionStateChanged(callback func(webrtc.ICEConnectionState)) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onICEStateChangedCallbacks = append(c.onICEStateChangedCallbacks, callback)
+}
+
+func (c *Client) onICEConnectionStateChanged(state webrtc.ICEConnectionState) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	for _, callback := range c.onICEStateChangedCallbacks {
+		callback := callback
+		go callUserCallback(c.log, "OnICEConnectionStateChanged", func() {
+			callback(state)
+		})
+	}
+}
+
+func (c *Client) onJoined() {
+	c.muCallback.Lock()
+	callbacks := slices.Clone(c.onJoinedCallbacks)
+	c.muCallback.Unlock()
+
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnJoined", callback)
+	}
+}
+
+// OnJoined event is called when the client is joined to the room.
+// This doesn't mean that the client's tracks are already published to the room.
+// This event can be use to track number of clients in the room.
+func (c *Client) OnJoined(callback func()) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onJoinedCallbacks = append(c.onJoinedCallbacks, callback)
+}
+
+// OnLeft event is called when the client is left from the room.
+// This event can be use to track number of clients in the room.
+func (c *Client) OnLeft(callback func()) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onLeftCallbacks = append(c.onLeftCallbacks, callback)
+}
+
+func (c *Client) onLeft() {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	for _, callback := range c.onLeftCallbacks {
+		go callUserCallback(c.log, "OnLeft", callback)
+	}
+}
+
+// OnTrackAdded event is called when a track from another client is added to the client after it's subscribed.
+// It's paired with OnTrackRemoved that is called when the track is removed from the client.
+func (c *Client) OnTrackAdded(callback func(sourceType string, track *webrtc.TrackLocalStaticRTP)) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onTrackAddedCallbacks = append(c.onTrackAddedCallbacks, callback)
+}
+
+func (c *Client) onTrackAdded(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+	c.muCallback.Lock()
+	callbacks := slices.Clone(c.onTrackAddedCallbacks)
+	c.muCallback.Unlock()
+
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnTrackAdded", func() {
+			callback(sourceType, track)
+		})
+	}
+}
+
+// OnTrackRemoved event is called when the client's track is removed from the room.
+// Usually this triggered when the client is disconnected from the room or a track is unpublished from the client.
+func (c *Client) OnTrackRemoved(callback func(sourceType string, track *webrtc.TrackLocalStaticRTP)) {
+	c.muCallback.Lock()
+	defer c.muCallback.Unlock()
+
+	c.onTrackRemovedCallbacks = append(c.onTrackRemovedCallbacks, callback)
 }
 
-func (c *Client) sendPendingLocalCandidates() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *Client) onTrackRemoved(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+	c.muCallback.Lock()
+	callbacks := slices.Clone(c.onTrackRemovedCallbacks)
+	c.muCallback.Unlock()
 
-	for _, candidate := range c.pendingLocalCandidates {
-		c.onIceCandidateCallback(candidate)
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnTrackRemoved", func() {
+			callback(sourceType, track)
+		})
 	}
-
-	c.pendingLocalCandidates = nil
 }
 
-// OnConnectionStateChanged event is called when the SFU connection state is changed.
-// The callback will receive the connection state as the new state.
-func (c *Client) OnConnectionStateChanged(callback func(webrtc.PeerConnectionState)) {
+// OnQualityChanged event is called when the simulcast layer selected for a subscribed track is no longer sent by the publisher
+// and the SFU falls back to another active layer. The trackID is the subscribed track ID,
+// from is the selected quality and to is the quality that will be forwarded instead.
+func (c *Client) OnQualityChanged(callback func(trackID string, from, to QualityLevel)) {
 	c.muCallback.Lock()
 	defer c.muCallback.Unlock()
 
-	c.onConnectionStateChangedCallbacks = append(c.onConnectionStateChangedCallbacks, callback)
+	c.onQualityChangedCallbacks = append(c.onQualityChangedCallbacks, callback)
 }
 
-func (c *Client) onConnectionStateChanged(state webrtc.PeerConnectionState) {
-	c.muCallback.Lock()
-	defer c.muCallback.Unlock()
+// onQualityChanged is called from the packet forwarding goroutine,
+// so the callbacks are queued to run in order on another goroutine instead of blocking the forwarding
+func (c *Client) onQualityChanged(trackID string, from, to QualityLevel) {
+	c.trackEvents.push(func() {
+		c.muCallback.Lock()
+		callbacks := slices.Clone(c.onQualityChangedCallbacks)
+		c.muCallback.Unlock()
 
-	for _, callback := range c.onConnectionStateChangedCallbacks {
-		go callback(webrtc.PeerConnectionState(state))
-	}
+		for _, callback := range callbacks {
+			callUserCallback(c.log, "OnQualityChanged", func() {
+				callback(trackID, from, to)
+			})
+		}
+	})
 }
 
-func (c *Client) onJoined() {
+// OnTrackPauseChanged event is called when a subscribed simulcast track is paused because the bandwidth can't fit its lowest layer
+// or the video is not displayed, and when it's resumed once the bandwidth recovers. The client is also notified
+// through the internal data channel with the track_paused and track_resumed messages, so the UI can show the video is paused.
+func (c *Client) OnTrackPauseChanged(callback func(trackID string, paused bool)) {
 	c.muCallback.Lock()
 	defer c.muCallback.Unlock()
 
-	for _, callback := range c.onJoinedCallbacks {
-		callback()
+	c.onTrackPauseChangedCallbacks = append(c.onTrackPauseChangedCallbacks, callback)
+}
+
+// onTrackPauseChanged is called from the packet forwarding goroutine, so the callbacks and the data channel message
+// are queued to run in order on another goroutine instead of blocking the forwarding
+func (c *Client) onTrackPauseChanged(trackID string, paused bool) {
+	c.trackEvents.push(func() {
+		c.muCallback.Lock()
+		callbacks := slices.Clone(c.onTrackPauseChangedCallbacks)
+		c.muCallback.Unlock()
+
+		for _, callback := range callbacks {
+			callUserCallback(c.log, "OnTrackPauseChanged", func() {
+				callback(trackID, paused)
+			})
+		}
+
+		c.sendTrackPaused(trackID, paused)
+	})
+}
+
+func (c *Client) sendTrackPaused(trackID string, paused bool) {
+	if c.internalDataChannel == nil || c.internalDataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+
+	dataType := messageTypeResumed
+	if paused {
+		dataType = messageTypePaused
+	}
+
+	data, err := json.Marshal(internalDataTrackPaused{
+		Type: dataType,
+		Data: trackPaused{TrackID: trackID},
+	})
+	if err != nil {
+		c.log.Errorf("client: error marshal track paused data %s", err.Error())
+		return
+	}
+
+	if err := c.internalDataChannel.SendText(string(data)); err != nil {
+		c.log.Errorf("client: error send track paused data %s", err.Error())
 	}
 }
 
-// OnJoined event is called when the client is joined to the room.
-// This doesn't mean that the client's tracks are already published to the room.
-// This event can be use to track number of clients in the room.
-func (c *Client) OnJoined(callback func()) {
+// OnDataChannel event is called when the client opens a new data channel to the SFU.
+// The data channels created by the SFU and the internal data channels with the reserved labels are not passed to this event.
+// Setting the OnMessage handler of the data channel will replace the handlers registered with Client.OnMessage.
+func (c *Client) OnDataChannel(callback func(*webrtc.DataChannel)) {
 	c.muCallback.Lock()
 	defer c.muCallback.Unlock()
 
-	c.onJoinedCallbacks = append(c.onJoinedCallbacks, callback)
+	c.onDataChannelCallbacks = append(c.onDataChannelCallbacks, callback)
 }
 
-// OnLeft event is called when the client is left from the room.
-// This event can be use to track number of clients in the room.
-func (c *Client) OnLeft(callback func()) {
+func (c *Client) onDataChannel(dc *webrtc.DataChannel) {
 	c.muCallback.Lock()
-	defer c.muCallback.Unlock()
+	callbacks := slices.Clone(c.onDataChannelCallbacks)
+	c.muCallback.Unlock()
 
-	c.onLeftCallbacks = append(c.onLeftCallbacks, callback)
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnDataChannel", func() {
+			callback(dc)
+		})
+	}
 }
 
-func (c *Client) onLeft() {
+// OnMessage event is called when the client sends a message on the data channel with the label.
+// It receives the messages from the data channels opened by the client and the data channels created with SFU.CreateDataChannel.
+// The messages on the internal data channels with the reserved labels are never passed to this event.
+func (c *Client) OnMessage(label string, callback func(data []byte)) {
+	if IsReservedDataChannelLabel(label) {
+		c.log.Warnf("client: can't listen to the messages of the reserved data channel %s", label)
+		return
+	}
+
 	c.muCallback.Lock()
 	defer c.muCallback.Unlock()
 
-	for _, callback := range c.onLeftCallbacks {
-		go callback()
+	if c.onMessageCallbacks == nil {
+		c.onMessageCallbacks = make(map[string][]func(data []byte))
 	}
+
+	c.onMessageCallbacks[label] = append(c.onMessageCallbacks[label], callback)
 }
 
-// OnTrackRemoved event is called when the client's track is removed from the room.
-// Usually this triggered when the client is disconnected from the room or a track is unpublished from the client.
-func (c *Client) OnTrackRemoved(callback func(sourceType string, track *webrtc.TrackLocalStaticRTP)) {
-	c.onTrackRemovedCallbacks = append(c.onTrackRemovedCallbacks, callback)
+func (c *Client) onMessage(label string, data []byte) {
+	c.muCallback.Lock()
+	callbacks := slices.Clone(c.onMessageCallbacks[label])
+	c.muCallback.Unlock()
+
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnMessage", func() {
+			callback(data)
+		})
+	}
 }
 
 func (c *Client) IsBridge() bool {
@@ -1289,26 +2505,26 @@ func (c *Client) startIdleTimeout(timeout time.Duration) {
 	defer c.mu.Unlock()
 
 	// cancel previous timeout and start a new one
-	if c.idleTimeoutContext != nil && c.idleTimeoutContext.Err() == nil {
+	if c.idleTimeoutCancel != nil {
 		c.idleTimeoutCancel()
 	}
 
+	// create the context before starting the goroutine so a cancelIdleTimeout call
+	// right after this can't be missed by the goroutine
+	ctx, cancel := context.WithTimeout(c.context, timeout)
+	c.idleTimeoutContext, c.idleTimeoutCancel = ctx, cancel
+
 	go func() {
-		c.idleTimeoutContext, c.idleTimeoutCancel = context.WithTimeout(c.context, timeout)
-		<-c.idleTimeoutContext.Done()
-		if c == nil || c.idleTimeoutContext == nil || c.idleTimeoutCancel == nil {
-			return
-		}
+		defer cancel()
 
-		defer c.idleTimeoutCancel()
+		<-ctx.Done()
 
-		err := c.idleTimeoutContext.Err()
-		if err != nil && err == context.DeadlineExceeded {
-			c.log.Infof("client: idle timeout reached ", c.ID)
+		if ctx.Err() == context.DeadlineExceeded {
+			c.log.Infof("client: idle timeout reached %s", c.ID())
 
 			err := c.stop()
 			if err != nil {
-				c.log.Errorf("client: error stop client ", err)
+				c.log.Errorf("client: error stop client %s", err.Error())
 			}
 		}
 	}()
@@ -1325,10 +2541,65 @@ func (c *Client) cancelIdleTimeout() {
 	}
 }
 
+// State returns the client state, one of ClientStateNew, ClientStateActive, ClientStateRestart or ClientStateEnded
+func (c *Client) State() int {
+	if state, ok := c.state.Load().(int); ok {
+		return state
+	}
+
+	return ClientStateNew
+}
+
 func (c *Client) Type() string {
+	if clientType, ok := c.clientType.Load().(string); ok {
+		return clientType
+	}
+
 	return c.options.Type
 }
 
+// SetType changes the client type, for example to promote a peer to a bridge when the server topology changes.
+// The type must be one of ClientTypePeer, ClientTypeUpBridge or ClientTypeDownBridge.
+// It returns ErrClientTypeNegotiating if the client is negotiating, retry once the negotiation is completed.
+// The published tracks of a peer are held until all the tracks in the offer are received, a bridge publishes them immediately,
+// so the held tracks are published when the peer is promoted to a bridge.
+func (c *Client) SetType(clientType string) error {
+	switch clientType {
+	case ClientTypePeer, ClientTypeUpBridge, ClientTypeDownBridge:
+	default:
+		return ErrInvalidClientType
+	}
+
+	if c.PendingNegotiations() > 0 || c.peerConnection.PC().SignalingState() != webrtc.SignalingStateStable {
+		return ErrClientTypeNegotiating
+	}
+
+	oldType := c.Type()
+	if oldType == clientType {
+		return nil
+	}
+
+	c.clientType.Store(clientType)
+
+	c.log.Infof("client: %s type changed from %s to %s", c.ID(), oldType, clientType)
+
+	if oldType == ClientTypePeer && c.pendingPublishedTracks.Length() > 0 {
+		c.publishPendingTracks()
+	}
+
+	return nil
+}
+
+func (c *Client) publishPendingTracks() {
+	addedTracks := c.pendingPublishedTracks.GetTracks()
+
+	if c.onTracksAdded != nil {
+		callUserCallback(c.log, "OnTracksAdded", func() {
+			c.onTracksAdded(addedTracks)
+		})
+	}
+}
+
 func (c *Client) PeerConnection() *PeerConnection {
 	return c.peerConnection
 }
@@ -1377,6 +2648,123 @@ func (c *Client) SetTracksSourceType(trackTypes map[string]TrackType) {
 	}
 }
 
+// SetTrackMuted mutes or unmutes the track published by the client on the server side.
+// The muted track is not forwarded to the subscribers without the client cooperation, for example when a moderator mutes the client.
+// Unmuting the video track will request a keyframe from the client so the subscribers can resume the video.
+func (c *Client) SetTrackMuted(streamID, trackID string, muted bool) error {
+	track, err := c.tracks.Get(trackID)
+	if err != nil {
+		return err
+	}
+
+	if track.StreamID() != streamID {
+		return ErrTrackIsNotExists
+	}
+
+	track.SetMuted(muted)
+
+	return nil
+}
+
+// ReplaceTrack replaces the track sent to the client with the new track without a renegotiation, for example when the camera is switched.
+// The renegotiation is only needed when the new track codec is not compatible with the old one,
+// in that case the old track is removed and the new track is added through a renegotiation.
+// The caller is responsible to write the RTP packets to the new track.
+func (c *Client) ReplaceTrack(oldStreamID, oldTrackID string, newTrack *webrtc.TrackLocalStaticRTP) error {
+	var sender *webrtc.RTPSender
+
+	for _, transceiver := range c.peerConnection.PC().GetTransceivers() {
+		s := transceiver.Sender()
+		if s == nil || s.Track() == nil {
+			continue
+		}
+
+		if s.Track().ID() == oldTrackID && s.Track().StreamID() == oldStreamID {
+			sender = s
+			break
+		}
+	}
+
+	if sender == nil {
+		return ErrTrackIsNotExists
+	}
+
+	// the forwarded source track is no longer written to the old track, the new track is written by the caller
+	c.detachClientTrack(oldTrackID)
+
+	oldTrack, ok := sender.Track().(*webrtc.TrackLocalStaticRTP)
+	if ok && strings.EqualFold(oldTrack.Codec().MimeType, newTrack.Codec().MimeType) {
+		err := sender.ReplaceTrack(newTrack)
+		if err == nil {
+			return nil
+		}
+
+		c.log.Warnf("client: error replace track %s, fallback to renegotiation: %s", oldTrackID, err.Error())
+	}
+
+	if err := c.peerConnection.PC().RemoveTrack(sender); err != nil {
+		return err
+	}
+
+	if _, err := c.peerConnection.PC().AddTransceiverFromTrack(newTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		return err
+	}
+
+	c.renegotiate(false)
+
+	return nil
+}
+
+// GetTransceiverInfo returns a snapshot of the client transceivers, to diagnose the m-line and transceiver mismatches on renegotiation.
+func (c *Client) GetTransceiverInfo() []TransceiverInfo {
+	currentDirections := make(map[string]webrtc.RTPTransceiverDirection)
+
+	if desc := c.peerConnection.PC().CurrentLocalDescription(); desc != nil {
+		if parsed, err := desc.Unmarshal(); err == nil {
+			for _, media := range parsed.MediaDescriptions {
+				mid, ok := media.Attribute(sdp.AttrKeyMID)
+				if !ok {
+					continue
+				}
+
+				for _, direction := range []string{sdp.AttrKeySendRecv, sdp.AttrKeySendOnly, sdp.AttrKeyRecvOnly, sdp.AttrKeyInactive} {
+					if _, ok := media.Attribute(direction); ok {
+						currentDirections[mid] = webrtc.NewRTPTransceiverDirection(direction)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	transceivers := c.peerConnection.PC().GetTransceivers()
+	infos := make([]TransceiverInfo, 0, len(transceivers))
+
+	for _, transceiver := range transceivers {
+		info := TransceiverInfo{
+			Mid:              transceiver.Mid(),
+			Kind:             transceiver.Kind(),
+			Direction:        transceiver.Direction(),
+			CurrentDirection: currentDirections[transceiver.Mid()],
+		}
+
+		if sender := transceiver.Sender(); sender != nil && sender.Track() != nil {
+			info.TrackID = sender.Track().ID()
+
+			if track, ok := sender.Track().(*webrtc.TrackLocalStaticRTP); ok {
+				info.Codec = track.Codec().MimeType
+			}
+		} else if receiver := transceiver.Receiver(); receiver != nil && receiver.Track() != nil {
+			info.TrackID = receiver.Track().ID()
+			info.Codec = receiver.Track().Codec().MimeType
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
 // SubscribeTracks subscribe tracks from other clients that are published to this client
 // The client must listen for `client.OnTracksAvailable` to know if a new track is available to subscribe.
 // Calling subscribe tracks will trigger the SFU renegotiation with the client.
@@ -1386,6 +2774,14 @@ func (c *Client) SubscribeTracks(req []SubscribeTrackRequest) error {
 		c.pendingReceivedTracks = append(c.pendingReceivedTracks, req...)
 		c.mu.Unlock()
 
+		if c.IsBridge() {
+			for _, r := range req {
+				if track, ok := c.sfu.publishedTrack(r); ok {
+					c.addBridgeTrack(r, track)
+				}
+			}
+		}
+
 		return nil
 	}
 
@@ -1410,6 +2806,10 @@ func (c *Client) SubscribeTracks(req []SubscribeTrackRequest) error {
 					clientTracks = append(clientTracks, clientTrack)
 				}
 
+				if c.IsBridge() {
+					c.addBridgeTrack(r, track)
+				}
+
 				c.log.Debugf("client: subscribe track %s from %s to %s", r.TrackID, r.ClientID, c.ID())
 
 				trackFound = true
@@ -1424,6 +2824,10 @@ func (c *Client) SubscribeTracks(req []SubscribeTrackRequest) error {
 					clientTracks = append(clientTracks, clientTrack)
 				}
 
+				if c.IsBridge() {
+					c.addBridgeTrack(r, track)
+				}
+
 				trackFound = true
 			}
 		}
@@ -1448,6 +2852,14 @@ func (c *Client) SubscribeTracks(req []SubscribeTrackRequest) error {
 	return nil
 }
 
+// SyncTracks subscribes the client to all the tracks published by the other clients in the same group that the client is not subscribed yet.
+// Use it to reconcile the client subscriptions with the room after the tracks are subscribed or unsubscribed manually.
+// Returns true if new tracks are added, the SFU renegotiates with the client to send them.
+// If the client is not connected yet, the tracks are subscribed once it's connected and false is returned.
+func (c *Client) SyncTracks() (needsRenegotiation bool) {
+	return c.sfu.syncTrack(c)
+}
+
 // SetQuality method is to set the maximum quality of the video that will be sent to the client.
 // This is for bandwidth efficiency purpose and use when the video is rendered in smaller size than the original size.
 func (c *Client) SetQuality(quality QualityLevel) {
@@ -1469,6 +2881,35 @@ func (c *Client) SetQuality(quality QualityLevel) {
 	}
 }
 
+// PinTrack pins the subscribed video track at the high quality regardless of the bandwidth distribution,
+// for example the dominant speaker in a speaker view layout. The other simulcast and scaleable video tracks are demoted to the low quality.
+// Only one track is pinned at a time, pinning another track replaces the pinned track. The track is unpinned when it's ended.
+func (c *Client) PinTrack(streamID, trackID string) error {
+	clientTrack, ok := c.ClientTracks()[trackID]
+	if !ok || clientTrack.StreamID() != streamID {
+		return ErrTrackIsNotExists
+	}
+
+	if clientTrack.Kind() != webrtc.RTPCodecTypeVideo {
+		return ErrTrackIsNotVideo
+	}
+
+	c.log.Infof("client: %s pin track %s", c.ID(), trackID)
+	c.bitrateController.pin(trackID)
+
+	return nil
+}
+
+// UnpinTrack releases the pinned track, the quality of the video tracks is adjusted to the bandwidth again
+func (c *Client) UnpinTrack() {
+	c.bitrateController.unpin()
+}
+
+// PinnedTrack returns the ID of the pinned track, or an empty string if no track is pinned
+func (c *Client) PinnedTrack() string {
+	return c.bitrateController.pinnedTrack()
+}
+
 // GetEstimatedBandwidth returns the estimated bandwidth in bits per second based on
 // Google Congestion Controller estimation. If the congestion controller is not enabled,
 // it will return the initial bandwidth. If the receiving bandwidth is not 0, it will return the smallest value between
@@ -1477,12 +2918,49 @@ func (c *Client) GetEstimatedBandwidth() uint32 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	var bw uint32
+
 	if c.estimator == nil {
-		return c.sfu.bitrateConfigs.InitialBandwidth
+		bw = c.sfu.bitrateConfigs.InitialBandwidth
+	} else {
+		// overshot the bandwidth by 40%
+		bw = uint32(c.estimator.GetTargetBitrate() * 1400 / 1000)
+	}
+
+	if maxBitrate := c.maxBitrateCap(); maxBitrate > 0 && bw > maxBitrate {
+		return maxBitrate
+	}
+
+	return bw
+}
+
+// SetMaxBitrate caps the total bitrate in kbps that will be sent to the client.
+// The simulcast and scaleable tracks will be switched to the lower layers to fit the cap,
+// and the publishers of the non simulcast video tracks will be requested to reduce the bitrate through RTCP REMB.
+// Set to 0 to remove the cap.
+func (c *Client) SetMaxBitrate(kbps uint32) {
+	bitrate := kbps * 1000
+
+	if bitrate > 0 && bitrate < c.sfu.bitrateConfigs.VideoLow {
+		c.log.Warnf("client: max bitrate %d kbps is below the low video bitrate, the low video layer will still be forwarded", kbps)
+	}
+
+	c.maxBitrate.Store(bitrate)
+}
+
+// maxBitrateCap returns the max bitrate in bps, or 0 if not capped.
+// The cap never goes below the low video bitrate to make sure the low layer is still forwarded.
+func (c *Client) maxBitrateCap() uint32 {
+	maxBitrate := c.maxBitrate.Load()
+	if maxBitrate == 0 {
+		return 0
+	}
+
+	if maxBitrate < c.sfu.bitrateConfigs.VideoLow {
+		return c.sfu.bitrateConfigs.VideoLow
 	}
 
-	// overshot the bandwidth by 40%
-	return uint32(c.estimator.GetTargetBitrate() * 1400 / 1000)
+	return maxBitrate
 }
 
 // This should get from the publisher client using RTCIceCandidatePairStats.availableOutgoingBitrate
@@ -1507,7 +2985,7 @@ func (c *Client) createDataChannel(label string, initOpts *webrtc.DataChannelIni
 	}
 
 	c.log.Infof("client: data channel created ", label, " ", c.ID())
-	c.sfu.setupMessageForwarder(c.ID(), newDc)
+	c.sfu.setupMessageForwarder(c, newDc)
 	c.dataChannels.Add(newDc)
 
 	return nil
@@ -1570,6 +3048,22 @@ func (c *Client) SetReceivingBandwidthLimit(bandwidth uint32) {
 	c.receivingBandwidth.Store(bandwidth)
 }
 
+// SetPlayoutDelay changes the playout delay extension added to the packets sent to the client,
+// the client plays out the media with a delay between minDelay and maxDelay. Use a higher delay to trade the latency for a smoother playback,
+// like keeping the subscribers of a watch party in sync. The delay is sent in 10ms units up to 40.95s.
+// Returns ErrPlayoutDelayNotEnabled if the client is created without ClientOptions.EnablePlayoutDelay.
+func (c *Client) SetPlayoutDelay(minDelay, maxDelay time.Duration) error {
+	if c.playoutDelay == nil {
+		return ErrPlayoutDelayNotEnabled
+	}
+
+	if minDelay < 0 || minDelay > maxDelay || maxDelay > maxPlayoutDelay {
+		return ErrInvalidPlayoutDelay
+	}
+
+	return c.playoutDelay.SetDelay(uint16(minDelay.Milliseconds()), uint16(maxDelay.Milliseconds()))
+}
+
 // SetName update the name of the client, that previously set on create client
 // The name then later can use by call client.Name() method
 func (c *Client) SetName(name string) {
@@ -1579,6 +3073,49 @@ func (c *Client) SetName(name string) {
 	c.name = name
 }
 
+// GetSelectedCandidatePair returns the ICE candidate pair that is selected to send the media to the client.
+// The local candidate is the SFU side and the remote candidate is the client side, a relay candidate means the side is connected through a TURN server.
+// Returns ErrCandidatePairNotSelected if the client is not connected yet.
+func (c *Client) GetSelectedCandidatePair() (*webrtc.ICECandidatePair, error) {
+	pair, err := c.peerConnection.PC().SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return nil, err
+	}
+
+	if pair == nil {
+		return nil, ErrCandidatePairNotSelected
+	}
+
+	return pair, nil
+}
+
+// setSelectedCandidatePairStats fills the candidate types and the relay protocol of the selected ICE candidate pair.
+// The fields are left empty if the candidate pair is not selected yet.
+func (c *Client) setSelectedCandidatePairStats(clientStats *ClientTrackStats) {
+	pair, err := c.GetSelectedCandidatePair()
+	if err != nil {
+		return
+	}
+
+	clientStats.LocalCandidateType = pair.Local.Typ.String()
+	clientStats.RemoteCandidateType = pair.Remote.Typ.String()
+	clientStats.Relayed = pair.Local.Typ == webrtc.ICECandidateTypeRelay || pair.Remote.Typ == webrtc.ICECandidateTypeRelay
+
+	// the relay protocol is only known for the local relay candidate, the client doesn't signal the protocol of its TURN server
+	if pair.Local.Typ != webrtc.ICECandidateTypeRelay {
+		return
+	}
+
+	pairStats, ok := c.peerConnection.PC().SCTP().Transport().ICETransport().GetSelectedCandidatePairStats()
+	if !ok {
+		return
+	}
+
+	if candidateStats, ok := c.peerConnection.PC().GetStats()[pairStats.LocalCandidateID].(webrtc.ICECandidateStats); ok {
+		clientStats.RelayProtocol = candidateStats.RelayProtocol
+	}
+}
+
 // TODO: fix the panic nil here when the client is ended
 func (c *Client) Stats() ClientTrackStats {
 	if c.peerConnection.PC().ConnectionState() == webrtc.PeerConnectionStateClosed {
@@ -1587,7 +3124,7 @@ func (c *Client) Stats() ClientTrackStats {
 
 	clientStats := ClientTrackStats{
 		ID:                       c.id,
-		Name:                     c.name,
+		Name:                     c.Name(),
 		ConsumerBandwidth:        c.GetEstimatedBandwidth(),
 		PublisherBandwidth:       c.ingressBandwidth.Load(),
 		Sents:                    make([]TrackSentStats, 0),
@@ -1597,6 +3134,12 @@ func (c *Client) Stats() ClientTrackStats {
 		VoiceActivityDurationMS:  uint32(c.stats.VoiceActivity().Milliseconds()),
 	}
 
+	c.setSelectedCandidatePairStats(&clientStats)
+
+	for _, track := range c.ClientTracks() {
+		clientStats.PacketsDropped += track.PacketsDropped()
+	}
+
 	for _, track := range c.Tracks() {
 		if track.IsSimulcast() {
 			simulcastClientTrack := track.(*SimulcastTrack)
@@ -1679,18 +3222,26 @@ func (c *Client) Stats() ClientTrackStats {
 		}
 
 		sentStats := TrackSentStats{
-			ID:             id,
-			StreamID:       track.StreamID(),
-			Kind:           track.Kind(),
-			Codec:          track.MimeType(),
-			PacketsLost:    stat.RemoteInboundRTPStreamStats.PacketsLost,
-			PacketSent:     stat.OutboundRTPStreamStats.PacketsSent,
-			FractionLost:   stat.RemoteInboundRTPStreamStats.FractionLost,
-			BytesSent:      stat.OutboundRTPStreamStats.BytesSent,
-			CurrentBitrate: track.SendBitrate(),
-			Source:         source,
-			Quality:        track.Quality(),
-			MaxQuality:     track.MaxQuality(),
+			ID:               id,
+			StreamID:         track.StreamID(),
+			Kind:             track.Kind(),
+			Codec:            track.MimeType(),
+			PacketsLost:      stat.RemoteInboundRTPStreamStats.PacketsLost,
+			PacketSent:       stat.OutboundRTPStreamStats.PacketsSent,
+			FractionLost:     stat.RemoteInboundRTPStreamStats.FractionLost,
+			BytesSent:        stat.OutboundRTPStreamStats.BytesSent,
+			CurrentBitrate:   track.SendBitrate(),
+			Source:           source,
+			Quality:          track.Quality(),
+			MaxQuality:       track.MaxQuality(),
+			Muted:            track.IsMuted(),
+			TimeToFirstFrame: track.TimeToFirstFrame(),
+			PacketsDropped:   track.PacketsDropped(),
+		}
+
+		// the bitrate controller target, the headroom of the adaptation is the difference with the current bitrate
+		if claim := c.bitrateController.GetClaim(id); claim != nil {
+			sentStats.TargetBitrate = claim.TargetBitrate()
 		}
 
 		clientStats.Sents = append(clientStats.Sents, sentStats)
@@ -1699,6 +3250,47 @@ func (c *Client) Stats() ClientTrackStats {
 	return clientStats
 }
 
+// GetStats returns the client stats on demand. The sent and received track stats are the same with `client.Stats()`,
+// but the current consumer bitrate is measured from the peer connection transport stats over a short sampling window.
+// This method will block for the duration of the sampling window.
+func (c *Client) GetStats() ClientTrackStats {
+	clientStats := c.Stats()
+	if clientStats.ID == "" {
+		// client is already closed
+		return clientStats
+	}
+
+	previousBytesSent := c.transportBytesSent()
+
+	select {
+	case <-c.context.Done():
+		return clientStats
+	case <-time.After(statsSamplingWindow):
+	}
+
+	currentBytesSent := c.transportBytesSent()
+	if currentBytesSent < previousBytesSent {
+		return clientStats
+	}
+
+	clientStats.CurrentConsumerBitrate = uint32((currentBytesSent - previousBytesSent) * 8 * uint64(time.Second) / uint64(statsSamplingWindow))
+
+	return clientStats
+}
+
+// transportBytesSent returns the total bytes sent through the peer connection transports
+func (c *Client) transportBytesSent() uint64 {
+	var bytesSent uint64
+
+	for _, stat := range c.peerConnection.PC().GetStats() {
+		if transportStats, ok := stat.(webrtc.TransportStats); ok {
+			bytesSent += transportStats.BytesSent
+		}
+	}
+
+	return bytesSent
+}
+
 func (c *Client) EnableDebug() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -1724,8 +3316,17 @@ func (c *Client) OnTracksAvailable(callback func([]ITrack)) {
 }
 
 func (c *Client) onTracksAvailable(tracks []ITrack) {
+	if c.options.AudioOnly {
+		tracks = audioTracksOnly(tracks)
+		if len(tracks) == 0 {
+			return
+		}
+	}
+
 	for _, callback := range c.onTracksAvailableCallbacks {
-		callback(tracks)
+		callUserCallback(c.log, "OnTracksAvailable", func() {
+			callback(tracks)
+		})
 	}
 }
 
@@ -1739,7 +3340,9 @@ func (c *Client) OnTracksReady(callback func([]ITrack)) {
 
 func (c *Client) onTracksReady(tracks []ITrack) {
 	for _, callback := range c.onTracksReadyCallbacks {
-		callback(tracks)
+		callUserCallback(c.log, "OnTracksReady", func() {
+			callback(tracks)
+		})
 	}
 }
 
@@ -1754,9 +3357,13 @@ func (c *Client) OnVoiceSentDetected(callback func(activity voiceactivedetector.
 
 func (c *Client) onVoiceSentDetected(activity voiceactivedetector.VoiceActivity) {
 	c.muCallback.Lock()
-	defer c.muCallback.Unlock()
-	for _, callback := range c.onVoiceSentDetectedCallbacks {
-		callback(activity)
+	callbacks := slices.Clone(c.onVoiceSentDetectedCallbacks)
+	c.muCallback.Unlock()
+
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnVoiceSentDetected", func() {
+			callback(activity)
+		})
 	}
 }
 
@@ -1845,10 +3452,13 @@ func (c *Client) enableVADStatUpdate() {
 
 func (c *Client) onVoiceReceiveDetected(activity voiceactivedetector.VoiceActivity) {
 	c.muCallback.Lock()
-	defer c.muCallback.Unlock()
+	callbacks := slices.Clone(c.onVoiceReceivedDetectedCallbacks)
+	c.muCallback.Unlock()
 
-	for _, callback := range c.onVoiceReceivedDetectedCallbacks {
-		callback(activity)
+	for _, callback := range callbacks {
+		callUserCallback(c.log, "OnVoiceReceivedDetected", func() {
+			callback(activity)
+		})
 	}
 }
 
@@ -1877,6 +3487,8 @@ func registerInterceptors(m *webrtc.MediaEngine, interceptorRegistry *intercepto
 		return err
 	}
 
+	// generate the transport-wide CC feedback for the received packets,
+	// so the publishers can adapt their send bitrate based on the network condition seen by the SFU
 	return webrtc.ConfigureTWCCSender(m, interceptorRegistry)
 }
 
@@ -1893,6 +3505,12 @@ func generateClientReceiverStats(c *Client, track IRemoteTrack, stat stats.Stats
 		CurrentBitrate:  bitrate,
 		PacketsLost:     stat.InboundRTPStreamStats.PacketsLost,
 		PacketsReceived: stat.InboundRTPStreamStats.PacketsReceived,
+		NACKCount:       stat.InboundRTPStreamStats.NACKCount,
+	}
+
+	// the jitter is measured in the RTP timestamp units
+	if clockRate := track.Codec().ClockRate; clockRate > 0 {
+		receivedStats.Jitter = stat.InboundRTPStreamStats.Jitter / float64(clockRate)
 	}
 
 	return receivedStats, nil
@@ -1907,6 +3525,8 @@ func (c *Client) OnNetworkConditionChanged(callback func(networkmonitor.NetworkC
 
 func (c *Client) onNetworkConditionChanged(condition networkmonitor.NetworkConditionType) {
 	if c.onNetworkConditionChangedFunc != nil {
-		c.onNetworkConditionChangedFunc(condition)
+		callUserCallback(c.log, "OnNetworkConditionChanged", func() {
+			c.onNetworkConditionChangedFunc(condition)
+		})
 	}
 }
@@ -1,13 +1,32 @@
 package sfu
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/inlivedev/sfu/pkg/interceptors/voiceactivedetector"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/logging"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/turn/v3"
 	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
 )
 
 func TestTracksSubscribe(t *testing.T) {
@@ -226,6 +245,146 @@ func addSimulcastPair(t *testing.T, ctx context.Context, room *Room, peerName st
 	return client, pc.PeerConnection
 }
 
+func TestSimulcastTrackConcurrentRIDs(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-room", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	// the three RID layers start sending at the same time once ICE is connected, so their OnTrack run concurrently
+	pc, client, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "peer1", true, true)
+	defer func() {
+		_ = testRoom.StopClient(client.ID())
+		_ = pc.PeerConnection.Close()
+	}()
+
+	addedChan := make(chan ITrack, 3)
+	client.OnTracksAdded(func(addedTracks []ITrack) {
+		setTracks := make(map[string]TrackType, 0)
+		for _, track := range addedTracks {
+			setTracks[track.ID()] = TrackTypeMedia
+			addedChan <- track
+		}
+		client.SetTracksSourceType(setTracks)
+	})
+
+	var simulcastTrack *SimulcastTrack
+	select {
+	case track := <-addedChan:
+		require.True(t, track.IsSimulcast())
+		simulcastTrack = track.(*SimulcastTrack)
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for the simulcast track")
+	}
+
+	// all the layers are grouped into the first simulcast track
+	require.Eventually(t, func() bool {
+		simulcastTrack.mu.RLock()
+		defer simulcastTrack.mu.RUnlock()
+
+		return simulcastTrack.remoteTrackHigh != nil &&
+			simulcastTrack.remoteTrackMid != nil &&
+			simulcastTrack.remoteTrackLow != nil
+	}, 10*time.Second, 50*time.Millisecond)
+
+	select {
+	case track := <-addedChan:
+		t.Fatalf("unexpected track %s added for the same transceiver", track.ID())
+	case <-time.After(time.Second):
+	}
+
+	require.Len(t, client.Tracks(), 1)
+}
+
+func TestClientAddSimulcastRemoteTrackConcurrently(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-simulcast-rids", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	client, err := testRoom.AddClient(testRoom.CreateClientID(), "client", DefaultClientOptions())
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	onTrackCount := make(map[string]int)
+	client.onTrack = func(track ITrack) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		onTrackCount[track.ID()]++
+	}
+
+	// the race between the layers is narrow, so it's repeated with a new track on each round
+	for i := 0; i < 50; i++ {
+		sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, fmt.Sprintf("video-%d", i), "stream")
+		require.NoError(t, err)
+
+		layers := make([]*ridSampleTrack, 0, 3)
+		for _, rid := range []string{"high", "mid", "low"} {
+			layer := &ridSampleTrack{sampleTrack: newSampleTrack(client.context, sample, getRTPParameters(webrtc.MimeTypeVP8)), rid: rid}
+			defer layer.close()
+
+			layers = append(layers, layer)
+		}
+
+		// the OnTrack of the RID layers are fired at the same time like pion does on their own goroutines
+		start := make(chan struct{})
+
+		var wg sync.WaitGroup
+		for _, layer := range layers {
+			wg.Add(1)
+			go func(layer *ridSampleTrack) {
+				defer wg.Done()
+				<-start
+				client.addSimulcastRemoteTrack(layer, func() {}, func(*stats.Stats) {})
+			}(layer)
+		}
+
+		close(start)
+		wg.Wait()
+
+		mu.Lock()
+		require.Equal(t, 1, onTrackCount[sample.ID()], "onTrack must be called once for %s", sample.ID())
+		mu.Unlock()
+
+		track, err := client.tracks.Get(sample.ID())
+		require.NoError(t, err)
+
+		simulcastTrack, ok := track.(*SimulcastTrack)
+		require.True(t, ok)
+		require.True(t, simulcastTrack.IsProcessed())
+
+		simulcastTrack.mu.RLock()
+		require.NotNil(t, simulcastTrack.remoteTrackHigh)
+		require.NotNil(t, simulcastTrack.remoteTrackMid)
+		require.NotNil(t, simulcastTrack.remoteTrackLow)
+		simulcastTrack.mu.RUnlock()
+	}
+
+	// only one simulcast track is created for each transceiver
+	require.Len(t, client.Tracks(), 50)
+
+	require.NoError(t, testRoom.Close())
+}
+
 func TestClientDataChannel(t *testing.T) {
 	report := CheckRoutines(t)
 	defer report()
@@ -269,3 +428,3070 @@ func TestClientDataChannel(t *testing.T) {
 		require.Equal(t, "internal", dc.Label())
 	}
 }
+
+func TestClientMaxBitrate(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-max-bitrate", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	client, err := testRoom.AddClient("client-1", "client-1", DefaultClientOptions())
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	uncapped := client.GetEstimatedBandwidth()
+
+	capped := uncapped/1000 - 100
+	client.SetMaxBitrate(capped)
+	require.Equal(t, capped*1000, client.GetEstimatedBandwidth())
+
+	// the cap below the low video bitrate should still allow the low video layer
+	client.SetMaxBitrate(1)
+	require.Equal(t, testRoom.sfu.bitrateConfigs.VideoLow, client.GetEstimatedBandwidth())
+
+	client.SetMaxBitrate(0)
+	require.Equal(t, uncapped, client.GetEstimatedBandwidth())
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientRelayCandidateType(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// start a TURN server on a free port, so it doesn't collide with the test STUN server
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	turnServer, err := turn.NewServer(turn.ServerConfig{
+		Realm: "test",
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return turn.GenerateAuthKey(username, realm, "pass"), username == "user"
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	defer turnServer.Close()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-relay-candidate", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	settingEngine.SetIncludeLoopbackCandidate(true)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(GetMediaEngine()), webrtc.WithSettingEngine(settingEngine))
+
+	// only use the relay candidates
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs:           []string{"turn:" + udpListener.LocalAddr().String()},
+				Username:       "user",
+				Credential:     "pass",
+				CredentialType: webrtc.ICECredentialTypePassword,
+			},
+		},
+		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
+	})
+	require.NoError(t, err)
+
+	defer pc.Close()
+
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	connectedChan := make(chan bool, 1)
+
+	client, err := testRoom.AddClient("client-relay", "client-relay", DefaultClientOptions())
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	client.OnConnectionStateChanged(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			select {
+			case connectedChan <- true:
+			default:
+			}
+		}
+	})
+
+	client.OnIceCandidate(func(ctx context.Context, candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			_ = pc.AddICECandidate(candidate.ToJSON())
+		}
+	})
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			_ = client.PeerConnection().PC().AddICECandidate(candidate.ToJSON())
+		}
+	})
+
+	negotiate(pc, client, TestLogger)
+
+	select {
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for client connected")
+	case <-connectedChan:
+	}
+
+	stats := client.Stats()
+	require.Equal(t, webrtc.ICECandidateTypeRelay.String(), stats.RemoteCandidateType)
+	require.Equal(t, webrtc.ICECandidateTypeHost.String(), stats.LocalCandidateType)
+	require.True(t, stats.Relayed)
+	require.Empty(t, stats.RelayProtocol)
+
+	pair, err := client.GetSelectedCandidatePair()
+	require.NoError(t, err)
+	require.Equal(t, webrtc.ICECandidateTypeRelay, pair.Remote.Typ)
+	require.Equal(t, webrtc.ICECandidateTypeHost, pair.Local.Typ)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientSetTrackMuted(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-track-muted", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, publisher, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+	subscriberPC, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	var mu sync.Mutex
+	packetsReceived := make(map[string]int)
+	trackChan := make(chan string, 2)
+
+	subscriberPC.PeerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		trackChan <- track.ID()
+
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+
+			mu.Lock()
+			packetsReceived[track.ID()]++
+			mu.Unlock()
+		}
+	})
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+
+	var videoTrack ITrack
+
+	// wait for the publisher video track to be received by the subscriber
+	for videoTrack == nil {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for publisher video track")
+		case id := <-trackChan:
+			track, err := publisher.tracks.Get(id)
+			if err == nil && track.Kind() == webrtc.RTPCodecTypeVideo {
+				videoTrack = track
+			}
+		}
+	}
+
+	countPackets := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return packetsReceived[videoTrack.ID()]
+	}
+
+	time.Sleep(1 * time.Second)
+	require.Greater(t, countPackets(), 0)
+
+	require.ErrorIs(t, publisher.SetTrackMuted("unknown-stream", videoTrack.ID(), true), ErrTrackIsNotExists)
+
+	require.NoError(t, publisher.SetTrackMuted(videoTrack.StreamID(), videoTrack.ID(), true))
+
+	// let the packets that already forwarded to arrive
+	time.Sleep(500 * time.Millisecond)
+	mutedCount := countPackets()
+	time.Sleep(1 * time.Second)
+	require.Equal(t, mutedCount, countPackets())
+
+	// the sent stats should show the muted track
+	mutedInStats := false
+	for _, sent := range subscriber.Stats().Sents {
+		if sent.ID == videoTrack.ID() {
+			mutedInStats = sent.Muted
+		}
+	}
+	require.True(t, mutedInStats)
+
+	require.NoError(t, publisher.SetTrackMuted(videoTrack.StreamID(), videoTrack.ID(), false))
+
+	time.Sleep(1 * time.Second)
+	require.Greater(t, countPackets(), mutedCount)
+
+	require.NoError(t, testRoom.Close())
+}
+
+type rtcpReaderInterceptorFactory struct {
+	onRTCP func([]rtcp.Packet)
+}
+
+func (f *rtcpReaderInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &rtcpReaderInterceptor{onRTCP: f.onRTCP}, nil
+}
+
+// rtcpReaderInterceptor passes the incoming RTCP packets to the callback
+type rtcpReaderInterceptor struct {
+	interceptor.NoOp
+	onRTCP func([]rtcp.Packet)
+}
+
+func (r *rtcpReaderInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err == nil {
+			if pkts, unmarshalErr := rtcp.Unmarshal(b[:n]); unmarshalErr == nil {
+				r.onRTCP(pkts)
+			}
+		}
+
+		return n, attr, err
+	})
+}
+
+func TestTWCCFeedbackToPublisher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-twcc-feedback", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	feedbackChan := make(chan bool, 1)
+
+	mediaEngine := GetMediaEngine()
+	i := &interceptor.Registry{}
+	require.NoError(t, webrtc.RegisterDefaultInterceptors(mediaEngine, i))
+
+	// add the transport-wide sequence numbers to the published packets like the browsers do
+	require.NoError(t, webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, i))
+
+	i.Add(&rtcpReaderInterceptorFactory{onRTCP: func(pkts []rtcp.Packet) {
+		for _, pkt := range pkts {
+			if _, ok := pkt.(*rtcp.TransportLayerCC); ok {
+				select {
+				case feedbackChan <- true:
+				default:
+				}
+			}
+		}
+	}})
+
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	settingEngine.SetIncludeLoopbackCandidate(true)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: DefaultTestIceServers()})
+	require.NoError(t, err)
+
+	defer pc.Close()
+
+	iceConnectedCtx, iceConnectedCtxCancel := context.WithCancel(ctx)
+	defer iceConnectedCtxCancel()
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			iceConnectedCtxCancel()
+		}
+	})
+
+	tracks, _ := GetStaticTracks(ctx, iceConnectedCtx, "publisher", true)
+	SetPeerConnectionTracks(ctx, pc, tracks)
+
+	client, err := testRoom.AddClient("publisher", "publisher", DefaultClientOptions())
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	client.OnIceCandidate(func(ctx context.Context, candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			_ = pc.AddICECandidate(candidate.ToJSON())
+		}
+	})
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			_ = client.PeerConnection().PC().AddICECandidate(candidate.ToJSON())
+		}
+	})
+
+	negotiate(pc, client, TestLogger)
+
+	select {
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for TWCC feedback")
+	case <-feedbackChan:
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientKeyframeRequestToPublisher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-keyframe-request-publisher", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	plis := make(chan uint32, 100)
+	nacks := make(chan rtcp.TransportLayerNack, 100)
+
+	mediaEngine := GetMediaEngine()
+	i := &interceptor.Registry{}
+	require.NoError(t, webrtc.RegisterDefaultInterceptors(mediaEngine, i))
+
+	i.Add(&rtcpReaderInterceptorFactory{onRTCP: func(pkts []rtcp.Packet) {
+		for _, pkt := range pkts {
+			switch packet := pkt.(type) {
+			case *rtcp.PictureLossIndication:
+				select {
+				case plis <- packet.MediaSSRC:
+				default:
+				}
+			case *rtcp.TransportLayerNack:
+				select {
+				case nacks <- *packet:
+				default:
+				}
+			}
+		}
+	}})
+
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	settingEngine.SetIncludeLoopbackCandidate(true)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: DefaultTestIceServers()})
+	require.NoError(t, err)
+
+	defer pc.Close()
+
+	iceConnectedCtx, iceConnectedCtxCancel := context.WithCancel(ctx)
+	defer iceConnectedCtxCancel()
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			iceConnectedCtxCancel()
+		}
+	})
+
+	tracks, _ := GetStaticTracks(ctx, iceConnectedCtx, "publisher", true)
+	SetPeerConnectionTracks(ctx, pc, tracks)
+
+	var publisherSSRC uint32
+	for _, sender := range pc.GetSenders() {
+		if sender.Track() != nil && sender.Track().Kind() == webrtc.RTPCodecTypeVideo {
+			publisherSSRC = uint32(sender.GetParameters().Encodings[0].SSRC)
+		}
+	}
+
+	publisher, err := testRoom.AddClient("publisher", "publisher", DefaultClientOptions())
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	publisher.OnTracksAdded(func(addedTracks []ITrack) {
+		setTracks := make(map[string]TrackType, 0)
+		for _, track := range addedTracks {
+			setTracks[track.ID()] = TrackTypeMedia
+		}
+		publisher.SetTracksSourceType(setTracks)
+	})
+
+	publisher.OnIceCandidate(func(ctx context.Context, candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			_ = pc.AddICECandidate(candidate.ToJSON())
+		}
+	})
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			_ = publisher.PeerConnection().PC().AddICECandidate(candidate.ToJSON())
+		}
+	})
+
+	negotiate(pc, publisher, TestLogger)
+
+	subscriberPC, _, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	subscriberSSRC := make(chan uint32, 1)
+	subscriberPC.PeerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeVideo && strings.Contains(track.StreamID(), "publisher") {
+			subscriberSSRC <- uint32(track.SSRC())
+		}
+
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := track.Read(buf); err != nil {
+				return
+			}
+		}
+	})
+
+	var ssrc uint32
+	select {
+	case ssrc = <-subscriberSSRC:
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for the subscriber track")
+	}
+
+	// wait until the keyframe requests of the subscription are sent
+	waitKeyframeRequests := func() {
+		for {
+			select {
+			case <-plis:
+			case <-time.After(2 * time.Second):
+				return
+			}
+		}
+	}
+
+	// the keyframe request of the subscriber reaches the publisher with the publisher SSRC
+	for _, packet := range []rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}, &rtcp.FullIntraRequest{MediaSSRC: ssrc, FIR: []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: 1}}}} {
+		waitKeyframeRequests()
+
+		require.NoError(t, subscriberPC.PeerConnection.WriteRTCP([]rtcp.Packet{packet}))
+
+		select {
+		case mediaSSRC := <-plis:
+			require.Equal(t, publisherSSRC, mediaSSRC)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the keyframe request from %T", packet)
+		}
+	}
+
+	// the NACK of the subscriber is answered by the SFU and not forwarded to the publisher
+	require.NoError(t, subscriberPC.PeerConnection.WriteRTCP([]rtcp.Packet{&rtcp.TransportLayerNack{
+		MediaSSRC: ssrc,
+		Nacks:     []rtcp.NackPair{{PacketID: 1, LostPackets: 0xffff}},
+	}}))
+
+	timeout := time.After(time.Second)
+Loop:
+	for {
+		select {
+		case nack := <-nacks:
+			require.NotEqual(t, []rtcp.NackPair{{PacketID: 1, LostPackets: 0xffff}}, nack.Nacks)
+		case <-timeout:
+			break Loop
+		}
+	}
+
+	require.NoError(t, subscriberPC.PeerConnection.Close())
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientStripHeaderExtensions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-strip-extensions", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	negotiateClient := func(id string, opts ClientOptions) string {
+		mediaEngine := GetMediaEngine()
+		i := &interceptor.Registry{}
+		require.NoError(t, webrtc.RegisterDefaultInterceptors(mediaEngine, i))
+
+		pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(i)).NewPeerConnection(webrtc.Configuration{})
+		require.NoError(t, err)
+
+		t.Cleanup(func() { _ = pc.Close() })
+
+		_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		require.NoError(t, err)
+
+		client, err := testRoom.AddClient(id, id, opts)
+		require.NoError(t, err, "error adding client to room: %v", err)
+
+		offer, err := pc.CreateOffer(nil)
+		require.NoError(t, err)
+		require.NoError(t, pc.SetLocalDescription(offer))
+
+		answer, err := client.Negotiate(offer)
+		require.NoError(t, err)
+
+		return answer.SDP
+	}
+
+	opts := DefaultClientOptions()
+	opts.StripHeaderExtensions = []string{sdp.TransportCCURI}
+
+	strippedAnswer := negotiateClient("client-stripped", opts)
+	require.NotContains(t, strippedAnswer, sdp.TransportCCURI)
+	require.Contains(t, strippedAnswer, sdp.SDESMidURI)
+
+	answer := negotiateClient("client-default", DefaultClientOptions())
+	require.Contains(t, answer, sdp.TransportCCURI)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-idle-timeout", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	client, err := testRoom.AddClient("client-1", "client-1", DefaultClientOptions())
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	// a cancelled idle timeout should not stop the client
+	client.startIdleTimeout(100 * time.Millisecond)
+	client.cancelIdleTimeout()
+
+	time.Sleep(300 * time.Millisecond)
+	require.NotEqual(t, webrtc.PeerConnectionStateClosed, client.peerConnection.pc.ConnectionState())
+
+	// restarting the idle timeout should only keep the latest one
+	client.startIdleTimeout(time.Minute)
+	client.startIdleTimeout(100 * time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		return client.peerConnection.pc.ConnectionState() == webrtc.PeerConnectionStateClosed
+	}, 2*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientOfferHeaderExtensions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-offer-extensions", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	client, err := testRoom.AddClient("client-1", "client-1", DefaultClientOptions())
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	// the SFU offers the tracks to the subscribers with sendonly transceivers
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		_, err = client.peerConnection.pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		require.NoError(t, err)
+	}
+
+	offer, err := client.peerConnection.pc.CreateOffer(nil)
+	require.NoError(t, err)
+
+	parsed := &sdp.SessionDescription{}
+	require.NoError(t, parsed.UnmarshalString(offer.SDP))
+	require.Len(t, parsed.MediaDescriptions, 2)
+
+	for _, media := range parsed.MediaDescriptions {
+		extensions := []string{}
+		for _, attr := range media.Attributes {
+			if attr.Key == sdp.AttrKeyExtMap {
+				extensions = append(extensions, attr.Value)
+			}
+		}
+
+		require.True(t, slices.ContainsFunc(extensions, func(ext string) bool { return strings.HasSuffix(ext, sdp.TransportCCURI) }), "%s offer has no transport-cc", media.MediaName.Media)
+		require.True(t, slices.ContainsFunc(extensions, func(ext string) bool { return strings.HasSuffix(ext, sdp.ABSSendTimeURI) }), "%s offer has no abs-send-time", media.MediaName.Media)
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientOnRenegotiationComplete(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-renegotiation-complete", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	subscriberPC, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	completeChan := make(chan bool, 1)
+	subscriber.OnRenegotiationComplete(func() {
+		select {
+		case completeChan <- true:
+		default:
+		}
+	})
+
+	// the publisher tracks are added to the subscriber through the renegotiation
+	_, _, _, _ = CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+
+	select {
+	case <-completeChan:
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for renegotiation complete")
+	}
+
+	require.Equal(t, webrtc.SignalingStateStable, subscriberPC.PeerConnection.SignalingState())
+	require.Equal(t, webrtc.SignalingStateStable, subscriber.peerConnection.PC().SignalingState())
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientRenegotiationTimeout(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-renegotiation-timeout", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	subscriber.options.RenegotiationTimeout = 500 * time.Millisecond
+
+	// the signaling of the subscriber hangs until the callback context is canceled
+	subscriber.OnRenegotiation(func(ctx context.Context, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+		<-ctx.Done()
+		return webrtc.SessionDescription{}, ctx.Err()
+	})
+
+	failedChan := make(chan error, 1)
+	subscriber.OnRenegotiationFailed(func(err error) {
+		select {
+		case failedChan <- err:
+		default:
+		}
+	})
+
+	// the publisher tracks are added to the subscriber through the renegotiation
+	_, _, _, _ = CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+
+	select {
+	case err := <-failedChan:
+		require.ErrorIs(t, err, ErrRenegotiationTimeout)
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for renegotiation failed")
+	}
+
+	// the wedged renegotiation is released and the client is stopped so it can reconnect
+	require.Eventually(t, func() bool {
+		return !subscriber.isInRenegotiation.Load() && subscriber.state.Load() == ClientStateEnded
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the unset timeout gets the default, a negative timeout is kept to disable it
+	testRoom.SFU().SetDefaultClientOptions(DefaultClientOptions())
+	require.Equal(t, 30*time.Second, testRoom.SFU().mergeDefaultClientOptions(ClientOptions{}).RenegotiationTimeout)
+	require.Equal(t, -time.Second, testRoom.SFU().mergeDefaultClientOptions(ClientOptions{RenegotiationTimeout: -time.Second}).RenegotiationTimeout)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientReplaceTrack(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-replace-track", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, _, _, _ = CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+	subscriberPC, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	trackChan := make(chan *webrtc.TrackRemote, 4)
+	subscriberPC.PeerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		trackChan <- track
+	})
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+
+	var videoTrack *webrtc.TrackRemote
+
+	for videoTrack == nil {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for publisher video track")
+		case track := <-trackChan:
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				videoTrack = track
+			}
+		}
+	}
+
+	require.ErrorIs(t, subscriber.ReplaceTrack("unknown", "unknown", nil), ErrTrackIsNotExists)
+
+	getSender := func(trackID string) *webrtc.RTPSender {
+		for _, transceiver := range subscriber.peerConnection.PC().GetTransceivers() {
+			if transceiver.Sender() != nil && transceiver.Sender().Track() != nil && transceiver.Sender().Track().ID() == trackID {
+				return transceiver.Sender()
+			}
+		}
+
+		return nil
+	}
+
+	oldSender := getSender(videoTrack.ID())
+	require.NotNil(t, oldSender)
+
+	// the same codec is replaced on the same sender without a renegotiation
+	newVideo, err := webrtc.NewTrackLocalStaticRTP(oldSender.Track().(*webrtc.TrackLocalStaticRTP).Codec(), "new-video", "new-stream")
+	require.NoError(t, err)
+
+	transceivers := len(subscriber.peerConnection.PC().GetTransceivers())
+
+	subscriber.muTracks.Lock()
+	oldClientTrack, ok := subscriber.clientTracks[videoTrack.ID()].(*clientTrack)
+	subscriber.muTracks.Unlock()
+	require.True(t, ok)
+
+	lastSequence := func() uint16 {
+		oldClientTrack.sequenceRewriter.mu.Lock()
+		defer oldClientTrack.sequenceRewriter.mu.Unlock()
+
+		return oldClientTrack.sequenceRewriter.lastSeq
+	}
+
+	// the old track is forwarded and claims the bandwidth before it's replaced
+	require.Eventually(t, func() bool {
+		return subscriber.bitrateController.Exist(videoTrack.ID()) && lastSequence() != 0
+	}, 10*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, subscriber.ReplaceTrack(videoTrack.StreamID(), videoTrack.ID(), newVideo))
+	require.Equal(t, oldSender, getSender("new-video"))
+	require.Len(t, subscriber.peerConnection.PC().GetTransceivers(), transceivers)
+	require.False(t, subscriber.negotiationNeeded.Load())
+
+	// the old track is detached from the publisher track, it gets no more packets and its claim is released
+	require.False(t, subscriber.bitrateController.Exist(videoTrack.ID()))
+	require.NotContains(t, oldClientTrack.baseTrack.clientTracks.GetTracks(), iClientTrack(oldClientTrack))
+
+	subscriber.muTracks.Lock()
+	require.NotContains(t, subscriber.clientTracks, videoTrack.ID())
+	subscriber.muTracks.Unlock()
+
+	sequence := lastSequence()
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, sequence, lastSequence())
+
+	// the incompatible track is added through a renegotiation
+	newAudio, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "new-audio", "new-stream")
+	require.NoError(t, err)
+
+	require.NoError(t, subscriber.ReplaceTrack("new-stream", "new-video", newAudio))
+	require.Nil(t, getSender("new-video"))
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-timeout.Done():
+				return
+			case <-ticker.C:
+				_ = newAudio.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{0x00}})
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for the replaced audio track")
+		case track := <-trackChan:
+			if track.ID() == "new-audio" {
+				require.NoError(t, testRoom.Close())
+				return
+			}
+		}
+	}
+}
+
+func TestClientStatsTargetBitrate(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-target-bitrate", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, _, _, _ = CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+	subscriberPC, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	subscriberPC.PeerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+
+	// both the actual and the target bitrate are available once the controller decided the video quality
+	require.Eventually(t, func() bool {
+		for _, sent := range subscriber.Stats().Sents {
+			if sent.Kind == webrtc.RTPCodecTypeVideo && sent.CurrentBitrate > 0 && sent.TargetBitrate > 0 {
+				return true
+			}
+		}
+
+		return false
+	}, 30*time.Second, 500*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientGetStats(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-get-stats", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, publisher, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+	subscriberPC, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	subscriberPC.PeerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+
+	// the consumer bitrate is sampled from the transport while the media flows to the subscriber
+	var stats ClientTrackStats
+	require.Eventually(t, func() bool {
+		stats = subscriber.GetStats()
+
+		return stats.CurrentConsumerBitrate > 0 && len(stats.Sents) > 0 && len(stats.Receives) > 0
+	}, 30*time.Second, 100*time.Millisecond)
+
+	require.Equal(t, subscriber.ID(), stats.ID)
+
+	for _, sent := range stats.Sents {
+		require.NotEmpty(t, sent.ID)
+	}
+
+	for _, received := range stats.Receives {
+		require.NotEmpty(t, received.ID)
+	}
+
+	// the closed client returns the empty stats right away without sampling
+	require.NoError(t, testRoom.StopClient(publisher.ID()))
+	require.Eventually(t, func() bool {
+		return publisher.PeerConnection().PC().ConnectionState() == webrtc.PeerConnectionStateClosed
+	}, 10*time.Second, 50*time.Millisecond)
+
+	start := time.Now()
+	require.Equal(t, ClientTrackStats{}, publisher.GetStats())
+	require.Less(t, time.Since(start), statsSamplingWindow)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientRenegotiationCallbackAddsTrack(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-renegotiation-callback", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	newTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "callback-audio", "callback-stream")
+	require.NoError(t, err)
+
+	var addOnce sync.Once
+
+	offeredChan := make(chan bool, 1)
+	answer := subscriber.onRenegotiation
+
+	// add a track while the SFU is waiting for the answer of the first offer
+	subscriber.OnRenegotiation(func(ctx context.Context, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+		addOnce.Do(func() {
+			_, err := subscriber.peerConnection.PC().AddTransceiverFromTrack(newTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+			require.NoError(t, err)
+
+			subscriber.renegotiate(false)
+		})
+
+		if strings.Contains(offer.SDP, "callback-audio") {
+			select {
+			case offeredChan <- true:
+			default:
+			}
+		}
+
+		return answer(ctx, offer)
+	})
+
+	// the publisher tracks are added to the subscriber through the renegotiation
+	_, _, _, _ = CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+
+	select {
+	case <-offeredChan:
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for the follow-up offer with the track added in the callback")
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientMaxMediaSections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-max-media-sections", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	createOffer := func(transceivers int) webrtc.SessionDescription {
+		mediaEngine := GetMediaEngine()
+		i := &interceptor.Registry{}
+		require.NoError(t, webrtc.RegisterDefaultInterceptors(mediaEngine, i))
+
+		pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(i)).NewPeerConnection(webrtc.Configuration{})
+		require.NoError(t, err)
+
+		t.Cleanup(func() { _ = pc.Close() })
+
+		for i := 0; i < transceivers; i++ {
+			_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+			require.NoError(t, err)
+		}
+
+		offer, err := pc.CreateOffer(nil)
+		require.NoError(t, err)
+
+		return offer
+	}
+
+	opts := DefaultClientOptions()
+	opts.MaxMediaSections = 2
+
+	client, err := testRoom.AddClient("client-1", "client-1", opts)
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	// the rejected offer should not change the peer connection state
+	_, err = client.Negotiate(createOffer(3))
+	require.ErrorIs(t, err, ErrTooManyMediaSections)
+	require.Nil(t, client.peerConnection.PC().RemoteDescription())
+
+	_, err = client.Negotiate(createOffer(2))
+	require.NoError(t, err)
+
+	// the offer larger than the max SDP size is rejected before it's parsed
+	offer := createOffer(1)
+
+	opts = DefaultClientOptions()
+	opts.MaxSDPSize = len(offer.SDP) - 1
+
+	client, err = testRoom.AddClient("client-2", "client-2", opts)
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	_, err = client.Negotiate(offer)
+	require.ErrorIs(t, err, ErrSDPTooLarge)
+	require.Nil(t, client.peerConnection.PC().RemoteDescription())
+
+	// the error reports the client and the failed negotiation step
+	var negotiationErr *NegotiationError
+	require.ErrorAs(t, err, &negotiationErr)
+	require.Equal(t, "client-2", negotiationErr.ClientID)
+	require.Equal(t, NegotiationStepCheckOffer, negotiationErr.Step)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientTimeToFirstFrame(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-first-frame", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, _, _, _ = CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+	_, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	// the latency is measured once the first keyframe of the video track is forwarded
+	require.Eventually(t, func() bool {
+		clientTracks := subscriber.ClientTracks()
+		if len(clientTracks) != 2 {
+			return false
+		}
+
+		for _, track := range clientTracks {
+			if track.TimeToFirstFrame() <= 0 {
+				return false
+			}
+		}
+
+		return true
+	}, 30*time.Second, 100*time.Millisecond)
+
+	for _, track := range subscriber.ClientTracks() {
+		require.Less(t, track.TimeToFirstFrame(), 30*time.Second)
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientDecoderLevelCapsSimulcastQuality(t *testing.T) {
+	// the subscriber answer only supports H264 level 1.0, max 99 macroblocks per frame
+	answer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+			"m=video 9 UDP/TLS/RTP/SAVPF 102\r\nc=IN IP4 0.0.0.0\r\n" +
+			"a=rtpmap:102 H264/90000\r\n" +
+			"a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e00a\r\n",
+	}
+
+	clientTrack := newTestSimulcastClientTrack(t)
+	clientTrack.mimeType = webrtc.MimeTypeH264
+
+	client := clientTrack.client
+
+	client.updateMaxDecodePixels(answer)
+
+	require.Equal(t, QualityLevel(QualityLow), client.maxDecodeQuality(webrtc.MimeTypeH264))
+	// the codecs without level parameters are not limited
+	require.Equal(t, QualityLevel(QualityHigh), client.maxDecodeQuality(webrtc.MimeTypeVP8))
+
+	client.bitrateController.claims.Store(clientTrack.ID(), &bitrateClaim{track: clientTrack, quality: QualityHigh, simulcast: true})
+
+	require.Equal(t, QualityLevel(QualityLow), clientTrack.MaxQuality())
+
+	// only the high layer is active
+	clientTrack.remoteTrack.lastReadHighTS.Store(time.Now().UnixNano())
+	require.Equal(t, QualityLevel(QualityLow), clientTrack.getQuality())
+
+	// the high layer is sent when the decoder level is ignored
+	client.options.IgnoreDecoderLevel = true
+
+	require.Equal(t, QualityLevel(QualityHigh), clientTrack.MaxQuality())
+	require.Equal(t, QualityLevel(QualityHigh), clientTrack.getQuality())
+}
+
+func TestClientSimulcastFallbackToActiveLayer(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	clientTrack := newTestSimulcastClientTrack(t)
+	client := clientTrack.client
+	remoteTrack := clientTrack.remoteTrack
+
+	client.bitrateController.claims.Store(clientTrack.ID(), &bitrateClaim{track: clientTrack, quality: QualityHigh, simulcast: true})
+
+	type qualityChange struct {
+		trackID  string
+		from, to QualityLevel
+	}
+
+	// the callbacks are called off the forwarding goroutine, in the order of the changes
+	changes := make(chan qualityChange, 10)
+
+	client.OnQualityChanged(func(trackID string, from, to QualityLevel) {
+		changes <- qualityChange{trackID: trackID, from: from, to: to}
+	})
+
+	requireChange := func(from, to QualityLevel) {
+		select {
+		case change := <-changes:
+			require.Equal(t, qualityChange{trackID: clientTrack.ID(), from: from, to: to}, change)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for the quality change from %d to %d", from, to)
+		}
+	}
+
+	now := time.Now().UnixNano()
+	remoteTrack.lastReadHighTS.Store(now)
+	remoteTrack.lastReadMidTS.Store(now)
+	remoteTrack.lastReadLowTS.Store(now)
+
+	require.Equal(t, QualityLevel(QualityHigh), clientTrack.getQuality())
+	require.Equal(t, remoteTrack.remoteTrackHigh, clientTrack.GetRemoteTrack())
+
+	// the publisher stopped sending the high layer
+	remoteTrack.lastReadHighTS.Store(time.Now().Add(-2 * simulcastLayerInactiveThreshold).UnixNano())
+
+	require.Equal(t, QualityLevel(QualityMid), clientTrack.getQuality())
+	require.Equal(t, QualityLevel(QualityMid), clientTrack.getQuality())
+	require.Equal(t, remoteTrack.remoteTrackMid, clientTrack.GetRemoteTrack())
+	requireChange(QualityHigh, QualityMid)
+
+	// the mid layer stopped too
+	remoteTrack.lastReadMidTS.Store(time.Now().Add(-2 * simulcastLayerInactiveThreshold).UnixNano())
+
+	require.Equal(t, QualityLevel(QualityLow), clientTrack.getQuality())
+	requireChange(QualityHigh, QualityLow)
+
+	// the high layer is resumed
+	remoteTrack.lastReadHighTS.Store(time.Now().UnixNano())
+
+	require.Equal(t, QualityLevel(QualityHigh), clientTrack.getQuality())
+
+	// the lowest active layer above is used when there is no active layer below
+	clientTrack.maxQuality.Store(QualityMid)
+	remoteTrack.lastReadLowTS.Store(time.Now().Add(-2 * simulcastLayerInactiveThreshold).UnixNano())
+
+	require.Equal(t, QualityLevel(QualityHigh), clientTrack.getQuality())
+	requireChange(QualityMid, QualityHigh)
+
+	// the callback doesn't block the forwarding goroutine
+	blocked := make(chan struct{})
+	client.OnQualityChanged(func(string, QualityLevel, QualityLevel) {
+		<-blocked
+	})
+
+	clientTrack.maxQuality.Store(QualityHigh)
+	remoteTrack.lastReadHighTS.Store(time.Now().Add(-2 * simulcastLayerInactiveThreshold).UnixNano())
+	remoteTrack.lastReadMidTS.Store(time.Now().UnixNano())
+
+	require.Equal(t, QualityLevel(QualityMid), clientTrack.getQuality())
+	requireChange(QualityHigh, QualityMid)
+
+	close(blocked)
+}
+
+func TestClientTrackEndedOnPublisherRemoveTrack(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-track-ended", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	trackAdded := make(chan string, 4)
+	subscriber.OnTrackAdded(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+		require.Equal(t, TrackTypeMedia, sourceType)
+		trackAdded <- track.ID()
+	})
+
+	publisherPC, publisher, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+
+	var videoTrackID string
+
+	// wait until the subscriber receives the publisher video track
+	require.Eventually(t, func() bool {
+		for _, track := range publisher.Tracks() {
+			if track.Kind() != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+
+			if _, ok := subscriber.ClientTracks()[track.ID()]; ok {
+				videoTrackID = track.ID()
+				return true
+			}
+		}
+
+		return false
+	}, 30*time.Second, 100*time.Millisecond)
+
+	addedTracks := make([]string, 0)
+	for len(addedTracks) < 2 {
+		select {
+		case id := <-trackAdded:
+			addedTracks = append(addedTracks, id)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for the subscriber track added callback")
+		}
+	}
+
+	require.Contains(t, addedTracks, videoTrackID)
+
+	trackEnded := make(chan struct{})
+	subscriber.ClientTracks()[videoTrackID].OnEnded(func() {
+		close(trackEnded)
+	})
+
+	trackRemoved := make(chan string, 1)
+	subscriber.OnTrackRemoved(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+		if track.ID() == videoTrackID {
+			trackRemoved <- sourceType
+		}
+	})
+
+	// the publisher stops the video track
+	for _, sender := range publisherPC.PeerConnection.GetSenders() {
+		if sender.Track() != nil && sender.Track().ID() == videoTrackID {
+			require.NoError(t, publisherPC.PeerConnection.RemoveTrack(sender))
+		}
+	}
+
+	negotiate(publisherPC.PeerConnection, publisher, TestLogger)
+
+	select {
+	case <-trackEnded:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the subscriber track ended callback")
+	}
+
+	select {
+	case sourceType := <-trackRemoved:
+		require.Equal(t, TrackTypeMedia, sourceType)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the subscriber track removed callback")
+	}
+
+	require.Eventually(t, func() bool {
+		_, ok := subscriber.ClientTracks()[videoTrackID]
+		return !ok
+	}, 5*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+}
+
+// syncBuffer is a bytes buffer that is safe to write from the logger goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestClientNegotiationStateLog(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logs := &syncBuffer{}
+
+	opts := sfuOpts
+	opts.Log = logging.NewDefaultLeveledLoggerForScope("sfu", logging.LogLevelDebug, logs)
+
+	roomManager := NewManager(ctx, "test", opts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-negotiation-log", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, publisher, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+	_, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	require.Contains(t, logs.String(), "event=remote_negotiation_started client_id="+publisher.ID())
+
+	// the subscriber is renegotiated to receive the publisher tracks
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "event=renegotiation_answer_received client_id="+subscriber.ID()+" signaling_state=stable")
+	}, 30*time.Second, 100*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "event=renegotiation_finished client_id="+subscriber.ID())
+	}, 5*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientPendingNegotiations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-pending-negotiations", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err)
+
+	client, err := testRoom.AddClient(testRoom.CreateClientID(), "client", DefaultClientOptions())
+	require.NoError(t, err)
+
+	client.OnRenegotiation(func(ctx context.Context, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+		return webrtc.SessionDescription{}, nil
+	})
+
+	require.Equal(t, 0, client.PendingNegotiations())
+
+	// simulate a running renegotiation, the new requests wait for it to finish
+	client.isInRenegotiation.Store(true)
+
+	client.renegotiate(false)
+	require.Equal(t, 2, client.PendingNegotiations())
+	require.Equal(t, uint64(0), client.CoalescedNegotiations())
+
+	// the next requests are merged into the pending renegotiation
+	client.renegotiate(false)
+	client.renegotiate(false)
+	require.Equal(t, 2, client.PendingNegotiations())
+	require.Equal(t, uint64(2), client.CoalescedNegotiations())
+
+	// the remote negotiation waits for the renegotiation to finish
+	require.False(t, client.IsAllowNegotiation())
+	require.Equal(t, 3, client.PendingNegotiations())
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientNegotiationWindow(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	negotiationWindow := time.Second
+	roomOpts.NegotiationWindow = &negotiationWindow
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-negotiation-window", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+	require.Equal(t, negotiationWindow, testRoom.SFU().NegotiationWindow())
+
+	_, client, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "client", true, false)
+
+	require.Eventually(t, func() bool {
+		return client.PeerConnection().PC().ConnectionState() == webrtc.PeerConnectionStateConnected &&
+			client.PendingNegotiations() == 0
+	}, 30*time.Second, 100*time.Millisecond)
+
+	completed := &atomic.Int32{}
+	client.OnRenegotiationComplete(func() {
+		completed.Add(1)
+	})
+
+	coalesced := client.CoalescedNegotiations()
+
+	// the requests within the window are batched into a single renegotiation
+	client.renegotiate(false)
+	time.Sleep(200 * time.Millisecond)
+	client.renegotiate(false)
+	time.Sleep(200 * time.Millisecond)
+	client.renegotiate(false)
+
+	require.Eventually(t, func() bool {
+		return completed.Load() == 1 && client.PendingNegotiations() == 0
+	}, 10*time.Second, 50*time.Millisecond)
+
+	require.Equal(t, coalesced+2, client.CoalescedNegotiations())
+	require.Equal(t, int32(1), completed.Load())
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientGracefulClose(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-graceful-close", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, client1, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "peer1", true, false)
+	_, client2, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "peer2", true, false)
+
+	require.Eventually(t, func() bool {
+		return client1.PeerConnection().PC().ConnectionState() == webrtc.PeerConnectionStateConnected &&
+			client2.PeerConnection().PC().ConnectionState() == webrtc.PeerConnectionStateConnected
+	}, 30*time.Second, 100*time.Millisecond)
+
+	left := make(chan struct{})
+	client1.OnLeft(func() {
+		close(left)
+	})
+
+	closeCtx, cancelClose := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelClose()
+
+	require.NoError(t, client1.Close(closeCtx))
+	require.Equal(t, 0, client1.PendingNegotiations())
+
+	select {
+	case <-left:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the left event")
+	}
+
+	_, err = testRoom.sfu.GetClient(client1.ID())
+	require.ErrorIs(t, err, ErrClientNotFound)
+
+	// the client is closed anyway when the pending negotiation is not done before the context
+	client2.negotiationNeeded.Store(true)
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelTimeout()
+
+	require.ErrorIs(t, client2.Close(timeoutCtx), context.DeadlineExceeded)
+	require.Equal(t, ClientStateEnded, client2.state.Load())
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientICEConnectionStateChanged(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-ice-state", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, client, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "peer", true, false)
+
+	require.Eventually(t, func() bool {
+		return client.PeerConnection().PC().ICEConnectionState() == webrtc.ICEConnectionStateConnected
+	}, 30*time.Second, 100*time.Millisecond)
+
+	closed := make(chan struct{})
+	client.OnICEConnectionStateChanged(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateClosed {
+			close(closed)
+		}
+	})
+
+	require.NoError(t, client.End())
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the ice connection closed state")
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientGetTransceiverInfo(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-transceiver-info", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, publisher, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "publisher", true, false)
+	subscriberPC, subscriber, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", true, false)
+
+	trackChan := make(chan *webrtc.TrackRemote, 4)
+	subscriberPC.PeerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		trackChan <- track
+	})
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+
+	var videoTrack *webrtc.TrackRemote
+
+	for videoTrack == nil {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for publisher video track")
+		case track := <-trackChan:
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				videoTrack = track
+			}
+		}
+	}
+
+	findInfo := func(infos []TransceiverInfo, trackID string) *TransceiverInfo {
+		for i := range infos {
+			if infos[i].TrackID == trackID {
+				return &infos[i]
+			}
+		}
+
+		return nil
+	}
+
+	// the subscriber transceiver sends the publisher video track
+	require.Eventually(t, func() bool {
+		info := findInfo(subscriber.GetTransceiverInfo(), videoTrack.ID())
+		return info != nil && info.CurrentDirection == webrtc.RTPTransceiverDirectionSendonly
+	}, 10*time.Second, 100*time.Millisecond)
+
+	infos := subscriber.GetTransceiverInfo()
+	require.Len(t, infos, len(subscriber.peerConnection.PC().GetTransceivers()))
+
+	info := findInfo(infos, videoTrack.ID())
+	require.NotEmpty(t, info.Mid)
+	require.Equal(t, webrtc.RTPCodecTypeVideo, info.Kind)
+	require.Equal(t, webrtc.RTPTransceiverDirectionSendonly, info.Direction)
+	require.Equal(t, webrtc.MimeTypeH264, info.Codec)
+
+	// the publisher transceivers receive the published tracks
+	for _, track := range publisher.Tracks() {
+		info := findInfo(publisher.GetTransceiverInfo(), track.ID())
+		require.NotNil(t, info, "transceiver info of track %s", track.ID())
+		require.Equal(t, track.Kind(), info.Kind)
+		require.Equal(t, webrtc.RTPTransceiverDirectionRecvonly, info.CurrentDirection)
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientSimulcastPauseAndResume(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	clientTrack := newTestSimulcastClientTrack(t)
+	client := clientTrack.client
+	remoteTrack := clientTrack.remoteTrack
+
+	plis := &atomic.Int32{}
+	onPLI := func() {
+		plis.Add(1)
+	}
+
+	remoteTrack.remoteTrackHigh.onPLI = onPLI
+	remoteTrack.remoteTrackMid.onPLI = onPLI
+	remoteTrack.remoteTrackLow.onPLI = onPLI
+	remoteTrack.lastReadLowTS.Store(time.Now().UnixNano())
+
+	// the track has been forwarded before it's paused
+	clientTrack.lastQuality.Store(QualityLow)
+	clientTrack.sequenceNumber.Store(100)
+
+	claim := &bitrateClaim{track: clientTrack, quality: QualityNone, simulcast: true}
+	client.bitrateController.claims.Store(clientTrack.ID(), claim)
+
+	type pauseChange struct {
+		trackID string
+		paused  bool
+	}
+
+	// the callbacks are called off the forwarding goroutine, in the order of the changes
+	changes := make(chan pauseChange, 10)
+
+	client.OnTrackPauseChanged(func(trackID string, paused bool) {
+		changes <- pauseChange{trackID: trackID, paused: paused}
+	})
+
+	requireChange := func(paused bool) {
+		select {
+		case change := <-changes:
+			require.Equal(t, pauseChange{trackID: clientTrack.ID(), paused: paused}, change)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for the track paused %t", paused)
+		}
+	}
+
+	// the bandwidth can't fit the lowest layer
+	clientTrack.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 1}, Payload: []byte{0x10, 0x01}}, nil, QualityLow)
+	clientTrack.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2}, Payload: []byte{0x10, 0x01}}, nil, QualityLow)
+
+	require.True(t, clientTrack.IsPaused())
+	require.Equal(t, QualityLevel(QualityNone), clientTrack.LastQuality())
+	requireChange(true)
+
+	// the bandwidth recovers, a keyframe is requested to resume the track
+	claim.SetQuality(QualityLow)
+
+	clientTrack.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 3}, Payload: []byte{0x10, 0x01}}, nil, QualityLow)
+
+	require.False(t, clientTrack.IsPaused())
+	requireChange(false)
+
+	require.Eventually(t, func() bool {
+		return plis.Load() > 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the callback doesn't block the forwarding goroutine
+	blocked := make(chan struct{})
+	client.OnTrackPauseChanged(func(string, bool) {
+		<-blocked
+	})
+
+	claim.SetQuality(QualityNone)
+
+	clientTrack.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 4}, Payload: []byte{0x10, 0x01}}, nil, QualityLow)
+
+	require.True(t, clientTrack.IsPaused())
+	requireChange(true)
+
+	close(blocked)
+}
+
+func TestClientSimulcastSwitchOnKeyframe(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	clientTrack := newTestSimulcastClientTrack(t)
+	client := clientTrack.client
+	writer := clientTrack.writer
+
+	highPLIs := &atomic.Int32{}
+	clientTrack.remoteTrack.remoteTrackHigh.onPLI = func() { highPLIs.Add(1) }
+
+	now := time.Now().UnixNano()
+	clientTrack.remoteTrack.lastReadHighTS.Store(now)
+	clientTrack.remoteTrack.lastReadMidTS.Store(now)
+	clientTrack.remoteTrack.lastReadLowTS.Store(now)
+
+	claim := &bitrateClaim{track: clientTrack, quality: QualityLow, simulcast: true}
+	client.bitrateController.claims.Store(clientTrack.ID(), claim)
+
+	keyframe := []byte{0x10, 0x00}
+	deltaframe := []byte{0x10, 0x01}
+
+	// each layer has its own sequence numbers
+	sequences := map[QualityLevel]uint16{}
+	push := func(payload []byte, quality QualityLevel) {
+		sequences[quality]++
+		seq := sequences[quality]
+		clientTrack.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 3000}, Payload: payload}, nil, quality)
+	}
+
+	// forwarded returns the payloads written to the subscriber since the last call
+	forwarded := func() [][]byte {
+		payloads := make([][]byte, 0)
+
+		for len(writer.queue) > 0 {
+			queued := <-writer.queue
+			payloads = append(payloads, slices.Clone(queued.packet.Payload))
+			queued.source.Release()
+		}
+
+		return payloads
+	}
+
+	// the track is not started until a keyframe arrives
+	push(deltaframe, QualityLow)
+	push(deltaframe, QualityMid)
+	push(deltaframe, QualityLow)
+	require.Empty(t, forwarded())
+
+	push(keyframe, QualityLow)
+	push(deltaframe, QualityLow)
+	push(deltaframe, QualityHigh)
+	require.Equal(t, [][]byte{keyframe, deltaframe}, forwarded())
+	require.Equal(t, QualityLevel(QualityLow), clientTrack.LastQuality())
+
+	// the bandwidth allows the high layer, the low layer is forwarded until the high layer sends a keyframe
+	claim.SetQuality(QualityHigh)
+
+	push(deltaframe, QualityHigh)
+	push(deltaframe, QualityLow)
+	require.Equal(t, [][]byte{deltaframe}, forwarded())
+	require.Equal(t, QualityLevel(QualityLow), clientTrack.LastQuality())
+
+	require.Eventually(t, func() bool {
+		return highPLIs.Load() > 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	push(keyframe, QualityHigh)
+	push(deltaframe, QualityLow)
+	push(deltaframe, QualityHigh)
+	require.Equal(t, [][]byte{keyframe, deltaframe}, forwarded())
+	require.Equal(t, QualityLevel(QualityHigh), clientTrack.LastQuality())
+}
+
+func TestClientName(t *testing.T) {
+	client := &Client{id: "client-id"}
+
+	// the name defaults to the client ID so the stats always have a label
+	require.Equal(t, "client-id", client.Name())
+
+	client.SetName("Alice")
+	require.Equal(t, "Alice", client.Name())
+
+	client.SetName("")
+	require.Equal(t, "client-id", client.Name())
+}
+
+func TestClientCallbackPanic(t *testing.T) {
+	client := &Client{id: "client-id", log: TestLogger}
+
+	client.OnRenegotiation(func(ctx context.Context, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+		panic("buggy renegotiation callback")
+	})
+
+	// the panic is returned as an error so the renegotiation fails instead of crashing the SFU
+	_, err := client.requestRenegotiationAnswer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer})
+	require.ErrorIs(t, err, ErrRenegotiationPanic)
+
+	joined := 0
+	client.OnJoined(func() {
+		panic("buggy joined callback")
+	})
+	client.OnJoined(func() {
+		joined++
+	})
+
+	// the next callbacks are still called and the callback lock is released
+	client.onJoined()
+	client.onJoined()
+	require.Equal(t, 2, joined)
+}
+
+func TestClientCallbackRegistersCallback(t *testing.T) {
+	client := &Client{id: "client-id", log: TestLogger}
+
+	// the callbacks are called without the callback lock, so they can register other callbacks
+	client.OnJoined(func() {
+		client.OnJoined(func() {})
+	})
+	client.OnTrackAdded(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+		client.OnTrackRemoved(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {})
+	})
+	client.OnTrackRemoved(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+		client.OnTrackAdded(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {})
+	})
+	client.OnDataChannel(func(dc *webrtc.DataChannel) {
+		client.OnDataChannel(func(dc *webrtc.DataChannel) {})
+	})
+	client.OnMessage("chat", func(data []byte) {
+		client.OnMessage("chat", func(data []byte) {})
+		client.OnLeft(func() {})
+	})
+	client.OnVoiceSentDetected(func(activity voiceactivedetector.VoiceActivity) {
+		client.OnVoiceSentDetected(func(activity voiceactivedetector.VoiceActivity) {})
+	})
+	client.OnVoiceReceivedDetected(func(activity voiceactivedetector.VoiceActivity) {
+		client.OnVoiceReceivedDetected(func(activity voiceactivedetector.VoiceActivity) {})
+	})
+	client.OnRenegotiationFailed(func(err error) {
+		client.OnRenegotiationFailed(func(err error) {})
+	})
+	client.OnRenegotiationComplete(func() {
+		client.OnRenegotiationComplete(func() {})
+	})
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		client.onJoined()
+		client.onTrackAdded(TrackTypeMedia, nil)
+		client.onTrackRemoved(TrackTypeMedia, nil)
+		client.onDataChannel(nil)
+		client.onMessage("chat", []byte("hello"))
+		client.onVoiceSentDetected(voiceactivedetector.VoiceActivity{})
+		client.onVoiceReceiveDetected(voiceactivedetector.VoiceActivity{})
+		client.onRenegotiationFailed(errors.New("renegotiation failed"))
+		client.onRenegotiationComplete()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the callbacks, the callback lock is held while they're called")
+	}
+
+	// the callbacks registered while calling are called the next time
+	client.muCallback.Lock()
+	require.Len(t, client.onJoinedCallbacks, 2)
+	require.Len(t, client.onMessageCallbacks["chat"], 2)
+	client.muCallback.Unlock()
+}
+
+func TestQualityLevelString(t *testing.T) {
+	require.Equal(t, "high", QualityLevel(QualityHigh).String())
+	require.Equal(t, "midlow", QualityLevel(QualityMidLow).String())
+	require.Equal(t, "none", QualityLevel(QualityNone).String())
+	require.Equal(t, "42", QualityLevel(42).String())
+
+	quality, err := ParseQualityLevel("Mid")
+	require.NoError(t, err)
+	require.Equal(t, QualityLevel(QualityMid), quality)
+
+	_, err = ParseQualityLevel("ultra")
+	require.ErrorIs(t, err, ErrInvalidQuality)
+
+	data, err := json.Marshal(TrackSentStats{Quality: QualityLow, MaxQuality: QualityHigh})
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"quality":"low","max_quality":"high"`)
+
+	var stats TrackSentStats
+	require.NoError(t, json.Unmarshal(data, &stats))
+	require.Equal(t, QualityLevel(QualityLow), stats.Quality)
+	require.Equal(t, QualityLevel(QualityHigh), stats.MaxQuality)
+
+	// the numeric quality level is still accepted
+	require.NoError(t, json.Unmarshal([]byte(`{"quality":6}`), &stats))
+	require.Equal(t, QualityLevel(QualityMid), stats.Quality)
+
+	require.ErrorIs(t, json.Unmarshal([]byte(`{"quality":"ultra"}`), &stats), ErrInvalidQuality)
+	require.ErrorIs(t, json.Unmarshal([]byte(`{"quality":42}`), &stats), ErrInvalidQuality)
+}
+
+func TestClientStatsBitrateWindow(t *testing.T) {
+	now := time.Now()
+	window := 3 * time.Second
+
+	samples, _, ok := windowBitrate(nil, bitrateSample{ts: now, bytes: 0}, window)
+	require.False(t, ok)
+
+	// 125,000 bytes per second is 1 Mbps
+	var bitrate uint32
+	for i := 1; i <= 3; i++ {
+		samples, bitrate, ok = windowBitrate(samples, bitrateSample{ts: now.Add(time.Duration(i) * time.Second), bytes: uint64(i) * 125_000}, window)
+		require.True(t, ok)
+		require.Equal(t, uint32(1_000_000), bitrate)
+	}
+
+	// the spike in the last second is smoothed over the window
+	samples, bitrate, ok = windowBitrate(samples, bitrateSample{ts: now.Add(4 * time.Second), bytes: 3*125_000 + 500_000}, window)
+	require.True(t, ok)
+	require.Equal(t, uint32(2_000_000), bitrate)
+	require.Len(t, samples, 4)
+
+	// the counter reset doesn't underflow
+	_, bitrate, ok = windowBitrate(samples, bitrateSample{ts: now.Add(5 * time.Second), bytes: 0}, window)
+	require.True(t, ok)
+	require.Equal(t, uint32(0), bitrate)
+}
+
+func TestClientReceiverStatsJitter(t *testing.T) {
+	client := &Client{
+		stats: &ClientStats{TrackStats: &TrackStats{receiverBitrates: make(map[string]uint32)}},
+	}
+
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "stream")
+	require.NoError(t, err)
+
+	track := newSampleTrack(context.Background(), sample, getRTPParameters(webrtc.MimeTypeOpus))
+	defer track.close()
+
+	stat := stats.Stats{}
+	stat.InboundRTPStreamStats.Jitter = 960
+	stat.InboundRTPStreamStats.NACKCount = 3
+
+	receivedStats, err := generateClientReceiverStats(client, track, stat)
+	require.NoError(t, err)
+
+	// 960 timestamp units of the 48kHz clock is 20ms
+	require.InDelta(t, 0.02, receivedStats.Jitter, 0.0001)
+	require.Equal(t, uint32(3), receivedStats.NACKCount)
+}
+
+func TestClientSetType(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-set-type", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	client, err := testRoom.AddClient(testRoom.CreateClientID(), "client", DefaultClientOptions())
+	require.NoError(t, err)
+
+	require.ErrorIs(t, client.SetType("mesh"), ErrInvalidClientType)
+	require.Equal(t, ClientTypePeer, client.Type())
+
+	// the type can't be changed during a negotiation
+	client.negotiationNeeded.Store(true)
+	require.ErrorIs(t, client.SetType(ClientTypeUpBridge), ErrClientTypeNegotiating)
+	client.negotiationNeeded.Store(false)
+
+	// the peer holds the published track until all the tracks in the offer are received
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "stream")
+	require.NoError(t, err)
+
+	remoteTrack := newSampleTrack(client.context, sample, getRTPParameters(webrtc.MimeTypeOpus))
+	defer remoteTrack.close()
+
+	published := make(chan []ITrack, 1)
+	client.OnTracksAdded(func(addedTracks []ITrack) {
+		published <- addedTracks
+	})
+
+	client.initialReceiverCount.Store(2)
+	client.onTrack(newTrack(client.context, client, remoteTrack, 0, 0, 0, func() {}, nil, nil))
+
+	select {
+	case <-published:
+		t.Fatal("the track is published before all the tracks are received")
+	default:
+	}
+
+	// the held track is published once the peer is promoted to a bridge
+	require.NoError(t, client.SetType(ClientTypeUpBridge))
+	require.Equal(t, ClientTypeUpBridge, client.Type())
+	require.True(t, client.IsBridge())
+
+	select {
+	case tracks := <-published:
+		require.Len(t, tracks, 1)
+		require.Equal(t, "audio", tracks[0].ID())
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the held track published")
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientTrackAddedSourceType(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-track-added", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	publisher, err := testRoom.AddClient(testRoom.CreateClientID(), "publisher", DefaultClientOptions())
+	require.NoError(t, err)
+
+	subscriber, err := testRoom.AddClient(testRoom.CreateClientID(), "subscriber", DefaultClientOptions())
+	require.NoError(t, err)
+
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "screen-audio", "screen")
+	require.NoError(t, err)
+
+	remoteTrack := newSampleTrack(publisher.context, sample, getRTPParameters(webrtc.MimeTypeOpus))
+	defer remoteTrack.close()
+
+	track := newTrack(publisher.context, publisher, remoteTrack, 0, 0, 0, func() {}, nil, nil)
+	track.SetSourceType(TrackTypeScreen)
+
+	type addedTrack struct {
+		sourceType string
+		trackID    string
+	}
+
+	added := make([]addedTrack, 0)
+	subscriber.OnTrackAdded(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+		added = append(added, addedTrack{sourceType: sourceType, trackID: track.ID()})
+	})
+
+	require.NotNil(t, subscriber.setClientTrack(track))
+	require.Equal(t, []addedTrack{{sourceType: TrackTypeScreen, trackID: "screen-audio"}}, added)
+
+	// the track that is already added is not added again
+	require.Nil(t, subscriber.setClientTrack(track))
+	require.Len(t, added, 1)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientOnLocalDescription(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-local-description", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	munged, err := testRoom.AddClient(testRoom.CreateClientID(), "munged", DefaultClientOptions())
+	require.NoError(t, err)
+
+	munged.OnLocalDescription(func(desc webrtc.SessionDescription) webrtc.SessionDescription {
+		require.Equal(t, webrtc.SDPTypeOffer, desc.Type)
+		desc.SDP = strings.Replace(desc.SDP, "s=-", "s=munged", 1)
+
+		return desc
+	})
+
+	offer := munged.InitNegotiation()
+	require.Contains(t, offer.SDP, "s=munged")
+
+	// the invalid SDP is ignored and the original SDP is used
+	invalid, err := testRoom.AddClient(testRoom.CreateClientID(), "invalid", DefaultClientOptions())
+	require.NoError(t, err)
+
+	invalid.OnLocalDescription(func(desc webrtc.SessionDescription) webrtc.SessionDescription {
+		return webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: desc.SDP}
+	})
+
+	offer = invalid.InitNegotiation()
+	require.Equal(t, webrtc.SDPTypeOffer, offer.Type)
+	require.Contains(t, offer.SDP, "s=-")
+
+	require.Error(t, validateMungedDescription(*offer, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "invalid"}))
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientAudioOnly(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-audio-only", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	opts := DefaultClientOptions()
+	opts.AudioOnly = true
+	audioOnly, err := testRoom.AddClient(testRoom.CreateClientID(), "dial-in", opts)
+	require.NoError(t, err)
+
+	availableTracks := make([]string, 0)
+	audioOnly.OnTracksAvailable(func(tracks []ITrack) {
+		for _, track := range tracks {
+			availableTracks = append(availableTracks, track.ID())
+		}
+	})
+
+	publisher, err := testRoom.AddClient(testRoom.CreateClientID(), "publisher", DefaultClientOptions())
+	require.NoError(t, err)
+
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "publisher")
+	require.NoError(t, err)
+	require.NoError(t, publisher.PublishSample(audio, TrackTypeMedia))
+
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "publisher")
+	require.NoError(t, err)
+	require.NoError(t, publisher.PublishSample(video, TrackTypeMedia))
+
+	// the video track is not available and can't be forwarded to the audio only client
+	require.Equal(t, []string{"audio"}, availableTracks)
+
+	videoTrack, err := publisher.tracks.Get("video")
+	require.NoError(t, err)
+	require.Nil(t, audioOnly.setClientTrack(videoTrack))
+
+	audioTrack, err := publisher.tracks.Get("audio")
+	require.NoError(t, err)
+	require.NotNil(t, audioOnly.setClientTrack(audioTrack))
+
+	// the video codecs and extensions are not offered
+	offer := audioOnly.InitNegotiation()
+	require.Contains(t, offer.SDP, "m=audio")
+	require.NotContains(t, offer.SDP, "m=video")
+	require.NotContains(t, offer.SDP, "H264")
+
+	require.Equal(t, []string{webrtc.MimeTypeOpus}, audioCodecsOnly([]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus, webrtc.MimeTypeVP8}))
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientGetSubscribedQualities(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &Client{
+		clientTracks: make(map[string]iClientTrack),
+		log:          TestLogger,
+	}
+
+	lastQuality := &atomic.Uint32{}
+	lastQuality.Store(QualityMid)
+
+	simulcast := &simulcastClientTrack{
+		id:          "simulcast",
+		streamid:    "stream",
+		lastQuality: lastQuality,
+		isPaused:    &atomic.Bool{},
+	}
+
+	pausedQuality := &atomic.Uint32{}
+	pausedQuality.Store(QualityLow)
+
+	paused := &simulcastClientTrack{
+		id:          "paused",
+		streamid:    "stream",
+		lastQuality: pausedQuality,
+		isPaused:    &atomic.Bool{},
+	}
+	paused.isPaused.Store(true)
+
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "stream")
+	require.NoError(t, err)
+
+	audio := &clientTrack{
+		id:          "audio",
+		streamid:    "stream",
+		remoteTrack: &remoteTrack{track: newSampleTrack(ctx, sample, getRTPParameters(webrtc.MimeTypeOpus))},
+	}
+
+	client.clientTracks[simulcast.ID()] = simulcast
+	client.clientTracks[paused.ID()] = paused
+	client.clientTracks[audio.ID()] = audio
+
+	require.Equal(t, map[string]QualityLevel{
+		"stream-simulcast": QualityMid,
+		"stream-paused":    QualityNone,
+		"stream-audio":     QualityAudio,
+	}, client.GetSubscribedQualities())
+}
+
+func TestLossKeyframeRequester(t *testing.T) {
+	requester := newLossKeyframeRequester()
+
+	now := time.Now()
+
+	// 5% loss is below the threshold
+	require.False(t, requester.onReceiverReport(13, now))
+
+	// 25% loss requests a keyframe once per interval
+	require.True(t, requester.onReceiverReport(64, now))
+	require.False(t, requester.onReceiverReport(64, now.Add(lossKeyframeInterval/2)))
+	require.True(t, requester.onReceiverReport(64, now.Add(lossKeyframeInterval)))
+}
+
+func TestCountNewMediaSections(t *testing.T) {
+	offer := &sdp.SessionDescription{}
+	require.NoError(t, offer.UnmarshalString("v=0\r\n"+
+		"o=- 0 0 IN IP4 127.0.0.1\r\n"+
+		"s=-\r\n"+
+		"t=0 0\r\n"+
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n"+
+		"a=mid:0\r\n"+
+		"a=sendrecv\r\n"+
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n"+
+		"a=mid:1\r\n"+
+		"a=sendonly\r\n"+
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n"+
+		"a=mid:2\r\n"+
+		"a=recvonly\r\n"+
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n"+
+		"a=mid:3\r\n"+
+		"a=inactive\r\n"+
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n"+
+		"a=mid:4\r\n"))
+
+	sending, receiving := countNewMediaSections(offer, map[string]bool{})
+	require.Equal(t, 2, sending)
+	require.Equal(t, 2, receiving)
+
+	// the negotiated media sections are not counted again
+	sending, receiving = countNewMediaSections(offer, map[string]bool{"0": true})
+	require.Equal(t, 1, sending)
+	require.Equal(t, 1, receiving)
+}
+
+func TestClientSendRecvInitialTracks(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-sendrecv-initial-tracks", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err)
+
+	// the room is active with another client
+	_, err = testRoom.AddClient(testRoom.CreateClientID(), "other", DefaultClientOptions())
+	require.NoError(t, err)
+
+	client, err := testRoom.AddClient(testRoom.CreateClientID(), "sendrecv", DefaultClientOptions())
+	require.NoError(t, err)
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, pc.Close())
+	}()
+
+	// the client publishes the audio and video on sendrecv transceivers and receives another video on a recvonly transceiver
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendrecv})
+	require.NoError(t, err)
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendrecv})
+	require.NoError(t, err)
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	offer, err := pc.CreateOffer(nil)
+	require.NoError(t, err)
+	require.NoError(t, pc.SetLocalDescription(offer))
+
+	_, err = client.Negotiate(*pc.LocalDescription())
+	require.NoError(t, err)
+
+	// the publishing waits for the 2 sent tracks only
+	require.Equal(t, uint32(2), client.initialReceiverCount.Load())
+	require.Equal(t, uint32(3), client.initialSenderCount.Load())
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientPeerConnectionConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-peer-connection-config", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	config := &webrtc.Configuration{
+		ICEServers:         []webrtc.ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass"}},
+		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
+		BundlePolicy:       webrtc.BundlePolicyMaxBundle,
+	}
+
+	opts := DefaultClientOptions()
+	opts.PeerConnectionConfig = config
+
+	client, err := testRoom.AddClient("client-1", "client-1", opts)
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	clientConfig := client.PeerConnection().PC().GetConfiguration()
+	require.Equal(t, webrtc.ICETransportPolicyRelay, clientConfig.ICETransportPolicy)
+	require.Equal(t, webrtc.BundlePolicyMaxBundle, clientConfig.BundlePolicy)
+	require.Len(t, clientConfig.ICEServers, 1+len(sfuOpts.IceServers))
+	require.Equal(t, config.ICEServers[0].URLs, clientConfig.ICEServers[0].URLs)
+
+	// the configuration passed by the caller is not modified
+	require.Len(t, config.ICEServers, 1)
+
+	// the SFU ICE servers are used without the client configuration
+	client, err = testRoom.AddClient("client-2", "client-2", DefaultClientOptions())
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	clientConfig = client.PeerConnection().PC().GetConfiguration()
+	require.Equal(t, webrtc.ICETransportPolicyAll, clientConfig.ICETransportPolicy)
+	require.Len(t, clientConfig.ICEServers, len(sfuOpts.IceServers))
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientICECandidateFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-ice-candidate-filter", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	var mu sync.Mutex
+
+	filtered := 0
+	sent := make([]*webrtc.ICECandidate, 0)
+
+	// drop the loopback candidates
+	opts := DefaultClientOptions()
+	opts.ICECandidateFilter = func(candidate *webrtc.ICECandidate) bool {
+		if candidate.Address != "127.0.0.1" {
+			return true
+		}
+
+		mu.Lock()
+		filtered++
+		mu.Unlock()
+
+		return false
+	}
+
+	client, err := testRoom.AddClient("client-1", "client-1", opts)
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	client.OnIceCandidate(func(ctx context.Context, candidate *webrtc.ICECandidate) {
+		mu.Lock()
+		sent = append(sent, candidate)
+		mu.Unlock()
+	})
+
+	pc, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	defer pc.Close()
+
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	offer, err := pc.CreateOffer(nil)
+	require.NoError(t, err)
+	require.NoError(t, pc.SetLocalDescription(offer))
+
+	_, err = client.Negotiate(offer)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return client.PeerConnection().PC().ICEGatheringState() == webrtc.ICEGatheringStateComplete
+	}, 10*time.Second, 50*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return filtered > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	mu.Lock()
+	for _, candidate := range sent {
+		require.NotEqual(t, "127.0.0.1", candidate.Address)
+	}
+	mu.Unlock()
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestSenderSSRCCollision(t *testing.T) {
+	pc, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	defer pc.Close()
+
+	addTrack := func(id string) *webrtc.RTPTransceiver {
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, id, "stream")
+		require.NoError(t, err)
+
+		transceiver, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		require.NoError(t, err)
+
+		return transceiver
+	}
+
+	first := addTrack("first")
+	second := addTrack("second")
+
+	firstSSRCs := senderSSRCs(first.Sender())
+	secondSSRCs := senderSSRCs(second.Sender())
+
+	// the video sender has the media and the RTX SSRCs
+	require.Len(t, firstSSRCs, 2)
+	require.NotEqual(t, firstSSRCs, secondSSRCs)
+
+	used := usedSSRCs(pc, second)
+	require.False(t, ssrcsCollide(secondSSRCs, used))
+	require.True(t, ssrcsCollide(firstSSRCs, used))
+
+	// the SSRCs of the removed sender are not used anymore
+	require.NoError(t, pc.RemoveTrack(first.Sender()))
+	require.False(t, ssrcsCollide(firstSSRCs, usedSSRCs(pc, second)))
+}
+
+func TestClientCodecPreferences(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-codec-preferences", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	defer func() {
+		require.NoError(t, testRoom.Close())
+	}()
+
+	opts := DefaultClientOptions()
+	opts.CodecPreferences = []string{webrtc.MimeTypeVP8, webrtc.MimeTypeH264}
+
+	client, err := testRoom.AddClient("client-codec-preferences", "client-codec-preferences", opts)
+	require.NoError(t, err)
+
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream")
+	require.NoError(t, err)
+
+	_, err = client.addSenderTransceiver(localTrack)
+	require.NoError(t, err)
+
+	offer, err := client.PeerConnection().PC().CreateOffer(nil)
+	require.NoError(t, err)
+
+	parsed := &sdp.SessionDescription{}
+	require.NoError(t, parsed.Unmarshal([]byte(offer.SDP)))
+	require.Len(t, parsed.MediaDescriptions, 1)
+
+	// the preferred codecs are offered first, followed by the other room codecs in the default order
+	mimeTypes := make([]string, 0)
+
+	for _, format := range parsed.MediaDescriptions[0].MediaName.Formats {
+		payloadType, err := strconv.ParseUint(format, 10, 8)
+		require.NoError(t, err)
+
+		codec, err := parsed.GetCodecForPayloadType(uint8(payloadType))
+		require.NoError(t, err)
+
+		if codec.Name != "rtx" && !slices.Contains(mimeTypes, "video/"+codec.Name) {
+			mimeTypes = append(mimeTypes, "video/"+codec.Name)
+		}
+	}
+
+	require.Equal(t, []string{webrtc.MimeTypeVP8, webrtc.MimeTypeH264, webrtc.MimeTypeVP9, webrtc.MimeTypeAV1}, mimeTypes)
+}
+
+func TestClientRTXOffered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-rtx", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	defer func() {
+		require.NoError(t, testRoom.Close())
+	}()
+
+	preferredOpts := DefaultClientOptions()
+	preferredOpts.CodecPreferences = []string{webrtc.MimeTypeH264}
+
+	// the codec preferences set the transceiver codecs, the RTX codecs must be kept
+	for id, opts := range map[string]ClientOptions{"client-rtx": DefaultClientOptions(), "client-rtx-preferences": preferredOpts} {
+		client, err := testRoom.AddClient(id, id, opts)
+		require.NoError(t, err)
+
+		localTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream")
+		require.NoError(t, err)
+
+		_, err = client.addSenderTransceiver(localTrack)
+		require.NoError(t, err)
+
+		offer, err := client.PeerConnection().PC().CreateOffer(nil)
+		require.NoError(t, err)
+
+		parsed := &sdp.SessionDescription{}
+		require.NoError(t, parsed.Unmarshal([]byte(offer.SDP)))
+		require.Len(t, parsed.MediaDescriptions, 1)
+
+		primaries := make([]string, 0)
+		associated := make([]string, 0)
+
+		for _, format := range parsed.MediaDescriptions[0].MediaName.Formats {
+			payloadType, err := strconv.ParseUint(format, 10, 8)
+			require.NoError(t, err)
+
+			codec, err := parsed.GetCodecForPayloadType(uint8(payloadType))
+			require.NoError(t, err)
+
+			if codec.Name == "rtx" {
+				associated = append(associated, codec.Fmtp)
+			} else {
+				primaries = append(primaries, "apt="+format)
+			}
+		}
+
+		// each offered video codec has its RTX codec
+		require.NotEmpty(t, primaries)
+		require.ElementsMatch(t, primaries, associated, id)
+	}
+}
+
+func TestClientREDFallbackToOpus(t *testing.T) {
+	redundant := []byte{0x01, 0x02, 0x03}
+	primary := []byte{0x0a, 0x0b, 0x0c, 0x0d}
+
+	// one redundant block of 3 bytes 960 samples before the primary block, both are Opus with payload type 111
+	header := make([]byte, 4)
+	header[0] = 0x80 | 111
+	binary.BigEndian.PutUint16(header[1:], 960<<2)
+	header[3] = byte(len(redundant))
+
+	payload := append(header, 111)
+	payload = append(payload, redundant...)
+	payload = append(payload, primary...)
+
+	// the client without RED receives the primary Opus encoding only
+	extracted, err := extractPrimaryEncodingForRED(payload)
+	require.NoError(t, err)
+	require.Equal(t, primary, extracted)
+
+	_, err = extractPrimaryEncodingForRED(payload[:3])
+	require.ErrorIs(t, err, ErrIncompleteRedHeader)
+
+	_, err = extractPrimaryEncodingForRED(payload[:6])
+	require.ErrorIs(t, err, ErrIncompleteRedBlock)
+
+	// the RED packets are forwarded as is only if the client negotiates RED
+	for codecs, withRED := range map[string]bool{"audio/red,audio/opus": true, "audio/opus": false} {
+		mediaEngine := &webrtc.MediaEngine{}
+		require.NoError(t, RegisterCodecs(mediaEngine, strings.Split(codecs, ",")))
+
+		pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+		require.NoError(t, err)
+
+		_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+		require.NoError(t, err)
+
+		offer, err := pc.CreateOffer(nil)
+		require.NoError(t, err)
+		require.NoError(t, pc.Close())
+
+		match, err := supportsRED(offer)
+		require.NoError(t, err)
+		require.Equal(t, withRED, match, codecs)
+	}
+}
+
+func TestClientOnNegotiationNeeded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-negotiation-needed", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	defer func() {
+		require.NoError(t, testRoom.Close())
+	}()
+
+	client, err := testRoom.AddClient("client-negotiation-needed", "client-negotiation-needed", DefaultClientOptions())
+	require.NoError(t, err)
+
+	needed := &atomic.Int32{}
+	client.OnNegotiationNeeded(func() {
+		needed.Add(1)
+	})
+
+	// each request is reported, including the one merged into the pending renegotiation
+	client.renegotiate(false)
+	client.renegotiate(false)
+
+	require.Eventually(t, func() bool { return needed.Load() == 2 }, time.Second, 10*time.Millisecond)
+}
+
+func TestClientPendingLocalCandidates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-pending-local-candidates", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	defer func() {
+		require.NoError(t, testRoom.Close())
+	}()
+
+	client, err := testRoom.AddClient("client-pending-candidates", "client-pending-candidates", DefaultClientOptions())
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+
+	sent := make([]*webrtc.ICECandidate, 0)
+
+	client.OnIceCandidate(func(ctx context.Context, candidate *webrtc.ICECandidate) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sent = append(sent, candidate)
+	})
+
+	// the candidates gathered before the local description is set are queued
+	require.False(t, client.canAddCandidate.Load())
+
+	candidates := []*webrtc.ICECandidate{{Address: "10.0.0.1", Port: 1000}, {Address: "10.0.0.2", Port: 2000}}
+
+	client.mu.Lock()
+	client.pendingLocalCandidates = append(client.pendingLocalCandidates, candidates...)
+	client.mu.Unlock()
+
+	// the pending candidates are sent once, and the next candidates are sent directly
+	client.sendPendingLocalCandidates()
+	client.sendPendingLocalCandidates()
+
+	require.True(t, client.canAddCandidate.Load())
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Equal(t, candidates, sent)
+	require.Empty(t, client.pendingLocalCandidates)
+}
+
+func TestClientLocalCandidatesOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-local-candidates-order", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	defer func() {
+		require.NoError(t, testRoom.Close())
+	}()
+
+	client, err := testRoom.AddClient("client-candidates-order", "client-candidates-order", DefaultClientOptions())
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+
+	sent := make([]string, 0)
+
+	client.OnIceCandidate(func(ctx context.Context, candidate *webrtc.ICECandidate) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sent = append(sent, candidate.ToJSON().Candidate)
+	})
+
+	pc := client.PeerConnection().PC()
+
+	// the local description needs a media section to list the candidates
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	// setting the local description starts the gathering, the candidates are trickled as they're gathered
+	offer := client.InitNegotiation()
+	require.NotNil(t, offer)
+
+	require.Eventually(t, func() bool {
+		return pc.ICEGatheringState() == webrtc.ICEGatheringStateComplete
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the local description lists the candidates in the gather order, the RTCP component is a copy of the RTP one
+	gathered := make([]string, 0)
+	for _, line := range strings.Split(pc.LocalDescription().SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") && strings.Fields(line)[1] == "1" {
+			gathered = append(gathered, strings.TrimPrefix(line, "a="))
+		}
+	}
+
+	require.NotEmpty(t, gathered)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(sent) == len(gathered)
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Equal(t, gathered, sent)
+}
+
+func TestClientSetPlayoutDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-playout-delay", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	defer func() {
+		require.NoError(t, testRoom.Close())
+	}()
+
+	client, err := testRoom.AddClient("client-playout-delay", "client-playout-delay", DefaultClientOptions())
+	require.NoError(t, err)
+
+	require.NoError(t, client.SetPlayoutDelay(400*time.Millisecond, time.Second))
+	require.ErrorIs(t, client.SetPlayoutDelay(time.Second, 400*time.Millisecond), ErrInvalidPlayoutDelay)
+	require.ErrorIs(t, client.SetPlayoutDelay(0, time.Minute), ErrInvalidPlayoutDelay)
+
+	opts := DefaultClientOptions()
+	opts.EnablePlayoutDelay = false
+
+	clientNoDelay, err := testRoom.AddClient("client-no-playout-delay", "client-no-playout-delay", opts)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, clientNoDelay.SetPlayoutDelay(0, time.Second), ErrPlayoutDelayNotEnabled)
+}
+
+func TestClientRenegotiationAfterOfferFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-renegotiation-offer-failure", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	pc, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	loopback, err := NewLoopback(testRoom, "client-offer-failure", pc, DefaultClientOptions())
+	require.NoError(t, err)
+
+	client := loopback.Client
+
+	require.Eventually(t, func() bool {
+		return client.PeerConnection().PC().ConnectionState() == webrtc.PeerConnectionStateConnected
+	}, 20*time.Second, 50*time.Millisecond)
+
+	failed := &atomic.Int32{}
+	completed := &atomic.Int32{}
+
+	client.OnRenegotiationComplete(func() {
+		completed.Add(1)
+	})
+
+	// the first offer of the client fails before the peer connection is changed
+	createOffer := createPeerConnectionOffer
+
+	defer func() {
+		createPeerConnectionOffer = createOffer
+	}()
+
+	createPeerConnectionOffer = func(pc *webrtc.PeerConnection, options *webrtc.OfferOptions) (webrtc.SessionDescription, error) {
+		if pc == client.PeerConnection().PC() && failed.Add(1) == 1 {
+			return webrtc.SessionDescription{}, errors.New("offer failure")
+		}
+
+		return createOffer(pc, options)
+	}
+
+	client.renegotiate(false)
+
+	require.Eventually(t, func() bool {
+		return failed.Load() == 1 && !client.isInRenegotiation.Load()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, ClientStateActive, client.state.Load())
+	require.Equal(t, int32(0), completed.Load())
+
+	// the next renegotiation still runs
+	client.renegotiate(false)
+
+	require.Eventually(t, func() bool {
+		return completed.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, loopback.Close())
+	require.NoError(t, testRoom.Close())
+}
+
+// fixedBitrateController selects the same quality for all tracks
+type fixedBitrateController struct {
+	quality QualityLevel
+	tracks  sync.Map
+}
+
+func (c *fixedBitrateController) GetQuality(track IClientTrack) QualityLevel {
+	c.tracks.Store(track.ID(), track)
+
+	return c.quality
+}
+
+func (c *fixedBitrateController) OnBandwidthEstimated(_ *Client, _, _ uint32) {}
+
+func TestClientBitrateController(t *testing.T) {
+	controller := &fixedBitrateController{quality: QualityMid}
+
+	clientTrack := newTestSimulcastClientTrack(t)
+	client := clientTrack.client
+	client.options.BitrateController = controller
+
+	// all layers are active
+	now := time.Now().UnixNano()
+	clientTrack.remoteTrack.lastReadHighTS.Store(now)
+	clientTrack.remoteTrack.lastReadMidTS.Store(now)
+	clientTrack.remoteTrack.lastReadLowTS.Store(now)
+
+	// the built-in controller claim is ignored when the controller is set
+	client.bitrateController.claims.Store(clientTrack.ID(), &bitrateClaim{track: clientTrack, quality: QualityHigh, simulcast: true})
+
+	require.Equal(t, QualityLevel(QualityMid), clientTrack.getQuality())
+
+	_, ok := controller.tracks.Load(clientTrack.ID())
+	require.True(t, ok)
+
+	// the selected quality is still capped by the track max quality
+	clientTrack.maxQuality.Store(QualityLow)
+	require.Equal(t, QualityLevel(QualityLow), clientTrack.getQuality())
+
+	// the built-in controller is used without the controller
+	client.options.BitrateController = nil
+	clientTrack.maxQuality.Store(QualityHigh)
+	require.Equal(t, QualityLevel(QualityHigh), clientTrack.getQuality())
+}
+
+func TestClientSyncTracks(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-sync-tracks", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	subscriberPC, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	_, err = subscriberPC.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	received := make(chan *webrtc.TrackRemote, 1)
+
+	subscriberPC.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			received <- track
+		}
+	})
+
+	// the subscriber doesn't subscribe to the available tracks
+	subscriber, err := NewLoopback(testRoom, "subscriber", subscriberPC, DefaultClientOptions())
+	require.NoError(t, err)
+
+	publisherPC, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "publisher")
+	require.NoError(t, err)
+
+	_, err = publisherPC.AddTransceiverFromTrack(audio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	require.NoError(t, err)
+
+	publisher, err := NewLoopback(testRoom, "publisher", publisherPC, DefaultClientOptions())
+	require.NoError(t, err)
+
+	publisher.Client.OnTracksAdded(func(addedTracks []ITrack) {
+		setTracks := make(map[string]TrackType, 0)
+		for _, track := range addedTracks {
+			setTracks[track.ID()] = TrackTypeMedia
+		}
+
+		publisher.Client.SetTracksSourceType(setTracks)
+	})
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = audio.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(publisher.Client.Tracks()) == 1 && subscriber.Client.PeerConnection().PC().ConnectionState() == webrtc.PeerConnectionStateConnected
+	}, 20*time.Second, 100*time.Millisecond)
+
+	require.Empty(t, subscriber.Client.ClientTracks())
+
+	// the missing track is subscribed and sent with a renegotiation
+	require.True(t, subscriber.Client.SyncTracks())
+	require.Len(t, subscriber.Client.ClientTracks(), 1)
+
+	select {
+	case track := <-received:
+		require.Equal(t, "audio", track.ID())
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for the synced track")
+	}
+
+	// the client is already in sync
+	require.False(t, subscriber.Client.SyncTracks())
+
+	cancel()
+
+	require.NoError(t, publisher.Close())
+	require.NoError(t, subscriber.Close())
+
+	require.Eventually(t, func() bool {
+		return testRoom.SFU().clients.Length() == 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+}
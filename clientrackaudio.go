@@ -17,12 +17,12 @@ func newClientTrackAudio(c *Client, t ITrack) *clientTrackAudio {
 		return nil
 	}
 
-	if !c.receiveRED {
+	if !c.receiveRED.Load() {
 		localTrack = audioTrack.createOpusLocalTrack()
 	} else {
 		localTrack = audioTrack.createLocalTrack()
 	}
-	ctBase := newClientTrack(c, audioTrack.Track, false, localTrack)
+	ctBase := newClientTrack(c, audioTrack.Track, audioTrack.IsScreen(), localTrack)
 	cta := &clientTrackAudio{
 		clientTrack: ctBase,
 	}
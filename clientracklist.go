@@ -33,6 +33,19 @@ func (l *clientTrackList) remove(id string) {
 	}
 }
 
+// removeTrack removes the client track itself, the tracks of the other subscribers have the same ID
+func (l *clientTrackList) removeTrack(track iClientTrack) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, t := range l.tracks {
+		if t == track {
+			l.tracks = append(l.tracks[:i], l.tracks[i+1:]...)
+			break
+		}
+	}
+}
+
 func (l *clientTrackList) Get(id string) iClientTrack {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
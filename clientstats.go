@@ -62,64 +62,99 @@ func newClientStats(c *Client) *ClientStats {
 	return cstats
 }
 
+// bitrateSample is the bytes counter of a track at the sample time
+type bitrateSample struct {
+	ts    time.Time
+	bytes uint64
+}
+
+// monitorBitrates measures the sender and receiver bitrates in bits per second over the SFU bitrate window.
+// The bytes counters are sampled every second, or every window if the window is shorter than a second.
 func (c *ClientStats) monitorBitrates(ctx context.Context) {
-	ticker := time.NewTicker(1 * time.Second)
+	window := c.bitrateWindow()
+
+	ticker := time.NewTicker(min(window, time.Second))
 	defer ticker.Stop()
 
-	var lastSenderBytesSent = make(map[string]uint64)
-	var lastReceiverBytesReceived = make(map[string]uint64)
+	var senderSamples = make(map[string][]bitrateSample)
+	var receiverSamples = make(map[string][]bitrateSample)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			lastSenderBytesSent = c.updateSenderBitrates(lastSenderBytesSent)
-			lastReceiverBytesReceived = c.updateReceiverBitrates(lastReceiverBytesReceived)
+		case now := <-ticker.C:
+			senderSamples = c.updateSenderBitrates(senderSamples, now, window)
+			receiverSamples = c.updateReceiverBitrates(receiverSamples, now, window)
 		}
 	}
 }
 
-func (c *ClientStats) updateSenderBitrates(lastSenderBytesSent map[string]uint64) map[string]uint64 {
+func (c *ClientStats) bitrateWindow() time.Duration {
+	if c.Client == nil || c.Client.sfu == nil || c.Client.sfu.bitrateWindow <= 0 {
+		return DefaultBitrateWindow
+	}
+
+	return c.Client.sfu.bitrateWindow
+}
+
+func (c *ClientStats) updateSenderBitrates(senderSamples map[string][]bitrateSample, now time.Time, window time.Duration) map[string][]bitrateSample {
 	c.senderMu.Lock()
 	defer c.senderMu.Unlock()
 
 	for id, stats := range c.senders {
-		lastBytesSent, ok := lastSenderBytesSent[id]
-		if !ok {
-			lastSenderBytesSent[id] = stats.OutboundRTPStreamStats.BytesSent
-			continue
-		}
+		samples, bitrate, ok := windowBitrate(senderSamples[id], bitrateSample{ts: now, bytes: stats.OutboundRTPStreamStats.BytesSent}, window)
 
-		delta := stats.OutboundRTPStreamStats.BytesSent - lastBytesSent
+		senderSamples[id] = samples
 
-		lastSenderBytesSent[id] = stats.OutboundRTPStreamStats.BytesSent
-
-		c.senderBitrates[id] = uint32(delta) * 8
+		if ok {
+			c.senderBitrates[id] = bitrate
+		}
 	}
 
-	return lastSenderBytesSent
+	return senderSamples
 }
 
-func (c *ClientStats) updateReceiverBitrates(lastReceiverBytesSent map[string]uint64) map[string]uint64 {
+func (c *ClientStats) updateReceiverBitrates(receiverSamples map[string][]bitrateSample, now time.Time, window time.Duration) map[string][]bitrateSample {
 	c.receiverMu.Lock()
 	defer c.receiverMu.Unlock()
 
 	for id, stats := range c.receivers {
-		lastBytesReceived, ok := lastReceiverBytesSent[id]
-		if !ok {
-			lastReceiverBytesSent[id] = stats.InboundRTPStreamStats.BytesReceived
-			continue
+		samples, bitrate, ok := windowBitrate(receiverSamples[id], bitrateSample{ts: now, bytes: stats.InboundRTPStreamStats.BytesReceived}, window)
+
+		receiverSamples[id] = samples
+
+		if ok {
+			c.receiverBitrates[id] = bitrate
 		}
+	}
+
+	return receiverSamples
+}
 
-		delta := stats.InboundRTPStreamStats.BytesReceived - lastBytesReceived
+// windowBitrate adds the sample and returns the bitrate in bits per second between the oldest sample in the window and the new sample.
+// The samples older than the window are removed, it returns false if there is no older sample to measure the bitrate yet.
+func windowBitrate(samples []bitrateSample, sample bitrateSample, window time.Duration) ([]bitrateSample, uint32, bool) {
+	samples = append(samples, sample)
 
-		lastReceiverBytesSent[id] = stats.InboundRTPStreamStats.BytesReceived
+	// keep the newest sample that is at least the window old as the base of the measurement
+	for len(samples) > 2 && !samples[1].ts.After(sample.ts.Add(-window)) {
+		samples = samples[1:]
+	}
+
+	base := samples[0]
+	elapsed := sample.ts.Sub(base.ts)
+
+	if len(samples) < 2 || elapsed <= 0 {
+		return samples, 0, false
+	}
 
-		c.receiverBitrates[id] = uint32(delta) * 8
+	var delta uint64
+	if sample.bytes > base.bytes {
+		delta = sample.bytes - base.bytes
 	}
 
-	return lastReceiverBytesSent
+	return samples, uint32(delta * 8 * uint64(time.Second) / uint64(elapsed)), true
 }
 
 func (c *ClientStats) removeSenderStats(trackId string) {
@@ -160,6 +195,7 @@ func (c *ClientStats) GetSender(id string) (stats.Stats, error) {
 	return sender, nil
 }
 
+// GetSenderBitrate returns the bitrate in bits per second sent to the client for the track, measured over the SFU bitrate window
 func (c *ClientStats) GetSenderBitrate(id string) (uint32, error) {
 	c.senderMu.RLock()
 	defer c.senderMu.RUnlock()
@@ -191,6 +227,7 @@ func (c *ClientStats) Receivers() map[string]stats.Stats {
 	return stats
 }
 
+// GetReceiverBitrate returns the bitrate in bits per second received from the client for the track, measured over the SFU bitrate window
 func (c *ClientStats) GetReceiverBitrate(id, rid string) (uint32, error) {
 	c.receiverMu.RLock()
 	defer c.receiverMu.RUnlock()
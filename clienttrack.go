@@ -4,34 +4,63 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/inlivedev/sfu/pkg/packetmap"
+	"github.com/inlivedev/sfu/pkg/rtppool"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+	"golang.org/x/exp/slices"
 )
 
 type iClientTrack interface {
-	push(rtp *rtp.Packet, quality QualityLevel)
-	ID() string
-	StreamID() string
+	IClientTrack
+	// push forwards the packet to the subscriber. The packet header can be rewritten by the subscriber,
+	// but the payload is owned by the source packet that is shared by all subscribers and must not be modified.
+	push(rtp *rtp.Packet, source *rtppool.RetainablePacket, quality QualityLevel)
 	Context() context.Context
-	Kind() webrtc.RTPCodecType
-	MimeType() string
 	LocalTrack() *webrtc.TrackLocalStaticRTP
-	IsScreen() bool
-	IsSimulcast() bool
-	IsScaleable() bool
 	SetSourceType(TrackType)
-	Client() *Client
 	RequestPLI()
 	SetMaxQuality(quality QualityLevel)
-	MaxQuality() QualityLevel
-	ReceiveBitrate() uint32
-	SendBitrate() uint32
 	Quality() QualityLevel
+	TimeToFirstFrame() time.Duration
+	PacketsDropped() uint64
 	OnEnded(func())
 }
 
+// firstFrameMeter measures the duration from the track is subscribed until the first frame is forwarded to the subscriber.
+// For video the first frame is the first forwarded keyframe, because the subscriber can't render anything before it.
+type firstFrameMeter struct {
+	subscribedAt time.Time
+	latency      atomic.Int64
+}
+
+func newFirstFrameMeter() *firstFrameMeter {
+	return &firstFrameMeter{
+		subscribedAt: time.Now(),
+	}
+}
+
+func (m *firstFrameMeter) record(kind webrtc.RTPCodecType, mimeType string, p *rtp.Packet) {
+	if m.latency.Load() != 0 {
+		return
+	}
+
+	if kind == webrtc.RTPCodecTypeVideo && !IsKeyframe(mimeType, p) {
+		return
+	}
+
+	m.latency.CompareAndSwap(0, int64(time.Since(m.subscribedAt)))
+}
+
+// timeToFirstFrame returns 0 if the first frame is not forwarded yet
+func (m *firstFrameMeter) timeToFirstFrame() time.Duration {
+	return time.Duration(m.latency.Load())
+}
+
 type clientTrack struct {
 	id                    string
 	streamid              string
@@ -47,6 +76,12 @@ type clientTrack struct {
 	isScreen              bool
 	ssrc                  webrtc.SSRC
 	onTrackEndedCallbacks []func()
+	sender                *webrtc.RTPSender
+	// the subscriber negotiated AV1 dependency descriptor header extension ID, 0 if not known yet
+	dependencyDescriptorID *atomic.Uint32
+	firstFrame             *firstFrameMeter
+	writer                 *packetWriter
+	sequenceRewriter       *sequenceRewriter
 }
 
 func newClientTrack(c *Client, t ITrack, isScreen bool, localTrack *webrtc.TrackLocalStaticRTP) *clientTrack {
@@ -58,20 +93,24 @@ func newClientTrack(c *Client, t ITrack, isScreen bool, localTrack *webrtc.Track
 	}
 
 	ct := &clientTrack{
-		id:                    localTrack.ID(),
-		streamid:              localTrack.StreamID(),
-		context:               ctx,
-		mu:                    sync.RWMutex{},
-		client:                c,
-		kind:                  localTrack.Kind(),
-		mimeType:              localTrack.Codec().MimeType,
-		localTrack:            localTrack,
-		remoteTrack:           track.remoteTrack,
-		baseTrack:             track.base,
-		isScreen:              isScreen,
-		ssrc:                  track.remoteTrack.track.SSRC(),
-		onTrackEndedCallbacks: make([]func(), 0),
-		packetmap:             &packetmap.Map{},
+		id:                     localTrack.ID(),
+		streamid:               localTrack.StreamID(),
+		context:                ctx,
+		mu:                     sync.RWMutex{},
+		client:                 c,
+		kind:                   localTrack.Kind(),
+		mimeType:               localTrack.Codec().MimeType,
+		localTrack:             localTrack,
+		remoteTrack:            track.remoteTrack,
+		baseTrack:              track.base,
+		isScreen:               isScreen,
+		ssrc:                   track.remoteTrack.track.SSRC(),
+		onTrackEndedCallbacks:  make([]func(), 0),
+		packetmap:              &packetmap.Map{},
+		dependencyDescriptorID: &atomic.Uint32{},
+		firstFrame:             newFirstFrameMeter(),
+		writer:                 newPacketWriter(ctx, c.context, localTrack, track.base.pool, c.sfu.bandwidth, c.log),
+		sequenceRewriter:       newSequenceRewriter(track.base.codec.ClockRate),
 	}
 
 	t.OnEnded(func() {
@@ -129,11 +168,14 @@ func (t *clientTrack) MimeType() string {
 	return t.mimeType
 }
 
-func (t *clientTrack) push(p *rtp.Packet, _ QualityLevel) {
+func (t *clientTrack) push(p *rtp.Packet, source *rtppool.RetainablePacket, _ QualityLevel) {
 	if t.client.peerConnection.PC().ConnectionState() != webrtc.PeerConnectionStateConnected {
 		return
 	}
 
+	// keep the sequence numbers and the timestamps continuous when the publisher source restarts
+	t.sequenceRewriter.rewrite(p, time.Now())
+
 	ok, newseqno, _ := t.packetmap.Map(p.SequenceNumber, 0)
 	if !ok {
 		return
@@ -159,8 +201,72 @@ func (t *clientTrack) push(p *rtp.Packet, _ QualityLevel) {
 		}
 	}
 
-	if err := t.localTrack.WriteRTP(p); err != nil {
-		t.client.log.Errorf("clienttrack: error on write rtp", err)
+	if t.mimeType == webrtc.MimeTypeAV1 {
+		t.rewriteDependencyDescriptor(p)
+	}
+
+	if !t.writer.write(p, source) {
+		return
+	}
+
+	t.firstFrame.record(t.Kind(), t.mimeType, p)
+}
+
+// PacketsDropped returns the number of packets dropped because the subscriber can't keep up with the track
+func (t *clientTrack) PacketsDropped() uint64 {
+	return t.writer.Dropped()
+}
+
+// TimeToFirstFrame returns the duration from the track subscribed until the first frame forwarded, 0 if not forwarded yet
+func (t *clientTrack) TimeToFirstFrame() time.Duration {
+	return t.firstFrame.timeToFirstFrame()
+}
+
+func (t *clientTrack) setSender(sender *webrtc.RTPSender) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sender = sender
+}
+
+// updateDependencyDescriptorID stores the AV1 dependency descriptor header extension ID negotiated with the subscriber
+func (t *clientTrack) updateDependencyDescriptorID() {
+	t.mu.RLock()
+	sender := t.sender
+	t.mu.RUnlock()
+
+	if sender == nil {
+		return
+	}
+
+	t.dependencyDescriptorID.Store(uint32(getHeaderExtensionID(sender.GetParameters().HeaderExtensions, AV1DependencyDescriptorURI)))
+}
+
+// clientTrackOf returns the clientTrack of the client track types that are built on it, nil for the other types
+func clientTrackOf(track iClientTrack) *clientTrack {
+	switch ct := track.(type) {
+	case *clientTrack:
+		return ct
+	case *scaleableClientTrack:
+		return ct.clientTrack
+	}
+
+	return nil
+}
+
+// rewriteDependencyDescriptor maps the AV1 dependency descriptor header extension ID
+// from the publisher negotiated ID to the subscriber negotiated ID
+func (t *clientTrack) rewriteDependencyDescriptor(p *rtp.Packet) {
+	fromID := uint8(t.baseTrack.dependencyDescriptorID.Load())
+	if fromID == 0 {
+		return
+	}
+
+	// the extension is removed until the ID is negotiated with the subscriber
+	toID := uint8(t.dependencyDescriptorID.Load())
+
+	if err := rewriteHeaderExtensionID(p, fromID, toID); err != nil {
+		t.client.log.Errorf("clienttrack: error on rewrite dependency descriptor %s", err.Error())
 	}
 }
 
@@ -172,6 +278,10 @@ func (t *clientTrack) IsScreen() bool {
 	return t.isScreen
 }
 
+func (t *clientTrack) IsMuted() bool {
+	return t.baseTrack.muted.Load()
+}
+
 func (t *clientTrack) SetSourceType(sourceType TrackType) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -191,6 +301,24 @@ func (t *clientTrack) RequestPLI() {
 	t.remoteTrack.sendPLI()
 }
 
+// requestMaxBitrate sends RTCP REMB to the publisher to limit the track bitrate
+func (t *clientTrack) requestMaxBitrate(bitrate uint32) {
+	if t.remoteTrack.IsRelay() {
+		return
+	}
+
+	publisher := t.baseTrack.client
+	if publisher.peerConnection == nil || publisher.peerConnection.PC() == nil || publisher.peerConnection.PC().ConnectionState() != webrtc.PeerConnectionStateConnected {
+		return
+	}
+
+	if err := publisher.peerConnection.PC().WriteRTCP([]rtcp.Packet{
+		&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: float32(bitrate), SSRCs: []uint32{uint32(t.ssrc)}},
+	}); err != nil {
+		t.client.log.Errorf("clienttrack: error on write remb %s", err.Error())
+	}
+}
+
 func (t *clientTrack) SetMaxQuality(_ QualityLevel) {
 	// do nothing
 }
@@ -224,22 +352,16 @@ func (t *clientTrack) OnEnded(f func()) {
 
 func (t *clientTrack) onEnded() {
 	t.mu.RLock()
-	defer t.mu.RUnlock()
+	callbacks := slices.Clone(t.onTrackEndedCallbacks)
+	t.mu.RUnlock()
 
-	for _, f := range t.onTrackEndedCallbacks {
-		f()
+	for _, f := range callbacks {
+		callUserCallback(t.client.log, "OnTrackEnded", f)
 	}
 }
 
 func (t *clientTrack) getQuality() QualityLevel {
-	claim := t.client.bitrateController.GetClaim(t.ID())
-
-	if claim == nil {
-		t.client.log.Warnf("clienttrack: claim is nil")
-		return QualityNone
-	}
-
-	return min(t.MaxQuality(), claim.Quality(), Uint32ToQualityLevel(t.client.quality.Load()))
+	return min(t.MaxQuality(), t.client.getBitrateController().GetQuality(t), Uint32ToQualityLevel(t.client.quality.Load()))
 }
 
 func qualityLevelToPreset(lvl QualityLevel) (qualityPreset QualityPreset) {
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 
+	"github.com/inlivedev/sfu/pkg/rtppool"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
@@ -25,36 +26,34 @@ func newClientTrackRed(t *clientTrackAudio) *clientTrackRed {
 	return ct
 }
 
-func (t *clientTrackRed) push(p *rtp.Packet, _ QualityLevel) {
+func (t *clientTrackRed) push(p *rtp.Packet, source *rtppool.RetainablePacket, _ QualityLevel) {
 	if t.client.peerConnection.PC().ConnectionState() != webrtc.PeerConnectionStateConnected {
 		return
 	}
 
-	if !t.client.receiveRED {
+	if !t.client.receiveRED.Load() {
+		// the client doesn't negotiate RED, send the primary Opus encoding only
+		payload, err := extractPrimaryEncodingForRED(p.Payload)
+		if err != nil {
+			// the RED payload can't be sent as Opus, the packet is dropped like a lost packet
+			t.client.log.Tracef("clienttrack: error on extract primary encoding for red %s", err.Error())
+			return
+		}
+
 		primaryPacket := t.remoteTrack.rtppool.GetPacket()
-		primaryPacket.Payload = t.getPrimaryEncoding(p.Payload[:len(p.Payload)])
+		primaryPacket.Payload = payload
 		primaryPacket.Header = p.Header
-		if err := t.localTrack.WriteRTP(primaryPacket); err != nil {
-			t.client.log.Tracef("clienttrack: error on write primary rtp %s", err.Error())
+		if t.writer.write(primaryPacket, source) {
+			t.firstFrame.record(t.Kind(), t.mimeType, primaryPacket)
 		}
 		t.remoteTrack.rtppool.PutPacket(primaryPacket)
 	} else {
-		if err := t.localTrack.WriteRTP(p); err != nil {
-			t.client.log.Tracef("clienttrack: error on write rtp %s", err.Error())
+		if t.writer.write(p, source) {
+			t.firstFrame.record(t.Kind(), t.mimeType, p)
 		}
 	}
 }
 
-func (t *clientTrackRed) getPrimaryEncoding(payload []byte) []byte {
-	primaryPayload, err := extractPrimaryEncodingForRED(payload)
-	if err != nil {
-		t.client.log.Tracef("clienttrack: error on extract primary encoding for red %s", err.Error())
-		return payload
-	}
-
-	return primaryPayload
-}
-
 // // Credit to Livekit
 // // https://github.com/livekit/livekit/blob/56dd39968408f0973374e5b336a28606a1da79d2/pkg/sfu/redprimaryreceiver.go#L267
 func extractPrimaryEncodingForRED(payload []byte) ([]byte, error) {
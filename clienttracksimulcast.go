@@ -4,10 +4,13 @@ import (
 	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/inlivedev/sfu/pkg/packetmap"
+	"github.com/inlivedev/sfu/pkg/rtppool"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+	"golang.org/x/exp/slices"
 )
 
 type simulcastClientTrack struct {
@@ -26,13 +29,18 @@ type simulcastClientTrack struct {
 	lastQuality             *atomic.Uint32
 	paddingTS               *atomic.Uint32
 	maxQuality              *atomic.Uint32
+	fallbackQuality         *atomic.Uint32
 	lastTimestamp           *atomic.Uint32
 	isScreen                *atomic.Bool
 	isEnded                 *atomic.Bool
+	isPaused                *atomic.Bool
 	packetmapHigh           *packetmap.Map
 	packetmapMid            *packetmap.Map
 	packetmapLow            *packetmap.Map
 	onTrackEndedCallbacks   []func()
+	firstFrame              *firstFrameMeter
+	writer                  *packetWriter
+	timestamps              *timestampRewriter
 }
 
 func newSimulcastClientTrack(c *Client, t *SimulcastTrack) *simulcastClientTrack {
@@ -67,14 +75,19 @@ func newSimulcastClientTrack(c *Client, t *SimulcastTrack) *simulcastClientTrack
 		lastQuality:             lastQuality,
 		paddingTS:               &atomic.Uint32{},
 		maxQuality:              &atomic.Uint32{},
+		fallbackQuality:         &atomic.Uint32{},
 		lastBlankSequenceNumber: &atomic.Uint32{},
 		lastTimestamp:           lastTimestamp,
 		isScreen:                isScreen,
 		isEnded:                 &atomic.Bool{},
+		isPaused:                &atomic.Bool{},
 		onTrackEndedCallbacks:   make([]func(), 0),
 		packetmapHigh:           &packetmap.Map{},
 		packetmapMid:            &packetmap.Map{},
 		packetmapLow:            &packetmap.Map{},
+		firstFrame:              newFirstFrameMeter(),
+		writer:                  newPacketWriter(ctx, c.context, track, t.base.pool, c.sfu.bandwidth, c.log),
+		timestamps:              newTimestampRewriter(t.base.codec.ClockRate),
 	}
 
 	ct.SetMaxQuality(QualityHigh)
@@ -105,40 +118,67 @@ func (t *simulcastClientTrack) isFirstKeyframePacket(p *rtp.Packet) bool {
 	return isKeyframe && t.lastTimestamp.Load() != p.Timestamp
 }
 
-func (t *simulcastClientTrack) send(p *rtp.Packet, quality QualityLevel) {
+func (t *simulcastClientTrack) send(p *rtp.Packet, source *rtppool.RetainablePacket, quality QualityLevel) {
 	t.lastTimestamp.Store(p.Timestamp)
 
 	t.rewritePacket(p, quality)
 
 	// t.client.log.Infof("track: ", t.id, " send packet with quality ", quality, " and sequence number ", p.SequenceNumber)
 
-	t.writeRTP(p)
+	t.writeRTP(p, source)
 }
 
-func (t *simulcastClientTrack) writeRTP(p *rtp.Packet) {
-	if err := t.localTrack.WriteRTP(p); err != nil {
-		t.client.log.Errorf("track: error on write rtp", err)
+func (t *simulcastClientTrack) writeRTP(p *rtp.Packet, source *rtppool.RetainablePacket) {
+	if !t.writer.write(p, source) {
+		return
 	}
+
+	t.firstFrame.record(t.kind, t.mimeType, p)
+}
+
+// PacketsDropped returns the number of packets dropped because the subscriber can't keep up with the track
+func (t *simulcastClientTrack) PacketsDropped() uint64 {
+	return t.writer.Dropped()
 }
 
-func (t *simulcastClientTrack) push(p *rtp.Packet, quality QualityLevel) {
+// TimeToFirstFrame returns the duration from the track subscribed until the first keyframe forwarded, 0 if not forwarded yet
+func (t *simulcastClientTrack) TimeToFirstFrame() time.Duration {
+	return t.firstFrame.timeToFirstFrame()
+}
+
+func (t *simulcastClientTrack) push(p *rtp.Packet, source *rtppool.RetainablePacket, quality QualityLevel) {
 	isKeyframe := IsKeyframe(t.mimeType, p)
 
 	currentQuality := t.LastQuality()
 
 	targetQuality := t.getQuality()
 
-	if targetQuality == QualityNone {
-		// TODO: figure out what to do if the target quality is none
-		// probably we should send a blank frame
-		targetQuality = QualityLow
-	}
-
 	if !t.client.bitrateController.Exist(t.ID()) {
 		// do nothing if the bitrate claim is not exist
 		return
 	}
 
+	if targetQuality == QualityNone {
+		// the track is paused because the bandwidth can't fit the lowest layer or the video is not displayed,
+		// drop the packet so the sequence numbers stay continuous when the track is resumed
+		t.pause()
+
+		switch quality {
+		case QualityHigh:
+			t.packetmapHigh.Drop(p.SequenceNumber, 0)
+		case QualityMid:
+			t.packetmapMid.Drop(p.SequenceNumber, 0)
+		case QualityLow:
+			t.packetmapLow.Drop(p.SequenceNumber, 0)
+		}
+
+		return
+	}
+
+	if t.isPaused.Load() {
+		t.resume()
+	}
+
 	var canSwitch bool
 
 	if isKeyframe && quality == targetQuality && currentQuality != targetQuality {
@@ -179,24 +219,18 @@ func (t *simulcastClientTrack) push(p *rtp.Packet, quality QualityLevel) {
 
 	// check if it's a first packet to send
 	if currentQuality == QualityNone && t.sequenceNumber.Load() == 0 {
-		// we try to send the low quality first	if the track is active and fallback to upper quality if not
-		if t.remoteTrack.getRemoteTrack(QualityLow) != nil && quality == QualityLow {
-			t.lastQuality.Store(uint32(QualityLow))
-			// send PLI to make sure the client will receive the first frame
-			t.remoteTrack.sendPLI()
-		} else if t.remoteTrack.getRemoteTrack(QualityMid) != nil && quality == QualityMid {
-			t.lastQuality.Store(uint32(QualityMid))
-			// send PLI to make sure the client will receive the first frame
-			t.remoteTrack.sendPLI()
-		} else if t.remoteTrack.getRemoteTrack(QualityHigh) != nil && quality == QualityHigh {
-			t.lastQuality.Store(uint32(QualityHigh))
+		// start forwarding from the first keyframe of any layer, the subscriber can't decode the packets before it
+		if isKeyframe {
+			currentQuality = quality
+			t.lastQuality.Store(uint32(quality))
+
+			t.remoteTrack.onRemoteTrackAdded(func(remote *remoteTrack) {
+				t.remoteTrack.sendPLI()
+			})
+		} else {
 			// send PLI to make sure the client will receive the first frame
 			t.remoteTrack.sendPLI()
 		}
-
-		t.remoteTrack.onRemoteTrackAdded(func(remote *remoteTrack) {
-			t.remoteTrack.sendPLI()
-		})
 	} else if isKeyframe && canSwitch && quality == targetQuality && t.lastQuality.Load() != uint32(targetQuality) {
 		// change quality to target quality if it's a keyframe
 		t.client.log.Tracef("track: %s keyframe %v change quality from %d to %d ", t.id, isKeyframe, t.lastQuality.Load(), targetQuality)
@@ -206,35 +240,56 @@ func (t *simulcastClientTrack) push(p *rtp.Packet, quality QualityLevel) {
 	} else if quality == targetQuality && !isKeyframe && t.lastQuality.Load() != uint32(targetQuality) {
 		// request PLI to allow us switch quality to target quality
 		t.client.log.Tracef("track: %s keyframe %v send keyframe and sequence number %d and can switch %v ", t.id, isKeyframe, p.SequenceNumber, canSwitch)
-		t.remoteTrack.sendPLI()
+		t.remoteTrack.sendLayerPLI(targetQuality)
 	}
 
 	if currentQuality == quality {
-		t.send(p, quality)
+		t.send(p, source, quality)
+	}
+}
+
+// pause stops forwarding the track until it's resumed
+func (t *simulcastClientTrack) pause() {
+	if !t.isPaused.CompareAndSwap(false, true) {
+		return
 	}
+
+	// the track will be resumed from a keyframe like switching to a new layer
+	t.lastQuality.Store(uint32(QualityNone))
+
+	t.client.log.Infof("clienttrack: track %s is paused", t.id)
+	t.client.onTrackPauseChanged(t.id, true)
+}
+
+// resume requests a keyframe to resume forwarding the paused track
+func (t *simulcastClientTrack) resume() {
+	if !t.isPaused.CompareAndSwap(true, false) {
+		return
+	}
+
+	t.remoteTrack.sendPLI()
+
+	t.client.log.Infof("clienttrack: track %s is resumed", t.id)
+	t.client.onTrackPauseChanged(t.id, false)
+}
+
+// IsPaused returns true if the track is not forwarded because the bandwidth is too low or the video is not displayed
+func (t *simulcastClientTrack) IsPaused() bool {
+	return t.isPaused.Load()
 }
 
+// GetRemoteTrack returns the remote track of the last forwarded quality,
+// or the highest active layer if the last forwarded layer is no longer sent by the publisher.
 func (t *simulcastClientTrack) GetRemoteTrack() *remoteTrack {
 	lastQuality := Uint32ToQualityLevel(t.lastQuality.Load())
-	// lastQuality := t.lastQuality
-	switch lastQuality {
-	case QualityHigh:
-		return t.remoteTrack.remoteTrackHigh
-	case QualityMid:
-		return t.remoteTrack.remoteTrackMid
-	case QualityLow:
-		return t.remoteTrack.remoteTrackLow
-	default:
-		if t.remoteTrack.isTrackActive(QualityHigh) {
-			return t.remoteTrack.remoteTrackHigh
-		}
 
-		if t.remoteTrack.isTrackActive(QualityMid) {
-			return t.remoteTrack.remoteTrackMid
-		}
+	if lastQuality != QualityNone && t.remoteTrack.isTrackActive(lastQuality) {
+		return t.remoteTrack.getRemoteTrack(lastQuality)
+	}
 
-		if t.remoteTrack.isTrackActive(QualityLow) {
-			return t.remoteTrack.remoteTrackLow
+	for _, quality := range []QualityLevel{QualityHigh, QualityMid, QualityLow} {
+		if t.remoteTrack.isTrackActive(quality) {
+			return t.remoteTrack.getRemoteTrack(quality)
 		}
 	}
 
@@ -261,6 +316,10 @@ func (t *simulcastClientTrack) IsScreen() bool {
 	return t.isScreen.Load()
 }
 
+func (t *simulcastClientTrack) IsMuted() bool {
+	return t.baseTrack.muted.Load()
+}
+
 func (t *simulcastClientTrack) SetSourceType(sourceType TrackType) {
 	t.isScreen.Store(sourceType == TrackTypeScreen)
 }
@@ -277,18 +336,18 @@ func (t *simulcastClientTrack) OnEnded(callback func()) {
 }
 
 func (t *simulcastClientTrack) onEnded() {
-	if t.isEnded.Load() {
+	if !t.isEnded.CompareAndSwap(false, true) {
 		return
 	}
 
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	// the callbacks are called without the lock because they read the client track
+	t.mu.RLock()
+	callbacks := slices.Clone(t.onTrackEndedCallbacks)
+	t.mu.RUnlock()
 
-	for _, callback := range t.onTrackEndedCallbacks {
-		callback()
+	for _, callback := range callbacks {
+		callUserCallback(t.client.log, "OnEnded", callback)
 	}
-
-	t.isEnded.Store(true)
 }
 
 func (t *simulcastClientTrack) SetMaxQuality(quality QualityLevel) {
@@ -303,8 +362,9 @@ func (t *simulcastClientTrack) SetMaxQuality(quality QualityLevel) {
 	t.remoteTrack.sendPLI()
 }
 
+// MaxQuality returns the max quality set by the remote viewed size, capped by the max quality that the client can decode
 func (t *simulcastClientTrack) MaxQuality() QualityLevel {
-	return Uint32ToQualityLevel(t.maxQuality.Load())
+	return min(Uint32ToQualityLevel(t.maxQuality.Load()), t.client.maxDecodeQuality(t.mimeType))
 }
 
 func (t *simulcastClientTrack) IsSimulcast() bool {
@@ -323,16 +383,15 @@ func (t *simulcastClientTrack) rewritePacket(p *rtp.Packet, quality QualityLevel
 	// credit to https://github.com/k0nserv for helping me with this on Pion Slack channel
 	switch quality {
 	case QualityHigh:
-		p.Timestamp = t.remoteTrack.baseTS + ((p.Timestamp - t.remoteTrack.remoteTrackHighBaseTS) - t.remoteTrack.remoteTrackHighBaseTS)
 		sequenceDelta = t.remoteTrack.highSequence - t.remoteTrack.lastHighSequence
 	case QualityMid:
-		p.Timestamp = t.remoteTrack.baseTS + ((p.Timestamp - t.remoteTrack.remoteTrackMidBaseTS) - t.remoteTrack.remoteTrackMidBaseTS)
 		sequenceDelta = t.remoteTrack.midSequence - t.remoteTrack.lastMidSequence
 	case QualityLow:
-		p.Timestamp = t.remoteTrack.baseTS + ((p.Timestamp - t.remoteTrack.remoteTrackLowBaseTS) - t.remoteTrack.remoteTrackLowBaseTS)
 		sequenceDelta = t.remoteTrack.lowSequence - t.remoteTrack.lastLowSequence
 	}
 
+	t.timestamps.rewrite(p, quality, time.Now())
+
 	t.sequenceNumber.Add(uint32(sequenceDelta))
 	p.SequenceNumber = uint16(t.sequenceNumber.Load())
 }
@@ -344,29 +403,42 @@ func (t *simulcastClientTrack) RequestPLI() {
 func (t *simulcastClientTrack) getQuality() QualityLevel {
 	track := t.remoteTrack
 
-	claim := t.Client().bitrateController.GetClaim(t.ID())
+	quality := min(t.Client().getBitrateController().GetQuality(t), t.MaxQuality(), Uint32ToQualityLevel(t.client.quality.Load()), t.client.sfu.maxSimulcastQuality())
+
+	// never fall back to the quality that the client can't decode
+	decodeQuality := t.client.maxDecodeQuality(t.mimeType)
 
-	if claim == nil {
-		return QualityNone
+	if quality == QualityNone || track.isTrackActive(quality) {
+		t.fallbackQuality.Store(uint32(QualityNone))
+		return quality
 	}
 
-	quality := min(claim.Quality(), t.MaxQuality(), Uint32ToQualityLevel(t.client.quality.Load()))
+	fallback := quality
 
-	if quality != QualityNone && !track.isTrackActive(quality) {
-		if quality != QualityLow && track.isTrackActive(QualityLow) {
-			return QualityLow
+	// prefer the highest active layer below the requested quality
+	for _, candidate := range []QualityLevel{QualityMid, QualityLow} {
+		if candidate < quality && track.isTrackActive(candidate) {
+			fallback = candidate
+			break
 		}
+	}
 
-		if quality != QualityMid && track.isTrackActive(QualityMid) {
-			return QualityMid
+	// otherwise use the lowest active layer above it
+	if fallback == quality {
+		for _, candidate := range []QualityLevel{QualityMid, QualityHigh} {
+			if candidate > quality && candidate <= decodeQuality && track.isTrackActive(candidate) {
+				fallback = candidate
+				break
+			}
 		}
+	}
 
-		if quality != QualityHigh && track.isTrackActive(QualityHigh) {
-			return QualityHigh
-		}
+	if fallback != quality && t.fallbackQuality.Swap(uint32(fallback)) != uint32(fallback) {
+		t.client.log.Infof("clienttrack: track %s quality %d is not active, fallback to quality %d", t.id, quality, fallback)
+		t.client.onQualityChanged(t.id, quality, fallback)
 	}
 
-	return quality
+	return fallback
 }
 
 func (t *simulcastClientTrack) ReceiveBitrate() uint32 {
@@ -1,6 +1,7 @@
 package sfu
 
 import (
+	"github.com/inlivedev/sfu/pkg/rtppool"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 )
@@ -135,17 +136,10 @@ func (t *scaleableClientTrack) isKeyframe(vp9 *codecs.VP9Packet) bool {
 }
 
 func (t *scaleableClientTrack) getQuality() QualityLevel {
-	claim := t.client.bitrateController.GetClaim(t.ID())
-
-	if claim == nil {
-		t.client.log.Warnf("scalabletrack: claim is nil")
-		return QualityNone
-	}
-
-	return min(t.MaxQuality(), claim.Quality(), Uint32ToQualityLevel(t.client.quality.Load()))
+	return min(t.MaxQuality(), t.client.getBitrateController().GetQuality(t), Uint32ToQualityLevel(t.client.quality.Load()))
 }
 
-func (t *scaleableClientTrack) push(p *rtp.Packet, _ QualityLevel) {
+func (t *scaleableClientTrack) push(p *rtp.Packet, source *rtppool.RetainablePacket, _ QualityLevel) {
 
 	vp9Packet := &codecs.VP9Packet{}
 	if _, err := vp9Packet.Unmarshal(p.Payload); err != nil {
@@ -226,7 +220,7 @@ func (t *scaleableClientTrack) push(p *rtp.Packet, _ QualityLevel) {
 
 	marker := (p.Payload[1] & 0x80) != 0
 	if marker && newseqno == p.SequenceNumber && piddelta == 0 {
-		t.send(p)
+		t.send(p, source)
 		return
 	}
 
@@ -247,18 +241,20 @@ func (t *scaleableClientTrack) push(p *rtp.Packet, _ QualityLevel) {
 		p.Payload = p.Payload[:0]
 	}
 
-	t.send(p)
+	t.send(p, source)
 }
 
-func (t *scaleableClientTrack) send(p *rtp.Packet) {
+func (t *scaleableClientTrack) send(p *rtp.Packet, source *rtppool.RetainablePacket) {
 	t.mu.Lock()
 	t.lastTimestamp = p.Timestamp
 	t.mu.Unlock()
 
-	if err := t.localTrack.WriteRTP(p); err != nil {
-		t.client.log.Errorf("scaleabletrack: error on write rtp", err)
+	if !t.writer.write(p, source) {
+		return
 	}
 
+	t.firstFrame.record(t.Kind(), t.mimeType, p)
+
 }
 
 func (t *scaleableClientTrack) SetSourceType(sourceType TrackType) {
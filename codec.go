@@ -2,7 +2,7 @@ package sfu
 
 import (
 	"encoding/binary"
-	"log"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +13,9 @@ import (
 	"golang.org/x/exp/slices"
 )
 
+// DefaultOpusFmtpLine is the fmtp line of the Opus codec if it's not configured with RoomOptions.OpusFmtpLine
+const DefaultOpusFmtpLine = "minptime=10;useinbandfec=1"
+
 var (
 	videoRTCPFeedback = []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
 
@@ -102,6 +105,10 @@ var (
 			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: videoRTCPFeedback},
 			PayloadType:        45,
 		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=45", nil},
+			PayloadType:        46,
+		},
 	}
 
 	audioCodecs = []webrtc.RTPCodecParameters{
@@ -110,7 +117,7 @@ var (
 			PayloadType:        63,
 		},
 		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeOpus, 48000, 2, "minptime=10;useinbandfec=1", nil},
+			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeOpus, 48000, 2, DefaultOpusFmtpLine, nil},
 			PayloadType:        111,
 		},
 	}
@@ -144,10 +151,19 @@ var (
 )
 
 func RegisterCodecs(m *webrtc.MediaEngine, codecs []string) error {
+	return registerCodecs(m, codecs, DefaultOpusFmtpLine)
+}
+
+// registerCodecs registers the codecs with the Opus codec negotiated with the fmtp line
+func registerCodecs(m *webrtc.MediaEngine, codecs []string, opusFmtpLine string) error {
 	errors := []error{}
 
 	for _, codec := range audioCodecs {
 		if slices.Contains(codecs, codec.MimeType) {
+			if codec.MimeType == webrtc.MimeTypeOpus && opusFmtpLine != "" {
+				codec.SDPFmtpLine = opusFmtpLine
+			}
+
 			if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
 				errors = append(errors, err)
 			}
@@ -157,6 +173,10 @@ func RegisterCodecs(m *webrtc.MediaEngine, codecs []string) error {
 	registeredVideoCodecs := make([]webrtc.RTPCodecParameters, 0)
 
 	for _, codec := range videoCodecs {
+		// the RTX codecs are registered below for the registered codecs only
+		if codec.MimeType == webrtc.MimeTypeRTX {
+			continue
+		}
 
 		if slices.Contains(codecs, codec.MimeType) {
 			if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
@@ -167,16 +187,115 @@ func RegisterCodecs(m *webrtc.MediaEngine, codecs []string) error {
 		}
 	}
 
-	for _, codec := range registeredVideoCodecs {
+	for _, codec := range rtxCodecs(registeredVideoCodecs) {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	return FlattenErrors(errors)
+}
+
+// rtxCodecs returns the RTX codecs that are associated with the payload types of the video codecs,
+// so the retransmissions of the negotiated codecs are sent and received on their own RTX stream
+func rtxCodecs(codecs []webrtc.RTPCodecParameters) []webrtc.RTPCodecParameters {
+	rtx := make([]webrtc.RTPCodecParameters, 0, len(codecs))
+
+	for _, codec := range codecs {
 		for _, videoCodec := range videoCodecs {
-			if videoCodec.RTPCodecCapability.MimeType == "video/rtx" && videoCodec.RTPCodecCapability.SDPFmtpLine == "apt="+string(codec.PayloadType) {
-				if err := m.RegisterCodec(videoCodec, webrtc.RTPCodecTypeVideo); err != nil {
-					errors = append(errors, err)
-				}
+			if videoCodec.MimeType == webrtc.MimeTypeRTX && videoCodec.SDPFmtpLine == "apt="+strconv.Itoa(int(codec.PayloadType)) {
+				rtx = append(rtx, videoCodec)
 			}
 		}
 	}
-	return FlattenErrors(errors)
+
+	return rtx
+}
+
+// codecParameters returns the codecs of the kind that are registered by registerCodecs with the same codecs and fmtp line
+func codecParameters(kind webrtc.RTPCodecType, codecs []string, opusFmtpLine string) []webrtc.RTPCodecParameters {
+	source := videoCodecs
+	if kind == webrtc.RTPCodecTypeAudio {
+		source = audioCodecs
+	}
+
+	parameters := make([]webrtc.RTPCodecParameters, 0, len(source))
+
+	for _, codec := range source {
+		if !slices.Contains(codecs, codec.MimeType) || codec.MimeType == webrtc.MimeTypeRTX {
+			continue
+		}
+
+		if codec.MimeType == webrtc.MimeTypeOpus && opusFmtpLine != "" {
+			codec.SDPFmtpLine = opusFmtpLine
+		}
+
+		parameters = append(parameters, codec)
+	}
+
+	if kind == webrtc.RTPCodecTypeVideo {
+		parameters = append(parameters, rtxCodecs(parameters)...)
+	}
+
+	return parameters
+}
+
+// sortCodecsByPreference sorts the codecs by the order of the mime types in the preferences.
+// The codecs not in the preferences are kept after the preferred codecs in their original order.
+func sortCodecsByPreference(codecs []webrtc.RTPCodecParameters, preferences []string) []webrtc.RTPCodecParameters {
+	rank := func(codec webrtc.RTPCodecParameters) int {
+		for i, mimeType := range preferences {
+			if strings.EqualFold(mimeType, codec.MimeType) {
+				return i
+			}
+		}
+
+		return len(preferences)
+	}
+
+	sorted := slices.Clone(codecs)
+	slices.SortStableFunc(sorted, func(a, b webrtc.RTPCodecParameters) int {
+		return rank(a) - rank(b)
+	})
+
+	return sorted
+}
+
+// validateFmtpLine returns ErrInvalidFmtpLine if the fmtp line is not in the key=value;key=value format,
+// to make sure it's not breaking the SDP when it's added to the a=fmtp attribute
+func validateFmtpLine(fmtpLine string) error {
+	for _, param := range strings.Split(fmtpLine, ";") {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok || key == "" || value == "" {
+			return ErrInvalidFmtpLine
+		}
+
+		for _, r := range key {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return ErrInvalidFmtpLine
+			}
+		}
+
+		// the value can't have whitespaces or line breaks that end the fmtp attribute
+		if strings.ContainsFunc(value, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+			return ErrInvalidFmtpLine
+		}
+	}
+
+	return nil
+}
+
+// audioCodecsOnly returns the audio codecs from the codec mime types
+func audioCodecsOnly(codecs []string) []string {
+	filtered := make([]string, 0, len(codecs))
+
+	for _, codec := range codecs {
+		if strings.HasPrefix(strings.ToLower(codec), "audio/") {
+			filtered = append(filtered, codec)
+		}
+	}
+
+	return filtered
 }
 
 func RegisterDefaultCodecs(m *webrtc.MediaEngine) error {
@@ -268,7 +387,6 @@ func SendMediaSamples(p rtp.Packetizer, sequencer rtp.Sequencer, localRTP *webrt
 
 	for _, p := range packets {
 		if err := localRTP.WriteRTP(p); err != nil {
-			log.Println("send packet size: ", len(p.Payload))
 			writeErrs = append(writeErrs, err)
 		}
 		<-ticker.C
@@ -324,3 +442,133 @@ func getCodecCapability(mimeType string) webrtc.RTPCodecCapability {
 
 	return webrtc.RTPCodecCapability{}
 }
+
+// the max frame size in macroblocks for each H264 level_idc, based on the table A-1 of the H264 spec
+var h264LevelMaxFrameSizes = map[uint64]uint32{
+	10: 99,
+	11: 396,
+	12: 396,
+	13: 396,
+	20: 396,
+	21: 792,
+	22: 1620,
+	30: 1620,
+	31: 3600,
+	32: 5120,
+	40: 8192,
+	41: 8192,
+	42: 8704,
+	50: 22080,
+	51: 36864,
+	52: 36864,
+	60: 139264,
+	61: 139264,
+	62: 139264,
+}
+
+// supportsRED returns true if the remote endpoint negotiates the Opus RED codec in an audio media section of the SDP,
+// the RED packets are forwarded as is to the endpoint, otherwise the primary Opus packets are extracted.
+func supportsRED(sdp webrtc.SessionDescription) (bool, error) {
+	parsed, err := sdp.Unmarshal()
+	if err != nil {
+		return false, err
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "audio" {
+			continue
+		}
+
+		for _, attr := range media.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+
+			_, codec, ok := strings.Cut(attr.Value, " ")
+			if ok && strings.HasPrefix(strings.ToLower(codec), "red/") {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// maxDecodePixels returns the max frame size in pixels that the remote endpoint can decode for each video codec mime type in lower case.
+// The frame size is taken from the H264 profile-level-id and the max-fs fmtp parameters of the SDP.
+// The codec is not included if one of its payload types doesn't have the parameters, means there is no limit for the codec.
+func maxDecodePixels(sdp webrtc.SessionDescription) (map[string]uint32, error) {
+	parsed, err := sdp.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	limits := make(map[string]uint32)
+	unlimited := make(map[string]bool)
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != webrtc.RTPCodecTypeVideo.String() {
+			continue
+		}
+
+		mimeTypes := make(map[string]string)
+		fmtps := make(map[string]string)
+
+		for _, attr := range media.Attributes {
+			// a=rtpmap:<payload type> <encoding name>/<clock rate>
+			// a=fmtp:<payload type> <parameters>
+			payloadType, value, found := strings.Cut(attr.Value, " ")
+			if !found {
+				continue
+			}
+
+			switch attr.Key {
+			case "rtpmap":
+				name, _, _ := strings.Cut(value, "/")
+				mimeTypes[payloadType] = strings.ToLower("video/" + name)
+			case "fmtp":
+				fmtps[payloadType] = value
+			}
+		}
+
+		for payloadType, mimeType := range mimeTypes {
+			frameSize := fmtpMaxFrameSize(mimeType, fmtps[payloadType])
+			if frameSize == 0 {
+				unlimited[mimeType] = true
+				continue
+			}
+
+			// the remote endpoint can pick any of the payload types, so take the highest one
+			limits[mimeType] = max(limits[mimeType], frameSize*256)
+		}
+	}
+
+	for mimeType := range unlimited {
+		delete(limits, mimeType)
+	}
+
+	return limits, nil
+}
+
+// fmtpMaxFrameSize returns the max frame size in macroblocks from the fmtp parameters, 0 if not limited
+func fmtpMaxFrameSize(mimeType, fmtp string) uint32 {
+	frameSize := uint32(0)
+
+	for _, param := range strings.Split(fmtp, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+
+		switch {
+		case key == "max-fs":
+			if maxFS, err := strconv.ParseUint(value, 10, 32); err == nil {
+				frameSize = max(frameSize, uint32(maxFS))
+			}
+		case key == "profile-level-id" && mimeType == strings.ToLower(webrtc.MimeTypeH264) && len(value) == 6:
+			// the last byte of the profile-level-id is the level_idc
+			if level, err := strconv.ParseUint(value[4:], 16, 8); err == nil {
+				frameSize = max(frameSize, h264LevelMaxFrameSizes[level])
+			}
+		}
+	}
+
+	return frameSize
+}
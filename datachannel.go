@@ -10,13 +10,26 @@ import (
 )
 
 var (
-	ErrDataChannelExists = errors.New("error: data channel already exists")
+	ErrDataChannelExists        = errors.New("error: data channel already exists")
+	ErrDataChannelReservedLabel = errors.New("error: data channel label is reserved")
+	ErrDataChannelReliability   = errors.New("error: data channel can't have both max retransmits and max packet lifetime")
 )
 
+// the label of the internal data channel used to exchange the stats and voice activity messages with the client
+const internalDataChannelLabel = "internal"
+
+// IsReservedDataChannelLabel returns true if the label is used by the SFU internal data channels.
+// The reserved labels can't be used to create a data channel and are not surfaced through Client.OnDataChannel.
+func IsReservedDataChannelLabel(label string) bool {
+	return label == internalDataChannelLabel || label == metadataDataChannelLabel
+}
+
 type SFUDataChannel struct {
-	label     string
-	clientIDs []string
-	isOrdered bool
+	label             string
+	clientIDs         []string
+	isOrdered         bool
+	maxRetransmits    *uint16
+	maxPacketLifeTime *uint16
 }
 
 type SFUDataChannelList struct {
@@ -27,6 +40,11 @@ type SFUDataChannelList struct {
 type DataChannelOptions struct {
 	Ordered   bool
 	ClientIDs []string // empty means all clients
+	// MaxRetransmits limits the number of retransmissions of an unacknowledged message, nil means unlimited.
+	// Only one of MaxRetransmits or MaxPacketLifeTime can be set, none of them means a reliable data channel.
+	MaxRetransmits *uint16
+	// MaxPacketLifeTime limits the time in milliseconds an unacknowledged message is retransmitted, nil means unlimited.
+	MaxPacketLifeTime *uint16
 }
 
 type Data struct {
@@ -43,9 +61,11 @@ type DataChannelList struct {
 
 func NewSFUDataChannel(label string, opts DataChannelOptions) *SFUDataChannel {
 	return &SFUDataChannel{
-		label:     label,
-		clientIDs: opts.ClientIDs,
-		isOrdered: opts.Ordered,
+		label:             label,
+		clientIDs:         opts.ClientIDs,
+		isOrdered:         opts.Ordered,
+		maxRetransmits:    opts.MaxRetransmits,
+		maxPacketLifeTime: opts.MaxPacketLifeTime,
 	}
 }
 
@@ -57,6 +77,24 @@ func (s *SFUDataChannel) IsOrdered() bool {
 	return s.isOrdered
 }
 
+func (s *SFUDataChannel) MaxRetransmits() *uint16 {
+	return s.maxRetransmits
+}
+
+func (s *SFUDataChannel) MaxPacketLifeTime() *uint16 {
+	return s.maxPacketLifeTime
+}
+
+func (s *SFUDataChannel) initOptions() *webrtc.DataChannelInit {
+	ordered := s.isOrdered
+
+	return &webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxRetransmits:    s.maxRetransmits,
+		MaxPacketLifeTime: s.maxPacketLifeTime,
+	}
+}
+
 func NewSFUDataChannelList() *SFUDataChannelList {
 	return &SFUDataChannelList{
 		dataChannels: make(map[string]*SFUDataChannel),
@@ -134,6 +172,22 @@ func (d *DataChannelList) Get(label string) *webrtc.DataChannel {
 	return dc
 }
 
+// BufferedAmount returns the total bytes queued to be sent on the open data channels
+func (d *DataChannelList) BufferedAmount() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	total := uint64(0)
+
+	for _, dc := range d.dataChannels {
+		if dc.ReadyState() == webrtc.DataChannelStateOpen {
+			total += dc.BufferedAmount()
+		}
+	}
+
+	return total
+}
+
 func (d *DataChannelList) Clear() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
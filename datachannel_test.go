@@ -2,6 +2,7 @@ package sfu
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -292,3 +293,227 @@ Loop:
 func TestStillUsableAfterReconnect(t *testing.T) {
 
 }
+
+func TestRoomBroadcastMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	roomOpts.BroadcastMetadata = true
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-broadcast-metadata", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	openChan := make(chan bool, 2)
+	messageChan := make(chan MetadataChangedMessage, 2)
+
+	var onDataChannel = func(d *webrtc.DataChannel) {
+		if d.Label() != metadataDataChannelLabel {
+			return
+		}
+
+		d.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var message MetadataChangedMessage
+			require.NoError(t, json.Unmarshal(msg.Data, &message))
+			messageChan <- message
+		})
+
+		d.OnOpen(func() {
+			openChan <- true
+		})
+	}
+
+	pc1, client1, _, connChan1 := CreateDataPair(ctx, TestLogger, testRoom, roomManager.options.IceServers, "peer1", onDataChannel)
+	pc2, _, _, connChan2 := CreateDataPair(ctx, TestLogger, testRoom, roomManager.options.IceServers, "peer2", onDataChannel)
+
+	// drain the connection states until the peer connections are closed, only the data channels matter here
+	for _, connChan := range []chan webrtc.PeerConnectionState{connChan1, connChan2} {
+		go func(connChan chan webrtc.PeerConnectionState) {
+			for state := range connChan {
+				if state == webrtc.PeerConnectionStateClosed {
+					return
+				}
+			}
+		}(connChan)
+	}
+
+	defer func() {
+		_ = pc1.Close()
+		_ = pc2.Close()
+	}()
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for the metadata data channels to open")
+		case <-openChan:
+		}
+	}
+
+	client1.Metadata().Set("role", "host")
+
+	// the change is broadcasted to all clients including the client itself
+	for i := 0; i < 2; i++ {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for the metadata changed message")
+		case message := <-messageChan:
+			require.Equal(t, client1.ID(), message.ClientID)
+			require.Equal(t, "role", message.Key)
+			require.Equal(t, "host", message.Value)
+		}
+	}
+
+	// the bulk update is broadcasted in a single message with the values
+	profile := map[string]interface{}{"name": "alice", "status": "away"}
+	client1.Metadata().SetAll(profile)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for the metadata batch changed message")
+		case message := <-messageChan:
+			require.Equal(t, client1.ID(), message.ClientID)
+			require.Empty(t, message.Key)
+			require.Equal(t, profile, message.Values)
+		}
+	}
+
+	// the broadcast subscription is removed once the client is removed
+	require.NoError(t, testRoom.StopClient(client1.ID()))
+	require.Eventually(t, func() bool {
+		client1.Metadata().mu.RLock()
+		defer client1.Metadata().mu.RUnlock()
+
+		return len(client1.Metadata().onChangedCallbacks) == 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestClientOnDataChannel(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-on-data-channel", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	// the reserved labels can't be used by the application
+	require.ErrorIs(t, testRoom.CreateDataChannel(internalDataChannelLabel, DefaultDataChannelOptions()), ErrDataChannelReservedLabel)
+	require.ErrorIs(t, testRoom.CreateDataChannel(metadataDataChannelLabel, DefaultDataChannelOptions()), ErrDataChannelReservedLabel)
+
+	pc, client, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "peer", true, false)
+
+	defer func() {
+		_ = testRoom.StopClient(client.ID())
+	}()
+
+	// wait until connected and the SFU is done with the negotiations
+	require.Eventually(t, func() bool {
+		return pc.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected &&
+			pc.PeerConnection.SignalingState() == webrtc.SignalingStateStable &&
+			client.PendingNegotiations() == 0
+	}, 30*time.Second, 100*time.Millisecond)
+
+	dataChannelChan := make(chan string, 1)
+	client.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dataChannelChan <- dc.Label()
+	})
+
+	messageChan := make(chan string, 1)
+	client.OnMessage("chat", func(data []byte) {
+		messageChan <- string(data)
+	})
+
+	dc, err := pc.PeerConnection.CreateDataChannel("chat", nil)
+	require.NoError(t, err)
+
+	dc.OnOpen(func() {
+		_ = dc.SendText("hello")
+	})
+
+	negotiate(pc.PeerConnection, client, TestLogger)
+
+	select {
+	case label := <-dataChannelChan:
+		require.Equal(t, "chat", label)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the data channel")
+	}
+
+	select {
+	case msg := <-messageChan:
+		require.Equal(t, "hello", msg)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the message")
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestDataChannelReliabilityOptions(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-data-channel-reliability", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	maxRetransmits := uint16(0)
+	maxPacketLifeTime := uint16(100)
+
+	// only one of the reliability options can be set
+	err = testRoom.CreateDataChannel("invalid", DataChannelOptions{MaxRetransmits: &maxRetransmits, MaxPacketLifeTime: &maxPacketLifeTime})
+	require.ErrorIs(t, err, ErrDataChannelReliability)
+
+	require.NoError(t, testRoom.CreateDataChannel("control", DataChannelOptions{Ordered: false, MaxRetransmits: &maxRetransmits}))
+	require.NoError(t, testRoom.CreateDataChannel("chat", DefaultDataChannelOptions()))
+
+	_, client, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "peer", true, false)
+
+	defer func() {
+		_ = testRoom.StopClient(client.ID())
+	}()
+
+	// the data channels are created on the existing clients and the new clients with the same options
+	require.Eventually(t, func() bool {
+		return client.dataChannels.Get("control") != nil && client.dataChannels.Get("chat") != nil
+	}, 30*time.Second, 100*time.Millisecond)
+
+	control := client.dataChannels.Get("control")
+	require.False(t, control.Ordered())
+	require.NotNil(t, control.MaxRetransmits())
+	require.Equal(t, maxRetransmits, *control.MaxRetransmits())
+	require.Nil(t, control.MaxPacketLifeTime())
+
+	chat := client.dataChannels.Get("chat")
+	require.True(t, chat.Ordered())
+	require.Nil(t, chat.MaxRetransmits())
+	require.Nil(t, chat.MaxPacketLifeTime())
+
+	require.NoError(t, testRoom.Close())
+}
@@ -1,6 +1,9 @@
 package sfu
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrClientNotFound = errors.New("client not found")
@@ -8,7 +11,58 @@ var (
 
 	ErrRoomIsClosed   = errors.New("room is closed")
 	ErrRoomIsNotEmpty = errors.New("room is not empty")
+	ErrRoomFull       = errors.New("room is full")
 	ErrDecodingData   = errors.New("error decoding data")
 	ErrEncodingData   = errors.New("error encoding data")
 	ErrNotFound       = errors.New("not found")
+	ErrExtensionPanic = errors.New("extension panicked")
+
+	ErrInvalidPLIInterval = errors.New("pli interval must be 0 or at least 500ms")
+	ErrInvalidBitrates    = errors.New("bitrates must be video high > video mid > video low > 0")
+	ErrInvalidQuality     = errors.New("invalid quality level")
+	ErrInvalidFmtpLine    = errors.New("fmtp line must be semicolon separated key=value parameters")
+
+	ErrInvalidMaxSimulcastLayers = errors.New("max simulcast layers must be 0 or between 1 and 3")
 )
+
+// the negotiation steps reported by NegotiationError
+const (
+	NegotiationStepCheckOffer           = "check_offer"
+	NegotiationStepSetRemoteDescription = "set_remote_description"
+	NegotiationStepCreateAnswer         = "create_answer"
+	NegotiationStepSetLocalDescription  = "set_local_description"
+	NegotiationStepAddICECandidate      = "add_ice_candidate"
+	NegotiationStepRenegotiationAnswer  = "renegotiation_answer"
+)
+
+// NegotiationError is returned when a negotiation of the client fails.
+// Use errors.As to get the client ID and the failed step, the underlying error is still matched with errors.Is.
+type NegotiationError struct {
+	ClientID string
+	// Step is one of the NegotiationStep constants
+	Step string
+	Err  error
+}
+
+func (e *NegotiationError) Error() string {
+	return fmt.Sprintf("client: error negotiation of client %s failed on %s: %s", e.ClientID, e.Step, e.Err.Error())
+}
+
+func (e *NegotiationError) Unwrap() error {
+	return e.Err
+}
+
+// ClientError is returned when an operation on a client fails, like ErrClientNotFound or ErrClientExists.
+// Use errors.As to get the client ID, the underlying error is still matched with errors.Is.
+type ClientError struct {
+	ClientID string
+	Err      error
+}
+
+func (e *ClientError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Err.Error(), e.ClientID)
+}
+
+func (e *ClientError) Unwrap() error {
+	return e.Err
+}
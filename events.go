@@ -0,0 +1,113 @@
+package sfu
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EventClientAdded      = "client_added"
+	EventClientRemoved    = "client_removed"
+	EventTrackPublished   = "track_published"
+	EventTrackUnpublished = "track_unpublished"
+
+	// the number of events buffered in the events channel before the new events are dropped
+	eventsBufferSize = 1024
+)
+
+// eventQueue serializes the SFU events into a single buffered channel
+type eventQueue struct {
+	mu      sync.Mutex
+	ch      chan Event
+	closed  bool
+	dropped atomic.Uint64
+}
+
+// Events returns the channel that delivers the client and track events of the SFU in the order they occur.
+// The event type is one of EventClientAdded, EventClientRemoved, EventTrackPublished or EventTrackUnpublished.
+// The event data has the "client_id" key, and the track events also have the "track_id" and the "track" keys with the ITrack.
+// The events are sent from a single serialized source, so a track is never reported unpublished before it's published.
+// The channel is buffered and the events are never blocking the SFU. When the buffer is full because the receiver is too slow,
+// the new events are dropped and counted in DroppedEvents. The channel is closed when the SFU is stopped.
+// Only the events that occur after the first call are delivered.
+func (s *SFU) Events() <-chan Event {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	if s.events.ch == nil {
+		s.events.ch = make(chan Event, eventsBufferSize)
+
+		if s.events.closed {
+			close(s.events.ch)
+		}
+	}
+
+	return s.events.ch
+}
+
+// DroppedEvents returns the number of events dropped because the events channel buffer was full
+func (s *SFU) DroppedEvents() uint64 {
+	return s.events.dropped.Load()
+}
+
+func (s *SFU) emitEvent(eventType string, data map[string]interface{}) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	if s.events.ch == nil || s.events.closed {
+		return
+	}
+
+	event := Event{
+		Type: eventType,
+		Time: time.Now(),
+		Data: data,
+	}
+
+	select {
+	case s.events.ch <- event:
+	default:
+		if s.events.dropped.Add(1) == 1 {
+			s.log.Warnf("sfu: events channel is full, dropping event %s", event.Type)
+		}
+	}
+}
+
+func (s *SFU) emitTrackPublished(track ITrack) {
+	s.emitEvent(EventTrackPublished, trackEventData(track))
+
+	track.OnEnded(func() {
+		s.emitEvent(EventTrackUnpublished, trackEventData(track))
+	})
+}
+
+func clientEventData(clientID string) map[string]interface{} {
+	return map[string]interface{}{
+		"client_id": clientID,
+	}
+}
+
+func trackEventData(track ITrack) map[string]interface{} {
+	return map[string]interface{}{
+		"client_id": track.ClientID(),
+		"track_id":  track.ID(),
+		"track":     track,
+	}
+}
+
+// closeEvents closes the events channel, the events after the SFU is stopped are ignored
+func (s *SFU) closeEvents() {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	if s.events.closed {
+		return
+	}
+
+	s.events.closed = true
+
+	if s.events.ch != nil {
+		close(s.events.ch)
+	}
+}
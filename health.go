@@ -0,0 +1,58 @@
+package sfu
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+// HealthStatus is the SFU liveness reported by SFU.Health
+type HealthStatus struct {
+	// Alive is false once the SFU is stopped
+	Alive   bool `json:"alive"`
+	Clients int  `json:"clients"`
+	// Forwarders is the number of running goroutines that read the published tracks
+	Forwarders int `json:"forwarders"`
+	// LastErrorAt is the time of the last error logged by the SFU or its clients, zero if there is no error
+	LastErrorAt time.Time `json:"last_error_at"`
+}
+
+// Health returns the SFU liveness and the client counts, for example to serve a load balancer health check.
+// It only reads the atomic counters and the client count, so it's cheap enough to be called frequently.
+func (s *SFU) Health() HealthStatus {
+	health := HealthStatus{
+		Alive:      s.context.Err() == nil,
+		Clients:    s.clients.Length(),
+		Forwarders: s.forwarders.count(),
+	}
+
+	if lastError := s.lastErrorTS.Load(); lastError > 0 {
+		health.LastErrorAt = time.Unix(0, lastError)
+	}
+
+	return health
+}
+
+// errorTimeLogger records the time of the last error logged through the logger
+type errorTimeLogger struct {
+	logging.LeveledLogger
+	lastErrorTS *atomic.Int64
+}
+
+func newErrorTimeLogger(log logging.LeveledLogger, lastErrorTS *atomic.Int64) logging.LeveledLogger {
+	return &errorTimeLogger{
+		LeveledLogger: log,
+		lastErrorTS:   lastErrorTS,
+	}
+}
+
+func (l *errorTimeLogger) Error(msg string) {
+	l.lastErrorTS.Store(time.Now().UnixNano())
+	l.LeveledLogger.Error(msg)
+}
+
+func (l *errorTimeLogger) Errorf(format string, args ...interface{}) {
+	l.lastErrorTS.Store(time.Now().UnixNano())
+	l.LeveledLogger.Errorf(format, args...)
+}
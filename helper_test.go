@@ -1,12 +1,17 @@
 package sfu
 
 import (
+	"context"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/inlivedev/sfu/pkg/packetmap"
+	"github.com/inlivedev/sfu/pkg/rtppool"
 	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
 )
 
 type PeerClient struct {
@@ -23,6 +28,16 @@ type RemoteTrackTest struct {
 	Client *PeerClient
 }
 
+// ridSampleTrack is a sample track that is received as a simulcast layer with the RID
+type ridSampleTrack struct {
+	*sampleTrack
+	rid string
+}
+
+func (t *ridSampleTrack) RID() string {
+	return t.rid
+}
+
 func DefaultTestIceServers() []webrtc.ICEServer {
 	return []webrtc.ICEServer{
 		// {
@@ -37,6 +52,73 @@ func DefaultTestIceServers() []webrtc.ICEServer {
 	}
 }
 
+// newTestSimulcastClientTrack returns a VP8 simulcast client track of a client that is not connected, to test the layer selection.
+// The remote track layers are inactive until their last read timestamps are set, and the forwarded packets are left in the
+// writer queue because the writer loop is not started. The client is the track client, the claim is stored by the test.
+func newTestSimulcastClientTrack(t *testing.T) *simulcastClientTrack {
+	t.Helper()
+
+	quality := &atomic.Uint32{}
+	quality.Store(QualityHigh)
+
+	client := &Client{
+		sfu:               &SFU{bitrateConfigs: DefaultBitrates()},
+		quality:           quality,
+		maxDecodePixels:   &atomic.Pointer[map[string]uint32]{},
+		bitrateController: &bitrateController{},
+		log:               TestLogger,
+	}
+
+	remoteTrack := &SimulcastTrack{
+		base:            &baseTrack{client: client, isScreen: &atomic.Bool{}, muted: &atomic.Bool{}},
+		remoteTrackHigh: &remoteTrack{onPLI: func() {}},
+		remoteTrackMid:  &remoteTrack{onPLI: func() {}},
+		remoteTrackLow:  &remoteTrack{onPLI: func() {}},
+		lastReadHighTS:  &atomic.Int64{},
+		lastReadMidTS:   &atomic.Int64{},
+		lastReadLowTS:   &atomic.Int64{},
+	}
+
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "track", "stream")
+	require.NoError(t, err)
+
+	maxQuality := &atomic.Uint32{}
+	maxQuality.Store(QualityHigh)
+
+	return &simulcastClientTrack{
+		id:                      "track",
+		streamid:                "stream",
+		client:                  client,
+		context:                 context.Background(),
+		kind:                    webrtc.RTPCodecTypeVideo,
+		mimeType:                webrtc.MimeTypeVP8,
+		localTrack:              localTrack,
+		remoteTrack:             remoteTrack,
+		baseTrack:               remoteTrack.base,
+		lastBlankSequenceNumber: &atomic.Uint32{},
+		sequenceNumber:          &atomic.Uint32{},
+		lastQuality:             &atomic.Uint32{},
+		paddingTS:               &atomic.Uint32{},
+		maxQuality:              maxQuality,
+		fallbackQuality:         &atomic.Uint32{},
+		lastTimestamp:           &atomic.Uint32{},
+		isScreen:                &atomic.Bool{},
+		isEnded:                 &atomic.Bool{},
+		isPaused:                &atomic.Bool{},
+		packetmapHigh:           &packetmap.Map{},
+		packetmapMid:            &packetmap.Map{},
+		packetmapLow:            &packetmap.Map{},
+		firstFrame:              newFirstFrameMeter(),
+		writer: &packetWriter{
+			localTrack: localTrack,
+			pool:       rtppool.New(),
+			queue:      make(chan queuedPacket, packetWriterQueueSize),
+			log:        TestLogger,
+		},
+		timestamps: newTimestampRewriter(90000),
+	}
+}
+
 func CheckRoutines(t *testing.T) func() {
 	tryLoop := func(failMessage string) {
 		try := 0
@@ -215,3 +215,69 @@ func TestExtension(t *testing.T) {
 
 	require.True(t, ext.onClientRemoved, "OnClientRemoved is not called")
 }
+
+type panicExtension struct{}
+
+func (p *panicExtension) OnBeforeClientAdded(room *Room, id string) error {
+	panic("buggy extension")
+}
+
+func (p *panicExtension) OnClientAdded(room *Room, client *Client) {
+	panic("buggy extension")
+}
+
+func (p *panicExtension) OnClientRemoved(room *Room, client *Client) {
+	panic("buggy extension")
+}
+
+type panicManagerExtension struct{}
+
+func (p *panicManagerExtension) OnGetRoom(manager *Manager, roomID string) (*Room, error) {
+	panic("buggy extension")
+}
+
+func (p *panicManagerExtension) OnBeforeNewRoom(id, name, roomType string) error {
+	panic("buggy extension")
+}
+
+func (p *panicManagerExtension) OnNewRoom(manager *Manager, room *Room) {
+	panic("buggy extension")
+}
+
+func (p *panicManagerExtension) OnRoomClosed(manager *Manager, room *Room) {
+	panic("buggy extension")
+}
+
+func TestExtensionPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	// the panics are recovered, the hooks that can reject reject instead
+	roomManager.AddExtension(&panicManagerExtension{})
+
+	_, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-extension-panic", RoomTypeLocal, DefaultRoomOptions())
+	require.ErrorIs(t, err, ErrExtensionPanic)
+
+	_, err = roomManager.GetRoom("unknown-room")
+	require.ErrorIs(t, err, ErrExtensionPanic)
+
+	roomManager.extension = nil
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-extension-panic", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err)
+
+	testRoom.AddExtension(&panicExtension{})
+
+	_, err = testRoom.AddClient("client", "client", DefaultClientOptions())
+	require.ErrorIs(t, err, ErrExtensionPanic)
+
+	// the notification hooks are recovered
+	testRoom.onClientJoined(&Client{id: "client"})
+
+	roomManager.AddExtension(&panicManagerExtension{})
+	require.NoError(t, testRoom.Close())
+}
@@ -34,7 +34,10 @@ type Manager struct {
 func NewManager(ctx context.Context, name string, options Options) *Manager {
 	localCtx, cancel := context.WithCancel(ctx)
 
-	logger := logging.NewDefaultLoggerFactory().NewLogger("sfu")
+	logger := options.Log
+	if logger == nil {
+		logger = logging.NewDefaultLoggerFactory().NewLogger("sfu")
+	}
 
 	m := &Manager{
 		rooms:      make(map[string]*Room),
@@ -75,33 +78,83 @@ func (m *Manager) NewRoom(id, name, roomType string, opts RoomOptions) (*Room, e
 		return nil, ErrRoomAlreadyExists
 	}
 
+	if opts.PLIInterval != nil && *opts.PLIInterval > 0 && *opts.PLIInterval < MinPLIInterval {
+		return nil, ErrInvalidPLIInterval
+	}
+
+	if err := opts.Bitrates.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.OpusFmtpLine != "" {
+		if err := validateFmtpLine(opts.OpusFmtpLine); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaxSimulcastLayers < 0 || opts.MaxSimulcastLayers > 3 {
+		return nil, ErrInvalidMaxSimulcastLayers
+	}
+
 	err := m.onBeforeNewRoom(id, name, roomType)
 	if err != nil {
 		return nil, err
 	}
 
+	bitrateWindow := DefaultBitrateWindow
+	if opts.BitrateWindow != nil && *opts.BitrateWindow > 0 {
+		bitrateWindow = *opts.BitrateWindow
+	}
+
+	negotiationWindow := DefaultNegotiationWindow
+	if opts.NegotiationWindow != nil && *opts.NegotiationWindow > 0 {
+		negotiationWindow = *opts.NegotiationWindow
+	}
+
 	sfuOpts := sfuOptions{
-		Bitrates:      opts.Bitrates,
-		IceServers:    m.iceServers,
-		Codecs:        *opts.Codecs,
-		PLIInterval:   *opts.PLIInterval,
-		Log:           m.log,
-		SettingEngine: m.options.SettingEngine,
+		Bitrates:           opts.Bitrates,
+		IceServers:         m.iceServers,
+		Codecs:             *opts.Codecs,
+		PLIInterval:        *opts.PLIInterval,
+		KeyframeInterval:   opts.KeyframeRequestInterval,
+		BitrateWindow:      bitrateWindow,
+		NegotiationWindow:  negotiationWindow,
+		Log:                m.log,
+		SettingEngine:      m.options.SettingEngine,
+		BroadcastMetadata:  opts.BroadcastMetadata,
+		OpusFmtpLine:       opts.OpusFmtpLine,
+		BandwidthLimit:     opts.BandwidthLimit,
+		MaxSimulcastLayers: opts.MaxSimulcastLayers,
+		StopWhenEmpty:      opts.StopWhenEmpty,
+		EmptyGracePeriod:   opts.EmptyGracePeriod,
 	}
 
 	newSFU := New(m.context, sfuOpts)
 
 	room := newRoom(id, name, newSFU, roomType, opts)
 
+	if m.options.MetadataStore != nil {
+		m.restoreMetadata(room)
+	}
+
 	for _, ext := range m.extension {
-		ext.OnNewRoom(m, room)
+		callUserCallback(m.log, "OnNewRoom", func() {
+			ext.OnNewRoom(m, room)
+		})
 	}
 
-	// TODO: what manager should do when a room is closed?
-	// is there any neccesary resource to be released?
 	room.OnRoomClosed(func(id string) {
+		// the room can be closed by itself when it's empty, not only by the manager
+		m.mutex.Lock()
+		if m.rooms[id] == room {
+			delete(m.rooms, id)
+		}
+		m.mutex.Unlock()
+
 		for _, ext := range m.extension {
-			ext.OnRoomClosed(m, room)
+			callUserCallback(m.log, "OnRoomClosed", func() {
+				ext.OnRoomClosed(m, room)
+			})
 		}
 	})
 
@@ -140,7 +193,13 @@ func (m *Manager) NewRoom(id, name, roomType string, opts RoomOptions) (*Room, e
 
 func (m *Manager) onBeforeNewRoom(id, name, roomType string) error {
 	for _, ext := range m.extension {
-		err := ext.OnBeforeNewRoom(id, name, roomType)
+		// the room is rejected if the extension panics
+		err := ErrExtensionPanic
+
+		callUserCallback(m.log, "OnBeforeNewRoom", func() {
+			err = ext.OnBeforeNewRoom(id, name, roomType)
+		})
+
 		if err != nil {
 			return err
 		}
@@ -151,6 +210,9 @@ func (m *Manager) onBeforeNewRoom(id, name, roomType string) error {
 }
 
 func (m *Manager) RoomsCount() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	return len(m.rooms)
 }
 
@@ -160,10 +222,18 @@ func (m *Manager) GetRoom(id string) (*Room, error) {
 		err  error
 	)
 
+	m.mutex.RLock()
 	room, err = m.getRoom(id)
+	m.mutex.RUnlock()
+
 	if err == ErrRoomNotFound {
 		for _, ext := range m.extension {
-			room, err = ext.OnGetRoom(m, id)
+			room, err = nil, ErrExtensionPanic
+
+			callUserCallback(m.log, "OnGetRoom", func() {
+				room, err = ext.OnGetRoom(m, id)
+			})
+
 			if err == nil && room != nil {
 				return room, nil
 			}
@@ -188,20 +258,99 @@ func (m *Manager) getRoom(id string) (*Room, error) {
 	return room, nil
 }
 
+// ExportMetadata returns the metadata of the room encoded as JSON, use ImportMetadata to restore it.
+func (m *Manager) ExportMetadata(roomID string) ([]byte, error) {
+	m.mutex.RLock()
+	room, err := m.getRoom(roomID)
+	m.mutex.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return room.meta.MarshalJSON()
+}
+
+// ImportMetadata replaces the metadata of the room with the JSON metadata returned by ExportMetadata.
+// The metadata OnChanged callbacks are not called, but it's saved to the MetadataStore if it's configured.
+func (m *Manager) ImportMetadata(roomID string, data []byte) error {
+	m.mutex.RLock()
+	room, err := m.getRoom(roomID)
+	m.mutex.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := room.meta.UnmarshalJSON(data); err != nil {
+		return err
+	}
+
+	if m.options.MetadataStore != nil {
+		return m.options.MetadataStore.SaveMetadata(roomID, data)
+	}
+
+	return nil
+}
+
+// restoreMetadata loads the room metadata from the MetadataStore and saves it back every time it's changed
+func (m *Manager) restoreMetadata(room *Room) {
+	store := m.options.MetadataStore
+
+	data, err := store.LoadMetadata(room.id)
+	if err == nil {
+		if err := room.meta.UnmarshalJSON(data); err != nil {
+			m.log.Errorf("manager: error restore metadata of room %s: %s", room.id, err.Error())
+		}
+	} else if !errors.Is(err, ErrMetaNotFound) {
+		m.log.Errorf("manager: error load metadata of room %s: %s", room.id, err.Error())
+	}
+
+	// the callbacks run on their own goroutines, the metadata is encoded under the lock
+	// so the last save always contains the latest changes
+	var mu sync.Mutex
+
+	save := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		data, err := room.meta.MarshalJSON()
+		if err != nil {
+			m.log.Errorf("manager: error encode metadata of room %s: %s", room.id, err.Error())
+			return
+		}
+
+		if err := store.SaveMetadata(room.id, data); err != nil {
+			m.log.Errorf("manager: error save metadata of room %s: %s", room.id, err.Error())
+		}
+	}
+
+	onChanged := room.meta.OnChanged(func(key string, value interface{}) {
+		save()
+	})
+
+	onBatchChanged := room.meta.OnBatchChanged(func(values map[string]interface{}) {
+		save()
+	})
+
+	room.OnRoomClosed(func(id string) {
+		onChanged.Remove()
+		onBatchChanged.Remove()
+	})
+}
+
 // CloseRoom will stop all clients in the room and close it.
 // This is a shortcut to find a room with id and close it.
 func (m *Manager) CloseRoom(id string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	var room *Room
+	m.mutex.RLock()
+	room, ok := m.rooms[id]
+	m.mutex.RUnlock()
 
-	var ok bool
-
-	if room, ok = m.rooms[id]; !ok {
+	if !ok {
 		return ErrRoomNotFound
 	}
 
+	// the closed room is removed from the rooms by its OnRoomClosed callback
 	return room.Close()
 }
 
@@ -209,7 +358,14 @@ func (m *Manager) CloseRoom(id string) error {
 func (m *Manager) Close() {
 	defer m.cancel()
 
+	m.mutex.RLock()
+	rooms := make([]*Room, 0, len(m.rooms))
 	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	m.mutex.RUnlock()
+
+	for _, room := range rooms {
 		room.Close()
 	}
 }
@@ -228,10 +384,8 @@ func startRoomTimeout(m *Manager, room *Room) (context.Context, context.CancelFu
 	go func() {
 		<-ctx.Done()
 		if ctx.Err() == context.DeadlineExceeded {
-			m.mutex.Lock()
-			defer m.mutex.Unlock()
+			// the closed room is removed from the rooms by its OnRoomClosed callback
 			room.Close()
-			delete(m.rooms, room.id)
 			m.log.Infof("room ", room.id, " is closed because it's empty and idle for ", room.options.EmptyRoomTimeout)
 		}
 	}()
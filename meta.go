@@ -1,18 +1,54 @@
 package sfu
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"golang.org/x/exp/maps"
 )
 
 var (
-	ErrMetaNotFound = errors.New("meta: metadata not found")
+	ErrMetaNotFound     = errors.New("meta: metadata not found")
+	ErrMetaTypeMismatch = errors.New("meta: metadata type mismatch")
 )
 
+// the label of the data channel used to broadcast the client metadata changes when the room BroadcastMetadata option is enabled
+const metadataDataChannelLabel = "_meta"
+
+// MetadataChangedMessage is the JSON message sent over the metadata data channel when a client metadata is changed.
+// The value is null when the metadata key is deleted.
+// The keys changed together with Metadata.SetAll are sent in a single message with the values, the key is empty.
+type MetadataChangedMessage struct {
+	ClientID string                 `json:"client_id"`
+	Key      string                 `json:"key"`
+	Value    interface{}            `json:"value"`
+	Values   map[string]interface{} `json:"values,omitempty"`
+}
+
+// MetadataStore persists the room metadata, for example in Redis or a database, so it survives the server restarts.
+// Set it in Options.MetadataStore, the manager loads the metadata when a room is created and saves it every time it's changed.
+type MetadataStore interface {
+	// LoadMetadata returns the JSON metadata saved for the room, or ErrMetaNotFound if there is none
+	LoadMetadata(roomID string) ([]byte, error)
+	// SaveMetadata saves the JSON metadata of the room, it's called with the whole metadata on every change
+	SaveMetadata(roomID string, data []byte) error
+}
+
 type Metadata struct {
-	mu                 sync.RWMutex
-	m                  map[string]interface{}
-	onChangedCallbacks map[string]func(key string, value interface{})
+	mu                      sync.RWMutex
+	m                       map[string]interface{}
+	onChangedCallbacks      map[string]func(key string, value interface{})
+	onBatchChangedCallbacks map[string]func(values map[string]interface{})
+	context                 context.Context
+	log                     logging.LeveledLogger
+	expiries                map[string]time.Time
+	expiryTimer             *time.Timer
 }
 
 type OnMetaChangedCallback struct {
@@ -27,24 +63,80 @@ func (s *OnMetaChangedCallback) Remove() {
 	defer s.meta.mu.Unlock()
 
 	delete(s.meta.onChangedCallbacks, s.key)
+	delete(s.meta.onBatchChangedCallbacks, s.key)
 }
 
+// NewMetadata creates a standalone metadata. The panics in its callbacks are recovered and logged with the default pion logger,
+// the room and the client metadata log them with the SFU logger from Options.Log.
 func NewMetadata() *Metadata {
-	return &Metadata{
-		mu:                 sync.RWMutex{},
-		m:                  make(map[string]interface{}),
-		onChangedCallbacks: make(map[string]func(key string, value interface{}), 0),
+	return newMetadata(context.Background(), logging.NewDefaultLoggerFactory().NewLogger("sfu"))
+}
+
+// newMetadata creates the metadata of a room or a client, the expiry timer is stopped when the context is done
+// and the panics in the callbacks are logged with the log
+func newMetadata(ctx context.Context, log logging.LeveledLogger) *Metadata {
+	m := &Metadata{
+		mu:                      sync.RWMutex{},
+		m:                       make(map[string]interface{}),
+		onChangedCallbacks:      make(map[string]func(key string, value interface{}), 0),
+		onBatchChangedCallbacks: make(map[string]func(values map[string]interface{}), 0),
+		context:                 ctx,
+		log:                     log,
+		expiries:                make(map[string]time.Time),
 	}
+
+	context.AfterFunc(ctx, m.stopExpiryTimer)
+
+	return m
 }
 
 func (m *Metadata) Set(key string, value interface{}) {
 	m.mu.Lock()
 	m.m[key] = value
+	m.clearExpiry(key)
+	m.mu.Unlock()
+
+	m.onChanged(key, value)
+}
+
+// SetWithTTL sets the value that is deleted after the TTL, like a raised hand or a typing state.
+// The OnChanged callbacks are called with a nil value when it's expired, the same as Delete.
+// Setting the key again before the TTL replaces the expiry, Set removes it. A TTL that is not positive is the same as Set.
+func (m *Metadata) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	if ttl <= 0 {
+		m.Set(key, value)
+		return
+	}
+
+	m.mu.Lock()
+	m.m[key] = value
+	m.expiries[key] = time.Now().Add(ttl)
+	m.scheduleExpiry()
 	m.mu.Unlock()
 
 	m.onChanged(key, value)
 }
 
+// SetAll sets all the values under a single lock and calls the OnBatchChanged callbacks once with the changed values.
+// The per key OnChanged callbacks are not called, use it for the bulk updates like a full profile to avoid a burst of callbacks.
+func (m *Metadata) SetAll(values map[string]interface{}) {
+	if len(values) == 0 {
+		return
+	}
+
+	changed := make(map[string]interface{}, len(values))
+
+	m.mu.Lock()
+	for k, v := range values {
+		m.m[k] = v
+		m.clearExpiry(k)
+		changed[k] = v
+	}
+	m.mu.Unlock()
+
+	m.onBatchChanged(changed)
+}
+
 func (m *Metadata) Get(key string) (interface{}, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -55,6 +147,112 @@ func (m *Metadata) Get(key string) (interface{}, error) {
 	return m.m[key], nil
 }
 
+// GetString returns the string value of the key, or ErrMetaTypeMismatch if the value is not a string
+func (m *Metadata) GetString(key string) (string, error) {
+	value, err := m.Get(key)
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return "", ErrMetaTypeMismatch
+	}
+
+	return s, nil
+}
+
+// GetInt returns the integer value of the key, or ErrMetaTypeMismatch if the value is not an integer.
+// The whole float64 numbers are accepted because the numbers are decoded as float64 from the restored JSON metadata.
+func (m *Metadata) GetInt(key string) (int, error) {
+	value, err := m.Get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int8:
+		return int(v), nil
+	case int16:
+		return int(v), nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case uint8:
+		return int(v), nil
+	case uint16:
+		return int(v), nil
+	case uint32:
+		return int(v), nil
+	case uint:
+		if uint64(v) <= math.MaxInt {
+			return int(v), nil
+		}
+	case uint64:
+		if v <= math.MaxInt {
+			return int(v), nil
+		}
+	case float32:
+		if i, ok := floatToInt(float64(v)); ok {
+			return i, nil
+		}
+	case float64:
+		if i, ok := floatToInt(v); ok {
+			return i, nil
+		}
+	}
+
+	return 0, ErrMetaTypeMismatch
+}
+
+// floatToInt converts the whole float number that fits in an int
+func floatToInt(v float64) (int, bool) {
+	if v == math.Trunc(v) && v >= math.MinInt && v < math.MaxInt {
+		return int(v), true
+	}
+
+	return 0, false
+}
+
+// GetBool returns the boolean value of the key, or ErrMetaTypeMismatch if the value is not a boolean
+func (m *Metadata) GetBool(key string) (bool, error) {
+	value, err := m.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := value.(bool)
+	if !ok {
+		return false, ErrMetaTypeMismatch
+	}
+
+	return b, nil
+}
+
+// GetJSON decodes the value of the key into out through its JSON encoding, use it to get a struct value
+// that can be stored either as the struct or as the decoded JSON map. It returns an error wrapping ErrMetaTypeMismatch
+// if the value can't be decoded into out.
+func (m *Metadata) GetJSON(key string, out interface{}) error {
+	value, err := m.Get(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrMetaTypeMismatch, err.Error())
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%w: %s", ErrMetaTypeMismatch, err.Error())
+	}
+
+	return nil
+}
+
 func (m *Metadata) Delete(key string) error {
 	m.mu.Lock()
 	if _, ok := m.m[key]; !ok {
@@ -63,6 +261,7 @@ func (m *Metadata) Delete(key string) error {
 	}
 
 	delete(m.m, key)
+	m.clearExpiry(key)
 	m.mu.Unlock()
 
 	m.onChanged(key, nil)
@@ -70,21 +269,162 @@ func (m *Metadata) Delete(key string) error {
 	return nil
 }
 
+// ForEach calls the function with each key and value of a copy of the metadata,
+// so the function can change the metadata while iterating
 func (m *Metadata) ForEach(f func(key string, value interface{})) {
+	for k, v := range m.toMap() {
+		m.callCallback("ForEach", func() {
+			f(k, v)
+		})
+	}
+}
+
+// toMap returns a copy of the metadata
+func (m *Metadata) toMap() map[string]interface{} {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	data := make(map[string]interface{}, len(m.m))
 	for k, v := range m.m {
-		f(k, v)
+		data[k] = v
 	}
+
+	return data
 }
 
-func (m *Metadata) onChanged(key string, value interface{}) {
+// MarshalJSON encodes the metadata as a JSON object, use it to persist the metadata.
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.toMap())
+}
+
+// UnmarshalJSON replaces the metadata with the keys of the JSON object, use it to restore the persisted metadata.
+// The OnChanged callbacks are not called for the restored keys.
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	restored := make(map[string]interface{})
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.m = restored
+
+	// the restored keys never expire
+	m.expiries = make(map[string]time.Time)
+	if m.expiryTimer != nil {
+		m.expiryTimer.Stop()
+	}
+
+	if m.onChangedCallbacks == nil {
+		m.onChangedCallbacks = make(map[string]func(key string, value interface{}), 0)
+	}
+
+	if m.onBatchChangedCallbacks == nil {
+		m.onBatchChangedCallbacks = make(map[string]func(values map[string]interface{}), 0)
+	}
+
+	if m.context == nil {
+		m.context = context.Background()
+	}
+
+	return nil
+}
+
+// clearExpiry removes the expiry of the key, must be called with the lock held
+func (m *Metadata) clearExpiry(key string) {
+	if _, ok := m.expiries[key]; !ok {
+		return
+	}
+
+	delete(m.expiries, key)
+	m.scheduleExpiry()
+}
+
+// scheduleExpiry resets the single expiry timer to the earliest expiry, must be called with the lock held
+func (m *Metadata) scheduleExpiry() {
+	if m.context.Err() != nil {
+		return
+	}
+
+	var next time.Time
+	for _, expiry := range m.expiries {
+		if next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+
+	if next.IsZero() {
+		if m.expiryTimer != nil {
+			m.expiryTimer.Stop()
+		}
+
+		return
+	}
+
+	if m.expiryTimer == nil {
+		m.expiryTimer = time.AfterFunc(time.Until(next), m.expire)
+		return
+	}
+
+	m.expiryTimer.Reset(time.Until(next))
+}
+
+// expire deletes the expired keys and calls the OnChanged callbacks with nil values
+func (m *Metadata) expire() {
+	if m.context.Err() != nil {
+		return
+	}
+
+	now := time.Now()
+	expired := make([]string, 0)
+
+	m.mu.Lock()
+	for key, expiry := range m.expiries {
+		if !expiry.After(now) {
+			delete(m.m, key)
+			delete(m.expiries, key)
+			expired = append(expired, key)
+		}
+	}
+
+	m.scheduleExpiry()
+	m.mu.Unlock()
+
+	for _, key := range expired {
+		m.onChanged(key, nil)
+	}
+}
+
+func (m *Metadata) stopExpiryTimer() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.expiryTimer != nil {
+		m.expiryTimer.Stop()
+	}
+}
+
+// callCallback calls the callback and logs its panic with the metadata logger
+func (m *Metadata) callCallback(name string, f func()) {
+	callUserCallback(m.log, name, f)
+}
+
+// onChanged copies the callbacks under the lock and calls them without it,
+// so the callbacks can read and change the metadata
+func (m *Metadata) onChanged(key string, value interface{}) {
+	m.mu.RLock()
+	callbacks := make([]func(key string, value interface{}), 0, len(m.onChangedCallbacks))
 	for _, f := range m.onChangedCallbacks {
-		go f(key, value)
+		callbacks = append(callbacks, f)
+	}
+	m.mu.RUnlock()
+
+	for _, f := range callbacks {
+		f := f
+		go m.callCallback("OnChanged", func() {
+			f(key, value)
+		})
 	}
 }
 
@@ -103,3 +443,35 @@ func (m *Metadata) OnChanged(f func(key string, value interface{})) *OnMetaChang
 
 	return sub
 }
+
+func (m *Metadata) onBatchChanged(values map[string]interface{}) {
+	m.mu.RLock()
+	callbacks := make([]func(values map[string]interface{}), 0, len(m.onBatchChangedCallbacks))
+	for _, f := range m.onBatchChangedCallbacks {
+		callbacks = append(callbacks, f)
+	}
+	m.mu.RUnlock()
+
+	// each callback gets its own copy, the callbacks run concurrently and may modify the values
+	for _, f := range callbacks {
+		f := f
+		copied := maps.Clone(values)
+		go m.callCallback("OnBatchChanged", func() {
+			f(copied)
+		})
+	}
+}
+
+// OnBatchChanged registers a callback to be called once with all the values changed by SetAll
+// Make sure OnMetaChangedCallback.Remove() is called when the callback is no longer needed
+func (m *Metadata) OnBatchChanged(f func(values map[string]interface{})) *OnMetaChangedCallback {
+	m.mu.Lock()
+	key := GenerateID(21)
+	m.onBatchChangedCallbacks[key] = f
+	m.mu.Unlock()
+
+	return &OnMetaChangedCallback{
+		meta: m,
+		key:  key,
+	}
+}
@@ -1,6 +1,8 @@
 package sfu
 
 import (
+	"context"
+	"math"
 	"testing"
 	"time"
 
@@ -38,7 +40,8 @@ func TestMetadata(t *testing.T) {
 	// Test OnChanged method
 
 	receivedMetas := make(map[string]interface{})
-	chanMeta := make(chan dataValue, len(reqData))
+	// the deletes below are also sent to the channel, the callbacks may run after the listener is removed
+	chanMeta := make(chan dataValue, 2*len(reqData))
 	callback1 := m.OnChanged(func(key string, value interface{}) {
 		t.Logf("Key: %s, Value: %v", key, value)
 		chanMeta <- dataValue{key: key, value: value}
@@ -79,7 +82,6 @@ func TestMetadata(t *testing.T) {
 
 	// cancel the listener above
 	callback1.Remove()
-	close(chanMeta)
 
 	// Test OnChanged method with cancel
 	var state = true
@@ -95,3 +97,347 @@ func TestMetadata(t *testing.T) {
 
 	require.Equal(t, true, state)
 }
+
+func TestMetadataJSON(t *testing.T) {
+	m := NewMetadata()
+	m.Set("title", "daily standup")
+	m.Set("participants", float64(3))
+
+	data, err := m.MarshalJSON()
+	require.NoError(t, err)
+
+	changed := make(chan string, 1)
+	restored := NewMetadata()
+	restored.Set("stale", true)
+	callback := restored.OnChanged(func(key string, value interface{}) {
+		changed <- key
+	})
+	defer callback.Remove()
+
+	require.NoError(t, restored.UnmarshalJSON(data))
+
+	// the restored metadata replaces the existing keys without calling the callbacks
+	_, err = restored.Get("stale")
+	require.Equal(t, ErrMetaNotFound, err)
+
+	value, err := restored.Get("title")
+	require.NoError(t, err)
+	require.Equal(t, "daily standup", value)
+
+	value, err = restored.Get("participants")
+	require.NoError(t, err)
+	require.Equal(t, float64(3), value)
+
+	select {
+	case key := <-changed:
+		t.Fatalf("unexpected changed callback for %s", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.Error(t, restored.UnmarshalJSON([]byte("[1,2]")))
+}
+
+func TestMetadataSetAll(t *testing.T) {
+	m := NewMetadata()
+
+	changed := make(chan string, 10)
+	callback := m.OnChanged(func(key string, value interface{}) {
+		changed <- key
+	})
+	defer callback.Remove()
+
+	batches := make(chan map[string]interface{}, 10)
+	batchCallback := m.OnBatchChanged(func(values map[string]interface{}) {
+		batches <- values
+	})
+
+	// each callback gets its own copy of the values
+	mutated := make(chan bool, 10)
+	mutatingCallback := m.OnBatchChanged(func(values map[string]interface{}) {
+		values["name"] = "mallory"
+		mutated <- true
+	})
+
+	profile := map[string]interface{}{
+		"name":   "alice",
+		"avatar": "alice.png",
+		"status": "away",
+	}
+
+	m.SetAll(profile)
+
+	for k, v := range profile {
+		value, err := m.Get(k)
+		require.NoError(t, err)
+		require.Equal(t, v, value)
+	}
+
+	// the bulk update is notified once with all the values
+	select {
+	case <-mutated:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout waiting for the mutating batch changed callback")
+	}
+
+	mutatingCallback.Remove()
+
+	select {
+	case values := <-batches:
+		require.Equal(t, profile, values)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout waiting for the batch changed callback")
+	}
+
+	name, err := m.Get("name")
+	require.NoError(t, err)
+	require.Equal(t, "alice", name)
+
+	select {
+	case values := <-batches:
+		t.Fatalf("unexpected second batch %v", values)
+	case key := <-changed:
+		t.Fatalf("unexpected changed callback for %s", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the per key Set is unchanged
+	m.Set("status", "online")
+
+	select {
+	case key := <-changed:
+		require.Equal(t, "status", key)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout waiting for the changed callback")
+	}
+
+	batchCallback.Remove()
+
+	m.SetAll(map[string]interface{}{"status": "busy"})
+
+	select {
+	case values := <-batches:
+		t.Fatalf("unexpected batch after remove %v", values)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMetadataSetWithTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type dataValue struct {
+		key   string
+		value interface{}
+	}
+
+	m := newMetadata(ctx, TestLogger)
+
+	changed := make(chan dataValue, 10)
+	callback := m.OnChanged(func(key string, value interface{}) {
+		changed <- dataValue{key: key, value: value}
+	})
+	defer callback.Remove()
+
+	m.SetWithTTL("hand_raised", true, 50*time.Millisecond)
+	m.SetWithTTL("typing", true, 50*time.Millisecond)
+
+	// Set removes the expiry
+	m.Set("typing", false)
+
+	for i := 0; i < 3; i++ {
+		<-changed
+	}
+
+	select {
+	case data := <-changed:
+		require.Equal(t, dataValue{key: "hand_raised", value: nil}, data)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the expiry")
+	}
+
+	_, err := m.Get("hand_raised")
+	require.Equal(t, ErrMetaNotFound, err)
+
+	value, err := m.Get("typing")
+	require.NoError(t, err)
+	require.Equal(t, false, value)
+
+	// the keys are not expired once the context is done
+	m.SetWithTTL("hand_raised", true, 50*time.Millisecond)
+	<-changed
+
+	cancel()
+
+	select {
+	case data := <-changed:
+		t.Fatalf("unexpected expiry after the context is done %v", data)
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	value, err = m.Get("hand_raised")
+	require.NoError(t, err)
+	require.Equal(t, true, value)
+}
+
+func TestMetadataTypedGetters(t *testing.T) {
+	type profile struct {
+		Name  string `json:"name"`
+		Score int    `json:"score"`
+	}
+
+	m := NewMetadata()
+	m.Set("name", "alice")
+	m.Set("count", 3)
+	m.Set("restored_count", float64(7))
+	m.Set("ratio", 0.5)
+	m.Set("muted", true)
+	m.Set("profile", profile{Name: "alice", Score: 10})
+	m.Set("restored_profile", map[string]interface{}{"name": "bob", "score": float64(5)})
+
+	name, err := m.GetString("name")
+	require.NoError(t, err)
+	require.Equal(t, "alice", name)
+
+	_, err = m.GetString("count")
+	require.ErrorIs(t, err, ErrMetaTypeMismatch)
+
+	count, err := m.GetInt("count")
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// the numbers restored from JSON are float64
+	count, err = m.GetInt("restored_count")
+	require.NoError(t, err)
+	require.Equal(t, 7, count)
+
+	_, err = m.GetInt("ratio")
+	require.ErrorIs(t, err, ErrMetaTypeMismatch)
+
+	// the unsigned and float32 numbers are accepted if they fit in an int
+	for _, value := range []interface{}{uint(9), uint64(9), float32(9)} {
+		m.Set("converted_count", value)
+		count, err = m.GetInt("converted_count")
+		require.NoError(t, err, "%T", value)
+		require.Equal(t, 9, count)
+	}
+
+	for _, value := range []interface{}{uint(math.MaxUint), uint64(math.MaxUint64), float32(0.5), float32(math.MaxFloat32)} {
+		m.Set("converted_count", value)
+		_, err = m.GetInt("converted_count")
+		require.ErrorIs(t, err, ErrMetaTypeMismatch, "%T", value)
+	}
+
+	muted, err := m.GetBool("muted")
+	require.NoError(t, err)
+	require.True(t, muted)
+
+	_, err = m.GetBool("name")
+	require.ErrorIs(t, err, ErrMetaTypeMismatch)
+
+	var p profile
+	require.NoError(t, m.GetJSON("profile", &p))
+	require.Equal(t, profile{Name: "alice", Score: 10}, p)
+
+	require.NoError(t, m.GetJSON("restored_profile", &p))
+	require.Equal(t, profile{Name: "bob", Score: 5}, p)
+
+	require.ErrorIs(t, m.GetJSON("name", &p), ErrMetaTypeMismatch)
+
+	_, err = m.GetString("unknown")
+	require.ErrorIs(t, err, ErrMetaNotFound)
+	require.ErrorIs(t, m.GetJSON("unknown", &p), ErrMetaNotFound)
+}
+
+func TestMetadataCallbackPanic(t *testing.T) {
+	m := newMetadata(context.Background(), TestLogger)
+
+	changed := make(chan string, 1)
+
+	panicked := m.OnChanged(func(key string, value interface{}) {
+		panic("buggy callback")
+	})
+	defer panicked.Remove()
+
+	callback := m.OnChanged(func(key string, value interface{}) {
+		// the callbacks are called without the lock, so the metadata can be read in the callback
+		_, _ = m.Get(key)
+
+		select {
+		case changed <- key:
+		default:
+		}
+	})
+	defer callback.Remove()
+
+	m.Set("key", "value")
+
+	select {
+	case key := <-changed:
+		require.Equal(t, "key", key)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the changed callback")
+	}
+
+	// the panic doesn't leave the lock held
+	m.Set("key", "value2")
+	value, err := m.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, "value2", value)
+
+	// the ForEach function is called without the lock so it can change the metadata, and its panic is recovered
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		m.ForEach(func(key string, value interface{}) {
+			m.Set(key+"_copy", value)
+			panic("buggy function")
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for ForEach")
+	}
+
+	value, err = m.Get("key_copy")
+	require.NoError(t, err)
+	require.Equal(t, "value2", value)
+}
+
+func TestStandaloneMetadataCallbackPanic(t *testing.T) {
+	m := NewMetadata()
+
+	batches := make(chan map[string]interface{}, 1)
+
+	panicked := m.OnChanged(func(key string, value interface{}) {
+		panic("buggy callback")
+	})
+	defer panicked.Remove()
+
+	panickedBatch := m.OnBatchChanged(func(values map[string]interface{}) {
+		panic("buggy batch callback")
+	})
+	defer panickedBatch.Remove()
+
+	callback := m.OnBatchChanged(func(values map[string]interface{}) {
+		batches <- values
+	})
+	defer callback.Remove()
+
+	// the panics are recovered without the SFU logger, so they don't crash the process
+	m.Set("key", "value")
+	m.SetAll(map[string]interface{}{"key": "value2"})
+
+	select {
+	case values := <-batches:
+		require.Equal(t, map[string]interface{}{"key": "value2"}, values)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the batch changed callback")
+	}
+
+	// give the panicking callbacks time to run
+	time.Sleep(50 * time.Millisecond)
+}
@@ -0,0 +1,107 @@
+package sfu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const messageTypeMigrate = "migrate"
+
+var ErrInternalDataChannelNotOpen = errors.New("client: error internal data channel is not open")
+
+type internalDataMigrate struct {
+	Type string  `json:"type"`
+	Data migrate `json:"data"`
+}
+
+type migrate struct {
+	TargetURL string `json:"target_url"`
+}
+
+// RequestMigration asks the client to reconnect to another server, for example before the server is shut down in a rolling deploy.
+// The {"type":"migrate","data":{"target_url":"..."}} message is sent over the internal data channel,
+// then it waits for the client to leave until the ClientOptions.MigrationGracePeriod is reached, and stops the client.
+// Returns ErrInternalDataChannelNotOpen without stopping the client if the message can't be sent.
+func (c *Client) RequestMigration(targetURL string) error {
+	if c.internalDataChannel == nil || c.internalDataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		return ErrInternalDataChannelNotOpen
+	}
+
+	data, err := json.Marshal(internalDataMigrate{
+		Type: messageTypeMigrate,
+		Data: migrate{TargetURL: targetURL},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.internalDataChannel.SendText(string(data)); err != nil {
+		return err
+	}
+
+	c.log.Infof("client: %s requested to migrate to %s", c.ID(), targetURL)
+
+	select {
+	case <-c.context.Done():
+		// the client left by itself
+		return nil
+	case <-time.After(c.options.MigrationGracePeriod):
+	}
+
+	c.log.Infof("client: %s didn't leave after the migration grace period, stop the client", c.ID())
+
+	err = c.End()
+
+	// clean up immediately, instead of waiting the connection state changed event
+	c.afterClosed()
+
+	return err
+}
+
+// DrainAll requests all clients to migrate to the target URL concurrently with Client.RequestMigration
+// and waits until they are stopped or the context is done. The clients that can't receive the migration message are stopped immediately.
+// If the context is done first, the remaining clients are stopped and the context error is returned.
+func (s *SFU) DrainAll(ctx context.Context, targetURL string) error {
+	var wg sync.WaitGroup
+
+	for _, client := range s.clients.GetClients() {
+		wg.Add(1)
+
+		go func(c *Client) {
+			defer wg.Done()
+
+			if err := c.RequestMigration(targetURL); err != nil {
+				s.log.Warnf("sfu: error request client %s to migrate, stop the client: %s", c.ID(), err.Error())
+
+				_ = c.End()
+				c.afterClosed()
+			}
+		}(client)
+	}
+
+	drained := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.log.Warnf("sfu: timeout waiting %d clients to migrate", s.clients.Length())
+
+		for _, client := range s.clients.GetClients() {
+			_ = client.End()
+			client.afterClosed()
+		}
+
+		return ctx.Err()
+	}
+}
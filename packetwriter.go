@@ -0,0 +1,124 @@
+package sfu
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/inlivedev/sfu/pkg/rtppool"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// the number of packets that can be queued for a subscriber track before the new packets are dropped
+const packetWriterQueueSize = 128
+
+// packetWriter writes the RTP packets to the subscriber local track from its own goroutine through a bounded queue.
+// The publisher track read loop is shared by all subscribers, so a subscriber with a stalled network
+// only drops its own packets instead of slowing down the forwarding to the other subscribers.
+type packetWriter struct {
+	localTrack *webrtc.TrackLocalStaticRTP
+	pool       *rtppool.RTPPool
+	queue      chan queuedPacket
+	dropped    atomic.Uint64
+	meter      *bandwidthMeter
+	log        logging.LeveledLogger
+}
+
+// queuedPacket is the packet waiting to be written, the source is retained until the packet is written
+// because the payload is shared with the other subscribers.
+type queuedPacket struct {
+	packet rtp.Packet
+	source *rtppool.RetainablePacket
+}
+
+// newPacketWriter starts the writer goroutine that runs until the track or the subscriber client context is done
+func newPacketWriter(trackCtx, clientCtx context.Context, localTrack *webrtc.TrackLocalStaticRTP, pool *rtppool.RTPPool, meter *bandwidthMeter, log logging.LeveledLogger) *packetWriter {
+	w := &packetWriter{
+		localTrack: localTrack,
+		pool:       pool,
+		meter:      meter,
+		queue:      make(chan queuedPacket, packetWriterQueueSize),
+		log:        log,
+	}
+
+	go w.loop(trackCtx, clientCtx)
+
+	return w
+}
+
+// write queues the packet, the packet can be reused by the caller after this returns.
+// The source is the pooled packet that owns the payload, it is retained until the packet is written.
+// Without a source the payload is copied to the pool.
+// It returns false if the packet is dropped because the queue is full.
+func (w *packetWriter) write(p *rtp.Packet, source *rtppool.RetainablePacket) bool {
+	queued := queuedPacket{packet: *p}
+
+	if source == nil {
+		queued.source = w.pool.NewPacket(&p.Header, p.Payload)
+		if queued.source == nil {
+			w.dropped.Add(1)
+			return false
+		}
+
+		queued.packet.Header = *queued.source.Header()
+		queued.packet.Payload = queued.source.Payload()
+	} else {
+		if err := source.Retain(); err != nil {
+			w.dropped.Add(1)
+			return false
+		}
+
+		queued.source = source
+	}
+
+	select {
+	case w.queue <- queued:
+		w.meter.addOutbound(queued.packet.MarshalSize())
+
+		return true
+	default:
+		queued.source.Release()
+		w.dropped.Add(1)
+
+		return false
+	}
+}
+
+// Dropped returns the number of packets dropped because the subscriber can't keep up
+func (w *packetWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+func (w *packetWriter) loop(trackCtx, clientCtx context.Context) {
+	defer w.drain()
+
+	for {
+		select {
+		case <-trackCtx.Done():
+			return
+		case <-clientCtx.Done():
+			return
+		case queued := <-w.queue:
+			if err := w.localTrack.WriteRTP(&queued.packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				w.log.Errorf("packetwriter: error on write rtp %s", err.Error())
+			}
+
+			queued.source.Release()
+		}
+	}
+}
+
+// drain releases the queued packets back to the pool
+func (w *packetWriter) drain() {
+	for {
+		select {
+		case queued := <-w.queue:
+			queued.source.Release()
+		default:
+			return
+		}
+	}
+}
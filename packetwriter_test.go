@@ -0,0 +1,126 @@
+package sfu
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/inlivedev/sfu/pkg/rtppool"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketWriterDropsWhenQueueIsFull(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "stream")
+	require.NoError(t, err)
+
+	// the writer loop is not started yet to simulate a stalled subscriber
+	w := &packetWriter{
+		localTrack: localTrack,
+		pool:       rtppool.New(),
+		queue:      make(chan queuedPacket, packetWriterQueueSize),
+		log:        TestLogger,
+	}
+
+	p := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{0x01, 0x02}}
+
+	for i := 0; i < packetWriterQueueSize; i++ {
+		p.SequenceNumber = uint16(i)
+		require.True(t, w.write(p, nil))
+	}
+
+	// the queued packets are copies, the caller can reuse the packet
+	p.Payload[0] = 0xff
+	queued := <-w.queue
+	require.Equal(t, byte(0x01), queued.packet.Payload[0])
+	queued.source.Release()
+
+	require.True(t, w.write(p, nil))
+	require.False(t, w.write(p, nil))
+	require.False(t, w.write(p, nil))
+	require.Equal(t, uint64(2), w.Dropped())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clientCtx, cancelClient := context.WithCancel(context.Background())
+	defer cancelClient()
+
+	done := make(chan struct{})
+	go func() {
+		w.loop(ctx, clientCtx)
+		close(done)
+	}()
+
+	// the queue is written to the local track once the subscriber is writable again
+	require.Eventually(t, func() bool {
+		return len(w.queue) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	require.True(t, w.write(p, nil))
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("packet writer loop is not stopped")
+	}
+
+	require.Equal(t, uint64(2), w.Dropped())
+}
+
+func TestPacketWriterRetainsSharedPacket(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool := rtppool.New()
+
+	newWriter := func() *packetWriter {
+		localTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "stream")
+		require.NoError(t, err)
+
+		return newPacketWriter(ctx, ctx, localTrack, pool, nil, TestLogger)
+	}
+
+	writers := []*packetWriter{newWriter(), newWriter()}
+
+	source := pool.NewPacket(&rtp.Header{Version: 2}, []byte{0x01, 0x02})
+
+	// the source packet is shared by the writers, each writer rewrites its own header
+	for i, w := range writers {
+		p := pool.GetPacket()
+		p.Header = source.Header().Clone()
+		p.Header.SequenceNumber = uint16(i)
+		p.Payload = source.Payload()
+
+		require.True(t, w.write(p, source))
+
+		pool.PutPacket(p)
+	}
+
+	// the reader releases its reference after the fan out, the writers still hold the packet
+	source.Release()
+
+	// the source is returned to the pool once both writers have written the packet
+	require.Eventually(t, func() bool {
+		for _, w := range writers {
+			if len(w.queue) > 0 {
+				return false
+			}
+		}
+
+		if err := source.Retain(); err != nil {
+			return true
+		}
+
+		source.Release()
+
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
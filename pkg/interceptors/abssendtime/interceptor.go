@@ -0,0 +1,85 @@
+package abssendtime
+
+import (
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+type InterceptorFactory struct {
+	log logging.LeveledLogger
+}
+
+func NewInterceptor(log logging.LeveledLogger) *InterceptorFactory {
+	return &InterceptorFactory{
+		log: log,
+	}
+}
+
+// NewInterceptor constructs a new abs-send-time Interceptor
+func (g *InterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &Interceptor{
+		log: g.log,
+	}, nil
+}
+
+// Interceptor stamps the outgoing RTP packets with the abs-send-time header extension.
+// The forwarded packets carry the publisher send time under the publisher negotiated ID,
+// so the SFU replaces it with its own send time under the subscriber negotiated ID.
+type Interceptor struct {
+	interceptor.NoOp
+	log logging.LeveledLogger
+}
+
+// BindLocalStream lets you modify any outgoing RTP packets. It is called once for per LocalStream. The returned method
+// will be called once per rtp packet.
+func (v *Interceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	extID := getHeaderExtensionID(info, sdp.ABSSendTimeURI)
+	if extID == 0 {
+		return writer
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		v.addAbsSendTime(header, extID, time.Now())
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+func (v *Interceptor) addAbsSendTime(header *rtp.Header, extID uint8, now time.Time) {
+	payload, err := rtp.NewAbsSendTimeExtension(now).Marshal()
+	if err != nil {
+		v.log.Errorf("error on marshal abs-send-time payload: ", err)
+		return
+	}
+
+	// the extensions slice can be shared with the packets written to the other subscribers
+	header.Extensions = append([]rtp.Extension(nil), header.Extensions...)
+
+	if err := header.SetExtension(extID, payload); err != nil {
+		v.log.Errorf("error on set abs-send-time extension: ", err)
+	}
+}
+
+func RegisterAbsSendTimeHeaderExtension(m *webrtc.MediaEngine) {
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.ABSSendTimeURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		panic(err)
+	}
+
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.ABSSendTimeURI}, webrtc.RTPCodecTypeVideo); err != nil {
+		panic(err)
+	}
+}
+
+func getHeaderExtensionID(streamInfo *interceptor.StreamInfo, uri string) uint8 {
+	for _, extension := range streamInfo.RTPHeaderExtensions {
+		if extension.URI == uri {
+			return uint8(extension.ID)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,34 @@
+package abssendtime
+
+import (
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbsSendTimeExtension(t *testing.T) {
+	factory := NewInterceptor(logging.NewDefaultLoggerFactory().NewLogger("test"))
+	i, err := factory.NewInterceptor("")
+	require.NoError(t, err)
+
+	info := &interceptor.StreamInfo{
+		RTPHeaderExtensions: []interceptor.RTPHeaderExtension{{URI: sdp.ABSSendTimeURI, ID: 3}},
+	}
+
+	var written *rtp.Header
+	writer := i.BindLocalStream(info, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+		written = header
+		return len(payload), nil
+	}))
+
+	_, err = writer.Write(&rtp.Header{Version: 2}, []byte{0x00}, nil)
+	require.NoError(t, err)
+
+	ext := &rtp.AbsSendTimeExtension{}
+	require.NoError(t, ext.Unmarshal(written.GetExtension(3)))
+	require.NotZero(t, ext.Timestamp)
+}
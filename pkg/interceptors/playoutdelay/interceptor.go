@@ -1,6 +1,8 @@
 package playoutdelay
 
 import (
+	"sync/atomic"
+
 	"github.com/pion/interceptor"
 	"github.com/pion/logging"
 	"github.com/pion/rtp"
@@ -8,36 +10,51 @@ import (
 )
 
 type InterceptorFactory struct {
-	minDelay, maxDelay uint16
-	log                logging.LeveledLogger
+	payload *atomic.Pointer[[]byte]
+	log     logging.LeveledLogger
 }
 
 func NewInterceptor(log logging.LeveledLogger, minDelay, maxDelay uint16) *InterceptorFactory {
-	return &InterceptorFactory{
-		minDelay: minDelay,
-		maxDelay: maxDelay,
-		log:      log,
+	factory := &InterceptorFactory{
+		payload: &atomic.Pointer[[]byte]{},
+		log:     log,
+	}
+
+	if err := factory.SetDelay(minDelay, maxDelay); err != nil {
+		log.Errorf("error on marshal playout delay payload", err)
 	}
+
+	return factory
 }
 
 // NewInterceptor constructs a new ReceiverInterceptor
 func (g *InterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
-	i := new(g.log, g.minDelay, g.maxDelay)
+	i := new(g.log, g.payload)
 
 	return i, nil
 }
 
+// SetDelay changes the playout delay in milliseconds that is added to the next packets of all the streams
+func (g *InterceptorFactory) SetDelay(minDelay, maxDelay uint16) error {
+	payload, err := PlayoutDelayFromValue(minDelay, maxDelay).Marshal()
+	if err != nil {
+		return err
+	}
+
+	g.payload.Store(&payload)
+
+	return nil
+}
+
 type Interceptor struct {
-	minDelay uint16
-	maxDelay uint16
-	log      logging.LeveledLogger
+	payload *atomic.Pointer[[]byte]
+	log     logging.LeveledLogger
 }
 
-func new(log logging.LeveledLogger, min, max uint16) *Interceptor {
+func new(log logging.LeveledLogger, payload *atomic.Pointer[[]byte]) *Interceptor {
 	return &Interceptor{
-		minDelay: min,
-		maxDelay: max,
-		log:      log,
+		payload: payload,
+		log:     log,
 	}
 }
 
@@ -46,15 +63,12 @@ func new(log logging.LeveledLogger, min, max uint16) *Interceptor {
 func (v *Interceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
 	extID := v.getHeaderExtensionID(info, PlayoutDelayURI)
 
-	playOutDelay := PlayoutDelayFromValue(v.minDelay, v.maxDelay)
-
-	payloadDelay, err := playOutDelay.Marshal()
-	if err != nil {
-		v.log.Errorf("error on marshal playout delay payload", err)
-		return writer
-	}
-
 	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		var payloadDelay []byte
+		if p := v.payload.Load(); p != nil {
+			payloadDelay = *p
+		}
+
 		newHeader := v.addPlayoutDelay(info, header, extID, payloadDelay)
 		return writer.Write(newHeader, payload, attributes)
 	})
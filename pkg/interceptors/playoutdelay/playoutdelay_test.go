@@ -5,6 +5,9 @@ package playoutdelay
 import (
 	"testing"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
 	"github.com/stretchr/testify/require"
 )
 
@@ -35,3 +38,31 @@ func TestPlayoutDelay(t *testing.T) {
 	require.Equal(t, uint16((1<<12)-1)*10, p5.Min)
 	require.Equal(t, uint16((1<<12)-1)*10, p5.Max)
 }
+
+func TestInterceptorSetDelay(t *testing.T) {
+	factory := NewInterceptor(logging.NewDefaultLoggerFactory().NewLogger("test"), 100, 200)
+
+	i, err := factory.NewInterceptor("")
+	require.NoError(t, err)
+
+	info := &interceptor.StreamInfo{
+		RTPHeaderExtensions: []interceptor.RTPHeaderExtension{{URI: PlayoutDelayURI, ID: 5}},
+	}
+
+	var delay PlayOutDelay
+
+	writer := i.BindLocalStream(info, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		return 0, delay.Unmarshal(header.GetExtension(5))
+	}))
+
+	_, err = writer.Write(&rtp.Header{}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, PlayOutDelay{Min: 100, Max: 200}, delay)
+
+	// the new delay is added to the next packets of the bound streams
+	require.NoError(t, factory.SetDelay(400, 1000))
+
+	_, err = writer.Write(&rtp.Header{}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, PlayOutDelay{Min: 400, Max: 1000}, delay)
+}
@@ -24,10 +24,11 @@ func New() *RTPPool {
 	}
 }
 
+// PutPacket returns the packet to the pool. The payload is not cleared because the packet doesn't own it,
+// the payload can be shared with the other packets and is returned to the pool by its owner.
 func (r *RTPPool) PutPacket(localPacket *rtp.Packet) {
-
 	localPacket.Header = rtp.Header{}
-	copy(localPacket.Payload, blankPayload)
+	localPacket.Payload = nil
 
 	r.pool.Put(localPacket)
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/logging"
 	"github.com/pion/rtp"
+	"golang.org/x/exp/slices"
 )
 
 type remoteTrack struct {
@@ -29,14 +30,17 @@ type remoteTrack struct {
 	currentBytesReceived  *atomic.Uint64
 	latestUpdatedTS       *atomic.Uint64
 	lastPLIRequestTime    time.Time
+	keyframeInterval      time.Duration
+	pendingPLI            bool
 	onEndedCallbacks      []func()
 	statsGetter           stats.Getter
 	onStatsUpdated        func(*stats.Stats)
 	log                   logging.LeveledLogger
 	rtppool               *rtppool.RTPPool
+	forwarders            *forwarderGroup
 }
 
-func newRemoteTrack(ctx context.Context, log logging.LeveledLogger, useBuffer bool, track IRemoteTrack, minWait, maxWait, pliInterval time.Duration, onPLI func(), statsGetter stats.Getter, onStatsUpdated func(*stats.Stats), onRead func(interceptor.Attributes, *rtp.Packet), pool *rtppool.RTPPool, onNetworkConditionChanged func(networkmonitor.NetworkConditionType)) *remoteTrack {
+func newRemoteTrack(ctx context.Context, log logging.LeveledLogger, useBuffer bool, track IRemoteTrack, minWait, maxWait, pliInterval, keyframeInterval time.Duration, onPLI func(), statsGetter stats.Getter, onStatsUpdated func(*stats.Stats), onRead func(interceptor.Attributes, *rtp.Packet), pool *rtppool.RTPPool, forwarders *forwarderGroup, onNetworkConditionChanged func(networkmonitor.NetworkConditionType)) *remoteTrack {
 	localctx, cancel := context.WithCancel(ctx)
 
 	rt := &remoteTrack{
@@ -52,15 +56,23 @@ func newRemoteTrack(ctx context.Context, log logging.LeveledLogger, useBuffer bo
 		statsGetter:           statsGetter,
 		onStatsUpdated:        onStatsUpdated,
 		onPLI:                 onPLI,
+		keyframeInterval:      keyframeInterval,
 		onRead:                onRead,
 		log:                   log,
 		rtppool:               pool,
+		forwarders:            forwarders,
 	}
 
 	if pliInterval > 0 {
 		rt.enableIntervalPLI(pliInterval)
 	}
 
+	// the SFU is stopping and already waits for the forwarding goroutines, so the track is ended right away
+	if forwarders != nil && !forwarders.add() {
+		rt.forwarders = nil
+		rt.cancel()
+	}
+
 	go rt.readRTP()
 
 	return rt
@@ -71,6 +83,10 @@ func (t *remoteTrack) Context() context.Context {
 }
 
 func (t *remoteTrack) readRTP() {
+	if t.forwarders != nil {
+		defer t.forwarders.done()
+	}
+
 	readCtx, cancel := context.WithCancel(t.context)
 
 	defer cancel()
@@ -118,7 +134,7 @@ func (t *remoteTrack) readRTP() {
 				continue
 			}
 
-			if !t.IsRelay() {
+			if !t.IsRelay() && t.statsGetter != nil {
 				go t.updateStats()
 			}
 
@@ -179,21 +195,44 @@ func (t *remoteTrack) Track() IRemoteTrack {
 	return t.track
 }
 
+// sendPLI requests a keyframe from the publisher at most once per keyframe interval.
+// The requests within the interval are coalesced into a single PLI sent at the end of the interval,
+// so the subscribers that request it late still receive a keyframe.
 func (t *remoteTrack) sendPLI() {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	// return if there is a pending PLI request
-	maxGapSeconds := 250 * time.Millisecond
+	// a PLI is already scheduled at the end of the interval
+	if t.pendingPLI {
+		return
+	}
+
 	requestGap := time.Since(t.lastPLIRequestTime)
 
-	if requestGap < maxGapSeconds {
-		return // ignore PLI request
+	if requestGap >= t.keyframeInterval {
+		t.lastPLIRequestTime = time.Now()
+
+		go t.onPLI()
+
+		return
 	}
 
-	t.lastPLIRequestTime = time.Now()
+	t.pendingPLI = true
+
+	time.AfterFunc(t.keyframeInterval-requestGap, func() {
+		t.mu.Lock()
+		t.pendingPLI = false
+
+		if t.context.Err() != nil {
+			t.mu.Unlock()
+			return
+		}
+
+		t.lastPLIRequestTime = time.Now()
+		t.mu.Unlock()
 
-	go t.onPLI()
+		t.onPLI()
+	})
 }
 
 func (t *remoteTrack) enableIntervalPLI(interval time.Duration) {
@@ -228,9 +267,10 @@ func (t *remoteTrack) OnEnded(f func()) {
 
 func (t *remoteTrack) onEnded() {
 	t.mu.RLock()
-	defer t.mu.RUnlock()
+	callbacks := slices.Clone(t.onEndedCallbacks)
+	t.mu.RUnlock()
 
-	for _, f := range t.onEndedCallbacks {
-		f()
+	for _, f := range callbacks {
+		callUserCallback(t.log, "OnEnded", f)
 	}
 }
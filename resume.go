@@ -0,0 +1,97 @@
+package sfu
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+var (
+	ErrInvalidResumeToken = errors.New("client: error invalid resume token")
+)
+
+// clientSession is the state of the stale client that is carried over to the resumed client
+type clientSession struct {
+	metadata      map[string]interface{}
+	subscriptions []SubscribeTrackRequest
+}
+
+// ResumeToken returns the token to resume the client session when the same user reconnects with a new peer connection.
+// Pass it as ClientOptions.ResumeToken of the new client to keep the metadata and the subscriptions without a full re-sync.
+// The token is issued for each client, so the resumed client has a new token.
+func (c *Client) ResumeToken() string {
+	return c.resumeToken
+}
+
+// isResumeToken compares the token in constant time, so the token can't be guessed from the response time
+func (c *Client) isResumeToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(c.resumeToken), []byte(token)) == 1
+}
+
+// endForResume ends the stale client and returns its session to be resumed by the new client
+func (c *Client) endForResume() *clientSession {
+	session := &clientSession{
+		metadata:      c.meta.toMap(),
+		subscriptions: make([]SubscribeTrackRequest, 0),
+	}
+
+	for _, track := range c.publishedTracks.GetTracks() {
+		session.subscriptions = append(session.subscriptions, SubscribeTrackRequest{
+			ClientID: track.ClientID(),
+			TrackID:  track.ID(),
+		})
+	}
+
+	c.mu.Lock()
+	session.subscriptions = append(session.subscriptions, c.pendingReceivedTracks...)
+	c.mu.Unlock()
+
+	c.log.Infof("client: end stale client %s to resume the session", c.ID())
+
+	// remove the client from the SFU before the peer connection is closed, so the new client can use the same ID
+	c.afterClosed()
+
+	if err := c.stop(); err != nil {
+		c.log.Errorf("client: error stop stale client %s", err.Error())
+	}
+
+	return session
+}
+
+// resume restores the metadata and the subscriptions of the stale client.
+// The subscriptions are added once the client is connected, the tracks that are no longer published are skipped.
+func (c *Client) resume(session *clientSession) {
+	for key, value := range session.metadata {
+		c.meta.Set(key, value)
+	}
+
+	subscriptions := make([]SubscribeTrackRequest, 0, len(session.subscriptions))
+
+	for _, track := range session.subscriptions {
+		if track.ClientID == c.ID() || !c.sfu.isTrackPublished(track) {
+			continue
+		}
+
+		subscriptions = append(subscriptions, track)
+	}
+
+	c.log.Infof("client: %s resume session with %d tracks", c.ID(), len(subscriptions))
+
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	if err := c.SubscribeTracks(subscriptions); err != nil {
+		c.log.Errorf("client: error resume subscriptions %s", err.Error())
+	}
+}
+
+// clientByResumeToken returns the client that issued the resume token
+func (s *SFU) clientByResumeToken(token string) (*Client, error) {
+	for _, client := range s.clients.GetClients() {
+		if client.isResumeToken(token) {
+			return client, nil
+		}
+	}
+
+	return nil, ErrInvalidResumeToken
+}
@@ -5,7 +5,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pion/logging"
 	"github.com/pion/webrtc/v4"
+	"golang.org/x/exp/slices"
 )
 
 const (
@@ -13,6 +15,15 @@ const (
 	StateRoomClosed     = "closed"
 	EventRoomClosed     = "room_closed"
 	EventRoomClientLeft = "room_client_left"
+
+	// MinPLIInterval is the minimum interval of sending PLIs, to prevent flooding the publishers with keyframe requests
+	MinPLIInterval = 500 * time.Millisecond
+	// DefaultKeyframeRequestInterval is the default minimum interval between the keyframe requests sent to a publisher track
+	DefaultKeyframeRequestInterval = 500 * time.Millisecond
+	// DefaultBitrateWindow is the default duration of the sliding window that the track bitrates are measured over
+	DefaultBitrateWindow = time.Second
+	// DefaultNegotiationWindow is the default duration that the renegotiation requests of a client are batched in
+	DefaultNegotiationWindow = 100 * time.Millisecond
 )
 
 type Options struct {
@@ -24,6 +35,12 @@ type Options struct {
 	// SettingEngine is used to configure the WebRTC engine
 	// Use this to configure use of enable/disable mDNS, network types, use single port mux, etc.
 	SettingEngine *webrtc.SettingEngine
+	// Log is the logger used by the manager and passed to the rooms and clients.
+	// Implement the pion logging.LeveledLogger interface to integrate other loggers like zap or zerolog.
+	// The default logger is used if it's nil.
+	Log logging.LeveledLogger
+	// MetadataStore persists the room metadata across the server restarts, the metadata is in memory only if it's nil.
+	MetadataStore MetadataStore
 }
 
 func DefaultOptions() Options {
@@ -61,6 +78,7 @@ type Room struct {
 	RenegotiationChan       map[string]chan bool
 	name                    string
 	mu                      *sync.RWMutex
+	muAddClient             sync.Mutex
 	meta                    *Metadata
 	sfu                     *SFU
 	state                   string
@@ -74,28 +92,73 @@ type Room struct {
 type RoomOptions struct {
 	// Configures the bitrates configuration that will be used by the room
 	// Make sure to use the same bitrate config when publishing video because this is used to manage the usage bandwidth in this room
+	// The video bitrates must be ordered from high to low, otherwise NewRoom returns ErrInvalidBitrates
 	Bitrates BitrateConfigs `json:"bitrates,omitempty"`
 	// Configures the codecs that will be used by the room
 	Codecs *[]string `json:"codecs,omitempty" enums:"video/AV1,video/VP9,video/H264,video/VP8,audio/red,audio/opus" example:"video/VP9,video/H264,video/VP8,audio/red,audio/opus"`
 	// Configures the interval in nanoseconds of sending PLIs to clients that will generate keyframe, default is 0 means it will use auto PLI request only when needed.
 	// More often means more bandwidth usage but more stability on video quality when packet loss, but client libs supposed to request PLI automatically when needed.
+	// The interval must be at least 500ms (MinPLIInterval) if it's not 0.
 	PLIInterval *time.Duration `json:"pli_interval_ns,omitempty" example:"0"`
+	// Configures the minimum interval in nanoseconds between the keyframe requests sent to a publisher track.
+	// The requests from the new subscribers and the quality switches within the interval are coalesced into a single PLI at the end of the interval,
+	// to prevent the PLI storm in a busy room that degrades the publisher bitrate. Default is 500ms, 0 means no limit.
+	KeyframeRequestInterval *time.Duration `json:"keyframe_request_interval_ns,omitempty" example:"500000000"`
 	// Configure the mapping of spatsial and temporal layers to quality level
 	// Use this to use scalable video coding (SVC) to control the bitrate level of the video
 	QualityLevels []QualityLevel `json:"quality_levels,omitempty"`
 	// Configure the timeout in nanonseconds when the room is empty it will close after the timeout exceeded. Default is 5 minutes
 	EmptyRoomTimeout *time.Duration `json:"empty_room_timeout_ns,ompitempty" example:"300000000000" default:"300000000000"`
+	// Broadcast the client metadata changes to all clients in the room as JSON messages over the "_meta" data channel
+	BroadcastMetadata bool `json:"broadcast_metadata,omitempty"`
+	// The maximum number of clients in the room, adding more clients returns ErrRoomFull. Default is 0 means unlimited.
+	// The ended clients that are still cleaned up are not counted.
+	MaxClients int `json:"max_clients,omitempty" example:"0"`
+	// Configures the duration in nanoseconds of the sliding window that the track bitrates in bits per second are measured over.
+	// The bitrate controller selects the video quality based on these bitrates. A short window reacts faster to the bandwidth changes
+	// but the bitrates are jittery, a long window is smoother but slower to react. Default is 1s.
+	BitrateWindow *time.Duration `json:"bitrate_window_ns,omitempty" example:"1000000000"`
+	// Configures the duration in nanoseconds that the track adds and removes are batched in before a client is renegotiated.
+	// The changes within the window are sent to the client in a single renegotiation, so a longer window reduces
+	// the signaling load when many clients join or leave at once, but the tracks are added later. Default is 100ms.
+	NegotiationWindow *time.Duration `json:"negotiation_window_ns,omitempty" example:"100000000"`
+	// Configures the fmtp line of the Opus codec, use it to negotiate the stereo audio or the inband FEC and DTX for music use cases.
+	// The parameters must be in the key=value;key=value format, otherwise NewRoom returns ErrInvalidFmtpLine.
+	// Default is empty means it will use DefaultOpusFmtpLine.
+	OpusFmtpLine string `json:"opus_fmtp_line,omitempty" example:"minptime=10;useinbandfec=1;stereo=1"`
+	// Configures the limit in bits per second of the total bitrate forwarded to all the subscribers in the room.
+	// When the limit is exceeded, the simulcast subscribers are forced down one layer at a time until the bitrate is under the limit.
+	// Use SFU.GetBandwidthUsage to get the current usage. Default is 0 means unlimited.
+	BandwidthLimit uint64 `json:"bandwidth_limit,omitempty" example:"0"`
+	// Configures the maximum number of simulcast layers that are received from the publishers, from 1 to 3, otherwise NewRoom returns ErrInvalidMaxSimulcastLayers.
+	// The highest layers above the limit are not read at all, 2 drops the high layer and 1 keeps only the low layer.
+	// Use it to save the CPU on constrained servers, the tradeoff is that the subscribers with enough bandwidth
+	// can't receive the video in a better quality than the highest received layer. Default is 0 means all 3 layers.
+	MaxSimulcastLayers int `json:"max_simulcast_layers,omitempty" example:"3"`
+	// Stop the room SFU when the last client leaves and no client joins during the EmptyGracePeriod, to free the resources of the ephemeral rooms.
+	// A client that joins during the grace period cancels the stop, the clients added after the stop started get ErrRoomIsClosed.
+	// The room is closed like Room.Close, OnRoomClosed is called and the room is removed from the manager, so its ID can be reused.
+	StopWhenEmpty bool `json:"stop_when_empty,omitempty"`
+	// Configures the duration in nanoseconds to wait for a new client before the empty room SFU is stopped, used with StopWhenEmpty.
+	// Default is 0 means the SFU is stopped right after the last client leaves.
+	EmptyGracePeriod time.Duration `json:"empty_grace_period_ns,omitempty" example:"0"`
 }
 
 func DefaultRoomOptions() RoomOptions {
 	pli := time.Duration(0)
+	keyframeRequestInterval := DefaultKeyframeRequestInterval
+	bitrateWindow := DefaultBitrateWindow
+	negotiationWindow := DefaultNegotiationWindow
 	emptyDuration := time.Duration(3) * time.Minute
 	return RoomOptions{
-		Bitrates:         DefaultBitrates(),
-		QualityLevels:    DefaultQualityLevels(),
-		Codecs:           &[]string{webrtc.MimeTypeAV1, webrtc.MimeTypeVP9, webrtc.MimeTypeH264, webrtc.MimeTypeVP8, "audio/red", webrtc.MimeTypeOpus},
-		PLIInterval:      &pli,
-		EmptyRoomTimeout: &emptyDuration,
+		Bitrates:                DefaultBitrates(),
+		QualityLevels:           DefaultQualityLevels(),
+		Codecs:                  &[]string{webrtc.MimeTypeAV1, webrtc.MimeTypeVP9, webrtc.MimeTypeH264, webrtc.MimeTypeVP8, "audio/red", webrtc.MimeTypeOpus},
+		PLIInterval:             &pli,
+		EmptyRoomTimeout:        &emptyDuration,
+		KeyframeRequestInterval: &keyframeRequestInterval,
+		BitrateWindow:           &bitrateWindow,
+		NegotiationWindow:       &negotiationWindow,
 	}
 }
 
@@ -112,7 +175,7 @@ func newRoom(id, name string, sfu *SFU, kind string, opts RoomOptions) *Room {
 		state:      StateRoomOpen,
 		name:       name,
 		mu:         &sync.RWMutex{},
-		meta:       NewMetadata(),
+		meta:       newMetadata(localContext, sfu.log),
 		extensions: make([]IExtension, 0),
 		kind:       kind,
 		options:    opts,
@@ -122,6 +185,13 @@ func newRoom(id, name string, sfu *SFU, kind string, opts RoomOptions) *Room {
 		room.onClientLeft(client)
 	})
 
+	// the empty room is closed like Room.Close, so the OnRoomClosed callbacks release the room resources
+	sfu.setOnEmptyStop(func() {
+		if err := room.Close(); err != nil && err != ErrRoomIsClosed {
+			sfu.log.Errorf("room: error close empty room %s", err.Error())
+		}
+	})
+
 	go room.loopRecordStats()
 
 	return room
@@ -147,23 +217,35 @@ func (r *Room) AddExtension(extension IExtension) {
 // All clients will get `connectionstateevent` with `closed` state.
 // https://developer.mozilla.org/en-US/docs/Web/API/RTCPeerConnection/connectionstatechange_event
 func (r *Room) Close() error {
+	// the state is checked and set under the lock, the empty room can be closed concurrently by the SFU
+	r.mu.Lock()
 	if r.state == StateRoomClosed {
+		r.mu.Unlock()
 		return ErrRoomIsClosed
 	}
 
+	r.state = StateRoomClosed
+	r.mu.Unlock()
+
 	r.cancel()
 
-	r.sfu.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	err := r.sfu.Stop(ctx)
 
+	// the callbacks are called without the lock, so a callback can read the room
 	r.mu.RLock()
-	defer r.mu.RUnlock()
-	for _, callback := range r.onRoomClosedCallbacks {
-		callback(r.id)
-	}
+	callbacks := slices.Clone(r.onRoomClosedCallbacks)
+	r.mu.RUnlock()
 
-	r.state = StateRoomClosed
+	for _, callback := range callbacks {
+		callUserCallback(r.sfu.log, "OnRoomClosed", func() {
+			callback(r.id)
+		})
+	}
 
-	return nil
+	return err
 }
 
 // Stopping client is async, it will just stop the client and return immediately
@@ -183,30 +265,79 @@ func (r *Room) StopClient(id string) error {
 	return client.stop()
 }
 
+// activeClientsCount returns the number of clients in the room that are not ended yet
+func (r *Room) activeClientsCount() int {
+	count := 0
+
+	for _, client := range r.sfu.GetClients() {
+		if client.state.Load() != ClientStateEnded {
+			count++
+		}
+	}
+
+	return count
+}
+
 func (r *Room) AddClient(id, name string, opts ClientOptions) (*Client, error) {
-	if r.state == StateRoomClosed {
+	r.mu.RLock()
+	closed := r.state == StateRoomClosed
+	r.mu.RUnlock()
+
+	if closed {
 		return nil, ErrRoomIsClosed
 	}
 
 	opts.qualityLevels = r.options.QualityLevels
 
 	for _, ext := range r.extensions {
-		if err := ext.OnBeforeClientAdded(r, id); err != nil {
+		// the client is rejected if the extension panics
+		err := ErrExtensionPanic
+
+		callUserCallback(r.sfu.log, "OnBeforeClientAdded", func() {
+			err = ext.OnBeforeClientAdded(r, id)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// make sure the concurrent clients can't pass the limit check before they are added
+	r.muAddClient.Lock()
+
+	if opts.ResumeToken != "" {
+		if _, err := r.sfu.clientByResumeToken(opts.ResumeToken); err != nil {
+			r.muAddClient.Unlock()
 			return nil, err
 		}
 	}
 
+	// the stale client with the same ID is replaced when its session is resumed
 	client, _ := r.sfu.GetClient(id)
-	if client != nil {
-		return nil, ErrClientExists
+	if client != nil && (opts.ResumeToken == "" || !client.isResumeToken(opts.ResumeToken)) {
+		r.muAddClient.Unlock()
+		return nil, &ClientError{ClientID: id, Err: ErrClientExists}
+	}
+
+	// the resumed session replaces the stale client, so it doesn't change the clients count
+	if r.options.MaxClients > 0 && opts.ResumeToken == "" && r.activeClientsCount() >= r.options.MaxClients {
+		r.muAddClient.Unlock()
+		return nil, ErrRoomFull
 	}
 
-	client = r.sfu.NewClient(id, name, opts)
+	client, err := r.sfu.newClient(id, name, opts)
+
+	r.muAddClient.Unlock()
+
+	if err != nil {
+		// the empty room SFU is stopping, the client can't join anymore
+		return nil, ErrRoomIsClosed
+	}
 
 	// stop client if not connecting for a specific time
 	initConnection := true
 	go func() {
-		timeout, cancel := context.WithTimeout(client.context, opts.IdleTimeout)
+		timeout, cancel := context.WithTimeout(client.context, client.options.IdleTimeout)
 		defer cancel()
 
 		mu := sync.Mutex{}
@@ -266,11 +397,15 @@ func (r *Room) onClientLeft(client *Client) {
 	exts := r.extensions
 	r.mu.RUnlock()
 	for _, callback := range callbacks {
-		callback(client)
+		callUserCallback(r.sfu.log, "OnClientLeft", func() {
+			callback(client)
+		})
 	}
 
 	for _, ext := range exts {
-		ext.OnClientRemoved(r, client)
+		callUserCallback(r.sfu.log, "OnClientRemoved", func() {
+			ext.OnClientRemoved(r, client)
+		})
 	}
 
 	// update the latest stats from client before they left
@@ -282,11 +417,15 @@ func (r *Room) onClientLeft(client *Client) {
 
 func (r *Room) onClientJoined(client *Client) {
 	for _, callback := range r.onClientJoinedCallbacks {
-		callback(client)
+		callUserCallback(r.sfu.log, "OnClientJoined", func() {
+			callback(client)
+		})
 	}
 
 	for _, ext := range r.extensions {
-		ext.OnClientAdded(r, client)
+		callUserCallback(r.sfu.log, "OnClientAdded", func() {
+			ext.OnClientAdded(r, client)
+		})
 	}
 }
 
@@ -411,6 +550,14 @@ func (r *Room) Meta() *Metadata {
 	return r.meta
 }
 
+// Snapshot returns the state of the clients in the room including the room metadata.
+func (r *Room) Snapshot() RoomSnapshot {
+	snapshot := r.sfu.Snapshot()
+	snapshot.Metadata = r.meta.toMap()
+
+	return snapshot
+}
+
 func (r *Room) Options() RoomOptions {
 	return r.options
 }
@@ -21,9 +21,15 @@ type TrackSentStats struct {
 	FractionLost   float64             `json:"fraction_lost"`
 	BytesSent      uint64              `json:"bytes_sent"`
 	CurrentBitrate uint32              `json:"current_bitrate"`
+	TargetBitrate  uint32              `json:"target_bitrate"`
 	Source         string              `json:"source"`
 	Quality        QualityLevel        `json:"quality"`
 	MaxQuality     QualityLevel        `json:"max_quality"`
+	Muted          bool                `json:"muted"`
+	// the duration from the track subscribed until the first frame forwarded, 0 if not forwarded yet
+	TimeToFirstFrame time.Duration `json:"time_to_first_frame"`
+	// the packets dropped by the SFU because the client can't keep up with the track
+	PacketsDropped uint64 `json:"packets_dropped"`
 }
 
 type TrackReceivedStats struct {
@@ -36,6 +42,10 @@ type TrackReceivedStats struct {
 	PacketsLost     int64               `json:"packets_lost"`
 	PacketsReceived uint64              `json:"packets_received"`
 	BytesReceived   int64               `json:"bytes_received"`
+	// the interarrival jitter in seconds
+	Jitter float64 `json:"jitter"`
+	// the number of NACKs sent to the publisher to request the lost packets retransmission
+	NACKCount uint32 `json:"nack_count"`
 }
 
 type ClientTrackStats struct {
@@ -49,6 +59,15 @@ type ClientTrackStats struct {
 	Receives                 []TrackReceivedStats `json:"received_track_stats"`
 	// in milliseconds
 	VoiceActivityDurationMS uint32 `json:"voice_activity_duration_ms"`
+	// the candidate types of the selected ICE candidate pair: host, srflx, prflx, or relay
+	LocalCandidateType  string `json:"local_candidate_type"`
+	RemoteCandidateType string `json:"remote_candidate_type"`
+	// true if the client or the SFU is connected through a TURN relay
+	Relayed bool `json:"relayed"`
+	// the protocol between the SFU and its TURN server when the local candidate is relay: udp, tcp, tls, or dtls
+	RelayProtocol string `json:"relay_protocol"`
+	// the total packets dropped by the SFU on all sent tracks because the client can't keep up
+	PacketsDropped uint64 `json:"packets_dropped"`
 }
 
 type RoomStats struct {
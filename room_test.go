@@ -2,9 +2,11 @@ package sfu
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pion/logging"
 	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
 )
@@ -353,3 +355,468 @@ func TestRoomAddClientTimeout(t *testing.T) {
 		require.Equal(t, c.ID(), client.ID())
 	}
 }
+
+func TestRoomPLIIntervalValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	pliInterval := 100 * time.Millisecond
+	roomOpts.PLIInterval = &pliInterval
+
+	_, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-pli-interval", RoomTypeLocal, roomOpts)
+	require.ErrorIs(t, err, ErrInvalidPLIInterval)
+
+	pliInterval = MinPLIInterval
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-pli-interval", RoomTypeLocal, roomOpts)
+	require.NoError(t, err)
+	require.Equal(t, MinPLIInterval, testRoom.SFU().PLIInterval())
+	require.Equal(t, DefaultBitrateWindow, testRoom.SFU().BitrateWindow())
+	require.Equal(t, DefaultNegotiationWindow, testRoom.SFU().NegotiationWindow())
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestRoomBitratesValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Bitrates.VideoMid = roomOpts.Bitrates.VideoHigh
+
+	_, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-bitrates", RoomTypeLocal, roomOpts)
+	require.ErrorIs(t, err, ErrInvalidBitrates)
+
+	roomOpts.Bitrates = BitrateConfigs{}
+	_, err = roomManager.NewRoom(roomManager.CreateRoomID(), "test-bitrates", RoomTypeLocal, roomOpts)
+	require.ErrorIs(t, err, ErrInvalidBitrates)
+
+	roomOpts.Bitrates = DefaultBitrates()
+	roomOpts.Bitrates.VideoHigh = 1_500_000
+	roomOpts.Bitrates.VideoMid = 500_000
+	roomOpts.Bitrates.VideoLow = 150_000
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-bitrates", RoomTypeLocal, roomOpts)
+	require.NoError(t, err)
+	require.Equal(t, roomOpts.Bitrates, testRoom.BitrateConfigs())
+
+	require.NoError(t, testRoom.Close())
+}
+
+type testMetadataStore struct {
+	mu    sync.Mutex
+	data  map[string][]byte
+	saved chan string
+}
+
+func (s *testMetadataStore) LoadMetadata(roomID string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.data[roomID]
+	if !ok {
+		return nil, ErrMetaNotFound
+	}
+
+	return data, nil
+}
+
+func (s *testMetadataStore) SaveMetadata(roomID string, data []byte) error {
+	s.mu.Lock()
+	s.data[roomID] = data
+	s.mu.Unlock()
+
+	s.saved <- roomID
+
+	return nil
+}
+
+func TestManagerMetadataStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &testMetadataStore{
+		data:  map[string][]byte{"persistent": []byte(`{"topic":"design review"}`)},
+		saved: make(chan string, 10),
+	}
+
+	opts := sfuOpts
+	opts.MetadataStore = store
+
+	roomManager := NewManager(ctx, "test", opts)
+
+	defer roomManager.Close()
+
+	// the metadata is restored from the store when the room is created
+	testRoom, err := roomManager.NewRoom("persistent", "test-metadata", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err)
+
+	topic, err := testRoom.Meta().Get("topic")
+	require.NoError(t, err)
+	require.Equal(t, "design review", topic)
+
+	// and saved back when it's changed
+	testRoom.Meta().Set("locked", true)
+
+	select {
+	case roomID := <-store.saved:
+		require.Equal(t, "persistent", roomID)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the metadata saved")
+	}
+
+	data, err := store.LoadMetadata("persistent")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"topic":"design review","locked":true}`, string(data))
+
+	exported, err := roomManager.ExportMetadata("persistent")
+	require.NoError(t, err)
+	require.JSONEq(t, string(data), string(exported))
+
+	require.NoError(t, roomManager.ImportMetadata("persistent", []byte(`{"topic":"retro"}`)))
+
+	topic, err = testRoom.Meta().Get("topic")
+	require.NoError(t, err)
+	require.Equal(t, "retro", topic)
+
+	data, err = store.LoadMetadata("persistent")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"topic":"retro"}`, string(data))
+
+	_, err = roomManager.ExportMetadata("unknown")
+	require.ErrorIs(t, err, ErrRoomNotFound)
+	require.ErrorIs(t, roomManager.ImportMetadata("unknown", []byte(`{}`)), ErrRoomNotFound)
+}
+
+func TestRoomMaxSimulcastLayers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+
+	for _, layers := range []int{-1, 4} {
+		roomOpts.MaxSimulcastLayers = layers
+		_, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-simulcast-layers", RoomTypeLocal, roomOpts)
+		require.ErrorIs(t, err, ErrInvalidMaxSimulcastLayers, layers)
+	}
+
+	roomOpts.MaxSimulcastLayers = 2
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-simulcast-layers", RoomTypeLocal, roomOpts)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, testRoom.Close())
+	}()
+
+	// the high layer is dropped, the subscribers are capped to the mid layer
+	s := testRoom.SFU()
+	require.Equal(t, 2, s.simulcastLayers())
+	require.True(t, s.isSimulcastLayerEnabled(QualityLow))
+	require.True(t, s.isSimulcastLayerEnabled(QualityMid))
+	require.False(t, s.isSimulcastLayerEnabled(QualityHigh))
+	require.Equal(t, QualityLevel(QualityMid), s.maxSimulcastQuality())
+
+	s.maxSimulcastLayers = 1
+	require.False(t, s.isSimulcastLayerEnabled(QualityMid))
+	require.Equal(t, QualityLevel(QualityLow), s.maxSimulcastQuality())
+
+	// 0 means all the layers
+	s.maxSimulcastLayers = 0
+	require.Equal(t, 3, s.simulcastLayers())
+	require.True(t, s.isSimulcastLayerEnabled(QualityHigh))
+	require.Equal(t, QualityLevel(QualityHigh), s.maxSimulcastQuality())
+}
+
+func TestRoomStopWhenEmpty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := sfuOpts
+	opts.MetadataStore = &testMetadataStore{data: make(map[string][]byte), saved: make(chan string, 10)}
+
+	roomManager := NewManager(ctx, "test", opts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.StopWhenEmpty = true
+	roomOpts.EmptyGracePeriod = 100 * time.Millisecond
+
+	roomID := roomManager.CreateRoomID()
+	testRoom, err := roomManager.NewRoom(roomID, "test-stop-when-empty", RoomTypeLocal, roomOpts)
+	require.NoError(t, err)
+
+	closed := make(chan string, 1)
+	testRoom.OnRoomClosed(func(id string) {
+		closed <- id
+	})
+
+	client, err := testRoom.AddClient("client", "client", DefaultClientOptions())
+	require.NoError(t, err)
+
+	require.NoError(t, testRoom.StopClient(client.ID()))
+
+	select {
+	case id := <-closed:
+		require.Equal(t, roomID, id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the empty room closed")
+	}
+
+	// the empty room is closed and removed from the manager
+	require.ErrorIs(t, testRoom.Close(), ErrRoomIsClosed)
+	require.Equal(t, 0, roomManager.RoomsCount())
+
+	_, err = roomManager.GetRoom(roomID)
+	require.ErrorIs(t, err, ErrRoomNotFound)
+
+	// the metadata store listeners are removed with the room
+	testRoom.Meta().mu.RLock()
+	require.Empty(t, testRoom.Meta().onChangedCallbacks)
+	require.Empty(t, testRoom.Meta().onBatchChangedCallbacks)
+	testRoom.Meta().mu.RUnlock()
+
+	// the clients can't join the closed room
+	_, err = testRoom.AddClient("late-client", "late-client", DefaultClientOptions())
+	require.ErrorIs(t, err, ErrRoomIsClosed)
+	require.Equal(t, 0, testRoom.SFU().clients.Length())
+
+	// the room ID can be used again
+	newRoom, err := roomManager.NewRoom(roomID, "test-stop-when-empty", RoomTypeLocal, roomOpts)
+	require.NoError(t, err)
+	require.NoError(t, newRoom.Close())
+}
+
+func TestRoomOpusFmtpLine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+
+	for _, fmtpLine := range []string{"stereo", "stereo=1;", "stereo=1;=1", "stereo=1\r\na=ssrc:1 cname:x", "stereo=1; useinbandfec=1"} {
+		roomOpts.OpusFmtpLine = fmtpLine
+		_, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-opus-fmtp", RoomTypeLocal, roomOpts)
+		require.ErrorIs(t, err, ErrInvalidFmtpLine, fmtpLine)
+	}
+
+	roomOpts.OpusFmtpLine = "minptime=10;useinbandfec=1;stereo=1"
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-opus-fmtp", RoomTypeLocal, roomOpts)
+	require.NoError(t, err)
+
+	client, err := testRoom.AddClient(testRoom.CreateClientID(), "client", DefaultClientOptions())
+	require.NoError(t, err)
+
+	_, err = client.PeerConnection().PC().AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+	require.NoError(t, err)
+
+	offer, err := client.PeerConnection().PC().CreateOffer(nil)
+	require.NoError(t, err)
+	require.Contains(t, offer.SDP, "a=fmtp:111 minptime=10;useinbandfec=1;stereo=1")
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestRoomSnapshotMetadata(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-snapshot-metadata", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err, "error creating room: %v", err)
+
+	client, err := testRoom.AddClient("client-1", "client-1", DefaultClientOptions())
+	require.NoError(t, err, "error adding client to room: %v", err)
+
+	changedChan := make(chan string, 1)
+	sub := client.Metadata().OnChanged(func(key string, value interface{}) {
+		changedChan <- key
+	})
+
+	defer sub.Remove()
+
+	client.Metadata().Set("role", "moderator")
+	testRoom.Meta().Set("topic", "weekly sync")
+
+	select {
+	case key := <-changedChan:
+		require.Equal(t, "role", key)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the client metadata changed event")
+	}
+
+	snapshot := testRoom.Snapshot()
+	require.Equal(t, "weekly sync", snapshot.Metadata["topic"])
+	require.Len(t, snapshot.Clients, 1)
+	require.Equal(t, "moderator", snapshot.Clients[0].Metadata["role"])
+
+	// the client metadata is scoped to the client
+	_, err = testRoom.Meta().Get("role")
+	require.ErrorIs(t, err, ErrMetaNotFound)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestManagerCustomLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := sfuOpts
+	opts.Log = logging.NewDefaultLoggerFactory().NewLogger("custom")
+
+	roomManager := NewManager(ctx, "test", opts)
+
+	defer roomManager.Close()
+
+	require.Equal(t, opts.Log, roomManager.Log())
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-custom-logger", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err)
+
+	client, err := testRoom.AddClient(testRoom.CreateClientID(), "client", DefaultClientOptions())
+	require.NoError(t, err)
+
+	// the logger is passed to the clients and their components, wrapped to record the last error time for the health check
+	require.Equal(t, opts.Log, client.log.(*errorTimeLogger).LeveledLogger)
+	require.Equal(t, opts.Log, client.bitrateController.log.(*errorTimeLogger).LeveledLogger)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestRoomMaxClients(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.MaxClients = 2
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-max-clients", RoomTypeLocal, roomOpts)
+	require.NoError(t, err)
+
+	client1, err := testRoom.AddClient(testRoom.CreateClientID(), "client1", DefaultClientOptions())
+	require.NoError(t, err)
+
+	_, err = testRoom.AddClient(testRoom.CreateClientID(), "client2", DefaultClientOptions())
+	require.NoError(t, err)
+
+	_, err = testRoom.AddClient(testRoom.CreateClientID(), "client3", DefaultClientOptions())
+	require.ErrorIs(t, err, ErrRoomFull)
+
+	// the ended client is not counted
+	require.NoError(t, client1.End())
+	require.Eventually(t, func() bool {
+		return client1.state.Load() == ClientStateEnded
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err = testRoom.AddClient(testRoom.CreateClientID(), "client3", DefaultClientOptions())
+	require.NoError(t, err)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestRoomResumeClient(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.MaxClients = 2
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-resume-client", RoomTypeLocal, roomOpts)
+	require.NoError(t, err)
+
+	publisher, err := testRoom.AddClient(testRoom.CreateClientID(), "publisher", DefaultClientOptions())
+	require.NoError(t, err)
+
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "announcement", "publisher")
+	require.NoError(t, err)
+	require.NoError(t, publisher.PublishSample(sample, TrackTypeMedia))
+
+	staleClient, err := testRoom.AddClient("user-1", "user-1", DefaultClientOptions())
+	require.NoError(t, err)
+	require.NotEmpty(t, staleClient.ResumeToken())
+
+	staleClient.Metadata().Set("role", "moderator")
+
+	// the subscriptions are pending until the client is connected
+	require.NoError(t, staleClient.SubscribeTracks([]SubscribeTrackRequest{
+		{ClientID: publisher.ID(), TrackID: "announcement"},
+		{ClientID: publisher.ID(), TrackID: "unpublished"},
+	}))
+
+	_, err = testRoom.AddClient("user-1", "user-1", DefaultClientOptions())
+	require.ErrorIs(t, err, ErrClientExists)
+
+	var clientErr *ClientError
+	require.ErrorAs(t, err, &clientErr)
+	require.Equal(t, "user-1", clientErr.ClientID)
+
+	opts := DefaultClientOptions()
+	opts.ResumeToken = "invalid"
+	_, err = testRoom.AddClient("user-1", "user-1", opts)
+	require.ErrorIs(t, err, ErrInvalidResumeToken)
+
+	// the token is compared as a whole
+	opts.ResumeToken = staleClient.ResumeToken()[:16]
+	_, err = testRoom.AddClient("user-1", "user-1", opts)
+	require.ErrorIs(t, err, ErrInvalidResumeToken)
+
+	// the full room accepts the resumed client because it replaces the stale client
+	opts.ResumeToken = staleClient.ResumeToken()
+	resumedClient, err := testRoom.AddClient("user-1", "user-1", opts)
+	require.NoError(t, err)
+
+	require.Equal(t, ClientStateEnded, staleClient.state.Load())
+	require.NotEqual(t, staleClient.ResumeToken(), resumedClient.ResumeToken())
+
+	client, err := testRoom.SFU().GetClient("user-1")
+	require.NoError(t, err)
+	require.Same(t, resumedClient, client)
+
+	role, err := resumedClient.Metadata().Get("role")
+	require.NoError(t, err)
+	require.Equal(t, "moderator", role)
+
+	// the unpublished track is skipped
+	resumedClient.mu.Lock()
+	require.Equal(t, []SubscribeTrackRequest{{ClientID: publisher.ID(), TrackID: "announcement"}}, resumedClient.pendingReceivedTracks)
+	resumedClient.mu.Unlock()
+
+	// the token is used once
+	_, err = testRoom.AddClient(testRoom.CreateClientID(), "user-2", opts)
+	require.ErrorIs(t, err, ErrInvalidResumeToken)
+
+	require.NoError(t, testRoom.Close())
+}
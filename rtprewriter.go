@@ -0,0 +1,155 @@
+package sfu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// the forward sequence number gap that is treated as a source restart instead of a packet loss
+	maxSequenceGap = 3000
+	// the backward sequence number gap of the reordered packets, the older packets are treated as a source restart
+	maxSequenceReorder = 512
+)
+
+// sequenceRewriter keeps the sequence numbers and the timestamps forwarded to a subscriber continuous
+// when the publisher source restarts on the same track, for example a publisher that restarts its packetizer after EOF.
+// Without it the subscriber sees a sequence discontinuity and the video freezes until the jitter buffer recovers.
+// Each subscriber track has its own rewriter, so the offsets are kept per subscriber.
+type sequenceRewriter struct {
+	mu        sync.Mutex
+	clockRate uint32
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastTime  time.Time
+}
+
+func newSequenceRewriter(clockRate uint32) *sequenceRewriter {
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+
+	return &sequenceRewriter{
+		clockRate: clockRate,
+	}
+}
+
+// rewrite applies the offsets to the packet. When the source restarts the offsets are updated,
+// so the packet continues from the last forwarded sequence number and the timestamp advances by the elapsed time.
+func (r *sequenceRewriter) rewrite(p *rtp.Packet, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.started {
+		r.started = true
+		r.setLast(p, now)
+
+		return
+	}
+
+	forward := p.SequenceNumber - r.lastSeq
+	backward := r.lastSeq - p.SequenceNumber
+
+	restarted := false
+
+	switch {
+	case forward == 0:
+		// duplicated packet
+	case forward < maxSequenceGap:
+		// the timestamp of the next packets can't go back more than a second unless the source is restarted
+		restarted = int32(p.Timestamp-r.lastTS) < -int32(r.clockRate)
+	case backward <= maxSequenceReorder:
+		// reordered packet, the offsets are still valid
+		p.SequenceNumber += r.seqOffset
+		p.Timestamp += r.tsOffset
+
+		return
+	default:
+		restarted = true
+	}
+
+	if restarted {
+		outSeq := r.lastSeq + r.seqOffset
+		outTS := r.lastTS + r.tsOffset
+
+		elapsed := uint32(now.Sub(r.lastTime).Seconds() * float64(r.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+
+		r.seqOffset = outSeq + 1 - p.SequenceNumber
+		r.tsOffset = outTS + elapsed - p.Timestamp
+	}
+
+	r.setLast(p, now)
+
+	p.SequenceNumber += r.seqOffset
+	p.Timestamp += r.tsOffset
+}
+
+func (r *sequenceRewriter) setLast(p *rtp.Packet, now time.Time) {
+	r.lastSeq = p.SequenceNumber
+	r.lastTS = p.Timestamp
+	r.lastTime = now
+}
+
+// timestampRewriter keeps the timestamps forwarded to a simulcast subscriber monotonic when it switches layers.
+// The layers are encoded from the same source, but each layer starts from its own random timestamp,
+// so on each switch the offset is recalculated to continue from the last forwarded timestamp advanced by the elapsed time.
+type timestampRewriter struct {
+	mu        sync.Mutex
+	clockRate uint32
+	started   bool
+	quality   QualityLevel
+	tsOffset  uint32
+	lastTS    uint32
+	lastTime  time.Time
+}
+
+func newTimestampRewriter(clockRate uint32) *timestampRewriter {
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+
+	return &timestampRewriter{
+		clockRate: clockRate,
+	}
+}
+
+// rewrite translates the timestamp of the packet from the layer quality to the timestamp forwarded to the subscriber.
+func (r *timestampRewriter) rewrite(p *rtp.Packet, quality QualityLevel, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.started {
+		r.started = true
+		r.quality = quality
+		r.lastTS = p.Timestamp
+		r.lastTime = now
+
+		return
+	}
+
+	if quality != r.quality {
+		elapsed := uint32(now.Sub(r.lastTime).Seconds() * float64(r.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+
+		r.quality = quality
+		r.tsOffset = r.lastTS + elapsed - p.Timestamp
+	}
+
+	p.Timestamp += r.tsOffset
+
+	// the packets of the same frame share the timestamp, only a new frame moves the last timestamp forward
+	if int32(p.Timestamp-r.lastTS) > 0 {
+		r.lastTS = p.Timestamp
+		r.lastTime = now
+	}
+}
@@ -0,0 +1,112 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequenceRewriterSourceRestart(t *testing.T) {
+	r := newSequenceRewriter(90000)
+	now := time.Now()
+
+	rewrite := func(seq uint16, ts uint32) (uint16, uint32) {
+		p := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts}}
+		r.rewrite(p, now)
+
+		return p.SequenceNumber, p.Timestamp
+	}
+
+	// the packets are forwarded as is before the source restarts, including the lost and the reordered packets
+	seq, ts := rewrite(65534, 1000)
+	require.Equal(t, uint16(65534), seq)
+	require.Equal(t, uint32(1000), ts)
+
+	seq, _ = rewrite(65535, 4000)
+	require.Equal(t, uint16(65535), seq)
+
+	seq, ts = rewrite(10, 7000)
+	require.Equal(t, uint16(10), seq)
+	require.Equal(t, uint32(7000), ts)
+
+	seq, _ = rewrite(5, 6000)
+	require.Equal(t, uint16(5), seq)
+
+	// the source restarts with a new sequence number and timestamp 100ms later
+	now = now.Add(100 * time.Millisecond)
+
+	seq, ts = rewrite(30000, 500)
+	require.Equal(t, uint16(11), seq)
+	require.Equal(t, uint32(7000+9000), ts)
+
+	seq, ts = rewrite(30001, 3500)
+	require.Equal(t, uint16(12), seq)
+	require.Equal(t, uint32(7000+9000+3000), ts)
+
+	// the source restarts with a close sequence number but the timestamp goes back more than a second
+	now = now.Add(time.Second)
+
+	restartTS := uint32(3500)
+	restartTS -= 200000
+
+	seq, ts = rewrite(30002, restartTS)
+	require.Equal(t, uint16(13), seq)
+	require.Equal(t, uint32(7000+9000+3000+90000), ts)
+}
+
+func TestTimestampRewriterLayerSwitch(t *testing.T) {
+	r := newTimestampRewriter(90000)
+	now := time.Now()
+
+	// each layer starts from its own random timestamp, the high layer is behind the low layer
+	lowTS := uint32(4000000000)
+	highTS := uint32(1000)
+
+	// the first packet is forwarded as is
+	last := lowTS - 1
+
+	rewrite := func(ts uint32, quality QualityLevel) uint32 {
+		p := &rtp.Packet{Header: rtp.Header{Timestamp: ts}}
+		r.rewrite(p, quality, now)
+
+		require.Greater(t, int32(p.Timestamp-last), int32(0), "timestamp is not monotonic")
+		last = p.Timestamp
+
+		return p.Timestamp
+	}
+
+	start := rewrite(lowTS, QualityLow)
+	require.Equal(t, lowTS, start)
+
+	// 30fps frames on the low layer, the low layer timestamp wraps around
+	for i := 1; i <= 100; i++ {
+		now = now.Add(33 * time.Millisecond)
+		lowTS += 3000
+		highTS += 3000
+
+		require.Equal(t, start+uint32(i)*3000, rewrite(lowTS, QualityLow))
+	}
+
+	// switch to the high layer on the next frame, the timestamp advances by the elapsed time
+	now = now.Add(33 * time.Millisecond)
+	highTS += 3000
+
+	switched := rewrite(highTS, QualityHigh)
+	require.Equal(t, start+100*3000+2970, switched)
+
+	// the high layer keeps its own pacing after the switch
+	for i := 1; i <= 10; i++ {
+		now = now.Add(33 * time.Millisecond)
+		highTS += 3000
+
+		require.Equal(t, switched+uint32(i)*3000, rewrite(highTS, QualityHigh))
+	}
+
+	// switch back to the low layer after the keyframe arrives 100ms later
+	now = now.Add(100 * time.Millisecond)
+	lowTS += 9000
+
+	require.Equal(t, switched+10*3000+9000, rewrite(lowTS, QualityLow))
+}
@@ -0,0 +1,256 @@
+package sfu
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	ErrSampleCodecNotSupported = errors.New("client: error sample track codec is not supported")
+)
+
+const (
+	// the number of packetized samples that can be queued before WriteSample blocks
+	sampleTrackQueueSize = 256
+	// pion packetizes the samples to this MTU
+	sampleTrackMTU = 1200
+)
+
+// sampleTrack is the remote side of a TrackLocalStaticSample published by the server.
+// The sample track is bound to it like it is bound to a peer connection, so pion packetizes the samples
+// and writes the RTP packets to it. The packets are read by the published track like the packets from a client.
+type sampleTrack struct {
+	context      context.Context
+	cancel       context.CancelFunc
+	id           string
+	streamID     string
+	kind         webrtc.RTPCodecType
+	ssrc         webrtc.SSRC
+	codec        webrtc.RTPCodecParameters
+	packets      chan []byte
+	readDeadline *atomic.Int64
+}
+
+func newSampleTrack(ctx context.Context, track *webrtc.TrackLocalStaticSample, codec webrtc.RTPCodecParameters) *sampleTrack {
+	localCtx, cancel := context.WithCancel(ctx)
+
+	return &sampleTrack{
+		context:      localCtx,
+		cancel:       cancel,
+		id:           track.ID(),
+		streamID:     track.StreamID(),
+		kind:         track.Kind(),
+		ssrc:         webrtc.SSRC(rand.Uint32()),
+		codec:        codec,
+		packets:      make(chan []byte, sampleTrackQueueSize),
+		readDeadline: &atomic.Int64{},
+	}
+}
+
+func (t *sampleTrack) ID() string {
+	return t.id
+}
+
+func (t *sampleTrack) RID() string {
+	return ""
+}
+
+func (t *sampleTrack) PayloadType() webrtc.PayloadType {
+	return t.codec.PayloadType
+}
+
+func (t *sampleTrack) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+func (t *sampleTrack) StreamID() string {
+	return t.streamID
+}
+
+func (t *sampleTrack) SSRC() webrtc.SSRC {
+	return t.ssrc
+}
+
+func (t *sampleTrack) Msid() string {
+	return t.StreamID() + " " + t.ID()
+}
+
+func (t *sampleTrack) Codec() webrtc.RTPCodecParameters {
+	return t.codec
+}
+
+// Read returns the next packetized sample, or 0 bytes if the read deadline is reached.
+// It returns io.EOF once the sample track is closed.
+func (t *sampleTrack) Read(b []byte) (n int, attributes interceptor.Attributes, err error) {
+	var timeout <-chan time.Time
+
+	if deadline := t.readDeadline.Load(); deadline > 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, deadline)))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case <-t.context.Done():
+		return 0, nil, io.EOF
+	case <-timeout:
+		return 0, nil, nil
+	case packet := <-t.packets:
+		if len(b) < len(packet) {
+			return 0, nil, io.ErrShortBuffer
+		}
+
+		return copy(b, packet), nil, nil
+	}
+}
+
+func (t *sampleTrack) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	b := make([]byte, sampleTrackMTU)
+
+	n, attributes, err := t.Read(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := &rtp.Packet{}
+	if err := p.Unmarshal(b[:n]); err != nil {
+		return nil, nil, err
+	}
+
+	return p, attributes, nil
+}
+
+func (t *sampleTrack) SetReadDeadline(deadline time.Time) error {
+	if deadline.IsZero() {
+		t.readDeadline.Store(0)
+		return nil
+	}
+
+	t.readDeadline.Store(deadline.UnixNano())
+
+	return nil
+}
+
+// WriteRTP is called by the bound sample track with the packetized sample
+func (t *sampleTrack) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	packet := &rtp.Packet{Header: *header, Payload: payload}
+
+	b, err := packet.Marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	return t.write(b)
+}
+
+func (t *sampleTrack) Write(b []byte) (int, error) {
+	packet := make([]byte, len(b))
+	copy(packet, b)
+
+	return t.write(packet)
+}
+
+func (t *sampleTrack) write(packet []byte) (int, error) {
+	select {
+	case <-t.context.Done():
+		return 0, io.ErrClosedPipe
+	case t.packets <- packet:
+		return len(packet), nil
+	}
+}
+
+func (t *sampleTrack) close() {
+	t.cancel()
+}
+
+// the methods below implement webrtc.TrackLocalContext to bind the sample track
+
+func (t *sampleTrack) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{t.codec}
+}
+
+func (t *sampleTrack) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter {
+	return nil
+}
+
+func (t *sampleTrack) SSRCRetransmission() webrtc.SSRC {
+	return 0
+}
+
+func (t *sampleTrack) SSRCForwardErrorCorrection() webrtc.SSRC {
+	return 0
+}
+
+func (t *sampleTrack) WriteStream() webrtc.TrackLocalWriter {
+	return t
+}
+
+func (t *sampleTrack) RTCPReader() interceptor.RTCPReader {
+	return nil
+}
+
+// PublishSample publishes the server generated media, for example an announcement, hold music or a test pattern, as the client track.
+// The samples written to the track are packetized by pion and forwarded to the subscribers like the tracks published by the client.
+// The track codec must be one of the codecs supported by the SFU. The track is unpublished when the client is ended.
+func (c *Client) PublishSample(track *webrtc.TrackLocalStaticSample, sourceType TrackType) error {
+	if _, err := c.tracks.Get(track.ID()); err == nil {
+		return ErrTrackExists
+	}
+
+	codec := getRTPParameters(track.Codec().MimeType)
+	if codec.MimeType == "" {
+		return ErrSampleCodecNotSupported
+	}
+
+	remoteTrack := newSampleTrack(c.context, track, codec)
+
+	if _, err := track.Bind(remoteTrack); err != nil {
+		remoteTrack.close()
+		return err
+	}
+
+	published := newTrack(c.context, c, remoteTrack, 0, 0, 0, func() {}, nil, nil)
+	published.SetSourceType(sourceType)
+
+	published.OnEnded(func() {
+		if err := track.Unbind(remoteTrack); err != nil {
+			c.log.Errorf("client: error unbind sample track %s", err.Error())
+		}
+
+		remoteTrack.close()
+		c.tracks.remove([]string{remoteTrack.ID()})
+	})
+
+	if err := c.tracks.Add(published); err != nil {
+		remoteTrack.close()
+		return err
+	}
+
+	c.log.Infof("client: %s publish sample track %s", c.ID(), track.ID())
+
+	availableTracks := []ITrack{published}
+	c.sfu.onTracksAvailable(c.ID(), availableTracks)
+	c.onTracksReady(availableTracks)
+
+	return nil
+}
+
+// PublishSample publishes the server generated media as the track of the client with the client ID.
+// See Client.PublishSample.
+func (s *SFU) PublishSample(clientID string, track *webrtc.TrackLocalStaticSample, sourceType TrackType) error {
+	client, err := s.GetClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	return client.PublishSample(track, sourceType)
+}
@@ -0,0 +1,133 @@
+package sfu
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientPublishSample(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-publish-sample", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	botPC, bot, _, botConnChan := CreateDataPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "bot", func(d *webrtc.DataChannel) {})
+	subscriberPC, subscriber, _, subscriberConnChan := CreateDataPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "subscriber", func(d *webrtc.DataChannel) {})
+
+	defer func() {
+		_ = testRoom.StopClient(bot.ID())
+		_ = testRoom.StopClient(subscriber.ID())
+	}()
+
+	// drain the connection states until both peer connections are closed
+	drained := make(chan struct{})
+
+	go func() {
+		defer close(drained)
+
+		closed := 0
+
+		for closed < 2 {
+			select {
+			case state := <-botConnChan:
+				if state == webrtc.PeerConnectionStateClosed {
+					closed++
+				}
+			case state := <-subscriberConnChan:
+				if state == webrtc.PeerConnectionStateClosed {
+					closed++
+				}
+			}
+		}
+	}()
+
+	subscriber.OnTracksAvailable(func(availableTracks []ITrack) {
+		subTracks := make([]SubscribeTrackRequest, 0)
+
+		for _, t := range availableTracks {
+			subTracks = append(subTracks, SubscribeTrackRequest{
+				ClientID: t.ClientID(),
+				TrackID:  t.ID(),
+			})
+		}
+
+		_ = subscriber.SubscribeTracks(subTracks)
+	})
+
+	received := make(chan *webrtc.TrackRemote, 1)
+
+	subscriberPC.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			received <- track
+		}
+	})
+
+	require.Eventually(t, func() bool {
+		return bot.PeerConnection().PC().ConnectionState() == webrtc.PeerConnectionStateConnected &&
+			subscriber.PeerConnection().PC().ConnectionState() == webrtc.PeerConnectionStateConnected
+	}, 30*time.Second, 100*time.Millisecond)
+
+	unsupported, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: "audio/unknown"}, "unknown", "bot")
+	require.NoError(t, err)
+	require.ErrorIs(t, bot.PublishSample(unsupported, TrackTypeMedia), ErrSampleCodecNotSupported)
+
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "announcement", "bot")
+	require.NoError(t, err)
+
+	require.NoError(t, testRoom.sfu.PublishSample(bot.ID(), sample, TrackTypeMedia))
+	require.ErrorIs(t, bot.PublishSample(sample, TrackTypeMedia), ErrTrackExists)
+
+	published, err := bot.tracks.Get("announcement")
+	require.NoError(t, err)
+	require.Equal(t, TrackType(TrackTypeMedia), published.SourceType())
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = sample.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+
+	select {
+	case track := <-received:
+		require.Equal(t, "announcement", track.ID())
+		require.Equal(t, webrtc.MimeTypeOpus, track.Codec().MimeType)
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for the sample track packets")
+	}
+
+	cancel()
+
+	require.NoError(t, botPC.Close())
+	require.NoError(t, subscriberPC.Close())
+
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the peer connections closed")
+	}
+
+	require.NoError(t, testRoom.Close())
+}
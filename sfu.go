@@ -2,7 +2,11 @@ package sfu
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
@@ -26,6 +30,12 @@ type BitrateConfigs struct {
 	VideoLow         uint32 `json:"video_low" example:"150000"`
 	VideoLowPixels   uint32 `json:"video_low_pixels" example:"64800"`
 	InitialBandwidth uint32 `json:"initial_bandwidth" example:"1000000"`
+	// DownswitchThreshold is the percentage of the sent bitrates over the estimated bandwidth that is tolerated
+	// before the bitrate controller switches down the video quality. 0 means switch down as soon as the bandwidth is exceeded.
+	DownswitchThreshold uint32 `json:"downswitch_threshold" example:"10"`
+	// DownswitchHoldTime is how long the bandwidth must be exceeded before the bitrate controller switches down the video quality.
+	// Longer hold time avoids quality thrashing on short congestion, but risks sustained packet loss.
+	DownswitchHoldTime time.Duration `json:"downswitch_hold_time" example:"2000000000"`
 }
 
 func DefaultBitrates() BitrateConfigs {
@@ -43,6 +53,16 @@ func DefaultBitrates() BitrateConfigs {
 	}
 }
 
+// Validate returns ErrInvalidBitrates if the video bitrates are not ordered from high to low,
+// the quality selection of the simulcast and scaleable tracks depends on it.
+func (b BitrateConfigs) Validate() error {
+	if b.VideoLow == 0 || b.VideoMid <= b.VideoLow || b.VideoHigh <= b.VideoMid {
+		return ErrInvalidBitrates
+	}
+
+	return nil
+}
+
 type SFUClients struct {
 	clients map[string]*Client
 	mu      sync.Mutex
@@ -68,7 +88,27 @@ func (s *SFUClients) GetClient(id string) (*Client, error) {
 		return client, nil
 	}
 
-	return nil, ErrClientNotFound
+	return nil, &ClientError{ClientID: id, Err: ErrClientNotFound}
+}
+
+// filter returns the clients that match the filter, sorted by the client ID
+func (s *SFUClients) filter(match func(*Client) bool) []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients := make([]*Client, 0)
+
+	for _, client := range s.clients {
+		if match(client) {
+			clients = append(clients, client)
+		}
+	}
+
+	slices.SortFunc(clients, func(a, b *Client) int {
+		return strings.Compare(a.ID(), b.ID())
+	})
+
+	return clients
 }
 
 func (s *SFUClients) Length() int {
@@ -83,7 +123,7 @@ func (s *SFUClients) Add(client *Client) error {
 	defer s.mu.Unlock()
 
 	if _, ok := s.clients[client.ID()]; ok {
-		return ErrClientExists
+		return &ClientError{ClientID: client.ID(), Err: ErrClientExists}
 	}
 
 	s.clients[client.ID()] = client
@@ -96,7 +136,7 @@ func (s *SFUClients) Remove(client *Client) error {
 	defer s.mu.Unlock()
 
 	if _, ok := s.clients[client.ID()]; !ok {
-		return ErrClientNotFound
+		return &ClientError{ClientID: client.ID(), Err: ErrClientNotFound}
 	}
 
 	delete(s.clients, client.ID())
@@ -114,7 +154,12 @@ type SFU struct {
 	iceServers                []webrtc.ICEServer
 	mu                        sync.Mutex
 	onStop                    func()
+	shutdownHooks             []shutdownHook
 	pliInterval               time.Duration
+	keyframeInterval          time.Duration
+	bitrateWindow             time.Duration
+	negotiationWindow         time.Duration
+	opusFmtpLine              string
 	onTrackAvailableCallbacks []func(tracks []ITrack)
 	onClientRemovedCallbacks  []func(*Client)
 	onClientAddedCallbacks    []func(*Client)
@@ -122,6 +167,111 @@ type SFU struct {
 	clientStats               map[string]*ClientStats
 	log                       logging.LeveledLogger
 	defaultSettingEngine      *webrtc.SettingEngine
+	defaultClientOptions      *ClientOptions
+	forwarders                *forwarderGroup
+	broadcastMetadata         bool
+	lastErrorTS               *atomic.Int64
+	events                    eventQueue
+	keyframeAllRequestTime    time.Time
+	pendingKeyframeAll        bool
+	stopWhenEmpty             bool
+	emptyGracePeriod          time.Duration
+	emptyStopTimer            *time.Timer
+	emptyStopping             bool
+	onEmptyStop               func()
+	bandwidth                 *bandwidthMeter
+	bandwidthLimit            uint64
+	maxSimulcastLayers        int
+}
+
+const (
+	// the maximum duration to wait for the forwarding goroutines to exit when the SFU is stopped
+	forwardersDrainTimeout = 5 * time.Second
+	// the maximum duration to wait for the clients to stop when the room is closed
+	stopTimeout = 10 * time.Second
+)
+
+var ErrSFUStopTimeout = errors.New("sfu: timeout waiting clients to stop")
+
+var ErrSFUStopping = errors.New("sfu: sfu is stopping because it's empty")
+
+// forwarderGroup tracks the running track forwarding goroutines so they can be drained on stop
+type forwarderGroup struct {
+	mu       sync.Mutex
+	active   int
+	stopping bool
+	// closed when the last forwarding goroutine exits while waiting
+	drained chan struct{}
+}
+
+// add registers a new forwarding goroutine, it returns false once the group is stopping
+// so no goroutine is started after the SFU waits for them to exit
+func (f *forwarderGroup) add() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stopping {
+		return false
+	}
+
+	f.active++
+
+	return true
+}
+
+func (f *forwarderGroup) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active--
+
+	if f.active == 0 && f.drained != nil {
+		close(f.drained)
+		f.drained = nil
+	}
+}
+
+// count returns the number of forwarding goroutines that are still running
+func (f *forwarderGroup) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.active
+}
+
+// wait stops accepting new forwarding goroutines and blocks until the running ones exit or the timeout is reached.
+// Returns false if the timeout is reached.
+func (f *forwarderGroup) wait(timeout time.Duration) bool {
+	f.mu.Lock()
+	f.stopping = true
+
+	if f.active == 0 {
+		f.mu.Unlock()
+		return true
+	}
+
+	if f.drained == nil {
+		f.drained = make(chan struct{})
+	}
+
+	drained := f.drained
+	f.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// shutdownHook is a function that is called when the SFU is stopped, the hooks are called in the priority order
+type shutdownHook struct {
+	priority int
+	hook     func(ctx context.Context)
 }
 
 type PublishedTrack struct {
@@ -137,12 +287,37 @@ type sfuOptions struct {
 	PLIInterval   time.Duration
 	Log           logging.LeveledLogger
 	SettingEngine *webrtc.SettingEngine
+	// broadcast the client metadata changes to all clients over the metadata data channel
+	BroadcastMetadata bool
+	// the minimum interval between the keyframe requests to a publisher track, nil means DefaultKeyframeRequestInterval and 0 means no limit
+	KeyframeInterval *time.Duration
+	// the duration of the sliding window that the track bitrates are measured over
+	BitrateWindow time.Duration
+	// the duration that the renegotiation requests of a client are batched in
+	NegotiationWindow time.Duration
+	// the fmtp line of the Opus codec, empty means DefaultOpusFmtpLine
+	OpusFmtpLine string
+	// stop the SFU when the last client is removed and no client joins during the grace period
+	StopWhenEmpty bool
+	// the duration to wait for a new client before the empty SFU is stopped, 0 means stop immediately
+	EmptyGracePeriod time.Duration
+	// the outbound bitrate limit in bits per second, the simulcast quality is lowered when it's exceeded. 0 means no limit
+	BandwidthLimit uint64
+	// the number of the lowest simulcast layers that are read from the publishers, 0 means all layers
+	MaxSimulcastLayers int
 }
 
 // @Param muxPort: port for udp mux
 func New(ctx context.Context, opts sfuOptions) *SFU {
 	localCtx, cancel := context.WithCancel(ctx)
 
+	lastErrorTS := &atomic.Int64{}
+
+	keyframeInterval := DefaultKeyframeRequestInterval
+	if opts.KeyframeInterval != nil {
+		keyframeInterval = *opts.KeyframeInterval
+	}
+
 	sfu := &SFU{
 		clients:                   &SFUClients{clients: make(map[string]*Client), mu: sync.Mutex{}},
 		context:                   localCtx,
@@ -153,24 +328,84 @@ func New(ctx context.Context, opts sfuOptions) *SFU {
 		iceServers:                opts.IceServers,
 		bitrateConfigs:            opts.Bitrates,
 		pliInterval:               opts.PLIInterval,
+		keyframeInterval:          keyframeInterval,
+		bitrateWindow:             opts.BitrateWindow,
+		negotiationWindow:         opts.NegotiationWindow,
+		opusFmtpLine:              opts.OpusFmtpLine,
 		relayTracks:               make(map[string]ITrack),
 		onTrackAvailableCallbacks: make([]func(tracks []ITrack), 0),
 		onClientRemovedCallbacks:  make([]func(*Client), 0),
 		onClientAddedCallbacks:    make([]func(*Client), 0),
-		log:                       opts.Log,
+		log:                       newErrorTimeLogger(opts.Log, lastErrorTS),
 		defaultSettingEngine:      opts.SettingEngine,
+		forwarders:                &forwarderGroup{},
+		broadcastMetadata:         opts.BroadcastMetadata,
+		lastErrorTS:               lastErrorTS,
+		stopWhenEmpty:             opts.StopWhenEmpty,
+		emptyGracePeriod:          opts.EmptyGracePeriod,
+		bandwidth:                 newBandwidthMeter(),
+		bandwidthLimit:            opts.BandwidthLimit,
+		maxSimulcastLayers:        opts.MaxSimulcastLayers,
 	}
 
+	go sfu.monitorBandwidth()
+
 	return sfu
 }
 
-func (s *SFU) addClient(client *Client) {
+func (s *SFU) addClient(client *Client) error {
+	// the stop check and the add are done under the same lock, so a client can't be added after the empty SFU decided to stop
+	s.mu.Lock()
+	if s.emptyStopping {
+		s.mu.Unlock()
+		return ErrSFUStopping
+	}
+
 	if err := s.clients.Add(client); err != nil {
+		s.mu.Unlock()
 		s.log.Errorf("sfu: failed to add client ", err)
-		return
+		return nil
+	}
+
+	if s.emptyStopTimer != nil {
+		s.emptyStopTimer.Stop()
+		s.emptyStopTimer = nil
+	}
+	s.mu.Unlock()
+
+	if s.broadcastMetadata {
+		client.metadataBroadcast = client.Metadata().OnChanged(func(key string, value interface{}) {
+			s.broadcastMetadataChanged(MetadataChangedMessage{ClientID: client.ID(), Key: key, Value: value})
+		})
+
+		client.metadataBatchBroadcast = client.Metadata().OnBatchChanged(func(values map[string]interface{}) {
+			s.broadcastMetadataChanged(MetadataChangedMessage{ClientID: client.ID(), Values: values})
+		})
 	}
 
 	s.onClientAdded(client)
+
+	return nil
+}
+
+// broadcastMetadataChanged sends the client metadata change to all clients in the SFU including the client itself
+func (s *SFU) broadcastMetadataChanged(message MetadataChangedMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		s.log.Errorf("sfu: error marshal metadata changed message %s", err.Error())
+		return
+	}
+
+	for _, client := range s.clients.GetClients() {
+		dc := client.metadataDataChannel.Load()
+		if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+
+		if err := dc.SendText(string(data)); err != nil {
+			s.log.Errorf("sfu: error send metadata changed message to client %s: %s", client.ID(), err.Error())
+		}
+	}
 }
 
 func (s *SFU) createClient(id string, name string, peerConnectionConfig webrtc.Configuration, opts ClientOptions) *Client {
@@ -182,20 +417,147 @@ func (s *SFU) createClient(id string, name string, peerConnectionConfig webrtc.C
 	return client
 }
 
+// NewClient creates a client and adds it to the SFU.
+// The client is returned already ended if the SFU is stopping because it's empty, see RoomOptions.StopWhenEmpty.
 func (s *SFU) NewClient(id, name string, opts ClientOptions) *Client {
+	client, err := s.newClient(id, name, opts)
+	if err != nil {
+		s.log.Warnf("sfu: client %s is not added: %s", id, err.Error())
+	}
+
+	return client
+}
+
+func (s *SFU) newClient(id, name string, opts ClientOptions) (*Client, error) {
+	opts = s.mergeDefaultClientOptions(opts)
+
 	peerConnectionConfig := webrtc.Configuration{}
 
+	if opts.PeerConnectionConfig != nil {
+		peerConnectionConfig = *opts.PeerConnectionConfig
+		// copy the ICE servers to not modify the configuration shared by the clients
+		peerConnectionConfig.ICEServers = slices.Clone(opts.PeerConnectionConfig.ICEServers)
+	}
+
 	if len(s.iceServers) > 0 {
-		peerConnectionConfig.ICEServers = s.iceServers
+		peerConnectionConfig.ICEServers = append(peerConnectionConfig.ICEServers, s.iceServers...)
 	}
 
 	opts.Log = s.log
 
+	var session *clientSession
+
+	if opts.ResumeToken != "" {
+		if staleClient, err := s.clientByResumeToken(opts.ResumeToken); err == nil {
+			session = staleClient.endForResume()
+		} else {
+			s.log.Warnf("sfu: resume token is not found, client %s starts a new session", id)
+		}
+	}
+
 	client := s.createClient(id, name, peerConnectionConfig, opts)
 
-	s.addClient(client)
+	if err := s.addClient(client); err != nil {
+		// the client is never added, so it's ended without the left callbacks and the clean up
+		client.state.Store(ClientStateEnded)
+		_ = client.stop()
+		client.cancel()
 
-	return client
+		return client, err
+	}
+
+	if session != nil {
+		client.resume(session)
+	}
+
+	return client, nil
+}
+
+// SetDefaultClientOptions sets the client options that will be used as the base options for every new client.
+// The zero value fields of the options passed to NewClient will be filled with the default options.
+// The boolean fields can't be detected as omitted, so they are always taken from the options passed to NewClient.
+func (s *SFU) SetDefaultClientOptions(opts ClientOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.defaultClientOptions = &opts
+}
+
+func (s *SFU) mergeDefaultClientOptions(opts ClientOptions) ClientOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.defaultClientOptions == nil {
+		return opts
+	}
+
+	defaults := s.defaultClientOptions
+
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = defaults.IdleTimeout
+	}
+
+	if opts.Type == "" {
+		opts.Type = defaults.Type
+	}
+
+	if opts.MinPlayoutDelay == 0 {
+		opts.MinPlayoutDelay = defaults.MinPlayoutDelay
+	}
+
+	if opts.MaxPlayoutDelay == 0 {
+		opts.MaxPlayoutDelay = defaults.MaxPlayoutDelay
+	}
+
+	if opts.JitterBufferMinWait == 0 {
+		opts.JitterBufferMinWait = defaults.JitterBufferMinWait
+	}
+
+	if opts.JitterBufferMaxWait == 0 {
+		opts.JitterBufferMaxWait = defaults.JitterBufferMaxWait
+	}
+
+	if opts.Group == "" {
+		opts.Group = defaults.Group
+	}
+
+	if opts.StripHeaderExtensions == nil {
+		opts.StripHeaderExtensions = defaults.StripHeaderExtensions
+	}
+
+	if opts.MaxMediaSections == 0 {
+		opts.MaxMediaSections = defaults.MaxMediaSections
+	}
+
+	if opts.MaxSDPSize == 0 {
+		opts.MaxSDPSize = defaults.MaxSDPSize
+	}
+
+	if opts.RenegotiationTimeout == 0 {
+		opts.RenegotiationTimeout = defaults.RenegotiationTimeout
+	}
+
+	if opts.MigrationGracePeriod == 0 {
+		opts.MigrationGracePeriod = defaults.MigrationGracePeriod
+	}
+
+	if opts.ICECandidateFilter == nil {
+		opts.ICECandidateFilter = defaults.ICECandidateFilter
+	}
+
+	if opts.PeerConnectionConfig == nil {
+		opts.PeerConnectionConfig = defaults.PeerConnectionConfig
+	}
+
+	if opts.CodecPreferences == nil {
+		opts.CodecPreferences = defaults.CodecPreferences
+	}
+
+	if opts.BitrateController == nil {
+		opts.BitrateController = defaults.BitrateController
+	}
+
+	return opts
 }
 
 func (s *SFU) AvailableTracks() []ITrack {
@@ -208,8 +570,9 @@ func (s *SFU) AvailableTracks() []ITrack {
 	return tracks
 }
 
-// Syncs track from connected client to other clients
-func (s *SFU) syncTrack(client *Client) {
+// syncTrack subscribes the client to the tracks of the other clients in the same group that the client is not subscribed yet.
+// Returns true if new tracks are added to the client, the added tracks are sent to the client with a renegotiation.
+func (s *SFU) syncTrack(client *Client) bool {
 	publishedTrackIDs := make([]string, 0)
 	for _, track := range client.publishedTracks.GetTracks() {
 		publishedTrackIDs = append(publishedTrackIDs, track.ID())
@@ -218,6 +581,11 @@ func (s *SFU) syncTrack(client *Client) {
 	subscribes := make([]SubscribeTrackRequest, 0)
 
 	for _, clientPeer := range s.clients.GetClients() {
+		// only sync the tracks within the same group
+		if client.Group() != clientPeer.Group() {
+			continue
+		}
+
 		for _, track := range clientPeer.tracks.GetTracks() {
 			if client.ID() != clientPeer.ID() {
 				if !slices.Contains(publishedTrackIDs, track.ID()) {
@@ -230,25 +598,80 @@ func (s *SFU) syncTrack(client *Client) {
 		}
 	}
 
-	if len(subscribes) > 0 {
-		err := client.SubscribeTracks(subscribes)
-		if err != nil {
-			s.log.Errorf("client: failed to subscribe tracks ", err)
-		}
+	if len(subscribes) == 0 {
+		return false
+	}
+
+	subscribed := client.publishedTracks.Length()
+
+	err := client.SubscribeTracks(subscribes)
+	if err != nil {
+		s.log.Errorf("client: failed to subscribe tracks ", err)
 	}
+
+	return client.publishedTracks.Length() > subscribed
 }
 
-func (s *SFU) Stop() {
+// Stop closes all the clients concurrently and waits until they are closed or the context is done.
+// Each client is ended and cleaned up, so the client left callbacks and the track removal are run.
+// The shutdown hooks registered with OnShutdown are called after the clients are closed, before the SFU context is cancelled.
+// Returns ErrSFUStopTimeout if the context is done before all clients are closed.
+func (s *SFU) Stop(ctx context.Context) error {
+	// the clients removed while stopping must not schedule another stop
+	s.mu.Lock()
+	s.stopWhenEmpty = false
+	s.mu.Unlock()
+
+	s.cancelStopWhenEmpty()
+
+	var wg sync.WaitGroup
+
 	for _, client := range s.clients.GetClients() {
-		client.PeerConnection().Close()
+		wg.Add(1)
+
+		go func(c *Client) {
+			defer wg.Done()
+
+			_ = c.End()
+
+			// make sure the clean up is done before return, instead of waiting the connection state changed event
+			c.afterClosed()
+		}(client)
+	}
+
+	clientsStopped := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(clientsStopped)
+	}()
+
+	var err error
+
+	select {
+	case <-clientsStopped:
+	case <-ctx.Done():
+		s.log.Warnf("sfu: timeout waiting %d clients to stop", s.clients.Length())
+		err = ErrSFUStopTimeout
 	}
 
+	// wait for the forwarding goroutines to exit before cancel the context,
+	// to make sure no packets are written to the closed tracks
+	if !s.forwarders.wait(forwardersDrainTimeout) {
+		s.log.Warnf("sfu: timeout waiting %d forwarding goroutines to exit", s.forwarders.count())
+	}
+
+	s.runShutdownHooks(ctx)
+
 	if s.onStop != nil {
-		s.onStop()
+		callUserCallback(s.log, "OnStopped", s.onStop)
 	}
 
+	s.closeEvents()
+
 	s.cancel()
 
+	return err
 }
 
 func (s *SFU) OnStopped(callback func()) {
@@ -258,6 +681,36 @@ func (s *SFU) OnStopped(callback func()) {
 	s.onStop = callback
 }
 
+// OnShutdown registers a hook that is called when the SFU is stopped, after all clients are closed and before the SFU context is cancelled.
+// The hooks are called one by one from the lowest priority value, the hooks with the same priority are called in the registration order.
+// Use this to shut down the subsystems that depend on each other in order, like stop the recorder before closing the bridges.
+// The context passed to the hook is the context passed to Stop.
+func (s *SFU) OnShutdown(priority int, hook func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// keep the hooks sorted by priority, after the hooks with the same priority
+	i := len(s.shutdownHooks)
+	for i > 0 && s.shutdownHooks[i-1].priority > priority {
+		i--
+	}
+
+	s.shutdownHooks = slices.Insert(s.shutdownHooks, i, shutdownHook{priority: priority, hook: hook})
+}
+
+func (s *SFU) runShutdownHooks(ctx context.Context) {
+	s.mu.Lock()
+	hooks := make([]shutdownHook, len(s.shutdownHooks))
+	copy(hooks, s.shutdownHooks)
+	s.mu.Unlock()
+
+	for _, h := range hooks {
+		callUserCallback(s.log, "shutdown hook", func() {
+			h.hook(ctx)
+		})
+	}
+}
+
 func (s *SFU) OnClientAdded(callback func(*Client)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -279,19 +732,40 @@ func (s *SFU) onAfterClientStopped(client *Client) {
 }
 
 func (s *SFU) onClientAdded(client *Client) {
+	s.emitEvent(EventClientAdded, clientEventData(client.ID()))
+
 	for _, callback := range s.onClientAddedCallbacks {
-		callback(client)
+		callUserCallback(s.log, "OnClientAdded", func() {
+			callback(client)
+		})
 	}
 }
 
 func (s *SFU) onClientRemoved(client *Client) {
+	s.emitEvent(EventClientRemoved, clientEventData(client.ID()))
+
 	for _, callback := range s.onClientRemovedCallbacks {
-		callback(client)
+		callUserCallback(s.log, "OnClientRemoved", func() {
+			callback(client)
+		})
 	}
 }
 
+// onTracksAvailable broadcasts the available tracks to the other clients in the same group as the publisher.
+// The client still can subscribe to the tracks from the other groups explicitly with client.SubscribeTracks().
 func (s *SFU) onTracksAvailable(clientId string, tracks []ITrack) {
+	// the publisher is not found for the relay tracks, they are available to all groups
+	publisher, _ := s.clients.GetClient(clientId)
+
+	for _, track := range tracks {
+		s.emitTrackPublished(track)
+	}
+
 	for _, client := range s.clients.GetClients() {
+		if publisher != nil && client.Group() != publisher.Group() {
+			continue
+		}
+
 		if client.ID() != clientId {
 			client.onTracksAvailable(tracks)
 			s.log.Infof("sfu: client %s have %d tracks available ", client.ID(), len(tracks))
@@ -300,7 +774,9 @@ func (s *SFU) onTracksAvailable(clientId string, tracks []ITrack) {
 
 	for _, callback := range s.onTrackAvailableCallbacks {
 		if callback != nil {
-			callback(tracks)
+			callUserCallback(s.log, "OnTracksAvailable", func() {
+				callback(tracks)
+			})
 		}
 	}
 }
@@ -313,29 +789,161 @@ func (s *SFU) GetClients() map[string]*Client {
 	return s.clients.GetClients()
 }
 
+// GetClientsByType returns the clients of the type, one of ClientTypePeer, ClientTypeUpBridge or ClientTypeDownBridge.
+// The clients are sorted by the client ID.
+func (s *SFU) GetClientsByType(clientType string) []*Client {
+	return s.clients.filter(func(client *Client) bool {
+		return client.Type() == clientType
+	})
+}
+
+// GetClientsByState returns the clients in the state, one of ClientStateNew, ClientStateActive, ClientStateRestart or ClientStateEnded.
+// The clients are sorted by the client ID.
+func (s *SFU) GetClientsByState(state int) []*Client {
+	return s.clients.filter(func(client *Client) bool {
+		return client.State() == state
+	})
+}
+
 func (s *SFU) removeClient(client *Client) error {
 	if err := s.clients.Remove(client); err != nil {
 		s.log.Errorf("sfu: failed to remove client ", err)
 		return err
 	}
 
+	if client.metadataBroadcast != nil {
+		client.metadataBroadcast.Remove()
+	}
+
+	if client.metadataBatchBroadcast != nil {
+		client.metadataBatchBroadcast.Remove()
+	}
+
+	s.removeOrphanedTracks(client)
+
 	s.onClientRemoved(client)
 
+	if s.clients.Length() == 0 {
+		s.scheduleStopWhenEmpty()
+	}
+
 	return nil
 }
 
+// removeOrphanedTracks makes sure the tracks of the removed publisher are no longer sent to the other clients.
+// The tracks are normally removed from the subscribers when the publisher tracks are ended, but the tracks are left
+// when the publisher is removed without its tracks ended, for example the publisher connection is dropped abruptly.
+func (s *SFU) removeOrphanedTracks(publisher *Client) {
+	// group the client tracks forwarded from the publisher tracks by the subscriber
+	orphaned := make(map[*Client][]iClientTrack)
+
+	for _, track := range publisher.tracks.GetTracks() {
+		base := trackBase(track)
+		if base == nil {
+			continue
+		}
+
+		for _, clientTrack := range base.clientTracks.GetTracks() {
+			client := clientTrack.Client()
+			orphaned[client] = append(orphaned[client], clientTrack)
+		}
+	}
+
+	for client, clientTracks := range orphaned {
+		// the ended clients are closing their peer connections, there is nothing to renegotiate
+		if client == nil || client == publisher || client.State() == ClientStateEnded {
+			continue
+		}
+
+		if removed := client.removeOrphanedTracks(clientTracks); removed > 0 {
+			s.log.Infof("sfu: removed %d orphaned tracks of client %s from client %s", removed, publisher.ID(), client.ID())
+		}
+	}
+}
+
+// scheduleStopWhenEmpty stops the SFU after the grace period if there is still no client.
+// A client that joins during the grace period cancels the pending stop.
+func (s *SFU) scheduleStopWhenEmpty() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.stopWhenEmpty || s.emptyStopTimer != nil || s.context.Err() != nil {
+		return
+	}
+
+	var timer *time.Timer
+
+	timer = time.AfterFunc(s.emptyGracePeriod, func() {
+		// the clients are added under the same lock, so no client can join between the check and the stop
+		s.mu.Lock()
+		if s.emptyStopTimer != timer || s.clients.Length() > 0 || s.context.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+
+		s.emptyStopTimer = nil
+		s.emptyStopping = true
+		onEmptyStop := s.onEmptyStop
+		s.mu.Unlock()
+
+		s.log.Infof("sfu: stop because no client joined in %s after the last client left", s.emptyGracePeriod)
+
+		// the owner of the SFU stops it with its own close path, so it can release its resources too
+		if onEmptyStop != nil {
+			onEmptyStop()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		defer cancel()
+
+		if err := s.Stop(ctx); err != nil {
+			s.log.Errorf("sfu: error stop empty sfu %s", err.Error())
+		}
+	})
+
+	s.emptyStopTimer = timer
+}
+
+// setOnEmptyStop sets the internal hook that is called instead of Stop when the empty SFU is stopped, the room uses it to close itself
+func (s *SFU) setOnEmptyStop(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onEmptyStop = f
+}
+
+// cancelStopWhenEmpty cancels the pending stop scheduled when the last client left
+func (s *SFU) cancelStopWhenEmpty() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.emptyStopTimer == nil {
+		return
+	}
+
+	s.emptyStopTimer.Stop()
+	s.emptyStopTimer = nil
+}
+
 func (s *SFU) CreateDataChannel(label string, opts DataChannelOptions) error {
+	if IsReservedDataChannelLabel(label) {
+		return ErrDataChannelReservedLabel
+	}
+
+	if opts.MaxRetransmits != nil && opts.MaxPacketLifeTime != nil {
+		return ErrDataChannelReliability
+	}
+
 	dc := s.dataChannels.Get(label)
 	if dc != nil {
 		return ErrDataChannelExists
 	}
 
-	s.dataChannels.Add(label, opts)
+	dc = s.dataChannels.Add(label, opts)
 
 	errors := []error{}
-	initOpts := &webrtc.DataChannelInit{
-		Ordered: &opts.Ordered,
-	}
+	initOpts := dc.initOptions()
 
 	for _, client := range s.clients.GetClients() {
 		if len(opts.ClientIDs) > 0 {
@@ -353,15 +961,17 @@ func (s *SFU) CreateDataChannel(label string, opts DataChannelOptions) error {
 	return FlattenErrors(errors)
 }
 
-func (s *SFU) setupMessageForwarder(clientID string, d *webrtc.DataChannel) {
+func (s *SFU) setupMessageForwarder(sender *Client, d *webrtc.DataChannel) {
 	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		sender.onMessage(d.Label(), msg.Data)
+
 		// broadcast to all clients
 		s.mu.Lock()
 		defer s.mu.Unlock()
 
 		for _, client := range s.clients.GetClients() {
 			// skip the sender
-			if client.id == clientID {
+			if client.id == sender.id {
 				continue
 			}
 
@@ -383,9 +993,7 @@ func (s *SFU) setupMessageForwarder(clientID string, d *webrtc.DataChannel) {
 
 func (s *SFU) createExistingDataChannels(c *Client) {
 	for _, dc := range s.dataChannels.dataChannels {
-		initOpts := &webrtc.DataChannelInit{
-			Ordered: &dc.isOrdered,
-		}
+		initOpts := dc.initOptions()
 		if len(dc.clientIDs) > 0 {
 			if !slices.Contains(dc.clientIDs, c.id) {
 				continue
@@ -409,6 +1017,16 @@ func (s *SFU) TotalActiveSessions() int {
 	return count
 }
 
+// BitrateWindow returns the duration of the sliding window that the track bitrates are measured over
+func (s *SFU) BitrateWindow() time.Duration {
+	return s.bitrateWindow
+}
+
+// NegotiationWindow returns the duration that the renegotiation requests of a client are batched in
+func (s *SFU) NegotiationWindow() time.Duration {
+	return s.negotiationWindow
+}
+
 func (s *SFU) PLIInterval() time.Duration {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -416,6 +1034,72 @@ func (s *SFU) PLIInterval() time.Duration {
 	return s.pliInterval
 }
 
+// RequestKeyFrameAll requests a keyframe from all the video tracks published in the SFU at once,
+// for example right after starting a recording so the output begins with the keyframes.
+// The calls within the keyframe request interval share one budget, they are coalesced into a single request at the end of the interval.
+// The request to each track is still limited by the track keyframe request interval.
+func (s *SFU) RequestKeyFrameAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a request is already scheduled at the end of the interval
+	if s.pendingKeyframeAll {
+		return
+	}
+
+	requestGap := time.Since(s.keyframeAllRequestTime)
+
+	if requestGap >= s.keyframeInterval {
+		s.keyframeAllRequestTime = time.Now()
+
+		go s.requestKeyFrameAll()
+
+		return
+	}
+
+	s.pendingKeyframeAll = true
+
+	time.AfterFunc(s.keyframeInterval-requestGap, func() {
+		s.mu.Lock()
+		s.pendingKeyframeAll = false
+
+		if s.context.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+
+		s.keyframeAllRequestTime = time.Now()
+		s.mu.Unlock()
+
+		s.requestKeyFrameAll()
+	})
+}
+
+func (s *SFU) requestKeyFrameAll() {
+	requested := 0
+
+	for _, client := range s.clients.GetClients() {
+		for _, track := range client.tracks.GetTracks() {
+			if track.Kind() != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+
+			switch t := track.(type) {
+			case *Track:
+				t.remoteTrack.sendPLI()
+			case *SimulcastTrack:
+				t.sendPLI()
+			default:
+				continue
+			}
+
+			requested++
+		}
+	}
+
+	s.log.Infof("sfu: requested keyframe from %d video tracks", requested)
+}
+
 func (s *SFU) OnTracksAvailable(callback func(tracks []ITrack)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -438,20 +1122,30 @@ func (s *SFU) AddRelayTrack(ctx context.Context, id, streamid, rid string, clien
 		s.mu.Unlock()
 	} else {
 		// simulcast
-		var simulcast *SimulcastTrack
-		var ok bool
+		var exists bool
+
+		if !s.isSimulcastLayerEnabled(RIDToQuality(relayTrack.RID())) {
+			s.log.Infof("sfu: skip relay track %s rid %s above the max simulcast layers", relayTrack.ID(), relayTrack.RID())
+			return nil
+		}
 
 		s.mu.Lock()
-		track, ok := s.relayTracks[relayTrack.ID()]
-		if !ok {
+		track, exists = s.relayTracks[relayTrack.ID()]
+		if !exists {
 			// if track not found, add it
 			track = newSimulcastTrack(client, relayTrack, 0, 0, s.pliInterval, onPLI, nil, nil)
 			s.relayTracks[relayTrack.ID()] = track
 
-		} else if simulcast, ok = track.(*SimulcastTrack); ok {
+		} else if simulcast, ok := track.(*SimulcastTrack); ok {
 			simulcast.AddRemoteTrack(relayTrack, 0, 0, nil, nil, onPLI)
 		}
 		s.mu.Unlock()
+
+		// the other layers are added to the simulcast track that is already available,
+		// so the track is only published once instead of once per layer
+		if exists {
+			return nil
+		}
 	}
 
 	// TODO: replace to with subscribe to all available tracks
@@ -462,3 +1156,29 @@ func (s *SFU) AddRelayTrack(ctx context.Context, id, streamid, rid string, clien
 
 	return nil
 }
+
+// simulcastLayers returns the number of the simulcast layers that are read from the publishers
+func (s *SFU) simulcastLayers() int {
+	if s.maxSimulcastLayers < 1 || s.maxSimulcastLayers > 3 {
+		return 3
+	}
+
+	return s.maxSimulcastLayers
+}
+
+// simulcastLayerQuality returns the highest simulcast quality that is read from the publishers under MaxSimulcastLayers
+func (s *SFU) simulcastLayerQuality() QualityLevel {
+	switch s.simulcastLayers() {
+	case 1:
+		return QualityLow
+	case 2:
+		return QualityMid
+	default:
+		return QualityHigh
+	}
+}
+
+// isSimulcastLayerEnabled returns false if the layer is above MaxSimulcastLayers, the disabled layers are not read from the publishers
+func (s *SFU) isSimulcastLayerEnabled(quality QualityLevel) bool {
+	return quality <= s.simulcastLayerQuality()
+}
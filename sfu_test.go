@@ -2,11 +2,18 @@ package sfu
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pion/rtp"
+	"github.com/pion/turn/v3"
 	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
 	"github.com/stretchr/testify/require"
 )
 
@@ -208,3 +215,1205 @@ Loop:
 
 	require.Equal(t, expectedTracksAfterAdded, trackReceived)
 }
+
+func TestDefaultClientOptions(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomID := roomManager.CreateRoomID()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomID, "test-default-client-options", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	defaults := DefaultClientOptions()
+	defaults.IdleTimeout = 30 * time.Second
+	defaults.Type = ClientTypeUpBridge
+	defaults.MinPlayoutDelay = 150
+	testRoom.SFU().SetDefaultClientOptions(defaults)
+
+	// omitted fields should inherit the defaults
+	client1, err := testRoom.AddClient("client-1", "client-1", ClientOptions{})
+	require.NoError(t, err, "error adding client to room: %v", err)
+	require.Equal(t, 30*time.Second, client1.options.IdleTimeout)
+	require.Equal(t, ClientTypeUpBridge, client1.Type())
+	require.Equal(t, uint16(150), client1.options.MinPlayoutDelay)
+	require.Equal(t, defaults.MaxPlayoutDelay, client1.options.MaxPlayoutDelay)
+
+	// the options passed to AddClient should override the defaults
+	opts := ClientOptions{
+		IdleTimeout:     10 * time.Second,
+		Type:            ClientTypePeer,
+		MinPlayoutDelay: 50,
+	}
+	client2, err := testRoom.AddClient("client-2", "client-2", opts)
+	require.NoError(t, err, "error adding client to room: %v", err)
+	require.Equal(t, 10*time.Second, client2.options.IdleTimeout)
+	require.Equal(t, ClientTypePeer, client2.Type())
+	require.Equal(t, uint16(50), client2.options.MinPlayoutDelay)
+	require.Equal(t, defaults.MaxPlayoutDelay, client2.options.MaxPlayoutDelay)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestStopDrainsForwarders(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomID := roomManager.CreateRoomID()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomID, "test-drain-forwarders", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	trackChan := make(chan bool)
+
+	for i := 0; i < 2; i++ {
+		pc, _, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), fmt.Sprintf("peer-%d", i), true, false)
+		pc.PeerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			trackChan <- true
+		})
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+
+	// each peer publishes an audio and a video track to the other peer
+	expectedTracks := 4
+	trackReceived := 0
+
+	for trackReceived < expectedTracks {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for tracks")
+		case <-trackChan:
+			trackReceived++
+		}
+	}
+
+	require.Greater(t, testRoom.sfu.forwarders.count(), 0)
+
+	require.NoError(t, testRoom.Close())
+
+	require.Equal(t, 0, testRoom.sfu.forwarders.count())
+}
+
+func TestForwarderGroupWait(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	f := &forwarderGroup{}
+
+	require.True(t, f.add())
+	require.True(t, f.add())
+	require.Equal(t, 2, f.count())
+
+	// the wait times out while a forwarding goroutine is running, without leaving a goroutine behind
+	f.done()
+	require.False(t, f.wait(10*time.Millisecond))
+
+	// no forwarding goroutine is added once the group is stopping
+	require.False(t, f.add())
+	require.Equal(t, 1, f.count())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		f.done()
+	}()
+
+	require.True(t, f.wait(time.Second))
+	require.Equal(t, 0, f.count())
+	require.True(t, f.wait(time.Second))
+}
+
+func TestStopClosesClients(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-stop-clients", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	peerCount := 3
+	connectedChan := make(chan bool, peerCount)
+
+	for i := 0; i < peerCount; i++ {
+		_, client, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), fmt.Sprintf("peer-%d", i), true, false)
+		client.OnConnectionStateChanged(func(state webrtc.PeerConnectionState) {
+			if state == webrtc.PeerConnectionStateConnected {
+				connectedChan <- true
+			}
+		})
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+
+	for connected := 0; connected < peerCount; connected++ {
+		select {
+		case <-timeout.Done():
+			t.Fatal("timeout waiting for clients connected")
+		case <-connectedChan:
+		}
+	}
+
+	var mu sync.Mutex
+	clientsLeft := 0
+
+	testRoom.OnClientLeft(func(client *Client) {
+		mu.Lock()
+		clientsLeft++
+		mu.Unlock()
+	})
+
+	stopCtx, cancelStop := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelStop()
+
+	require.NoError(t, testRoom.SFU().Stop(stopCtx))
+
+	// the clients are cleaned up when Stop returns
+	mu.Lock()
+	require.Equal(t, peerCount, clientsLeft)
+	mu.Unlock()
+
+	require.Equal(t, 0, testRoom.SFU().clients.Length())
+}
+
+func TestClientGroups(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-client-groups", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	type trackReceived struct {
+		peer string
+		id   string
+	}
+
+	trackChan := make(chan trackReceived, 10)
+
+	groups := map[string]string{
+		"peer-a1": "group-a",
+		"peer-a2": "group-a",
+		"peer-b1": "group-b",
+	}
+
+	for _, peer := range []string{"peer-a1", "peer-a2", "peer-b1"} {
+		defaults := DefaultClientOptions()
+		defaults.Group = groups[peer]
+		testRoom.SFU().SetDefaultClientOptions(defaults)
+
+		pc, client, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), peer, true, false)
+		require.Equal(t, groups[peer], client.Group())
+
+		peerName := peer
+		pc.PeerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			trackChan <- trackReceived{peer: peerName, id: track.ID()}
+		})
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelTimeout()
+
+	// each peer in group-a receives audio and video tracks from the other peer in group-a
+	expectedTracks := 4
+	received := make(map[string]int)
+
+Loop:
+	for {
+		select {
+		case <-timeout.Done():
+			break Loop
+		case track := <-trackChan:
+			received[track.peer]++
+
+			if received["peer-a1"]+received["peer-a2"] == expectedTracks {
+				// wait a bit to make sure no other tracks are received
+				time.Sleep(2 * time.Second)
+				break Loop
+			}
+		}
+	}
+
+	require.Equal(t, 2, received["peer-a1"])
+	require.Equal(t, 2, received["peer-a2"])
+	require.Equal(t, 0, received["peer-b1"])
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestSFUSnapshot(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-snapshot", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	_, client1, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "peer-1", true, false)
+	_, client2, _, _ := CreatePeerPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "peer-2", true, false)
+
+	// wait until both clients publish and subscribe the audio and video tracks
+	require.Eventually(t, func() bool {
+		snapshot := testRoom.SFU().Snapshot()
+		if len(snapshot.Clients) != 2 {
+			return false
+		}
+
+		for _, client := range snapshot.Clients {
+			if client.Direction != webrtc.RTPTransceiverDirectionSendrecv.String() || len(client.Tracks) != 2 {
+				return false
+			}
+		}
+
+		return true
+	}, 30*time.Second, 100*time.Millisecond)
+
+	data, err := json.Marshal(testRoom.SFU().Snapshot())
+	require.NoError(t, err)
+
+	var snapshot RoomSnapshot
+	require.NoError(t, json.Unmarshal(data, &snapshot))
+
+	for _, client := range snapshot.Clients {
+		require.Contains(t, []string{client1.ID(), client2.ID()}, client.ID)
+		require.Equal(t, ClientTypePeer, client.Type)
+		require.Equal(t, "active", client.State)
+
+		for _, track := range client.Tracks {
+			require.NotEmpty(t, track.ID)
+			require.NotEmpty(t, track.StreamID)
+			require.NotEmpty(t, track.Codec)
+		}
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestSFUTestTURN(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	turnServer, err := turn.NewServer(turn.ServerConfig{
+		Realm: "test",
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return turn.GenerateAuthKey(username, realm, "pass"), username == "user"
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	defer turnServer.Close()
+
+	newSFU := func(iceServers []webrtc.ICEServer) *SFU {
+		settingEngine := &webrtc.SettingEngine{}
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+
+		return New(ctx, sfuOptions{
+			IceServers:    iceServers,
+			Log:           TestLogger,
+			SettingEngine: settingEngine,
+		})
+	}
+
+	turnURL := "turn:" + udpListener.LocalAddr().String()
+
+	// the TURN server accepts the credentials
+	s := newSFU([]webrtc.ICEServer{{URLs: []string{turnURL}, Username: "user", Credential: "pass"}})
+	require.NoError(t, s.TestTURN(ctx))
+
+	// the TURN server rejects the credentials
+	s = newSFU([]webrtc.ICEServer{{URLs: []string{turnURL}, Username: "unknown", Credential: "pass"}})
+	require.ErrorIs(t, s.TestTURN(ctx), ErrTURNAllocationFailed)
+
+	// only a STUN server is configured
+	s = newSFU(DefaultTestIceServers())
+	require.ErrorIs(t, s.TestTURN(ctx), ErrNoTURNServer)
+}
+
+func TestSFUShutdownHooksOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(ctx, sfuOptions{Log: TestLogger, SettingEngine: &webrtc.SettingEngine{}})
+
+	called := make([]string, 0)
+
+	addHook := func(priority int, name string) {
+		s.OnShutdown(priority, func(ctx context.Context) {
+			// the SFU context is still usable by the hooks
+			require.NoError(t, s.context.Err())
+
+			called = append(called, name)
+		})
+	}
+
+	addHook(10, "bridge")
+	addHook(0, "recorder")
+	addHook(10, "metrics")
+	addHook(5, "egress")
+
+	s.OnStopped(func() {
+		called = append(called, "stopped")
+	})
+
+	require.NoError(t, s.Stop(ctx))
+
+	require.Equal(t, []string{"recorder", "egress", "bridge", "metrics", "stopped"}, called)
+	require.Error(t, s.context.Err())
+}
+
+func TestSFUHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(ctx, sfuOptions{Log: TestLogger, SettingEngine: &webrtc.SettingEngine{}})
+
+	health := s.Health()
+	require.True(t, health.Alive)
+	require.Equal(t, 0, health.Clients)
+	require.Equal(t, 0, health.Forwarders)
+	require.True(t, health.LastErrorAt.IsZero())
+
+	before := time.Now()
+
+	s.log.Errorf("sfu: test error")
+
+	health = s.Health()
+	require.False(t, health.LastErrorAt.Before(before))
+
+	require.NoError(t, s.Stop(ctx))
+
+	require.False(t, s.Health().Alive)
+}
+
+func TestSFUEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(ctx, sfuOptions{Log: TestLogger, SettingEngine: &webrtc.SettingEngine{}})
+
+	// the events before the first call are not delivered
+	s.onClientAdded(&Client{id: "early"})
+
+	events := s.Events()
+
+	s.onClientAdded(&Client{id: "peer"})
+	s.emitEvent(EventTrackPublished, map[string]interface{}{"client_id": "peer", "track_id": "audio"})
+	s.emitEvent(EventTrackUnpublished, map[string]interface{}{"client_id": "peer", "track_id": "audio"})
+	s.onClientRemoved(&Client{id: "peer"})
+
+	expected := []string{EventClientAdded, EventTrackPublished, EventTrackUnpublished, EventClientRemoved}
+
+	for _, eventType := range expected {
+		event := <-events
+		require.Equal(t, eventType, event.Type)
+		require.Equal(t, "peer", event.Data["client_id"])
+		require.False(t, event.Time.IsZero())
+	}
+
+	// the events are dropped instead of blocking when the buffer is full
+	for i := 0; i < eventsBufferSize+10; i++ {
+		s.emitEvent(EventClientAdded, clientEventData("peer"))
+	}
+
+	require.Equal(t, uint64(10), s.DroppedEvents())
+	require.Len(t, events, eventsBufferSize)
+
+	require.NoError(t, s.Stop(ctx))
+
+	received := 0
+	for range events {
+		received++
+	}
+
+	require.Equal(t, eventsBufferSize, received)
+}
+
+func TestSFUEventsRelaySimulcastTrack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-relay-events", RoomTypeLocal, DefaultRoomOptions())
+	require.NoError(t, err)
+
+	relay, err := testRoom.AddClient("relay", "relay", DefaultClientOptions())
+	require.NoError(t, err)
+
+	events := testRoom.SFU().Events()
+
+	available := &atomic.Int32{}
+	testRoom.SFU().OnTracksAvailable(func(tracks []ITrack) {
+		available.Add(1)
+	})
+
+	// each simulcast layer is relayed as a separate track with the same ID
+	for i, rid := range []string{"q", "h", "f"} {
+		rtpChan := make(chan *rtp.Packet)
+		defer close(rtpChan)
+
+		err := testRoom.SFU().AddRelayTrack(ctx, "video", "relay-stream", rid, relay, webrtc.RTPCodecTypeVideo, webrtc.SSRC(1000+i), webrtc.MimeTypeVP8, rtpChan)
+		require.NoError(t, err)
+	}
+
+	published := 0
+
+	for len(events) > 0 {
+		event := <-events
+		if event.Type != EventTrackPublished {
+			continue
+		}
+
+		published++
+
+		require.Equal(t, "video", event.Data["track_id"])
+		require.True(t, event.Data["track"].(ITrack).IsSimulcast())
+	}
+
+	require.Equal(t, 1, published)
+	require.Equal(t, int32(1), available.Load())
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestLoopbackForwarding(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-loopback", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	publisherPC, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "publisher")
+	require.NoError(t, err)
+
+	_, err = publisherPC.AddTransceiverFromTrack(audio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	require.NoError(t, err)
+
+	subscriberPC, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	_, err = subscriberPC.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	received := make(chan *webrtc.TrackRemote, 1)
+
+	subscriberPC.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			received <- track
+		}
+	})
+
+	subscriber, err := NewLoopback(testRoom, "subscriber", subscriberPC, DefaultClientOptions())
+	require.NoError(t, err)
+
+	subscriber.Client.OnTracksAvailable(func(availableTracks []ITrack) {
+		subTracks := make([]SubscribeTrackRequest, 0)
+
+		for _, t := range availableTracks {
+			subTracks = append(subTracks, SubscribeTrackRequest{
+				ClientID: t.ClientID(),
+				TrackID:  t.ID(),
+			})
+		}
+
+		_ = subscriber.Client.SubscribeTracks(subTracks)
+	})
+
+	publisher, err := NewLoopback(testRoom, "publisher", publisherPC, DefaultClientOptions())
+	require.NoError(t, err)
+
+	publisher.Client.OnTracksAdded(func(addedTracks []ITrack) {
+		setTracks := make(map[string]TrackType, 0)
+		for _, track := range addedTracks {
+			setTracks[track.ID()] = TrackTypeMedia
+		}
+
+		publisher.Client.SetTracksSourceType(setTracks)
+	})
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = audio.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+
+	select {
+	case track := <-received:
+		require.Equal(t, "audio", track.ID())
+		require.Equal(t, "publisher", track.StreamID())
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for the forwarded track")
+	}
+
+	cancel()
+
+	require.NoError(t, publisher.Close())
+	require.NoError(t, subscriber.Close())
+
+	require.Eventually(t, func() bool {
+		return testRoom.SFU().clients.Length() == 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestSFUDrainAll(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-drain-all", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	migrateChan := make(chan migrate, 2)
+
+	onDataChannel := func(d *webrtc.DataChannel) {
+		if d.Label() != internalDataChannelLabel {
+			return
+		}
+
+		d.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var message internalDataMigrate
+			if err := json.Unmarshal(msg.Data, &message); err == nil && message.Type == messageTypeMigrate {
+				migrateChan <- message.Data
+			}
+		})
+	}
+
+	// the leaving peer closes its peer connection once it's asked to migrate, the staying peer ignores it
+	leavingPC, leaving, _, leavingConnChan := CreateDataPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "leaving", onDataChannel)
+	stayingPC, staying, _, stayingConnChan := CreateDataPair(ctx, TestLogger, testRoom, DefaultTestIceServers(), "staying", onDataChannel)
+
+	leaving.options.MigrationGracePeriod = 10 * time.Second
+	staying.options.MigrationGracePeriod = 500 * time.Millisecond
+
+	// drain the connection states until both peer connections are closed
+	drained := make(chan struct{})
+
+	go func() {
+		defer close(drained)
+
+		closed := 0
+
+		for closed < 2 {
+			select {
+			case state := <-leavingConnChan:
+				if state == webrtc.PeerConnectionStateClosed {
+					closed++
+				}
+			case state := <-stayingConnChan:
+				if state == webrtc.PeerConnectionStateClosed {
+					closed++
+				}
+			}
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		for _, client := range []*Client{leaving, staying} {
+			if client.internalDataChannel == nil || client.internalDataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+				return false
+			}
+		}
+
+		return true
+	}, 30*time.Second, 100*time.Millisecond)
+
+	// the message is checked on the test goroutine, the leaving peer only closes its peer connection here
+	leavingMigrate := make(chan migrate, 1)
+
+	go func() {
+		msg := <-migrateChan
+		leavingMigrate <- msg
+
+		_ = leavingPC.Close()
+	}()
+
+	drainCtx, cancelDrain := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelDrain()
+
+	start := time.Now()
+
+	require.NoError(t, testRoom.SFU().DrainAll(drainCtx, "wss://sfu-2.example.com"))
+
+	// the staying client is stopped after its grace period, the leaving client is not waited for its grace period
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, 0, testRoom.SFU().clients.Length())
+
+	for _, messages := range []chan migrate{leavingMigrate, migrateChan} {
+		select {
+		case msg := <-messages:
+			require.Equal(t, "wss://sfu-2.example.com", msg.TargetURL)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the migrate message")
+		}
+	}
+
+	require.NoError(t, stayingPC.Close())
+
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the peer connections closed")
+	}
+
+	require.NoError(t, testRoom.Close())
+}
+
+func TestSFURequestKeyFrameAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the keyframe requests are coalesced within the default interval when it's not configured
+	require.Equal(t, DefaultKeyframeRequestInterval, New(ctx, sfuOptions{Log: TestLogger, SettingEngine: &webrtc.SettingEngine{}}).keyframeInterval)
+
+	keyframeInterval := 200 * time.Millisecond
+	s := New(ctx, sfuOptions{Log: TestLogger, SettingEngine: &webrtc.SettingEngine{}, KeyframeInterval: &keyframeInterval})
+
+	plis := &atomic.Int32{}
+	onPLI := func() {
+		plis.Add(1)
+	}
+
+	client := &Client{id: "publisher", tracks: newTrackList(TestLogger)}
+
+	require.NoError(t, client.tracks.Add(&Track{
+		base:        &baseTrack{id: "video", kind: webrtc.RTPCodecTypeVideo},
+		remoteTrack: &remoteTrack{context: ctx, onPLI: onPLI},
+	}))
+	require.NoError(t, client.tracks.Add(&Track{
+		base:        &baseTrack{id: "audio", kind: webrtc.RTPCodecTypeAudio},
+		remoteTrack: &remoteTrack{context: ctx, onPLI: onPLI},
+	}))
+	require.NoError(t, client.tracks.Add(&SimulcastTrack{
+		base:            &baseTrack{id: "simulcast", kind: webrtc.RTPCodecTypeVideo},
+		remoteTrackHigh: &remoteTrack{context: ctx, onPLI: onPLI},
+		remoteTrackMid:  &remoteTrack{context: ctx, onPLI: onPLI},
+		remoteTrackLow:  &remoteTrack{context: ctx, onPLI: onPLI},
+	}))
+
+	require.NoError(t, s.clients.Add(client))
+
+	// the video track and the three simulcast layers, the audio track is skipped
+	s.RequestKeyFrameAll()
+	require.Eventually(t, func() bool { return plis.Load() == 4 }, 100*time.Millisecond, 10*time.Millisecond)
+
+	// the requests within the interval are coalesced into one at the end of the interval
+	for i := 0; i < 5; i++ {
+		s.RequestKeyFrameAll()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(4), plis.Load())
+
+	require.Eventually(t, func() bool { return plis.Load() == 8 }, time.Second, 10*time.Millisecond)
+
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(8), plis.Load())
+}
+
+func TestSFUStopWhenEmpty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(ctx, sfuOptions{Log: TestLogger, SettingEngine: &webrtc.SettingEngine{}, StopWhenEmpty: true, EmptyGracePeriod: 200 * time.Millisecond})
+
+	stopped := &atomic.Bool{}
+	s.OnStopped(func() {
+		stopped.Store(true)
+	})
+
+	s.addClient(&Client{id: "client1"})
+	s.addClient(&Client{id: "client2"})
+
+	require.NoError(t, s.removeClient(&Client{id: "client1", tracks: newTrackList(TestLogger)}))
+	require.NoError(t, s.removeClient(&Client{id: "client2", tracks: newTrackList(TestLogger)}))
+
+	// a client joins during the grace period cancels the pending stop
+	time.Sleep(100 * time.Millisecond)
+	s.addClient(&Client{id: "client3"})
+
+	time.Sleep(300 * time.Millisecond)
+	require.False(t, stopped.Load())
+	require.NoError(t, s.context.Err())
+
+	// the SFU is stopped after the grace period once the last client leaves
+	require.NoError(t, s.removeClient(&Client{id: "client3", tracks: newTrackList(TestLogger)}))
+	require.Eventually(t, stopped.Load, time.Second, 10*time.Millisecond)
+	require.Error(t, s.context.Err())
+
+	// the clients can't be added once the empty SFU is stopping
+	require.ErrorIs(t, s.addClient(&Client{id: "client4"}), ErrSFUStopping)
+	require.Equal(t, 0, s.clients.Length())
+}
+
+func TestSFUBandwidthLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(ctx, sfuOptions{Log: TestLogger, SettingEngine: &webrtc.SettingEngine{}, BandwidthLimit: 1_000_000})
+
+	now := time.Now()
+
+	// send the bytes of the bitrate in bits per second over a second
+	measure := func(inbound, outbound uint64) {
+		s.bandwidth.addInbound(int(inbound / 8))
+		s.bandwidth.addOutbound(int(outbound / 8))
+
+		now = now.Add(time.Second)
+		s.bandwidth.update(now, time.Second)
+		s.checkBandwidthLimit()
+	}
+
+	s.bandwidth.update(now, time.Second)
+
+	measure(500_000, 800_000)
+
+	inbound, outbound := s.GetBandwidthUsage()
+	require.Equal(t, uint64(500_000), inbound)
+	require.Equal(t, uint64(800_000), outbound)
+	require.Equal(t, QualityLevel(QualityHigh), s.maxSimulcastQuality())
+
+	// the simulcast quality is lowered one layer each time the outbound bitrate is over the limit
+	measure(500_000, 2_000_000)
+	require.Equal(t, QualityLevel(QualityMid), s.maxSimulcastQuality())
+
+	measure(500_000, 1_200_000)
+	require.Equal(t, QualityLevel(QualityLow), s.maxSimulcastQuality())
+
+	measure(500_000, 1_100_000)
+	require.Equal(t, QualityLevel(QualityLow), s.maxSimulcastQuality())
+
+	// it's kept while the outbound bitrate is close to the limit, and raised back when it's well below the limit
+	measure(500_000, 700_000)
+	require.Equal(t, QualityLevel(QualityLow), s.maxSimulcastQuality())
+
+	measure(500_000, 300_000)
+	require.Equal(t, QualityLevel(QualityMid), s.maxSimulcastQuality())
+
+	measure(500_000, 300_000)
+	require.Equal(t, QualityLevel(QualityHigh), s.maxSimulcastQuality())
+}
+
+func TestSFUGetClientsByTypeAndState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(ctx, sfuOptions{Log: TestLogger, SettingEngine: &webrtc.SettingEngine{}})
+
+	newClient := func(id, clientType string, state int) *Client {
+		clientState := &atomic.Value{}
+		clientState.Store(state)
+
+		client := &Client{id: id, state: clientState, options: ClientOptions{Type: clientType}}
+		require.NoError(t, s.clients.Add(client))
+
+		return client
+	}
+
+	peer2 := newClient("peer2", ClientTypePeer, ClientStateActive)
+	peer1 := newClient("peer1", ClientTypePeer, ClientStateNew)
+	bridge := newClient("bridge", ClientTypeUpBridge, ClientStateActive)
+	ended := newClient("ended", ClientTypePeer, ClientStateEnded)
+
+	require.Equal(t, []*Client{ended, peer1, peer2}, s.GetClientsByType(ClientTypePeer))
+	require.Equal(t, []*Client{bridge}, s.GetClientsByType(ClientTypeUpBridge))
+	require.Empty(t, s.GetClientsByType(ClientTypeDownBridge))
+
+	require.Equal(t, []*Client{bridge, peer2}, s.GetClientsByState(ClientStateActive))
+	require.Equal(t, []*Client{peer1}, s.GetClientsByState(ClientStateNew))
+	require.Equal(t, []*Client{ended}, s.GetClientsByState(ClientStateEnded))
+
+	// the type changed with SetType is used
+	peer2.clientType.Store(ClientTypeDownBridge)
+	require.Equal(t, []*Client{peer2}, s.GetClientsByType(ClientTypeDownBridge))
+}
+
+func TestSFURemoveOrphanedTracks(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-orphaned-tracks", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	subscriberPC, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	_, err = subscriberPC.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	received := make(chan *webrtc.TrackRemote, 1)
+
+	subscriberPC.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			received <- track
+		}
+	})
+
+	subscriber, err := NewLoopback(testRoom, "subscriber", subscriberPC, DefaultClientOptions())
+	require.NoError(t, err)
+
+	subscriber.Client.OnTracksAvailable(func(availableTracks []ITrack) {
+		subTracks := make([]SubscribeTrackRequest, 0)
+
+		for _, t := range availableTracks {
+			subTracks = append(subTracks, SubscribeTrackRequest{
+				ClientID: t.ClientID(),
+				TrackID:  t.ID(),
+			})
+		}
+
+		_ = subscriber.Client.SubscribeTracks(subTracks)
+	})
+
+	removedTracks := make(chan string, 2)
+	subscriber.Client.OnTrackRemoved(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+		removedTracks <- track.ID()
+	})
+
+	publisherPC, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "publisher")
+	require.NoError(t, err)
+
+	_, err = publisherPC.AddTransceiverFromTrack(audio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	require.NoError(t, err)
+
+	publisher, err := NewLoopback(testRoom, "publisher", publisherPC, DefaultClientOptions())
+	require.NoError(t, err)
+
+	publisher.Client.OnTracksAdded(func(addedTracks []ITrack) {
+		setTracks := make(map[string]TrackType, 0)
+		for _, track := range addedTracks {
+			setTracks[track.ID()] = TrackTypeMedia
+		}
+
+		publisher.Client.SetTracksSourceType(setTracks)
+	})
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = audio.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for the forwarded track")
+	}
+
+	sentTracks := func() []string {
+		ids := make([]string, 0)
+
+		for _, sender := range subscriber.Client.PeerConnection().PC().GetSenders() {
+			if sender.Track() != nil {
+				ids = append(ids, sender.Track().ID())
+			}
+		}
+
+		return ids
+	}
+
+	require.Contains(t, sentTracks(), "audio")
+
+	// the publisher is removed mid-stream without its tracks ended, like a crashed publisher
+	// that the connection state transitions don't clean up
+	require.NoError(t, testRoom.SFU().removeClient(publisher.Client))
+
+	select {
+	case id := <-removedTracks:
+		require.Equal(t, "audio", id)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the orphaned track removed")
+	}
+
+	require.NotContains(t, sentTracks(), "audio")
+	require.Empty(t, subscriber.Client.ClientTracks())
+
+	cancel()
+
+	publisher.Client.afterClosed()
+	require.NoError(t, publisher.Client.stop())
+	require.NoError(t, publisher.Close())
+	require.NoError(t, subscriber.Close())
+
+	require.Eventually(t, func() bool {
+		return testRoom.SFU().clients.Length() == 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+
+	// the track removed callback is called once even the publisher track is ended after the removal
+	require.Empty(t, removedTracks)
+}
+
+func TestSFURemoveOrphanedTracksSameTrackID(t *testing.T) {
+	report := CheckRoutines(t)
+	defer report()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomManager := NewManager(ctx, "test", sfuOpts)
+
+	defer roomManager.Close()
+
+	roomOpts := DefaultRoomOptions()
+	roomOpts.Codecs = &[]string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	testRoom, err := roomManager.NewRoom(roomManager.CreateRoomID(), "test-orphaned-same-id", RoomTypeLocal, roomOpts)
+	require.NoError(t, err, "error creating room: %v", err)
+
+	subscriberPC, err := NewLoopbackPeerConnection()
+	require.NoError(t, err)
+
+	_, err = subscriberPC.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+
+	received := make(chan *webrtc.TrackRemote, 1)
+
+	subscriberPC.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			received <- track
+		}
+	})
+
+	subscriber, err := NewLoopback(testRoom, "subscriber", subscriberPC, DefaultClientOptions())
+	require.NoError(t, err)
+
+	// only subscribe to the track of the second publisher, both publishers use the same track ID
+	subscriber.Client.OnTracksAvailable(func(availableTracks []ITrack) {
+		subTracks := make([]SubscribeTrackRequest, 0)
+
+		for _, t := range availableTracks {
+			if t.ClientID() != "publisher-b" {
+				continue
+			}
+
+			subTracks = append(subTracks, SubscribeTrackRequest{
+				ClientID: t.ClientID(),
+				TrackID:  t.ID(),
+			})
+		}
+
+		if len(subTracks) > 0 {
+			_ = subscriber.Client.SubscribeTracks(subTracks)
+		}
+	})
+
+	removedTracks := make(chan string, 2)
+	subscriber.Client.OnTrackRemoved(func(sourceType string, track *webrtc.TrackLocalStaticRTP) {
+		removedTracks <- track.ID()
+	})
+
+	newPublisher := func(id string) (*Loopback, *webrtc.TrackLocalStaticSample) {
+		publisherPC, err := NewLoopbackPeerConnection()
+		require.NoError(t, err)
+
+		audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", id)
+		require.NoError(t, err)
+
+		_, err = publisherPC.AddTransceiverFromTrack(audio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		require.NoError(t, err)
+
+		publisher, err := NewLoopback(testRoom, id, publisherPC, DefaultClientOptions())
+		require.NoError(t, err)
+
+		publisher.Client.OnTracksAdded(func(addedTracks []ITrack) {
+			setTracks := make(map[string]TrackType, 0)
+			for _, track := range addedTracks {
+				setTracks[track.ID()] = TrackTypeMedia
+			}
+
+			publisher.Client.SetTracksSourceType(setTracks)
+		})
+
+		return publisher, audio
+	}
+
+	publisherA, audioA := newPublisher("publisher-a")
+	publisherB, audioB := newPublisher("publisher-b")
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = audioA.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+				_ = audioB.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+
+	select {
+	case track := <-received:
+		require.Equal(t, "publisher-b", track.StreamID())
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for the forwarded track")
+	}
+
+	sentStreams := func() []string {
+		ids := make([]string, 0)
+
+		for _, sender := range subscriber.Client.PeerConnection().PC().GetSenders() {
+			if sender.Track() != nil {
+				ids = append(ids, sender.Track().StreamID())
+			}
+		}
+
+		return ids
+	}
+
+	require.Contains(t, sentStreams(), "publisher-b")
+
+	// removing the publisher that nobody subscribes to must not remove the same track ID of the other publisher
+	require.NoError(t, testRoom.SFU().removeClient(publisherA.Client))
+
+	select {
+	case id := <-removedTracks:
+		t.Fatalf("unexpected track %s removed", id)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	require.Contains(t, sentStreams(), "publisher-b")
+	require.Len(t, subscriber.Client.ClientTracks(), 1)
+
+	// removing the subscribed publisher still removes its track
+	require.NoError(t, testRoom.SFU().removeClient(publisherB.Client))
+
+	select {
+	case id := <-removedTracks:
+		require.Equal(t, "audio", id)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the orphaned track removed")
+	}
+
+	require.NotContains(t, sentStreams(), "publisher-b")
+	require.Empty(t, subscriber.Client.ClientTracks())
+
+	cancel()
+
+	for _, publisher := range []*Loopback{publisherA, publisherB} {
+		publisher.Client.afterClosed()
+		require.NoError(t, publisher.Client.stop())
+		require.NoError(t, publisher.Close())
+	}
+
+	require.NoError(t, subscriber.Close())
+
+	require.Eventually(t, func() bool {
+		return testRoom.SFU().clients.Length() == 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, testRoom.Close())
+}
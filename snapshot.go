@@ -0,0 +1,113 @@
+package sfu
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// RoomSnapshot is a point-in-time view of the clients in the SFU.
+// It can be used by a signaling server to rebuild its state after a restart.
+type RoomSnapshot struct {
+	Clients   []ClientSnapshot `json:"clients"`
+	Timestamp time.Time        `json:"timestamp"`
+	// the room metadata, only available from Room.Snapshot()
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+type ClientSnapshot struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Group string `json:"group"`
+	// the direction is from the client point of view, sendonly means the client only publishes tracks
+	Direction string                 `json:"direction"`
+	State     string                 `json:"state"`
+	Tracks    []TrackSnapshot        `json:"published_tracks"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+type TrackSnapshot struct {
+	ID        string              `json:"id"`
+	StreamID  string              `json:"stream_id"`
+	Kind      webrtc.RTPCodecType `json:"kind"`
+	Codec     string              `json:"codec"`
+	Source    TrackType           `json:"source"`
+	Simulcast bool                `json:"simulcast"`
+	Muted     bool                `json:"muted"`
+}
+
+// Snapshot returns the state of all clients in the SFU and the tracks they publish.
+// The clients are read under the clients lock, so the snapshot is consistent with the clients added or removed at the same time.
+func (s *SFU) Snapshot() RoomSnapshot {
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+
+	snapshot := RoomSnapshot{
+		Clients:   make([]ClientSnapshot, 0, len(s.clients.clients)),
+		Timestamp: time.Now(),
+	}
+
+	for _, client := range s.clients.clients {
+		snapshot.Clients = append(snapshot.Clients, client.snapshot())
+	}
+
+	return snapshot
+}
+
+func (c *Client) snapshot() ClientSnapshot {
+	published := c.Tracks()
+
+	snapshot := ClientSnapshot{
+		ID:        c.ID(),
+		Name:      c.Name(),
+		Type:      c.Type(),
+		Group:     c.Group(),
+		Direction: clientDirection(len(published) > 0, len(c.ClientTracks()) > 0).String(),
+		State:     clientStateString(c.state.Load()),
+		Tracks:    make([]TrackSnapshot, 0, len(published)),
+		Metadata:  c.meta.toMap(),
+	}
+
+	for _, track := range published {
+		snapshot.Tracks = append(snapshot.Tracks, TrackSnapshot{
+			ID:        track.ID(),
+			StreamID:  track.StreamID(),
+			Kind:      track.Kind(),
+			Codec:     track.MimeType(),
+			Source:    track.SourceType(),
+			Simulcast: track.IsSimulcast(),
+			Muted:     track.IsMuted(),
+		})
+	}
+
+	return snapshot
+}
+
+func clientDirection(publishing, subscribing bool) webrtc.RTPTransceiverDirection {
+	switch {
+	case publishing && subscribing:
+		return webrtc.RTPTransceiverDirectionSendrecv
+	case publishing:
+		return webrtc.RTPTransceiverDirectionSendonly
+	case subscribing:
+		return webrtc.RTPTransceiverDirectionRecvonly
+	default:
+		return webrtc.RTPTransceiverDirectionInactive
+	}
+}
+
+func clientStateString(state interface{}) string {
+	switch state {
+	case ClientStateNew:
+		return "new"
+	case ClientStateActive:
+		return "active"
+	case ClientStateRestart:
+		return "restart"
+	case ClientStateEnded:
+		return "ended"
+	default:
+		return "unknown"
+	}
+}
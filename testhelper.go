@@ -845,3 +845,179 @@ func openV9File(videoFileName string) (*ivfreader.IVFReader, *ivfreader.IVFFileH
 
 	return ivf, header, nil
 }
+
+var ErrLoopbackNotStable = errors.New("loopback: error signaling state is not stable")
+
+// Loopback connects a peer connection to a client in the same process, the offers, the answers and the ICE candidates
+// are passed in memory instead of a signaling server. Use it to write the integration tests without a browser,
+// for example publish a track on a loopback peer connection and assert it's forwarded to another loopback peer connection.
+type Loopback struct {
+	PeerConnection    *webrtc.PeerConnection
+	Client            *Client
+	mu                sync.Mutex
+	pendingCandidates []webrtc.ICECandidateInit
+}
+
+// NewLoopbackPeerConnection creates a peer connection with the default codecs and interceptors
+// that only gathers the host candidates, so it can connect to the SFU on the same machine.
+func NewLoopbackPeerConnection() (*webrtc.PeerConnection, error) {
+	m := GetMediaEngine()
+	i := &interceptor.Registry{}
+
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	settingEngine.SetIncludeLoopbackCandidate(true)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
+
+	return api.NewPeerConnection(webrtc.Configuration{})
+}
+
+// NewLoopback adds a client to the room and connects the peer connection to it.
+// Add the tracks and the transceivers to the peer connection before calling NewLoopback, they are sent in the first offer.
+// The renegotiations requested by the client are answered by the peer connection, and the renegotiations
+// allowed by the client after it's done with its own are offered from the peer connection.
+// Call Negotiate after adding more tracks to the peer connection. The client is stopped when the peer connection is closed.
+func NewLoopback(room *Room, id string, pc *webrtc.PeerConnection, opts ClientOptions) (*Loopback, error) {
+	client, err := room.AddClient(id, id, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Loopback{
+		PeerConnection:    pc,
+		Client:            client,
+		pendingCandidates: make([]webrtc.ICECandidateInit, 0),
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			_ = room.StopClient(client.ID())
+		}
+	})
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		// the client keeps the candidates until the offer is received
+		_ = client.AddICECandidate(candidate.ToJSON())
+	})
+
+	client.OnIceCandidate(func(ctx context.Context, candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		l.addICECandidate(candidate.ToJSON())
+	})
+
+	client.OnRenegotiation(func(ctx context.Context, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+		return l.answer(offer)
+	})
+
+	client.OnAllowedRemoteRenegotiation(func() {
+		go func() {
+			_ = l.Negotiate()
+		}()
+	})
+
+	if err := l.Negotiate(); err != nil {
+		_ = room.StopClient(client.ID())
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Negotiate sends an offer from the peer connection to the client and applies the answer.
+// Returns ErrLoopbackNotStable if a negotiation is in progress, the client will allow it once the negotiation is done.
+func (l *Loopback) Negotiate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.PeerConnection.SignalingState() != webrtc.SignalingStateStable || !l.Client.IsAllowNegotiation() {
+		return ErrLoopbackNotStable
+	}
+
+	offer, err := l.PeerConnection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := l.PeerConnection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	answer, err := l.Client.Negotiate(offer)
+	if err != nil {
+		return err
+	}
+
+	if err := l.PeerConnection.SetRemoteDescription(*answer); err != nil {
+		return err
+	}
+
+	return l.addPendingCandidates()
+}
+
+// answer answers the renegotiation offer from the client
+func (l *Loopback) answer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.PeerConnection.SetRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	answer, err := l.PeerConnection.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	if err := l.PeerConnection.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	if err := l.addPendingCandidates(); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	return *l.PeerConnection.LocalDescription(), nil
+}
+
+// addICECandidate adds the client candidate to the peer connection, or keeps it until the answer is received
+func (l *Loopback) addICECandidate(candidate webrtc.ICECandidateInit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.PeerConnection.RemoteDescription() == nil {
+		l.pendingCandidates = append(l.pendingCandidates, candidate)
+		return
+	}
+
+	_ = l.PeerConnection.AddICECandidate(candidate)
+}
+
+func (l *Loopback) addPendingCandidates() error {
+	for _, candidate := range l.pendingCandidates {
+		if err := l.PeerConnection.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+
+	l.pendingCandidates = l.pendingCandidates[:0]
+
+	return nil
+}
+
+// Close closes the peer connection and stops the client
+func (l *Loopback) Close() error {
+	return l.PeerConnection.Close()
+}
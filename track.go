@@ -15,6 +15,7 @@ import (
 	"github.com/pion/logging"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+	"golang.org/x/exp/slices"
 )
 
 const (
@@ -22,9 +23,13 @@ const (
 	TrackTypeScreen = "screen"
 )
 
+// a simulcast layer is considered inactive when no packet is received for this duration
+const simulcastLayerInactiveThreshold = 500 * time.Millisecond
+
 var (
 	ErrTrackExists      = errors.New("client: error track already exists")
 	ErrTrackIsNotExists = errors.New("client: error track is not exists")
+	ErrTrackIsNotVideo  = errors.New("client: error track is not a video track")
 )
 
 type TrackType string
@@ -42,8 +47,11 @@ type baseTrack struct {
 	kind         webrtc.RTPCodecType
 	codec        webrtc.RTPCodecParameters
 	isScreen     *atomic.Bool // source of the track, can be media or screen
+	muted        *atomic.Bool // muted by the server, the packets are not forwarded to the subscribers
 	clientTracks *clientTrackList
 	pool         *rtppool.RTPPool
+	// the negotiated AV1 dependency descriptor header extension ID, 0 if not negotiated
+	dependencyDescriptorID atomic.Uint32
 }
 
 type ITrack interface {
@@ -59,6 +67,8 @@ type ITrack interface {
 	OnRead(func(interceptor.Attributes, *rtp.Packet, QualityLevel))
 	IsScreen() bool
 	IsRelay() bool
+	IsMuted() bool
+	SetMuted(muted bool)
 	Kind() webrtc.RTPCodecType
 	MimeType() string
 	TotalTracks() int
@@ -89,6 +99,7 @@ func newTrack(ctx context.Context, client *Client, trackRemote IRemoteTrack, min
 	baseTrack := &baseTrack{
 		id:           trackRemote.ID(),
 		isScreen:     &atomic.Bool{},
+		muted:        &atomic.Bool{},
 		msid:         trackRemote.Msid(),
 		streamid:     trackRemote.StreamID(),
 		client:       client,
@@ -108,24 +119,33 @@ func newTrack(ctx context.Context, client *Client, trackRemote IRemoteTrack, min
 	onRead := func(attrs interceptor.Attributes, p *rtp.Packet) {
 		tracks := t.base.clientTracks.GetTracks()
 
-		for _, track := range tracks {
-			//nolint:ineffassign,staticcheck // packet is from the pool
-			packet := pool.NewPacket(&p.Header, p.Payload)
+		// don't forward the packets to the subscribers if the track is muted
+		if t.base.muted.Load() {
+			tracks = nil
+		}
+
+		client.sfu.bandwidth.addInbound(p.MarshalSize())
+
+		// the packet is copied to the pool once and shared by all the subscribers,
+		// it is returned to the pool when the last subscriber releases it after writing
+		packet := pool.NewPacket(&p.Header, p.Payload)
+		if packet == nil {
+			return
+		}
+
+		defer packet.Release()
 
+		for _, track := range tracks {
+			// each subscriber rewrites its own header, the payload is shared
 			copyPacket := pool.GetPacket()
-			copyPacket.Header = *packet.Header()
+			copyPacket.Header = packet.Header().Clone()
 			copyPacket.Payload = packet.Payload()
 
-			track.push(copyPacket, QualityHigh)
+			track.push(copyPacket, packet, QualityHigh)
 
 			pool.PutPacket(copyPacket)
-
-			packet.Release()
 		}
 
-		//nolint:ineffassign // this is required
-		packet := pool.NewPacket(&p.Header, p.Payload)
-
 		copyPacket := pool.GetPacket()
 		copyPacket.Header = *packet.Header()
 		copyPacket.Payload = packet.Payload()
@@ -133,15 +153,13 @@ func newTrack(ctx context.Context, client *Client, trackRemote IRemoteTrack, min
 		t.onRead(attrs, copyPacket, QualityHigh)
 
 		pool.PutPacket(copyPacket)
-
-		packet.Release()
 	}
 
 	onNetworkConditionChanged := func(condition networkmonitor.NetworkConditionType) {
 		client.onNetworkConditionChanged(condition)
 	}
 
-	t.remoteTrack = newRemoteTrack(ctx, client.log, client.options.ReorderPackets, trackRemote, minWait, maxWait, pliInterval, onPLI, stats, onStatsUpdated, onRead, pool, onNetworkConditionChanged)
+	t.remoteTrack = newRemoteTrack(ctx, client.log, client.options.ReorderPackets, trackRemote, minWait, maxWait, pliInterval, client.sfu.keyframeInterval, onPLI, stats, onStatsUpdated, onRead, pool, client.sfu.forwarders, onNetworkConditionChanged)
 
 	var cancel context.CancelFunc
 
@@ -217,10 +235,13 @@ func (t *AudioTrack) SetVAD(vad *voiceactivedetector.VoiceDetector) {
 
 func (t *AudioTrack) onVoiceDetected(pkts []voiceactivedetector.VoicePacketData) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	callbacks := slices.Clone(t.vadCallbacks)
+	t.mu.Unlock()
 
-	for _, callback := range t.vadCallbacks {
-		callback(pkts)
+	for _, callback := range callbacks {
+		callUserCallback(t.base.client.log, "OnVoiceDetected", func() {
+			callback(pkts)
+		})
 	}
 }
 
@@ -237,9 +258,9 @@ func (t *AudioTrack) subscribe(c *Client) iClientTrack {
 	cta := newClientTrackAudio(c, t)
 
 	if t.PayloadType() == 63 {
-		t.base.client.log.Tracef("track: red enabled %v", c.receiveRED)
+		t.base.client.log.Tracef("track: red enabled %v", c.receiveRED.Load())
 
-		// TODO: detect if client supports RED and it's audio then send RED encoded packets
+		// the RED packets are sent as is if the client negotiates RED, otherwise the primary Opus encoding is extracted
 		ct = newClientTrackRed(cta)
 	} else {
 		ct = cta
@@ -261,6 +282,22 @@ func (t *Track) IsScreen() bool {
 	return t.base.isScreen.Load()
 }
 
+func (t *Track) IsMuted() bool {
+	return t.base.muted.Load()
+}
+
+// SetMuted stops forwarding the track to the subscribers when muted.
+// A keyframe is requested when unmuted so the subscribers can resume decoding the video.
+func (t *Track) SetMuted(muted bool) {
+	if t.base.muted.Swap(muted) == muted {
+		return
+	}
+
+	if !muted && t.Kind() == webrtc.RTPCodecTypeVideo {
+		t.remoteTrack.sendPLI()
+	}
+}
+
 func (t *Track) IsSimulcast() bool {
 	return false
 }
@@ -355,7 +392,9 @@ func (t *Track) onRead(attrs interceptor.Attributes, p *rtp.Packet, quality Qual
 		copyPacket := t.base.pool.GetPacket()
 		copyPacket.Header = p.Header
 		copyPacket.Payload = p.Payload
-		callback(attrs, p, quality)
+		callUserCallback(t.base.client.log, "OnRead", func() {
+			callback(attrs, p, quality)
+		})
 		t.base.pool.PutPacket(copyPacket)
 	}
 }
@@ -383,10 +422,11 @@ func (t *Track) OnEnded(f func()) {
 
 func (t *Track) onEnded() {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	callbacks := slices.Clone(t.onEndedCallbacks)
+	t.mu.Unlock()
 
-	for _, f := range t.onEndedCallbacks {
-		f()
+	for _, f := range callbacks {
+		callUserCallback(t.base.client.log, "OnEnded", f)
 	}
 }
 
@@ -395,18 +435,14 @@ type SimulcastTrack struct {
 	cancel                      context.CancelFunc
 	mu                          sync.RWMutex
 	base                        *baseTrack
-	baseTS                      uint32
 	onTrackCompleteCallbacks    []func()
 	remoteTrackHigh             *remoteTrack
-	remoteTrackHighBaseTS       uint32
 	highSequence                uint16
 	lastHighSequence            uint16
 	remoteTrackMid              *remoteTrack
-	remoteTrackMidBaseTS        uint32
 	midSequence                 uint16
 	lastMidSequence             uint16
 	remoteTrackLow              *remoteTrack
-	remoteTrackLowBaseTS        uint32
 	lowSequence                 uint16
 	lastLowSequence             uint16
 	lastReadHighTS              *atomic.Int64
@@ -430,6 +466,7 @@ func newSimulcastTrack(client *Client, track IRemoteTrack, minWait, maxWait, pli
 		base: &baseTrack{
 			id:           track.ID(),
 			isScreen:     &atomic.Bool{},
+			muted:        &atomic.Bool{},
 			msid:         track.Msid(),
 			streamid:     track.StreamID(),
 			client:       client,
@@ -483,10 +520,13 @@ func (t *SimulcastTrack) onRemoteTrackAdded(f func(*remoteTrack)) {
 
 func (t *SimulcastTrack) onRemoteTrackAddedCallbacks(track *remoteTrack) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	callbacks := slices.Clone(t.onAddedRemoteTrackCallbacks)
+	t.mu.Unlock()
 
-	for _, f := range t.onAddedRemoteTrackCallbacks {
-		f(track)
+	for _, f := range callbacks {
+		callUserCallback(t.base.client.log, "OnAddedRemoteTrack", func() {
+			f(track)
+		})
 	}
 }
 
@@ -499,10 +539,11 @@ func (t *SimulcastTrack) OnTrackComplete(f func()) {
 
 func (t *SimulcastTrack) onTrackComplete() {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	callbacks := slices.Clone(t.onTrackCompleteCallbacks)
+	t.mu.Unlock()
 
-	for _, f := range t.onTrackCompleteCallbacks {
-		f()
+	for _, f := range callbacks {
+		callUserCallback(t.base.client.log, "OnTrackComplete", f)
 	}
 }
 
@@ -541,19 +582,6 @@ func (t *SimulcastTrack) AddRemoteTrack(track IRemoteTrack, minWait, maxWait tim
 
 	onRead := func(attrs interceptor.Attributes, p *rtp.Packet) {
 
-		// set the base timestamp for the track if it is not set yet
-		if t.baseTS == 0 {
-			t.baseTS = p.Timestamp
-		}
-
-		if quality == QualityHigh && t.remoteTrackHighBaseTS == 0 {
-			t.remoteTrackHighBaseTS = p.Timestamp
-		} else if quality == QualityMid && t.remoteTrackMidBaseTS == 0 {
-			t.remoteTrackMidBaseTS = p.Timestamp
-		} else if quality == QualityLow && t.remoteTrackLowBaseTS == 0 {
-			t.remoteTrackLowBaseTS = p.Timestamp
-		}
-
 		readTime := time.Now().UnixNano()
 
 		switch quality {
@@ -572,24 +600,34 @@ func (t *SimulcastTrack) AddRemoteTrack(track IRemoteTrack, minWait, maxWait tim
 		}
 
 		tracks := t.base.clientTracks.GetTracks()
-		for _, track := range tracks {
-			//nolint:ineffassign,staticcheck // packet is from the pool
-			packet := t.base.pool.NewPacket(&p.Header, p.Payload)
 
+		// don't forward the packets to the subscribers if the track is muted
+		if t.base.muted.Load() {
+			tracks = nil
+		}
+
+		t.base.client.sfu.bandwidth.addInbound(p.MarshalSize())
+
+		// the packet is copied to the pool once and shared by all the subscribers,
+		// it is returned to the pool when the last subscriber releases it after writing
+		packet := t.base.pool.NewPacket(&p.Header, p.Payload)
+		if packet == nil {
+			return
+		}
+
+		defer packet.Release()
+
+		for _, track := range tracks {
+			// each subscriber rewrites its own header, the payload is shared
 			copyPacket := t.base.pool.GetPacket()
-			copyPacket.Header = *packet.Header()
+			copyPacket.Header = packet.Header().Clone()
 			copyPacket.Payload = packet.Payload()
 
-			track.push(copyPacket, quality)
+			track.push(copyPacket, packet, quality)
 
 			t.base.pool.PutPacket(copyPacket)
-
-			packet.Release()
 		}
 
-		//nolint:ineffassign // this is required
-		packet := t.base.pool.NewPacket(&p.Header, p.Payload)
-
 		copyPacket := t.base.pool.GetPacket()
 		copyPacket.Header = *packet.Header()
 		copyPacket.Payload = packet.Payload()
@@ -598,11 +636,9 @@ func (t *SimulcastTrack) AddRemoteTrack(track IRemoteTrack, minWait, maxWait tim
 
 		t.base.pool.PutPacket(copyPacket)
 
-		packet.Release()
-
 	}
 
-	remoteTrack = newRemoteTrack(t.Context(), t.base.client.log, t.reordered, track, minWait, maxWait, t.pliInterval, onPLI, stats, onStatsUpdated, onRead, t.base.pool, t.onNetworkConditionChanged)
+	remoteTrack = newRemoteTrack(t.Context(), t.base.client.log, t.reordered, track, minWait, maxWait, t.pliInterval, t.base.client.sfu.keyframeInterval, onPLI, stats, onStatsUpdated, onRead, t.base.pool, t.base.client.sfu.forwarders, t.onNetworkConditionChanged)
 
 	switch quality {
 	case QualityHigh:
@@ -648,8 +684,8 @@ func (t *SimulcastTrack) AddRemoteTrack(track IRemoteTrack, minWait, maxWait tim
 		return nil
 	}
 
-	// check if all simulcast tracks are available
-	if t.remoteTrackHigh != nil && t.remoteTrackMid != nil && t.remoteTrackLow != nil {
+	// check if all the enabled simulcast tracks are available
+	if t.IsTrackComplete() {
 		t.onTrackComplete()
 	}
 
@@ -707,8 +743,25 @@ func (t *SimulcastTrack) IsScreen() bool {
 	return t.base.isScreen.Load()
 }
 
+func (t *SimulcastTrack) IsMuted() bool {
+	return t.base.muted.Load()
+}
+
+// SetMuted stops forwarding the track to the subscribers when muted.
+// A keyframe is requested when unmuted so the subscribers can resume decoding the video.
+func (t *SimulcastTrack) SetMuted(muted bool) {
+	if t.base.muted.Swap(muted) == muted {
+		return
+	}
+
+	if !muted {
+		t.sendPLI()
+	}
+}
+
+// IsTrackComplete returns true when all the simulcast layers enabled by the max simulcast layers are received
 func (t *SimulcastTrack) IsTrackComplete() bool {
-	return t.TotalTracks() == 3
+	return t.TotalTracks() >= t.base.client.sfu.simulcastLayers()
 }
 
 func (t *SimulcastTrack) TotalTracks() int {
@@ -731,13 +784,13 @@ func (t *SimulcastTrack) TotalTracks() int {
 	return total
 }
 
-// track is considered active if the track is not nil and the latest read operation was 500ms ago
+// track is considered active if the track is not nil and the latest packet was read within simulcastLayerInactiveThreshold.
+// A publisher can stop sending a layer at any time, for example the browser drops the high layer under CPU pressure.
 func (t *SimulcastTrack) isTrackActive(quality QualityLevel) bool {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	// set max active track threshold to 500ms
-	threshold := time.Duration(500) * time.Millisecond
+	threshold := simulcastLayerInactiveThreshold
 
 	switch quality {
 	case QualityHigh:
@@ -762,7 +815,7 @@ func (t *SimulcastTrack) isTrackActive(quality QualityLevel) bool {
 
 		delta := time.Since(time.Unix(0, t.lastReadMidTS.Load()))
 		if delta > threshold {
-			t.base.client.log.Warnf("track: remote track %s mid is not active, last read was %d ms ago", delta.Milliseconds())
+			t.base.client.log.Warnf("track: remote track %s mid is not active, last read was %d ms ago", t.base.id, delta.Milliseconds())
 			return false
 		}
 
@@ -775,7 +828,7 @@ func (t *SimulcastTrack) isTrackActive(quality QualityLevel) bool {
 
 		delta := time.Since(time.Unix(0, t.lastReadLowTS.Load()))
 		if delta > threshold {
-			t.base.client.log.Warnf("track: remote track %s low is not active, last read was %d ms ago", delta.Milliseconds())
+			t.base.client.log.Warnf("track: remote track %s low is not active, last read was %d ms ago", t.base.id, delta.Milliseconds())
 			return false
 		}
 
@@ -808,6 +861,17 @@ func (t *SimulcastTrack) sendPLI() {
 	}
 }
 
+// sendLayerPLI requests a keyframe only from the layer of the quality, used when a subscriber waits to switch to that layer
+func (t *SimulcastTrack) sendLayerPLI(quality QualityLevel) {
+	track := t.getRemoteTrack(quality)
+	if track == nil {
+		t.base.client.log.Warnf("track: remote track %s is nil", quality)
+		return
+	}
+
+	track.sendPLI()
+}
+
 func (t *SimulcastTrack) MimeType() string {
 	return t.base.codec.MimeType
 }
@@ -821,7 +885,9 @@ func (t *SimulcastTrack) OnRead(callback func(interceptor.Attributes, *rtp.Packe
 
 func (t *SimulcastTrack) onRead(attr interceptor.Attributes, p *rtp.Packet, quality QualityLevel) {
 	for _, callback := range t.onReadCallbacks {
-		callback(attr, p, quality)
+		callUserCallback(t.base.client.log, "OnRead", func() {
+			callback(attr, p, quality)
+		})
 	}
 }
 
@@ -930,12 +996,14 @@ func (t *SimulcastTrack) OnEnded(f func()) {
 	t.onEndedCallbacks = append(t.onEndedCallbacks, f)
 }
 
+// onEnded calls the callbacks without holding the lock, the callbacks read the remote tracks of the layers under the same lock
 func (t *SimulcastTrack) onEnded() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	t.mu.RLock()
+	callbacks := slices.Clone(t.onEndedCallbacks)
+	t.mu.RUnlock()
 
-	for _, f := range t.onEndedCallbacks {
-		f()
+	for _, f := range callbacks {
+		callUserCallback(t.base.client.log, "OnEnded", f)
 	}
 }
 
@@ -957,6 +1025,20 @@ func newTrackList(log logging.LeveledLogger) *trackList {
 	}
 }
 
+// trackBase returns the base of the published track, or nil if the track type has no base
+func trackBase(t ITrack) *baseTrack {
+	switch track := t.(type) {
+	case *Track:
+		return track.base
+	case *AudioTrack:
+		return track.base
+	case *SimulcastTrack:
+		return track.base
+	}
+
+	return nil
+}
+
 func (t *trackList) Add(track ITrack) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -1020,6 +1102,19 @@ func (t *trackList) Length() int {
 	return len(t.tracks)
 }
 
+// audioTracksOnly returns the audio tracks from the tracks
+func audioTracksOnly(tracks []ITrack) []ITrack {
+	filtered := make([]ITrack, 0, len(tracks))
+
+	for _, track := range tracks {
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			filtered = append(filtered, track)
+		}
+	}
+
+	return filtered
+}
+
 func RIDToQuality(RID string) QualityLevel {
 	switch RID {
 	case "high":
@@ -3,11 +3,14 @@ package sfu
 import (
 	"context"
 	"errors"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pion/interceptor"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
 )
 
 func TestVoiceActivityDetection(t *testing.T) {
@@ -149,3 +152,106 @@ func sendAudioPackets(ctx context.Context, track *webrtc.TrackLocalStaticRTP) {
 
 	}
 }
+
+func TestAV1Keyframe(t *testing.T) {
+	// aggregation header W=2 N=1, a length prefixed sequence header OBU, then a frame OBU
+	keyframe := &rtp.Packet{Payload: []byte{0x28, 0x01, 0x08, 0x30, 0x10}}
+	require.True(t, IsKeyframe(webrtc.MimeTypeAV1, keyframe))
+
+	// same packet but the frame type is inter frame
+	deltaFrame := &rtp.Packet{Payload: []byte{0x28, 0x01, 0x08, 0x30, 0x20}}
+	require.False(t, IsKeyframe(webrtc.MimeTypeAV1, deltaFrame))
+
+	// not the start of a new coded video sequence
+	continuation := &rtp.Packet{Payload: []byte{0x10, 0x30, 0x10}}
+	require.False(t, IsKeyframe(webrtc.MimeTypeAV1, continuation))
+}
+
+func TestRewriteDependencyDescriptorID(t *testing.T) {
+	descriptor := []byte{0x80, 0x01, 0x02}
+
+	header := rtp.Header{}
+	require.NoError(t, header.SetExtension(3, []byte{0xff}))
+	require.NoError(t, header.SetExtension(5, descriptor))
+
+	// the extensions are shared between the subscriber packets
+	p1 := &rtp.Packet{Header: header}
+	p2 := &rtp.Packet{Header: header}
+
+	require.NoError(t, rewriteHeaderExtensionID(p1, 5, 7))
+	require.Equal(t, descriptor, p1.Header.GetExtension(7))
+	require.Nil(t, p1.Header.GetExtension(5))
+	require.Equal(t, []byte{0xff}, p1.Header.GetExtension(3))
+
+	// subscriber that doesn't negotiate the dependency descriptor
+	require.NoError(t, rewriteHeaderExtensionID(p2, 5, 0))
+	require.Nil(t, p2.Header.GetExtension(5))
+	require.Equal(t, []byte{0xff}, p2.Header.GetExtension(3))
+
+	// the original header is not modified
+	require.Equal(t, descriptor, header.GetExtension(5))
+	require.Nil(t, header.GetExtension(7))
+}
+
+func TestKeyframeRequestDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	plis := &atomic.Int32{}
+
+	track := &remoteTrack{
+		context:          ctx,
+		keyframeInterval: 200 * time.Millisecond,
+		onPLI: func() {
+			plis.Add(1)
+		},
+	}
+
+	// the first request is sent immediately and the rest are coalesced into one at the end of the interval
+	for i := 0; i < 5; i++ {
+		track.sendPLI()
+	}
+
+	require.Eventually(t, func() bool { return plis.Load() == 1 }, 100*time.Millisecond, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return plis.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(2), plis.Load())
+
+	// the request after the interval is sent immediately
+	track.sendPLI()
+	require.Eventually(t, func() bool { return plis.Load() == 3 }, 100*time.Millisecond, 10*time.Millisecond)
+
+	// the coalesced request is not sent after the track is ended
+	track.sendPLI()
+	cancel()
+
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(3), plis.Load())
+}
+
+func TestClientTrackRewriteDependencyDescriptor(t *testing.T) {
+	descriptor := []byte{0x80, 0x01, 0x02}
+
+	ct := &clientTrack{baseTrack: &baseTrack{}, dependencyDescriptorID: &atomic.Uint32{}}
+	ct.baseTrack.dependencyDescriptorID.Store(5)
+
+	newPacket := func() *rtp.Packet {
+		p := &rtp.Packet{}
+		require.NoError(t, p.Header.SetExtension(5, descriptor))
+
+		return p
+	}
+
+	// the descriptor is removed until the subscriber ID is stored after the negotiation
+	p := newPacket()
+	ct.rewriteDependencyDescriptor(p)
+	require.Nil(t, p.Header.GetExtension(5))
+
+	ct.dependencyDescriptorID.Store(7)
+
+	p = newPacket()
+	ct.rewriteDependencyDescriptor(p)
+	require.Equal(t, descriptor, p.Header.GetExtension(7))
+	require.Nil(t, p.Header.GetExtension(5))
+}
@@ -0,0 +1,105 @@
+package sfu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	ErrNoTURNServer         = errors.New("sfu: no TURN server configured")
+	ErrTURNAllocationFailed = errors.New("sfu: failed to allocate a relay candidate")
+)
+
+// TestTURN allocates a relay candidate against the configured TURN servers to verify the TURN configuration works.
+// Call it on startup to catch a misconfigured TURN server before serving the clients.
+// Returns nil when a relay candidate is allocated, ErrNoTURNServer if there is no TURN server in the ICE servers,
+// or ErrTURNAllocationFailed if the allocation fails or the context is done before the allocation succeeds.
+func (s *SFU) TestTURN(ctx context.Context) error {
+	turnServers := make([]webrtc.ICEServer, 0)
+
+	for _, server := range s.iceServers {
+		for _, url := range server.URLs {
+			if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+				turnServers = append(turnServers, server)
+				break
+			}
+		}
+	}
+
+	if len(turnServers) == 0 {
+		return ErrNoTURNServer
+	}
+
+	settingEngine := webrtc.SettingEngine{}
+	if s.defaultSettingEngine != nil {
+		settingEngine = *s.defaultSettingEngine
+	}
+
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers:         turnServers,
+		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
+	})
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := pc.Close(); err != nil {
+			s.log.Errorf("sfu: error closing TURN test peer connection %s", err.Error())
+		}
+	}()
+
+	var (
+		relayOnce     sync.Once
+		relayChan     = make(chan struct{})
+		gatheringOnce sync.Once
+		gatheringChan = make(chan struct{})
+	)
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			gatheringOnce.Do(func() { close(gatheringChan) })
+			return
+		}
+
+		if candidate.Typ == webrtc.ICECandidateTypeRelay {
+			relayOnce.Do(func() { close(relayChan) })
+		}
+	})
+
+	// a data channel is needed to have something to gather the candidates for
+	if _, err := pc.CreateDataChannel("turn-test", nil); err != nil {
+		return err
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	select {
+	case <-relayChan:
+		return nil
+	case <-gatheringChan:
+		// the relay candidate is emitted before the gathering complete, but both can be ready at the same time
+		select {
+		case <-relayChan:
+			return nil
+		default:
+			return ErrTURNAllocationFailed
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %s", ErrTURNAllocationFailed, ctx.Err().Error())
+	}
+}
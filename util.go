@@ -3,17 +3,21 @@ package sfu
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"log"
 	"net"
 	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/jaevor/go-nanoid"
 	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/logging"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/sdp/v3"
@@ -24,8 +28,9 @@ import (
 )
 
 const (
-	SdesRepairRTPStreamIDURI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
-	uint16SizeHalf           = uint16(1 << 15)
+	SdesRepairRTPStreamIDURI   = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+	AV1DependencyDescriptorURI = "https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension"
+	uint16SizeHalf             = uint16(1 << 15)
 )
 
 var customChars = [62]byte{
@@ -123,6 +128,55 @@ func RegisterSimulcastHeaderExtensions(m *webrtc.MediaEngine, codecType webrtc.R
 	}
 }
 
+// RegisterAV1HeaderExtensions registers the AV1 dependency descriptor header extension.
+// The dependency descriptor is required by the receiver to decode the AV1 SVC streams.
+func RegisterAV1HeaderExtensions(m *webrtc.MediaEngine) {
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: AV1DependencyDescriptorURI}, webrtc.RTPCodecTypeVideo); err != nil {
+		panic(err)
+	}
+}
+
+// getHeaderExtensionID returns the negotiated header extension ID for the URI, or 0 if it's not negotiated
+func getHeaderExtensionID(extensions []webrtc.RTPHeaderExtensionParameter, uri string) uint8 {
+	for _, extension := range extensions {
+		if extension.URI == uri {
+			return uint8(extension.ID)
+		}
+	}
+
+	return 0
+}
+
+// rewriteHeaderExtensionID moves the header extension payload from the publisher negotiated ID to the subscriber negotiated ID.
+// The extension is removed if the subscriber doesn't negotiate it. The packet extensions are copied
+// before modified because the extensions slice can be shared with the other subscribers' packets.
+func rewriteHeaderExtensionID(p *rtp.Packet, fromID, toID uint8) error {
+	if fromID == toID {
+		return nil
+	}
+
+	payload := p.Header.GetExtension(fromID)
+	if payload == nil {
+		return nil
+	}
+
+	p.Header.Extensions = append([]rtp.Extension(nil), p.Header.Extensions...)
+
+	// the errors are ignored, the extension is not found means nothing to delete
+	_ = p.Header.DelExtension(fromID)
+	_ = p.Header.DelExtension(toID)
+
+	if toID == 0 {
+		if len(p.Header.Extensions) == 0 {
+			p.Header.Extension = false
+		}
+
+		return nil
+	}
+
+	return p.Header.SetExtension(toID, payload)
+}
+
 func IsKeyframe(codec string, packet *rtp.Packet) bool {
 	isIt1, isIt2 := Keyframe(codec, packet)
 	return isIt1 && isIt2
@@ -480,6 +534,60 @@ func GetLocalIp() (net.IP, error) {
 	return ip, nil
 }
 
+// callUserCallback calls the user provided callback and recovers a panic in it, the panic is logged with the stack trace
+// so a buggy integration doesn't crash the SFU or stop the caller before it releases its locks.
+func callUserCallback(log logging.LeveledLogger, name string, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("sfu: recovered panic in %s callback: %v\n%s", name, r, debug.Stack())
+		}
+	}()
+
+	f()
+}
+
+// callbackQueue runs the pushed functions one by one in the pushed order on a separate goroutine,
+// the goroutine is started when a function is pushed to the empty queue and exits once the queue is drained
+type callbackQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool
+}
+
+func (q *callbackQueue) push(f func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending = append(q.pending, f)
+
+	if q.running {
+		return
+	}
+
+	q.running = true
+
+	go q.run()
+}
+
+func (q *callbackQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+
+			return
+		}
+
+		f := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		f()
+	}
+}
+
 func FlattenErrors(errs []error) error {
 	if len(errs) == 0 {
 		return nil
@@ -524,6 +632,75 @@ func Uint32ToQualityLevel(quality uint32) QualityLevel {
 	}
 }
 
+var qualityLevelNames = map[QualityLevel]string{
+	QualityNone:     "none",
+	QualityLowLow:   "lowlow",
+	QualityLowMid:   "lowmid",
+	QualityLow:      "low",
+	QualityMidLow:   "midlow",
+	QualityMidMid:   "midmid",
+	QualityMid:      "mid",
+	QualityHighLow:  "highlow",
+	QualityHighMid:  "highmid",
+	QualityHigh:     "high",
+	QualityAudio:    "audio",
+	QualityAudioRed: "audio_red",
+}
+
+// String returns the quality level name, for example "high", "mid", "low" or "none"
+func (q QualityLevel) String() string {
+	if name, ok := qualityLevelNames[q]; ok {
+		return name
+	}
+
+	return strconv.FormatUint(uint64(q), 10)
+}
+
+// ParseQualityLevel returns the quality level of the name returned by QualityLevel.String,
+// or ErrInvalidQuality if the name is unknown
+func ParseQualityLevel(name string) (QualityLevel, error) {
+	for quality, qualityName := range qualityLevelNames {
+		if strings.EqualFold(qualityName, name) {
+			return quality, nil
+		}
+	}
+
+	return QualityNone, ErrInvalidQuality
+}
+
+// MarshalJSON encodes the quality level as its name
+func (q QualityLevel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.String())
+}
+
+// UnmarshalJSON decodes the quality level from its name, or from the number for the backward compatibility
+func (q *QualityLevel) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var level uint32
+		if err := json.Unmarshal(data, &level); err != nil {
+			return ErrInvalidQuality
+		}
+
+		if _, ok := qualityLevelNames[QualityLevel(level)]; !ok {
+			return ErrInvalidQuality
+		}
+
+		*q = QualityLevel(level)
+
+		return nil
+	}
+
+	quality, err := ParseQualityLevel(name)
+	if err != nil {
+		return err
+	}
+
+	*q = quality
+
+	return nil
+}
+
 func ThousandSeparator(n int) string {
 	p := message.NewPrinter(language.English)
 	return p.Sprintf("%d", n)